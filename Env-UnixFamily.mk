@@ -22,5 +22,5 @@ $(LOCALFILES_RANDOM_BLOB):
 
 randomTestFile=$(LOCALFILES_RANDOM_BLOB)/random.blob
 changedTestFile=$(LOCALFILES_RANDOM_BLOB)/random-changed.blob
-diffChunksOriginal=$(LOCALFILES_RANDOM_BLOB)/refs.original
-diffChunksChanged=$(LOCALFILES_RANDOM_BLOB)/refs.changed
+diffChunksStore=$(LOCALFILES_RANDOM_BLOB)/store
+diffDbfs=./dist/dbfs -o human --storage-driver fs --storage-url $(diffChunksStore)
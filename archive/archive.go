@@ -0,0 +1,354 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/graph"
+)
+
+type (
+	// Root is one of the objects used to create an archive,
+	// Name is optional and usually the ref name it was resolved from
+	Root struct {
+		Name string
+		Node graph.Node
+	}
+
+	// Manifest describes the content of an archive
+	Manifest struct {
+		Version int
+		Roots   []Root
+	}
+
+	// IndexEntry is one object stored in the archive
+	IndexEntry struct {
+		Ref  cas.Ref
+		Kind graph.Kind
+		Size int64
+	}
+
+	// Stats contains the counters of an export or import
+	Stats struct {
+		Objects int   `json:"objects" yaml:"objects"`
+		Skipped int   `json:"skipped" yaml:"skipped"`
+		Bytes   int64 `json:"bytes" yaml:"bytes"`
+	}
+
+	// wireRoot and wireEntry are the json encoding of
+	// Root and IndexEntry
+	wireRoot struct {
+		Name string `json:"name,omitempty"`
+		Ref  string `json:"ref"`
+		Kind string `json:"kind"`
+	}
+
+	wireManifest struct {
+		Format  string     `json:"format"`
+		Version int        `json:"version"`
+		Roots   []wireRoot `json:"roots"`
+	}
+
+	wireEntry struct {
+		Ref  string `json:"ref"`
+		Kind string `json:"kind"`
+		Size int64  `json:"size"`
+	}
+
+	exporter struct {
+		c     *cas.C
+		tw    *tar.Writer
+		seen  map[cas.Ref]struct{}
+		index []wireEntry
+		stats Stats
+	}
+
+	importer struct {
+		c     *cas.C
+		tr    *tar.Reader
+		seen  map[cas.Ref]int64
+		stats Stats
+	}
+)
+
+const (
+	// Version of the archive format written by Export
+	Version = 1
+
+	// MaxObjectSize limits the size of a single object read by Import,
+	// objects are kept in memory until their ref is checked
+	MaxObjectSize = 64 << 20
+
+	format       = "dbfs-archive"
+	manifestName = "dbfs-archive.json"
+	indexName    = "dbfs-index.json"
+	objectsDir   = "objects/"
+)
+
+var (
+	// ErrCorrupted is returned by Import when the archive is truncated,
+	// malformed or an object doesn't match its ref
+	ErrCorrupted = errors.New("archive is corrupted")
+
+	// modTime is used for every entry, so exporting the same
+	// roots always produces the same bytes
+	modTime = time.Unix(0, 0).UTC()
+)
+
+// Export writes roots, and every object reachable from them, to w
+func Export(ctx context.Context, c *cas.C, w io.Writer, roots ...Root) (Stats, error) {
+	e := &exporter{c: c, tw: tar.NewWriter(w), seen: make(map[cas.Ref]struct{})}
+	if len(roots) == 0 {
+		return e.stats, errors.New("at least one root is required")
+	}
+	manifest := wireManifest{Format: format, Version: Version}
+	for _, r := range roots {
+		manifest.Roots = append(manifest.Roots, wireRoot{Name: r.Name, Ref: r.Node.Ref.String(), Kind: r.Node.Kind.String()})
+	}
+	if err := e.writeJSON(manifestName, manifest); err != nil {
+		return e.stats, err
+	}
+	for _, r := range roots {
+		if err := e.visit(ctx, r.Node); err != nil {
+			return e.stats, err
+		}
+	}
+	if err := e.writeJSON(indexName, e.index); err != nil {
+		return e.stats, err
+	}
+	return e.stats, e.tw.Close()
+}
+
+// Import reads an archive created by Export and writes its objects to c,
+// objects already present in c are skipped.
+//
+// The content of every object is checked against its ref before it is
+// written. Objects are written as they are read, if the archive turns
+// out to be truncated the objects written so far are kept, but since
+// children come before their parents none of them will have missing
+// children.
+func Import(ctx context.Context, c *cas.C, r io.Reader) (Manifest, Stats, error) {
+	i := &importer{c: c, tr: tar.NewReader(r), seen: make(map[cas.Ref]int64)}
+	manifest, err := i.readManifest()
+	if err != nil {
+		return Manifest{}, i.stats, err
+	}
+	var index []wireEntry
+	for {
+		if err := ctx.Err(); err != nil {
+			return manifest, i.stats, err
+		}
+		hdr, err := i.tr.Next()
+		if errors.Is(err, io.EOF) {
+			return manifest, i.stats, fmt.Errorf("%w: missing %v", ErrCorrupted, indexName)
+		} else if err != nil {
+			return manifest, i.stats, fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+		if hdr.Name == indexName {
+			if err := i.readJSON(hdr, &index); err != nil {
+				return manifest, i.stats, err
+			}
+			break
+		}
+		if !strings.HasPrefix(hdr.Name, objectsDir) {
+			return manifest, i.stats, fmt.Errorf("%w: unexpected entry %q", ErrCorrupted, hdr.Name)
+		}
+		if err := i.object(ctx, hdr); err != nil {
+			return manifest, i.stats, err
+		}
+	}
+	if _, err := i.tr.Next(); !errors.Is(err, io.EOF) {
+		return manifest, i.stats, fmt.Errorf("%w: entries after %v", ErrCorrupted, indexName)
+	}
+	return manifest, i.stats, i.check(manifest, index)
+}
+
+// visit writes the children of n and then n itself
+func (e *exporter) visit(ctx context.Context, n graph.Node) error {
+	if _, ok := e.seen[n.Ref]; ok {
+		return nil
+	}
+	e.seen[n.Ref] = struct{}{}
+	content, err := graph.Read(ctx, e.c, n)
+	if err != nil {
+		return err
+	}
+	if !n.Kind.Leaf() {
+		children, err := graph.Children(n, content)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := e.visit(ctx, child); err != nil {
+				return err
+			}
+		}
+	}
+	if err := e.writeEntry(objectsDir+n.Ref.String(), content); err != nil {
+		return err
+	}
+	e.index = append(e.index, wireEntry{Ref: n.Ref.String(), Kind: n.Kind.String(), Size: int64(len(content))})
+	e.stats.Objects++
+	e.stats.Bytes += int64(len(content))
+	return nil
+}
+
+func (e *exporter) writeJSON(name string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return err
+	}
+	return e.writeEntry(name, content)
+}
+
+func (e *exporter) writeEntry(name string, content []byte) error {
+	err := e.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+		Format:   tar.FormatUSTAR,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %v, cause: %w", name, err)
+	}
+	if _, err := e.tw.Write(content); err != nil {
+		return fmt.Errorf("unable to write %v, cause: %w", name, err)
+	}
+	return nil
+}
+
+func (i *importer) readManifest() (Manifest, error) {
+	hdr, err := i.tr.Next()
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: unable to read the manifest, cause: %v", ErrCorrupted, err)
+	}
+	if hdr.Name != manifestName {
+		return Manifest{}, fmt.Errorf("%w: first entry must be %v, got %q", ErrCorrupted, manifestName, hdr.Name)
+	}
+	var wire wireManifest
+	if err := i.readJSON(hdr, &wire); err != nil {
+		return Manifest{}, err
+	}
+	if wire.Format != format {
+		return Manifest{}, fmt.Errorf("%w: unknown format %q", ErrCorrupted, wire.Format)
+	}
+	if wire.Version != Version {
+		return Manifest{}, fmt.Errorf("unsupported archive version %v", wire.Version)
+	}
+	m := Manifest{Version: wire.Version}
+	for _, r := range wire.Roots {
+		n, err := parseNode(r.Ref, r.Kind)
+		if err != nil {
+			return Manifest{}, err
+		}
+		m.Roots = append(m.Roots, Root{Name: r.Name, Node: n})
+	}
+	if len(m.Roots) == 0 {
+		return Manifest{}, fmt.Errorf("%w: manifest has no roots", ErrCorrupted)
+	}
+	return m, nil
+}
+
+// object checks the content of the entry against its ref
+// and writes it to c
+func (i *importer) object(ctx context.Context, hdr *tar.Header) error {
+	ref, err := cas.ParseRef(strings.TrimPrefix(hdr.Name, objectsDir))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	content, err := i.read(hdr)
+	if err != nil {
+		return err
+	}
+	if actual := cas.PrecomputeHashBytes(content); actual != ref {
+		return fmt.Errorf("%w: object %v has content of %v", ErrCorrupted, ref, actual)
+	}
+	i.seen[ref] = int64(len(content))
+	exists, err := i.c.Exists(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if exists {
+		i.stats.Skipped++
+		return nil
+	}
+	if _, err := i.c.PutContent(ctx, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("unable to write %v, cause: %w", ref, err)
+	}
+	i.stats.Objects++
+	i.stats.Bytes += int64(len(content))
+	return nil
+}
+
+// check compares the objects read from the archive with its index
+func (i *importer) check(m Manifest, index []wireEntry) error {
+	if len(index) != len(i.seen) {
+		return fmt.Errorf("%w: index has %v objects but the archive has %v", ErrCorrupted, len(index), len(i.seen))
+	}
+	for _, e := range index {
+		n, err := parseNode(e.Ref, e.Kind)
+		if err != nil {
+			return err
+		}
+		size, ok := i.seen[n.Ref]
+		if !ok {
+			return fmt.Errorf("%w: object %v is missing", ErrCorrupted, n.Ref)
+		} else if size != e.Size {
+			return fmt.Errorf("%w: object %v has %v bytes but the index has %v", ErrCorrupted, n.Ref, size, e.Size)
+		}
+	}
+	for _, r := range m.Roots {
+		if _, ok := i.seen[r.Node.Ref]; !ok {
+			return fmt.Errorf("%w: root %v is missing", ErrCorrupted, r.Node.Ref)
+		}
+	}
+	return nil
+}
+
+func (i *importer) readJSON(hdr *tar.Header, out interface{}) error {
+	content, err := i.read(hdr)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, out); err != nil {
+		return fmt.Errorf("%w: unable to decode %v, cause: %v", ErrCorrupted, hdr.Name, err)
+	}
+	return nil
+}
+
+func (i *importer) read(hdr *tar.Header) ([]byte, error) {
+	if hdr.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("%w: %v is not a regular file", ErrCorrupted, hdr.Name)
+	}
+	if hdr.Size < 0 || hdr.Size > MaxObjectSize {
+		return nil, fmt.Errorf("%w: %v has %v bytes", ErrCorrupted, hdr.Name, hdr.Size)
+	}
+	content, err := ioutil.ReadAll(i.tr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to read %v, cause: %v", ErrCorrupted, hdr.Name, err)
+	}
+	return content, nil
+}
+
+func parseNode(ref, kind string) (graph.Node, error) {
+	r, err := cas.ParseRef(ref)
+	if err != nil {
+		return graph.Node{}, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	k, err := graph.ParseKind(kind)
+	if err != nil {
+		return graph.Node{}, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return graph.Node{Ref: r, Kind: k}, nil
+}
@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/graph"
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+// sampleCommit writes a commit whose tree has a large file,
+// an empty file and a sub-directory
+func sampleCommit(ctx context.Context, t *testing.T, c *cas.C, b *blob.B) (graph.Node, []byte) {
+	content := make([]byte, 2_000_000)
+	rand.New(rand.NewSource(1)).Read(content)
+	data, err := b.Upload(ctx, c, bytes.NewBuffer(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := b.Upload(ctx, c, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	sub, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "empty", Mode: 0644, ModTime: mtime, Ref: empty},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "data.bin", Mode: 0644, Size: int64(len(content)), ModTime: mtime, Ref: data},
+		{Name: "sub", Mode: os.ModeDir | 0755, ModTime: mtime, Ref: sub},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := commit.Write(ctx, c, commit.Commit{Tree: root, Author: "test", Time: mtime, Message: "sample"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return graph.Node{Ref: ref, Kind: graph.KindCommit}, content
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src, b := testutil.OpenStore(ctx, t)
+	dst, _ := testutil.OpenStore(ctx, t)
+	root, content := sampleCommit(ctx, t, src, b)
+
+	buf := &bytes.Buffer{}
+	exported, err := Export(ctx, src, buf, Root{Name: "refs/heads/main", Node: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := &bytes.Buffer{}
+	if _, err := Export(ctx, src, again, Root{Name: "refs/heads/main", Node: root}); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Error("Exporting the same root twice should produce the same archive")
+	}
+
+	manifest, imported, err := Import(ctx, dst, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Roots) != 1 || manifest.Roots[0].Name != "refs/heads/main" || manifest.Roots[0].Node != root {
+		t.Errorf("Unexpected manifest: %#v", manifest)
+	}
+	if imported != exported {
+		t.Errorf("Import should write every exported object, exported %#v imported %#v", exported, imported)
+	}
+	live, err := graph.Reachable(ctx, src, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != exported.Objects {
+		t.Errorf("Archive should have %v objects, got %v", len(live), exported.Objects)
+	}
+
+	cm, err := commit.Read(ctx, dst, root.Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := snapshot.Lookup(ctx, dst, cm.Tree, "data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if _, err := blob.Read(ctx, dst, out, e.Ref); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(out.Bytes(), content) {
+		t.Error("Imported file does not match the original content")
+	}
+
+	_, imported, err = Import(ctx, dst, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Objects != 0 || imported.Skipped != exported.Objects {
+		t.Errorf("Importing again should skip every object: %#v", imported)
+	}
+}
+
+func TestImportCorrupted(t *testing.T) {
+	ctx := context.Background()
+	src, b := testutil.OpenStore(ctx, t)
+	root, _ := sampleCommit(ctx, t, src, b)
+	buf := &bytes.Buffer{}
+	if _, err := Export(ctx, src, buf, Root{Node: root}); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	// flip a byte in the middle of the large file
+	changed := append([]byte(nil), archive...)
+	changed[len(changed)/2] ^= 0xff
+	dst, _ := testutil.OpenStore(ctx, t)
+	if _, _, err := Import(ctx, dst, bytes.NewReader(changed)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Changed content should be detected, got %v", err)
+	}
+
+	dst, _ = testutil.OpenStore(ctx, t)
+	truncated := archive[:len(archive)*3/4]
+	if _, _, err := Import(ctx, dst, bytes.NewReader(truncated)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Truncated archives should be detected, got %v", err)
+	}
+	if found, err := dst.Exists(ctx, root.Ref); err != nil {
+		t.Fatal(err)
+	} else if found {
+		t.Error("Root should be the last object imported")
+	}
+}
@@ -0,0 +1,13 @@
+// package archive moves objects between cas stores which cannot
+// reach each other, like rsync to a usb drive for air-gapped hosts
+//
+// An archive is a tar file with three kinds of entries:
+//
+//	dbfs-archive.json   the manifest, always the first entry
+//	objects/<ref>       the content of one object, as stored in cas
+//	dbfs-index.json     every object in the archive, always the last entry
+//
+// Objects are written children first, so an interrupted import
+// never leaves an object whose children are missing. Import checks
+// the content of every object against its ref before writing it.
+package archive
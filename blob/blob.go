@@ -26,6 +26,20 @@ type (
 	Tree struct {
 		Branches []cas.Ref
 		Leaves   []cas.Ref
+		// Sizes contains the number of bytes covered by each
+		// entry from Branches (or Leaves, since a tree never
+		// has both)
+		Sizes []int64
+	}
+
+	// rawRef computes the ref of a chunk as cas.C.PutRaw would, the
+	// content is only kept in memory for chunks which start with
+	// something that looks like a type header, since those are escaped
+	rawRef struct {
+		rr      cas.RollingRef
+		head    []byte
+		typed   bool
+		untyped bool
 	}
 
 	// Chunk contains a sequence of bytes whose hash value
@@ -100,15 +114,12 @@ func (b *B) Chunks(ctx context.Context, input io.Reader) ([]Chunk, error) {
 	var window [16]byte
 	var chunks []Chunk
 	var lastChunk Chunk
-	n, err := input.Read(window[:])
+	n, err := io.ReadFull(input, window[:])
 	if err != nil {
 		// input might be so short that it is less than the initial window
 		// in which case, we just upload whatever bytes we just read
-		if errors.Is(err, io.EOF) {
-			rr := cas.NewRollingRef()
-			rr.Write(window[:n])
-			lastChunk.Ref = rr.Ref()
-			rr.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			lastChunk.Ref = cas.RawRef(window[:n])
 			lastChunk.Size = n
 			lastChunk.End = lastChunk.Start + int64(lastChunk.Size)
 			lastChunk.Short = n < cap(window)
@@ -124,7 +135,7 @@ func (b *B) Chunks(ctx context.Context, input io.Reader) ([]Chunk, error) {
 		}
 		return nil, err
 	}
-	rr := cas.NewRollingRef()
+	rr := newRawRef()
 	defer rr.Close()
 	rr.Write(window[:])
 	hasher := b.hashes.Get().(*buzhash64.Buzhash64)
@@ -174,22 +185,41 @@ func (b *B) Chunks(ctx context.Context, input io.Reader) ([]Chunk, error) {
 // to the provided Cas object and returns the list of
 // references created
 func (b *B) UploadChunks(ctx context.Context, casObj *cas.C, input io.Reader) ([]cas.Ref, error) {
-	// TODO: return the chunks information rather than just the refs
-	// that way consumers can link chunks to the absolution position
-	// in the stream, as this is useful for random access
+	chunks, err := b.uploadChunks(ctx, casObj, input)
+	refs := make([]cas.Ref, len(chunks))
+	for i, c := range chunks {
+		refs[i] = c.Ref
+	}
+	return refs, err
+}
+
+// uploadChunks works like UploadChunks but returns the position
+// of each chunk in the stream
+func (b *B) uploadChunks(ctx context.Context, casObj *cas.C, input io.Reader) ([]Chunk, error) {
 	var window [16]byte
-	var refs []cas.Ref
-	n, err := input.Read(window[:])
+	var chunks []Chunk
+	var lastChunk Chunk
+	push := func(content []byte) error {
+		ref, err := pushRef(ctx, casObj, content)
+		if err != nil {
+			return err
+		}
+		lastChunk.Ref = ref
+		lastChunk.Size = len(content)
+		lastChunk.End = lastChunk.Start + int64(lastChunk.Size)
+		chunks = append(chunks, lastChunk)
+		lastChunk.Start = lastChunk.End
+		return nil
+	}
+	n, err := io.ReadFull(input, window[:])
 	if err != nil {
 		// input might be so short that it is less than the initial window
 		// in which case, we just upload whatever bytes we just read
-		if errors.Is(err, io.EOF) {
-			actual := window[:n]
-			ref, err := pushRef(ctx, casObj, actual)
-			if err != nil {
-				refs = append(refs, ref)
-				return refs, nil
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if err := push(window[:n]); err != nil {
+				return nil, err
 			}
+			return chunks, nil
 		}
 		return nil, err
 	}
@@ -206,38 +236,83 @@ func (b *B) UploadChunks(ctx context.Context, casObj *cas.C, input io.Reader) ([
 	scratch.Reset(input)
 	defer scratchBufPool.Put(scratch)
 
-	for b, err := scratch.ReadByte(); err == nil; b, err = scratch.ReadByte() {
-		hasher.Roll(b)
-		chunk = append(chunk, b)
+	var c byte
+	for c, err = scratch.ReadByte(); err == nil; c, err = scratch.ReadByte() {
+		hasher.Roll(c)
+		chunk = append(chunk, c)
 		if (hasher.Sum64()&CutPoint) == 0 ||
 			(len(chunk) == cap(block)) {
 			// we either reached a cutPoint
 			// or the current chunk reached the max size of a block
-			ref, err := pushRef(ctx, casObj, chunk)
-			if err != nil {
-				return refs, err
+			if err := push(chunk); err != nil {
+				return chunks, err
 			}
-			refs = append(refs, ref)
 			// reset for next chunk
 			chunk = block[:0]
 		}
 	}
+	if !errors.Is(err, io.EOF) {
+		return chunks, err
+	}
 
 	if len(chunk) > 0 {
 		// upload whatever was left
-		ref, err := pushRef(ctx, casObj, chunk)
-		if err != nil {
-			return refs, err
+		if err := push(chunk); err != nil {
+			return chunks, err
 		}
-		refs = append(refs, ref)
-		// reset for next chunk
-		chunk = block[:0]
 	}
-	return refs, nil
+	return chunks, nil
 }
 
 func pushRef(ctx context.Context, casObj *cas.C, actual []byte) (cas.Ref, error) {
-	return casObj.PutContent(ctx, bytes.NewBuffer(actual))
+	return casObj.PutRaw(ctx, actual)
+}
+
+func newRawRef() *rawRef {
+	return &rawRef{rr: cas.NewRollingRef()}
+}
+
+// Write implements io.Writer
+func (r *rawRef) Write(buf []byte) (int, error) {
+	for _, b := range buf {
+		r.WriteByte(b)
+	}
+	return len(buf), nil
+}
+
+// WriteByte implements io.ByteWriter, the first bytes of every chunk
+// are kept until it is clear they are not a type header
+func (r *rawRef) WriteByte(b byte) error {
+	switch {
+	case r.typed:
+		r.head = append(r.head, b)
+	case !r.untyped:
+		r.head = append(r.head, b)
+		if cas.HasTypeHeader(r.head) {
+			r.typed = true
+		} else if b == 0 || len(r.head) == cas.MaxHeaderLen {
+			r.head, r.untyped = r.head[:0], true
+		}
+	}
+	return r.rr.WriteByte(b)
+}
+
+// Ref returns the ref cas.C.PutRaw would return for the bytes
+// written since the last Reset
+func (r *rawRef) Ref() cas.Ref {
+	if r.typed {
+		return cas.RawRef(r.head)
+	}
+	return r.rr.Ref()
+}
+
+func (r *rawRef) Reset() {
+	r.rr.Reset()
+	r.head, r.typed, r.untyped = r.head[:0], false, false
+}
+
+func (r *rawRef) Close() error {
+	return r.rr.Close()
 }
 
 func newBlob(constructor func() *buzhash64.Buzhash64) *B {
@@ -1,12 +1,14 @@
-package blob
+package blob_test
 
 import (
 	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
+	"github.com/andrebq/dbfs/blob"
 	"github.com/andrebq/dbfs/cas"
 	"github.com/andrebq/dbfs/internal/testutil"
 )
@@ -14,20 +16,14 @@ import (
 func TestBlob(t *testing.T) {
 	ctx := context.Background()
 	largeRandomBuf := getRandom(t, 10, 50_000_000)
-	blob, err := WithSeed(int64(0x24717b279f5337))
-	if err != nil {
-		t.Fatal(err)
-	}
-	obj, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
-		return testutil.MemoryBucket(ctx, t), nil
-	})
-	refs, err := blob.UploadChunks(ctx, obj, bytes.NewBuffer(largeRandomBuf))
+	obj, b := testutil.OpenStore(ctx, t)
+	refs, err := b.UploadChunks(ctx, obj, bytes.NewBuffer(largeRandomBuf))
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Logf("refs: %v", refs)
 
-	chunks, err := blob.Chunks(ctx, bytes.NewBuffer(largeRandomBuf))
+	chunks, err := b.Chunks(ctx, bytes.NewBuffer(largeRandomBuf))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,3 +49,157 @@ func getRandom(t *testing.T, seed int64, size int) []byte {
 	}
 	return buf.Bytes()
 }
+
+func TestUploadRead(t *testing.T) {
+	ctx := context.Background()
+	obj, b := testutil.OpenStore(ctx, t)
+	for _, size := range []int{0, 5, 16, 5_000_000} {
+		content := getRandom(t, int64(size), size)
+		root, err := b.Upload(ctx, obj, bytes.NewBuffer(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := b.Chunks(ctx, bytes.NewBuffer(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, err := blob.TreeRef(chunks); err != nil {
+			t.Fatal(err)
+		} else if expected != root {
+			t.Errorf("blob.TreeRef should match the uploaded tree for size %v", size)
+		}
+		tree, err := blob.ReadTree(ctx, obj, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree.Size() != int64(size) {
+			t.Errorf("Tree should track %v bytes got %v", size, tree.Size())
+		}
+		buf := &bytes.Buffer{}
+		if n, err := blob.Read(ctx, obj, buf, root); err != nil {
+			t.Fatal(err)
+		} else if n != int64(size) || !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("Content read from tree does not match for size %v", size)
+		}
+	}
+}
+
+func TestMultiLevelTree(t *testing.T) {
+	ctx := context.Background()
+	obj, _ := testutil.OpenStore(ctx, t)
+	var chunks []blob.Chunk
+	for i := 0; i < blob.MaxTreeEntries*2+10; i++ {
+		chunks = append(chunks, blob.Chunk{Size: 10, Ref: cas.PrecomputeHashBytes([]byte{byte(i), byte(i >> 8)})})
+	}
+	root, err := blob.WriteTree(ctx, obj, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := blob.ReadTree(ctx, obj, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Branches) != 3 || len(tree.Leaves) != 0 {
+		t.Errorf("Root should have 3 branches got %v branches and %v leaves", len(tree.Branches), len(tree.Leaves))
+	}
+	if tree.Size() != int64(len(chunks)*10) {
+		t.Errorf("Unexpected tree size %v", tree.Size())
+	}
+	last, err := blob.ReadTree(ctx, obj, tree.Branches[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last.Leaves) != 10 || last.Leaves[9] != chunks[len(chunks)-1].Ref {
+		t.Errorf("Unexpected leaves on the last branch: %v", len(last.Leaves))
+	}
+}
+
+func TestReader(t *testing.T) {
+	ctx := context.Background()
+	obj, b := testutil.OpenStore(ctx, t)
+	content := getRandom(t, 3, 5_000_000)
+	root, err := b.Upload(ctx, obj, bytes.NewBuffer(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := blob.NewReader(ctx, obj, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(content)) {
+		t.Errorf("Size should be %v got %v", len(content), r.Size())
+	}
+	for _, rng := range [][2]int{{0, 10}, {1_048_000, 1_049_000}, {4_999_990, 5_000_000}, {0, 5_000_000}} {
+		buf := make([]byte, rng[1]-rng[0])
+		if n, err := r.ReadAt(buf, int64(rng[0])); err != nil || n != len(buf) {
+			t.Fatalf("ReadAt(%v) returned %v bytes, %v", rng, n, err)
+		}
+		if !bytes.Equal(buf, content[rng[0]:rng[1]]) {
+			t.Errorf("ReadAt(%v) returned the wrong content", rng)
+		}
+	}
+	if _, err := r.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, content[len(content)-10:]) {
+		t.Errorf("Read after Seek should return the last bytes, got %v", tail)
+	}
+	if n, err := r.ReadAt(make([]byte, 1), int64(len(content))); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt past the end should return io.EOF got %v %v", n, err)
+	}
+}
+
+func TestTypedContent(t *testing.T) {
+	ctx := context.Background()
+	obj, b := testutil.OpenStore(ctx, t)
+	for _, content := range []string{
+		"dir 5\x00hello",
+		"commit 20\x0001234567890123456789",
+		"raw 20\x0001234567890123456789",
+		"tree 30\x0001234567890123456789",
+	} {
+		root, err := b.Upload(ctx, obj, bytes.NewBufferString(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := b.Chunks(ctx, bytes.NewBufferString(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, err := blob.TreeRef(chunks); err != nil {
+			t.Fatal(err)
+		} else if expected != root {
+			t.Errorf("blob.TreeRef should match the uploaded tree for %q", content)
+		}
+		tree, err := blob.ReadTree(ctx, obj, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range tree.Leaves {
+			if typ, _, err := obj.GetTyped(ctx, l); err != nil {
+				t.Fatal(err)
+			} else if typ != cas.TypeRaw {
+				t.Errorf("Chunk of %q should be raw, got %v", content, typ)
+			}
+		}
+		buf := &bytes.Buffer{}
+		if _, err := blob.Read(ctx, obj, buf, root); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != content {
+			t.Errorf("Expecting %q got %q", content, buf.String())
+		}
+		r, err := blob.NewReader(ctx, obj, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if all, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if string(all) != content {
+			t.Errorf("Reader returned %q for %q", all, content)
+		}
+	}
+}
@@ -39,6 +39,33 @@ func (c Chunk) MarshalBinary() ([]byte, error) {
 }
 
 func (t Tree) MarshalBinary() ([]byte, error) {
-	tup := tuple.Pairs{}.Add("leaves", t.Leaves).Add("branches", t.Branches).Named()
+	tup := tuple.Pairs{}.Add("leaves", t.Leaves).Add("branches", t.Branches).Add("sizes", t.Sizes).Named()
 	return tuple.MarshalBinary(tup)
 }
+
+// treeView is the human friendly representation of a Tree
+type treeView struct {
+	Branches []string `json:"branches,omitempty" yaml:"branches,omitempty"`
+	Leaves   []string `json:"leaves,omitempty" yaml:"leaves,omitempty"`
+	Sizes    []int64  `json:"sizes" yaml:"sizes"`
+	Size     int64    `json:"size" yaml:"size"`
+}
+
+func (t Tree) view() treeView {
+	v := treeView{Sizes: t.Sizes, Size: t.Size()}
+	for _, r := range t.Branches {
+		v.Branches = append(v.Branches, r.String())
+	}
+	for _, r := range t.Leaves {
+		v.Leaves = append(v.Leaves, r.String())
+	}
+	return v
+}
+
+func (t Tree) MarshalYAML() (interface{}, error) {
+	return t.view(), nil
+}
+
+func (t Tree) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.view())
+}
@@ -0,0 +1,160 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// Reader provides random access to the content of a blob,
+	// only the trees and chunks covering the requested bytes are read.
+	//
+	// ReadAt can be called concurrently, Read and Seek cannot
+	Reader struct {
+		ctx    context.Context
+		c      *cas.C
+		root   Tree
+		size   int64
+		offset int64
+
+		mu    sync.Mutex
+		trees map[cas.Ref]Tree
+		// the last chunk read is kept, sequential reads
+		// usually hit the same chunk many times
+		chunkRef  cas.Ref
+		chunkData []byte
+	}
+)
+
+var (
+	errNegativeOffset = errors.New("negative offset")
+)
+
+// NewReader returns a Reader for the blob whose root tree is root,
+// ctx is used by every read
+func NewReader(ctx context.Context, c *cas.C, root cas.Ref) (*Reader, error) {
+	t, err := ReadTree(ctx, c, root)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		ctx:   ctx,
+		c:     c,
+		root:  t,
+		size:  t.Size(),
+		trees: make(map[cas.Ref]Tree),
+	}, nil
+}
+
+// Size returns the number of bytes in the blob
+func (r *Reader) Size() int64 { return r.size }
+
+func (r *Reader) Read(buf []byte) (int, error) {
+	n, err := r.ReadAt(buf, r.offset)
+	r.offset += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %v", whence)
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *Reader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	var total int
+	for total < len(buf) {
+		if off >= r.size {
+			return total, io.EOF
+		}
+		data, start, err := r.chunkAt(off)
+		if err != nil {
+			return total, err
+		}
+		n := copy(buf[total:], data[off-start:])
+		total += n
+		off += int64(n)
+	}
+	return total, nil
+}
+
+// chunkAt returns the content of the chunk which contains off
+// and the offset of its first byte
+func (r *Reader) chunkAt(off int64) ([]byte, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.root
+	var start int64
+	for {
+		idx := -1
+		for i, s := range t.Sizes {
+			if off < start+s {
+				idx = i
+				break
+			}
+			start += s
+		}
+		if idx < 0 {
+			return nil, 0, fmt.Errorf("offset %v is outside of the tree, cause: %w", off, io.ErrUnexpectedEOF)
+		}
+		if len(t.Branches) == 0 {
+			data, err := r.chunk(t.Leaves[idx], t.Sizes[idx])
+			return data, start, err
+		}
+		next, err := r.tree(t.Branches[idx])
+		if err != nil {
+			return nil, 0, err
+		}
+		t = next
+	}
+}
+
+func (r *Reader) tree(ref cas.Ref) (Tree, error) {
+	if t, ok := r.trees[ref]; ok {
+		return t, nil
+	}
+	t, err := ReadTree(r.ctx, r.c, ref)
+	if err != nil {
+		return Tree{}, err
+	}
+	r.trees[ref] = t
+	return t, nil
+}
+
+func (r *Reader) chunk(ref cas.Ref, size int64) ([]byte, error) {
+	if r.chunkData != nil && r.chunkRef == ref {
+		return r.chunkData, nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	if err := r.c.GetRaw(r.ctx, buf, ref); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) != size {
+		return nil, fmt.Errorf("chunk %v has %v bytes but the tree expects %v", ref, buf.Len(), size)
+	}
+	r.chunkRef, r.chunkData = ref, buf.Bytes()
+	return r.chunkData, nil
+}
@@ -0,0 +1,207 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/tuple"
+)
+
+type (
+	countWriter struct {
+		actual io.Writer
+		total  int64
+	}
+)
+
+const (
+	// TreeType is the cas.Type used to store Tree objects
+	TreeType cas.Type = "tree"
+
+	// MaxTreeEntries is the maximum number of branches or leaves
+	// kept by a single Tree object, larger blobs use more than
+	// one level of trees
+	MaxTreeEntries = 1024
+)
+
+// Upload splits input into chunks, uploads them and writes the
+// Tree objects required to track all chunks. It returns the ref
+// of the root Tree
+func (b *B) Upload(ctx context.Context, casObj *cas.C, input io.Reader) (cas.Ref, error) {
+	chunks, err := b.uploadChunks(ctx, casObj, input)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	return WriteTree(ctx, casObj, chunks)
+}
+
+// WriteTree writes the Tree objects for the given list of chunks and
+// returns the ref of the root tree.
+func WriteTree(ctx context.Context, casObj *cas.C, chunks []Chunk) (cas.Ref, error) {
+	return buildTree(chunks, func(t Tree) (cas.Ref, error) {
+		buf, err := t.MarshalBinary()
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		return casObj.PutTyped(ctx, TreeType, buf)
+	})
+}
+
+// TreeRef computes the ref WriteTree would return for chunks, without
+// writing anything
+func TreeRef(chunks []Chunk) (cas.Ref, error) {
+	return buildTree(chunks, func(t Tree) (cas.Ref, error) {
+		buf, err := t.MarshalBinary()
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		return cas.TypedRef(TreeType, buf)
+	})
+}
+
+func buildTree(chunks []Chunk, put func(Tree) (cas.Ref, error)) (cas.Ref, error) {
+	var level []Tree
+	for len(chunks) > 0 || len(level) == 0 {
+		n := len(chunks)
+		if n > MaxTreeEntries {
+			n = MaxTreeEntries
+		}
+		var t Tree
+		for _, c := range chunks[:n] {
+			t.Leaves = append(t.Leaves, c.Ref)
+			t.Sizes = append(t.Sizes, int64(c.Size))
+		}
+		level = append(level, t)
+		chunks = chunks[n:]
+	}
+	for {
+		if len(level) == 1 {
+			return put(level[0])
+		}
+		var parents []Tree
+		for i, t := range level {
+			if i%MaxTreeEntries == 0 {
+				parents = append(parents, Tree{})
+			}
+			ref, err := put(t)
+			if err != nil {
+				return cas.Ref{}, err
+			}
+			p := &parents[len(parents)-1]
+			p.Branches = append(p.Branches, ref)
+			p.Sizes = append(p.Sizes, t.Size())
+		}
+		level = parents
+	}
+}
+
+// ReadTree reads and decodes the Tree object identified by ref,
+// untyped trees (written before typed objects existed) are accepted
+func ReadTree(ctx context.Context, casObj *cas.C, ref cas.Ref) (Tree, error) {
+	typ, content, err := casObj.GetTyped(ctx, ref)
+	if err != nil {
+		return Tree{}, err
+	}
+	if typ != TreeType && typ != cas.TypeRaw {
+		return Tree{}, fmt.Errorf("object %v is a %v not a %v", ref, typ, TreeType)
+	}
+	var t Tree
+	if err := t.UnmarshalBinary(content); err != nil {
+		return Tree{}, fmt.Errorf("unable to decode tree %v, cause: %w", ref, err)
+	}
+	return t, nil
+}
+
+// Read writes the content of the blob identified by the root
+// tree ref to w
+func Read(ctx context.Context, casObj *cas.C, w io.Writer, root cas.Ref) (int64, error) {
+	t, err := ReadTree(ctx, casObj, root)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, br := range t.Branches {
+		n, err := Read(ctx, casObj, w, br)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	cw := &countWriter{actual: w}
+	for _, l := range t.Leaves {
+		if err := casObj.GetRaw(ctx, cw, l); err != nil {
+			return total + cw.total, err
+		}
+	}
+	return total + cw.total, nil
+}
+
+// Size returns the number of bytes tracked by this tree
+func (t Tree) Size() int64 {
+	var total int64
+	for _, s := range t.Sizes {
+		total += s
+	}
+	return total
+}
+
+// Children returns the refs referenced by this tree
+func (t Tree) Children() []cas.Ref {
+	if len(t.Branches) > 0 {
+		return t.Branches
+	}
+	return t.Leaves
+}
+
+func (t *Tree) UnmarshalBinary(buf []byte) error {
+	var n tuple.Named
+	if err := tuple.UnmarshalBinary(buf, &n); err != nil {
+		return err
+	}
+	leaves, err := decodeRefs(n, "leaves")
+	if err != nil {
+		return err
+	}
+	branches, err := decodeRefs(n, "branches")
+	if err != nil {
+		return err
+	}
+	sizes, err := n.Int64List("sizes")
+	if err != nil {
+		return err
+	}
+	if len(leaves) > 0 && len(branches) > 0 {
+		return errors.New("tree cannot have leaves and branches")
+	}
+	if len(sizes) != len(leaves)+len(branches) {
+		return fmt.Errorf("tree has %v sizes for %v entries", len(sizes), len(leaves)+len(branches))
+	}
+	t.Leaves, t.Branches, t.Sizes = leaves, branches, sizes
+	return nil
+}
+
+func decodeRefs(n tuple.Named, name string) ([]cas.Ref, error) {
+	raw, err := n.BytesList(name)
+	if err != nil {
+		return nil, err
+	}
+	var refs []cas.Ref
+	for _, r := range raw {
+		var ref cas.Ref
+		if len(r) != len(ref) {
+			return nil, fmt.Errorf("invalid ref in field %v", name)
+		}
+		copy(ref[:], r)
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func (c *countWriter) Write(buf []byte) (int, error) {
+	n, err := c.actual.Write(buf)
+	c.total += int64(n)
+	return n, err
+}
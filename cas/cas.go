@@ -3,9 +3,13 @@ package cas
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,13 +19,20 @@ type (
 	// C implements the CAS abstraction on top of a
 	// S3 compatible storage
 	C struct {
+		// objCount names temporary objects, it must only be
+		// accessed with sync/atomic and is kept as the first
+		// field so it is 64-bit aligned on 32-bit platforms
+		objCount uint64
+
 		dataTable KV
 
-		dataPath, tempPath string
-		rootTmpUUIDs       uuid.UUID
-		objCount           uint64
+		dataPath, tempPath, packPath string
+		rootTmpUUIDs                 uuid.UUID
 
 		hexDirCount int
+
+		index *Index
+		packs packSet
 	}
 
 	// Ref contains the binary value of the sha256 hash which identifies
@@ -33,6 +44,15 @@ type (
 	//
 	// cas package is responsible for closing the KV
 	NewTable func(context.Context) (KV, error)
+
+	// Option configures optional features of C
+	Option func(*C) error
+)
+
+const (
+	// existsConcurrency limits how many Exists calls are made
+	// concurrently by ExistsBatch
+	existsConcurrency = 16
 )
 
 var (
@@ -40,25 +60,45 @@ var (
 	uuidTmpBucket = uuid.NewSHA1(uuidCAS, []byte("temporary-buckets"))
 )
 
-// Open a new CAS store using newBucket to acquire the remote item
-func Open(ctx context.Context, newBucket NewTable) (*C, error) {
-	var c C
-	c.dataPath = path.Join("data")
-	c.tempPath = path.Join("tmp")
+// WithIndex configures C to use idx to avoid checking the remote
+// for objects which are known to be absent.
+//
+// The index is saved when C is closed
+func WithIndex(idx *Index) Option {
+	return func(c *C) error {
+		c.index = idx
+		return nil
+	}
+}
 
+// Open a new CAS store using newBucket to acquire the remote item
+func Open(ctx context.Context, newBucket NewTable, options ...Option) (*C, error) {
 	bucket, err := newBucket(ctx)
 	if err != nil {
 		return nil, err
 	}
 	var nowInBytes [8]byte
 	int64Bytes(&nowInBytes, time.Now().Unix())
-	tmpBucket := uuid.NewSHA1(uuidTmpBucket, nowInBytes[:])
+	// the random part keeps the temporary objects of processes
+	// which open the same KV within the same second apart
+	random := uuid.New()
+	tmpBucket := uuid.NewSHA1(uuidTmpBucket, append(nowInBytes[:], random[:]...))
 
-	return &C{
+	c := &C{
 		dataTable:    bucket,
+		dataPath:     path.Join("data"),
+		tempPath:     path.Join("tmp"),
+		packPath:     path.Join("packs"),
 		rootTmpUUIDs: tmpBucket,
 		hexDirCount:  4,
-	}, nil
+	}
+	for _, opt := range options {
+		if err := opt(c); err != nil {
+			bucket.Close()
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
 // PutContent writes content to a temporary object and later copies that object
@@ -74,10 +114,19 @@ func Open(ctx context.Context, newBucket NewTable) (*C, error) {
 //
 // If the provided KV object implementes the Mover interface, then instead
 // of Copy/Delete cas will use the Move operation.
+//
+// When an Index is configured, the remote check for the final object
+// is skipped if the index knows the object does not exist.
+//
+// If the KV implements ModTimer, objects which exist but were written
+// more than FreshenAge ago are written again, so a Prune with a grace
+// period does not remove them while the caller creates a reference.
+//
+// PutContent is safe for concurrent use, every call writes to its
+// own temporary object.
 func (c *C) PutContent(ctx context.Context, content io.Reader) (Ref, error) {
 	var counterInBytes [8]byte
-	c.objCount++
-	uint64Bytes(&counterInBytes, c.objCount)
+	uint64Bytes(&counterInBytes, atomic.AddUint64(&c.objCount, 1))
 	tmpIdentity := uuid.NewSHA1(c.rootTmpUUIDs, counterInBytes[:])
 	tmpPath := path.Join(c.tempPath, tmpIdentity.String())
 	var ref Ref
@@ -88,31 +137,220 @@ func (c *C) PutContent(ctx context.Context, content io.Reader) (Ref, error) {
 		return Ref{}, err
 	}
 	finalPath := path.Join(c.dataPath, ref.HexPath(c.hexDirCount))
-	if exists, _ := c.dataTable.Exists(ctx, finalPath); exists {
-		return ref, nil
+	if c.mayExist(ref) {
+		if exists, _ := c.Exists(ctx, ref); exists && !c.stale(ctx, ref) {
+			// the temporary object is not needed anymore, failing to remove
+			// it only wastes space, so the error can be ignored
+			c.dataTable.Delete(ctx, tmpPath)
+			c.indexAdd(ref)
+			return ref, nil
+		}
 	}
 	err = move(ctx, c.dataTable, finalPath, tmpPath)
 	if err != nil {
 		return Ref{}, fmt.Errorf("unable to copy %v to %v, cause: %w", tmpPath, finalPath, err)
 	}
+	c.indexAdd(ref)
 	return ref, nil
 }
 
-// Exists returns true if the ref already exists
+// stale returns true if ref was written more than FreshenAge ago,
+// either as a loose object or as part of a pack
+func (c *C) stale(ctx context.Context, ref Ref) bool {
+	mt, ok := c.dataTable.(ModTimer)
+	if !ok {
+		return false
+	}
+	modTime, err := mt.ModTime(ctx, c.loosePath(ref))
+	if errors.Is(err, ErrNotFound) {
+		e, ok, _ := c.lookupPacked(ctx, ref, false)
+		if !ok {
+			return false
+		}
+		modTime, err = mt.ModTime(ctx, c.packKey(e.pack))
+	}
+	return err == nil && time.Since(modTime) > FreshenAge
+}
+
+// Exists returns true if the ref already exists, either as a loose
+// object or inside a pack
 func (c *C) Exists(ctx context.Context, ref Ref) (bool, error) {
-	return c.dataTable.Exists(ctx, path.Join(c.dataPath, ref.HexPath(c.hexDirCount)))
+	if _, ok, err := c.lookupPacked(ctx, ref, false); err != nil {
+		return false, err
+	} else if ok {
+		return true, nil
+	}
+	return c.dataTable.Exists(ctx, c.loosePath(ref))
+}
+
+// ExistsBatch returns, for each ref, true if the ref already exists.
+//
+// If the KV implements BatchExister all refs are checked with one call,
+// otherwise refs are checked concurrently.
+func (c *C) ExistsBatch(ctx context.Context, refs []Ref) ([]bool, error) {
+	out := make([]bool, len(refs))
+	var keys []string
+	var pending []int
+	for i, r := range refs {
+		if _, ok, err := c.lookupPacked(ctx, r, false); err != nil {
+			return nil, err
+		} else if ok {
+			out[i] = true
+			continue
+		}
+		keys = append(keys, c.loosePath(r))
+		pending = append(pending, i)
+	}
+	if len(keys) == 0 {
+		return out, nil
+	}
+	loose, err := c.existsLoose(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, found := range loose {
+		out[pending[i]] = found
+	}
+	return out, nil
+}
+
+func (c *C) existsLoose(ctx context.Context, keys []string) ([]bool, error) {
+	if be, ok := c.dataTable.(BatchExister); ok {
+		return be.ExistsBatch(ctx, keys)
+	}
+	out := make([]bool, len(keys))
+	errs := make([]error, len(keys))
+	sem := make(chan struct{}, existsConcurrency)
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			out[i], errs[i] = c.dataTable.Exists(ctx, keys[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
 }
 
 // Get writes the object at ref to the given output
 // it returns the underlying KV error without any modification
+//
+// Objects which are not found as loose objects are searched
+// in the packs created by Repack
 func (c *C) GetContent(ctx context.Context, w io.Writer, ref Ref) error {
-	finalPath := path.Join(c.dataPath, ref.HexPath(c.hexDirCount))
-	_, err := c.dataTable.Read(ctx, w, finalPath)
+	_, err := c.dataTable.Read(ctx, w, c.loosePath(ref))
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if found, packErr := c.readPacked(ctx, w, ref); packErr != nil {
+		return packErr
+	} else if found {
+		return nil
+	}
 	return err
 }
 
+// GetRange writes length bytes of the object at ref to w, starting
+// at offset, without reading the rest of the object.
+//
+// Like GetContent, objects which are not found as loose objects are
+// searched in the packs created by Repack
+func (c *C) GetRange(ctx context.Context, w io.Writer, ref Ref, offset, length int64) (int64, error) {
+	n, err := ReadRange(ctx, c.dataTable, w, c.loosePath(ref), offset, length)
+	if !errors.Is(err, ErrNotFound) {
+		return n, err
+	}
+	e, ok, packErr := c.lookupPacked(ctx, ref, true)
+	if packErr != nil {
+		return 0, packErr
+	} else if !ok {
+		return 0, err
+	}
+	if offset >= e.length {
+		return 0, io.ErrUnexpectedEOF
+	}
+	short := offset+length > e.length
+	if short {
+		length = e.length - offset
+	}
+	n, err = ReadRange(ctx, c.dataTable, w, c.packKey(e.pack), e.offset+offset, length)
+	if err == nil && short {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// RebuildIndex replaces the content of the index with the
+// refs found in the remote KV.
+//
+// The KV must implement the Lister interface
+func (c *C) RebuildIndex(ctx context.Context) error {
+	if c.index == nil {
+		return errors.New("cas was opened without an index")
+	}
+	var refs []Ref
+	collect := func(r Ref) error {
+		refs = append(refs, r)
+		return nil
+	}
+	if err := c.listRefs(ctx, collect); err != nil {
+		return fmt.Errorf("unable to list objects, cause: %w", err)
+	}
+	if err := c.packedRefs(ctx, collect); err != nil {
+		return fmt.Errorf("unable to list packed objects, cause: %w", err)
+	}
+	c.index.reset(refs)
+	return c.index.Save()
+}
+
+// listRefs calls fn for every loose object under the data path
+func (c *C) listRefs(ctx context.Context, fn func(Ref) error) error {
+	lister, ok := c.dataTable.(Lister)
+	if !ok {
+		return ErrNotSupported
+	}
+	return lister.List(ctx, c.dataPath+"/", func(key string) error {
+		ref, err := ParseRef(strings.TrimPrefix(key, c.dataPath+"/"))
+		if err != nil {
+			// not an object created by cas
+			return nil
+		}
+		return fn(ref)
+	})
+}
+
+func (c *C) mayExist(ref Ref) bool {
+	return c.index == nil || c.index.MayContain(ref)
+}
+
+func (c *C) indexAdd(ref Ref) {
+	if c.index != nil {
+		c.index.Add(ref)
+	}
+}
+
+// KV returns the KV used to store the objects, it allows packages
+// which keep mutable keys (eg.: refs) to share the same storage
+func (c *C) KV() KV {
+	return c.dataTable
+}
+
 // Close the underlying bucket
 func (c *C) Close() error {
+	if c.index != nil {
+		if err := c.index.Save(); err != nil {
+			c.dataTable.Close()
+			return err
+		}
+	}
 	errData := c.dataTable.Close()
 	if errData != nil {
 		return fmt.Errorf("unable to close data bucket, cause: %w", errData)
@@ -1,18 +1,20 @@
+//go:build minio_driver
 // +build minio_driver
 
-package cas
+package cas_test
 
 import (
 	"context"
 	"testing"
 
+	"github.com/andrebq/dbfs/cas"
 	"github.com/andrebq/dbfs/drivers/minio/kv"
 )
 
 func TestMinioDriver(t *testing.T) {
 	// check the Makefile to get a glimpse of all environment variables
 	// or read the individual options on kv
-	sanityCheckCAS(t, context.Background(), func(ctx context.Context) (KV, error) {
+	sanityCheckCAS(t, context.Background(), func(ctx context.Context) (cas.KV, error) {
 		return kv.Connect(ctx, kv.FromEnv()...)
 	})
 }
@@ -1,23 +1,35 @@
-package cas
+package cas_test
 
 import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/drivers/gcloud/kv"
 	"github.com/andrebq/dbfs/internal/testutil"
 )
 
-func sanityCheckCAS(t *testing.T, ctx context.Context, newkv NewTable) {
-	cas, err := Open(ctx, newkv)
+func sanityCheckCAS(t *testing.T, ctx context.Context, newkv cas.NewTable) {
+	store, err := cas.Open(ctx, newkv)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// echo -n abc123 | shasum -a 256
 	expectedRef, _ := hex.DecodeString("6ca13d52ca70c883e0f0bb101e425a89e8624de51db2d2392593af6a84118090")
-	ref, err := cas.PutContent(ctx, bytes.NewBufferString("abc123"))
+	ref, err := store.PutContent(ctx, bytes.NewBufferString("abc123"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -27,7 +39,7 @@ func sanityCheckCAS(t *testing.T, ctx context.Context, newkv NewTable) {
 	}
 
 	buf := &bytes.Buffer{}
-	if err := cas.GetContent(ctx, buf, ref); err != nil {
+	if err := store.GetContent(ctx, buf, ref); err != nil {
 		t.Fatal(err)
 	} else if !bytes.Equal(buf.Bytes(), []byte("abc123")) {
 		t.Errorf("Unexpected content from buffer: %v", buf.String())
@@ -35,11 +47,539 @@ func sanityCheckCAS(t *testing.T, ctx context.Context, newkv NewTable) {
 }
 
 func TestCAS(t *testing.T) {
-	sanityCheckCAS(t, context.Background(), func(ctx context.Context) (KV, error) {
+	sanityCheckCAS(t, context.Background(), func(ctx context.Context) (cas.KV, error) {
 		return testutil.MemoryBucket(ctx, t), nil
 	})
 	// run twice so we can check if the exists short-circuit works
-	sanityCheckCAS(t, context.Background(), func(ctx context.Context) (KV, error) {
+	sanityCheckCAS(t, context.Background(), func(ctx context.Context) (cas.KV, error) {
 		return testutil.MemoryBucket(ctx, t), nil
 	})
 }
+
+type countingKV struct {
+	*kv.Bucket
+	exists int
+	lists  int
+}
+
+func (c *countingKV) Exists(ctx context.Context, key string) (bool, error) {
+	c.exists++
+	return c.Bucket.Exists(ctx, key)
+}
+
+func (c *countingKV) List(ctx context.Context, prefix string, fn func(string) error) error {
+	c.lists++
+	return c.Bucket.List(ctx, prefix, fn)
+}
+
+// barrierKV holds writes to temporary objects until n of
+// them are in progress
+type barrierKV struct {
+	*kv.Bucket
+	n       int
+	mu      sync.Mutex
+	arrived int
+	all     chan struct{}
+}
+
+func (b *barrierKV) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	if strings.HasPrefix(key, "tmp/") {
+		b.mu.Lock()
+		b.arrived++
+		if b.arrived == b.n {
+			close(b.all)
+		}
+		b.mu.Unlock()
+		select {
+		case <-b.all:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return b.Bucket.Write(ctx, key, input)
+}
+
+func TestConcurrentPut(t *testing.T) {
+	ctx := context.Background()
+	const writers = 32
+	bucket := &barrierKV{Bucket: testutil.MemoryBucket(ctx, t), n: writers, all: make(chan struct{})}
+	store, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) { return bucket, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := make([]cas.Ref, writers)
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			refs[i], errs[i] = store.PutContent(ctx, bytes.NewBufferString("object "+strconv.Itoa(i)))
+		}(i)
+	}
+	wg.Wait()
+	for i, ref := range refs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		buf := &bytes.Buffer{}
+		if err := store.GetContent(ctx, buf, ref); err != nil {
+			t.Fatal(err)
+		} else if expected := "object " + strconv.Itoa(i); buf.String() != expected {
+			t.Errorf("Object %v should contain %q got %q", ref, expected, buf.String())
+		}
+	}
+}
+
+func TestPack(t *testing.T) {
+	ctx := context.Background()
+	rangeBucket := testutil.MemoryBucket(ctx, t)
+	fullBucket := testutil.MemoryBucket(ctx, t)
+	for _, c := range []struct {
+		name  string
+		newkv cas.NewTable
+	}{
+		{"RangeReader", func(ctx context.Context) (cas.KV, error) { return rangeBucket, nil }},
+		// hides the RangeReader implementation from the bucket
+		{"FullRead", func(ctx context.Context) (cas.KV, error) {
+			return struct {
+				cas.KV
+				cas.Lister
+			}{fullBucket, fullBucket}, nil
+		}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			checkPack(ctx, t, c.newkv)
+		})
+	}
+}
+
+func TestMissingObjectsReloadPacks(t *testing.T) {
+	ctx := context.Background()
+	counter := &countingKV{Bucket: testutil.MemoryBucket(ctx, t)}
+	store, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) { return counter, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		missing := cas.PrecomputeHashBytes([]byte("missing " + strconv.Itoa(i)))
+		if err := store.GetContent(ctx, ioutil.Discard, missing); !errors.Is(err, cas.ErrNotFound) {
+			t.Fatalf("Missing objects should return ErrNotFound, got %v", err)
+		}
+	}
+	if counter.lists != 1 {
+		t.Errorf("Pack indexes should be listed once, got %v listings", counter.lists)
+	}
+}
+
+// agedKV reports keys passed to age as written two days ago,
+// until they are written again
+type agedKV struct {
+	*kv.Bucket
+	mu  sync.Mutex
+	old map[string]bool
+}
+
+func (a *agedKV) age(ctx context.Context, t *testing.T) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.Bucket.List(ctx, "", func(key string) error {
+		a.old[key] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (a *agedKV) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	a.mu.Lock()
+	delete(a.old, key)
+	a.mu.Unlock()
+	return a.Bucket.Write(ctx, key, input)
+}
+
+func (a *agedKV) Copy(ctx context.Context, to, from string) error {
+	a.mu.Lock()
+	delete(a.old, to)
+	a.mu.Unlock()
+	return a.Bucket.Copy(ctx, to, from)
+}
+
+func (a *agedKV) ModTime(ctx context.Context, key string) (time.Time, error) {
+	modTime, err := a.Bucket.ModTime(ctx, key)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.old[key] {
+		modTime = modTime.Add(-48 * time.Hour)
+	}
+	return modTime, err
+}
+
+func TestPruneMinAge(t *testing.T) {
+	ctx := context.Background()
+	bucket := &agedKV{Bucket: testutil.MemoryBucket(ctx, t), old: map[string]bool{}}
+	store, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) { return bucket, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(content string) cas.Ref {
+		ref, err := store.PutContent(ctx, bytes.NewBufferString(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+	none := func(cas.Ref) bool { return false }
+	opts := cas.PruneOptions{MinAge: cas.DefaultPruneMinAge}
+
+	old, freshened := put("old"), put("freshened")
+	bucket.age(ctx, t)
+	recent := put("recent")
+	if again := put("freshened"); again != freshened {
+		t.Fatalf("Same content should have the same ref, got %v and %v", freshened, again)
+	}
+	stats, err := store.Prune(ctx, none, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Loose != 1 || stats.Recent != 2 {
+		t.Errorf("Prune should remove 1 object and keep 2 recent ones: %#v", stats)
+	}
+	if err := store.GetContent(ctx, ioutil.Discard, old); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Old objects should be removed, got %v", err)
+	}
+	for _, ref := range []cas.Ref{recent, freshened} {
+		if err := store.GetContent(ctx, ioutil.Discard, ref); err != nil {
+			t.Errorf("Recent object %v should be kept, got %v", ref, err)
+		}
+	}
+
+	if _, err := store.Repack(ctx, cas.RepackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := store.Prune(ctx, none, opts); err != nil {
+		t.Fatal(err)
+	} else if stats.Packed != 0 || stats.Recent != 2 {
+		t.Errorf("Packs younger than MinAge should be kept: %#v", stats)
+	}
+	bucket.age(ctx, t)
+	if stats, err := store.Prune(ctx, none, opts); err != nil {
+		t.Fatal(err)
+	} else if stats.Packed != 2 {
+		t.Errorf("Old packs should be removed: %#v", stats)
+	}
+
+	if _, err := store.Prune(ctx, none, cas.PruneOptions{MinAge: time.Minute}); err == nil {
+		t.Error("MinAge shorter than FreshenAge should be rejected")
+	}
+	hidden, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return struct {
+			cas.KV
+			cas.Lister
+		}{bucket, bucket}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hidden.Prune(ctx, none, opts); !errors.Is(err, cas.ErrNotSupported) {
+		t.Errorf("MinAge requires a cas.ModTimer, got %v", err)
+	}
+}
+
+func checkPack(ctx context.Context, t *testing.T, newkv cas.NewTable) {
+	store, err := cas.Open(ctx, newkv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []cas.Ref
+	for i := 0; i < 20; i++ {
+		ref, err := store.PutContent(ctx, bytes.NewBufferString("small object "+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	large, err := store.PutContent(ctx, bytes.NewBuffer(make([]byte, 2000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.Repack(ctx, cas.RepackOptions{MaxObjectSize: 1000, PackSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Objects != len(refs) || stats.Packs < 2 {
+		t.Errorf("Repack should move every small object to more than one pack: %#v", stats)
+	}
+
+	// a new C must find the packs written by the previous one
+	reopened, err := cas.Open(ctx, newkv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectObject := func(store *cas.C, ref cas.Ref, content string) {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		if err := store.GetContent(ctx, buf, ref); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != content {
+			t.Errorf("Object %v should be %q got %q", ref, content, buf.String())
+		}
+	}
+	for i, ref := range refs {
+		expectObject(reopened, ref, "small object "+strconv.Itoa(i))
+	}
+	expectObject(reopened, large, string(make([]byte, 2000)))
+	for _, ref := range []cas.Ref{refs[2], large} {
+		full := &bytes.Buffer{}
+		if err := reopened.GetContent(ctx, full, ref); err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		if n, err := reopened.GetRange(ctx, buf, ref, 6, 6); err != nil || n != 6 {
+			t.Fatalf("GetRange returned %v bytes, %v", n, err)
+		} else if !bytes.Equal(buf.Bytes(), full.Bytes()[6:12]) {
+			t.Errorf("GetRange returned %q for %v", buf.Bytes(), ref)
+		}
+		if _, err := reopened.GetRange(ctx, ioutil.Discard, ref, int64(full.Len()-1), 2); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Ranges past the end of the object should fail, got %v", err)
+		}
+	}
+	found, err := reopened.ExistsBatch(ctx, append([]cas.Ref{large}, refs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range found {
+		if !f {
+			t.Errorf("Object %v should exist after repack", i)
+		}
+	}
+
+	live := map[cas.Ref]bool{refs[0]: true, large: true}
+	dry, err := reopened.Prune(ctx, func(r cas.Ref) bool { return live[r] }, cas.PruneOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dry.Packed != len(refs)-1 {
+		t.Errorf("Dry run should count %v packed objects: %#v", len(refs)-1, dry)
+	}
+	expectObject(reopened, refs[1], "small object 1")
+	if _, err := reopened.Prune(ctx, func(r cas.Ref) bool { return live[r] }, cas.PruneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectObject(reopened, refs[0], "small object 0")
+	expectObject(reopened, large, string(make([]byte, 2000)))
+	// store still has the old pack indexes in memory
+	expectObject(store, refs[0], "small object 0")
+	if err := store.GetContent(ctx, ioutil.Discard, refs[1]); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Pruned object should not be found, got %v", err)
+	}
+}
+
+func TestTyped(t *testing.T) {
+	ctx := context.Background()
+	store, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return testutil.MemoryBucket(ctx, t), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ref, err := store.PutTyped(ctx, "commit", []byte("content\x00with nul"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, err := cas.TypedRef("commit", []byte("content\x00with nul")); err != nil {
+		t.Fatal(err)
+	} else if expected != ref {
+		t.Error("TypedRef should match the ref returned by PutTyped")
+	}
+	typ, content, err := store.GetTyped(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != "commit" || string(content) != "content\x00with nul" {
+		t.Errorf("Unexpected typed object %v %q", typ, content)
+	}
+
+	raw, err := store.PutContent(ctx, bytes.NewBufferString("tree 3\x00abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ, content, err := store.GetTyped(ctx, raw); err != nil {
+		t.Fatal(err)
+	} else if typ != cas.TypeRaw || string(content) != "tree 3\x00abcd" {
+		t.Errorf("Header with an invalid length should be reported as raw, got %v %q", typ, content)
+	}
+
+	for _, content := range []string{"tree 4\x00abcd", "raw 4\x00abcd", "plain"} {
+		ref, err := store.PutRaw(ctx, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref != cas.RawRef([]byte(content)) {
+			t.Error("RawRef should match the ref returned by PutRaw")
+		}
+		if typ, decoded, err := store.GetTyped(ctx, ref); err != nil {
+			t.Fatal(err)
+		} else if typ != cas.TypeRaw || string(decoded) != content {
+			t.Errorf("Raw objects cannot be read as typed, got %v %q", typ, decoded)
+		}
+		buf := &bytes.Buffer{}
+		if err := store.GetRaw(ctx, buf, ref); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != content {
+			t.Errorf("Expecting %q got %q", content, buf.String())
+		}
+	}
+
+	for _, invalid := range []cas.Type{"", "raw", "Tree", "tree 1", cas.Type(strings.Repeat("a", 33))} {
+		if _, err := store.PutTyped(ctx, invalid, nil); err == nil {
+			t.Errorf("Type %q should be rejected", invalid)
+		}
+	}
+}
+
+func TestParseRef(t *testing.T) {
+	ref := cas.PrecomputeHashBytes([]byte("abc123"))
+	for _, str := range []string{ref.String(), ref.HexPath(4)} {
+		parsed, err := cas.ParseRef(str)
+		if err != nil {
+			t.Fatal(err)
+		} else if parsed != ref {
+			t.Errorf("Expecting %v got %v", ref, parsed)
+		}
+	}
+	if _, err := cas.ParseRef("abc"); err == nil {
+		t.Error("Short values should not be accepted")
+	}
+}
+
+func TestRefCalculatorDataWithEOF(t *testing.T) {
+	var ref cas.Ref
+	// iotest.DataErrReader returns the last bytes together with io.EOF
+	rc := cas.RefCalculator(&ref, iotest.DataErrReader(strings.NewReader("abc123")))
+	if _, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	}
+	if expected := cas.PrecomputeHashBytes([]byte("abc123")); ref != expected {
+		t.Errorf("Expecting %v got %v", expected, ref)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dbfs-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idxFile := filepath.Join(dir, "index")
+
+	counter := &countingKV{Bucket: testutil.MemoryBucket(ctx, t)}
+	newkv := func(ctx context.Context) (cas.KV, error) { return counter, nil }
+
+	// populate the remote before any index exists
+	plain, err := cas.Open(ctx, newkv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing, err := plain.PutContent(ctx, bytes.NewBufferString("already there"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := cas.OpenIndex(idxFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Complete() {
+		t.Fatal("New index should not be complete")
+	}
+	store, err := cas.Open(ctx, newkv, cas.WithIndex(idx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RebuildIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !idx.MayContain(existing) {
+		t.Error("Rebuilt index should contain objects from the remote")
+	}
+
+	counter.exists = 0
+	ref, err := store.PutContent(ctx, bytes.NewBufferString("new content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter.exists != 0 {
+		t.Errorf("New objects should not be checked against the remote, got %v calls", counter.exists)
+	}
+	if _, err := store.PutContent(ctx, bytes.NewBufferString("new content")); err != nil {
+		t.Fatal(err)
+	}
+	if counter.exists != 1 {
+		t.Errorf("Known objects must be confirmed with the remote, got %v calls", counter.exists)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := cas.OpenIndex(idxFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.Complete() || !reloaded.MayContain(ref) || !reloaded.MayContain(existing) {
+		t.Error("Index should be persisted when cas is closed")
+	}
+	// the store was almost empty when the index was rebuilt,
+	// it must not saturate after more objects are added
+	for i := 0; i < 10000; i++ {
+		reloaded.Add(cas.PrecomputeHashBytes([]byte("added-" + strconv.Itoa(i))))
+	}
+	var falsePositives int
+	for i := 0; i < 1000; i++ {
+		if reloaded.MayContain(cas.PrecomputeHashBytes([]byte(strconv.Itoa(i)))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("Too many false positives: %v", falsePositives)
+	}
+}
+
+// recordingKV records the temporary keys written to it
+type recordingKV struct {
+	cas.KV
+	tmp *[]string
+}
+
+func (r *recordingKV) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	if strings.HasPrefix(key, "tmp/") {
+		*r.tmp = append(*r.tmp, key)
+	}
+	return r.KV.Write(ctx, key, input)
+}
+
+func TestTemporaryKeys(t *testing.T) {
+	// two stores on the same KV, opened within the same second,
+	// must not write to the same temporary objects
+	ctx := context.Background()
+	bucket := testutil.MemoryBucket(ctx, t)
+	var keys []string
+	for i := 0; i < 2; i++ {
+		store, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+			return &recordingKV{KV: bucket, tmp: &keys}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.PutContent(ctx, bytes.NewBufferString("object "+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(keys) != 2 || keys[0] == keys[1] {
+		t.Errorf("Each store should use its own temporary keys, got %v", keys)
+	}
+}
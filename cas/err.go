@@ -1,12 +1,67 @@
 package cas
 
+import (
+	"errors"
+	"fmt"
+)
+
 type (
 	// Err represents errors that don't carry any extra information
 	Err string
+
+	// KVError is returned by drivers to classify a backend error
+	// into one of the Err values declared in this package.
+	//
+	// Callers should use errors.Is to check the kind of the error,
+	// the original error from the backend is kept as the cause
+	// and can be retrieved with errors.Unwrap
+	KVError struct {
+		Kind  Err
+		Op    string
+		Key   string
+		Cause error
+	}
 )
 
 const (
 	ErrNotFound = Err("cas reference could not be found")
+	// ErrPermissionDenied indicates that the credentials used by the
+	// KV are not allowed to execute the operation
+	ErrPermissionDenied = Err("cas permission denied")
+	// ErrTransient indicates a failure which might go away if the
+	// operation is retried later (eg.: throttling, connection resets)
+	ErrTransient = Err("cas transient failure")
+	// ErrPreconditionFailed indicates that a conditional operation
+	// could not be completed because the object changed
+	ErrPreconditionFailed = Err("cas precondition failed")
+	// ErrNotSupported indicates that the KV does not implement
+	// an optional operation
+	ErrNotSupported = Err("operation not supported by kv")
 )
 
 func (e Err) Error() string { return string(e) }
+
+// NewKVError returns a KVError of the given kind, if cause is nil
+// then nil is returned.
+func NewKVError(kind Err, op, key string, cause error) error {
+	if cause == nil {
+		return nil
+	}
+	return &KVError{Kind: kind, Op: op, Key: key, Cause: cause}
+}
+
+func (e *KVError) Error() string {
+	return fmt.Sprintf("%v %v: %v, cause: %v", e.Op, e.Key, e.Kind, e.Cause)
+}
+
+// Is returns true if target is the Kind of this error
+func (e *KVError) Is(target error) bool {
+	return target == error(e.Kind)
+}
+
+func (e *KVError) Unwrap() error { return e.Cause }
+
+// IsRetryable returns true if err was classified as ErrTransient
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
@@ -0,0 +1,26 @@
+package cas
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestKVError(t *testing.T) {
+	cause := errors.New("backend failure")
+	err := NewKVError(ErrTransient, "read", "data/ab", cause)
+	if !errors.Is(err, ErrTransient) {
+		t.Errorf("Error %v should be transient", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Errorf("Error %v should not be not-found", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("Error %v should wrap %v", err, cause)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("Error %v should be retryable", err)
+	}
+	if NewKVError(ErrNotFound, "read", "data/ab", nil) != nil {
+		t.Error("NewKVError should return nil when cause is nil")
+	}
+}
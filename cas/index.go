@@ -0,0 +1,219 @@
+package cas
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type (
+	// Index is a Bloom filter of refs which are known to exist
+	// in the remote KV.
+	//
+	// A Bloom filter never returns false negatives, so once the
+	// index is complete (see C.RebuildIndex) a negative answer
+	// means the object is not in the remote and cas can skip the
+	// network round-trip. Positive answers are always confirmed with
+	// the remote KV, therefore correctness never depends on the index.
+	Index struct {
+		mu       sync.Mutex
+		file     string
+		bits     []uint64
+		hashes   uint32
+		complete bool
+		dirty    bool
+	}
+)
+
+const (
+	// DefaultIndexCapacity is the number of refs used to size
+	// new indexes
+	DefaultIndexCapacity = 1_000_000
+
+	indexMagic             = "dbfsidx1"
+	indexFalsePositiveRate = 0.01
+	// indexGrowth leaves room for the objects added after
+	// the index is rebuilt
+	indexGrowth = 4
+)
+
+// OpenIndex loads the index saved at file, if file does not exist
+// an empty (incomplete) index is returned.
+//
+// An incomplete index is never used to skip a remote check, call
+// C.RebuildIndex to populate it from the remote KV
+func OpenIndex(file string) (*Index, error) {
+	idx := newIndex(file, DefaultIndexCapacity)
+	content, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := idx.decode(bytes.NewReader(content)); err != nil {
+		return nil, fmt.Errorf("unable to load index from %v, cause: %w", file, err)
+	}
+	return idx, nil
+}
+
+func newIndex(file string, capacity int) *Index {
+	if capacity < 1 {
+		capacity = 1
+	}
+	// optimal values for a Bloom filter, see
+	// https://en.wikipedia.org/wiki/Bloom_filter#Optimal_number_of_hash_functions
+	nbits := math.Ceil(-float64(capacity) * math.Log(indexFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Round(nbits / float64(capacity) * math.Ln2)
+	return &Index{
+		file:   file,
+		bits:   make([]uint64, (int(nbits)+63)/64),
+		hashes: uint32(math.Max(1, hashes)),
+	}
+}
+
+// Add records that ref exists in the remote
+func (i *Index) Add(ref Ref) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.add(ref)
+}
+
+// MayContain returns false if the index is complete and ref is
+// definitely not in the remote, true otherwise
+func (i *Index) MayContain(ref Ref) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.complete {
+		return true
+	}
+	nbits := uint64(len(i.bits) * 64)
+	h1, h2 := refHashes(ref)
+	for n := uint64(0); n < uint64(i.hashes); n++ {
+		bit := (h1 + n*h2) % nbits
+		if i.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Complete returns true if the index was populated from
+// a full listing of the remote
+func (i *Index) Complete() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.complete
+}
+
+// Save writes the index to its file, if the index has
+// not changed since it was loaded, nothing is done
+func (i *Index) Save() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.dirty {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(i.file), filepath.Base(i.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	err = i.encode(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save index to %v, cause: %w", i.file, err)
+	}
+	if err := os.Rename(tmp.Name(), i.file); err != nil {
+		return err
+	}
+	i.dirty = false
+	return nil
+}
+
+// add must be called with the lock held
+func (i *Index) add(ref Ref) {
+	nbits := uint64(len(i.bits) * 64)
+	h1, h2 := refHashes(ref)
+	for n := uint64(0); n < uint64(i.hashes); n++ {
+		bit := (h1 + n*h2) % nbits
+		i.bits[bit/64] |= 1 << (bit % 64)
+	}
+	i.dirty = true
+}
+
+// reset replaces the content of the index with refs and
+// marks it as complete, the index is never smaller than
+// DefaultIndexCapacity so it does not saturate when
+// rebuilt from an empty (or small) store
+func (i *Index) reset(refs []Ref) {
+	capacity := len(refs) * indexGrowth
+	if capacity < DefaultIndexCapacity {
+		capacity = DefaultIndexCapacity
+	}
+	fresh := newIndex(i.file, capacity)
+	for _, r := range refs {
+		fresh.add(r)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.bits = fresh.bits
+	i.hashes = fresh.hashes
+	i.complete = true
+	i.dirty = true
+}
+
+func (i *Index) encode(w io.Writer) error {
+	var complete uint8
+	if i.complete {
+		complete = 1
+	}
+	for _, v := range []interface{}{[]byte(indexMagic), complete, i.hashes, uint64(len(i.bits)), i.bits} {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Index) decode(r io.Reader) error {
+	var magic [len(indexMagic)]byte
+	var complete uint8
+	var words uint64
+	for _, v := range []interface{}{&magic, &complete, &i.hashes, &words} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	if string(magic[:]) != indexMagic {
+		return errors.New("invalid index header")
+	}
+	if i.hashes == 0 || words == 0 || words > math.MaxInt32 {
+		return errors.New("invalid index parameters")
+	}
+	i.bits = make([]uint64, words)
+	if err := binary.Read(r, binary.BigEndian, i.bits); err != nil {
+		return err
+	}
+	i.complete = complete == 1
+	return nil
+}
+
+// refHashes returns two independent hashes for ref, since
+// refs are sha256 values, their bytes are used directly
+func refHashes(ref Ref) (uint64, uint64) {
+	return binary.BigEndian.Uint64(ref[0:8]), binary.BigEndian.Uint64(ref[8:16]) | 1
+}
@@ -2,7 +2,9 @@ package cas
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 )
 
 type (
@@ -21,8 +23,88 @@ type (
 	Mover interface {
 		Move(context.Context, string, string) error
 	}
+
+	// Lister is implemented by KV objects which can enumerate
+	// the keys under a given prefix.
+	//
+	// fn is called once per key, if it returns an error the listing
+	// stops and that error is returned to the caller
+	Lister interface {
+		List(ctx context.Context, prefix string, fn func(key string) error) error
+	}
+
+	// BatchExister is implemented by KV objects which can check
+	// if many keys exist using a single request
+	BatchExister interface {
+		ExistsBatch(ctx context.Context, keys []string) ([]bool, error)
+	}
+
+	// RangeReader is implemented by KV objects which can read
+	// length bytes starting at offset without reading the whole object
+	RangeReader interface {
+		ReadRange(ctx context.Context, w io.Writer, key string, offset, length int64) (int64, error)
+	}
+
+	// ModTimer is implemented by KV objects which can report when
+	// a key was last written, it is used by Prune to keep objects
+	// which might still be referenced by a concurrent writer
+	ModTimer interface {
+		ModTime(ctx context.Context, key string) (time.Time, error)
+	}
+
+	// ConditionalWriter is implemented by KV objects which can replace a
+	// key only if it was not changed since it was read. cas objects are
+	// immutable, this is used by the few mutable keys (eg.: refs)
+	ConditionalWriter interface {
+		// ReadVersion writes the content of key to w and returns
+		// an opaque token identifying the version which was read
+		ReadVersion(ctx context.Context, w io.Writer, key string) (string, error)
+
+		// WriteIf replaces key only if its current version is version,
+		// an empty version requires that key does not exist yet.
+		//
+		// It returns the version of the new content, if key was changed
+		// the error matches ErrPreconditionFailed
+		WriteIf(ctx context.Context, key string, r io.Reader, version string) (string, error)
+	}
+
+	// ConditionalChecker is implemented by KV objects which implement
+	// ConditionalWriter but can only use it in some configurations
+	// (eg.: depending on the bucket scheme, or on the wrapped KV)
+	ConditionalChecker interface {
+		// CheckConditionalWrites returns an error matching
+		// ErrNotSupported if WriteIf cannot be used
+		CheckConditionalWrites() error
+	}
+
+	// rangeWriter discards the first skip bytes and stops after
+	// remaining bytes are written to actual
+	rangeWriter struct {
+		actual    io.Writer
+		skip      int64
+		remaining int64
+	}
+)
+
+var (
+	errRangeDone = errors.New("range done")
 )
 
+// AsConditionalWriter returns kv as a ConditionalWriter, the error
+// matches ErrNotSupported if kv cannot perform conditional writes
+func AsConditionalWriter(kv KV) (ConditionalWriter, error) {
+	cw, ok := kv.(ConditionalWriter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if cc, ok := kv.(ConditionalChecker); ok {
+		if err := cc.CheckConditionalWrites(); err != nil {
+			return nil, err
+		}
+	}
+	return cw, nil
+}
+
 // move objects from a location to another, if kv implements the
 // mover interface, that method is used.
 //
@@ -38,3 +120,46 @@ func move(ctx context.Context, kv KV, to, from string) error {
 	}
 	return kv.Delete(ctx, from)
 }
+
+// ReadRange reads length bytes from key starting at offset, if kv
+// implements the RangeReader interface, that method is used.
+//
+// Otherwise the object is read from the start and bytes outside
+// the range are discarded.
+func ReadRange(ctx context.Context, kv KV, w io.Writer, key string, offset, length int64) (int64, error) {
+	if rr, ok := kv.(RangeReader); ok {
+		return rr.ReadRange(ctx, w, key, offset, length)
+	}
+	rw := &rangeWriter{actual: w, skip: offset, remaining: length}
+	_, err := kv.Read(ctx, rw, key)
+	if errors.Is(err, errRangeDone) || (err == nil && rw.remaining == 0) {
+		return length, nil
+	} else if err != nil {
+		return length - rw.remaining, err
+	}
+	return length - rw.remaining, io.ErrUnexpectedEOF
+}
+
+func (r *rangeWriter) Write(buf []byte) (int, error) {
+	total := len(buf)
+	if r.skip > 0 {
+		if int64(len(buf)) <= r.skip {
+			r.skip -= int64(len(buf))
+			return total, nil
+		}
+		buf = buf[r.skip:]
+		r.skip = 0
+	}
+	if int64(len(buf)) > r.remaining {
+		buf = buf[:r.remaining]
+	}
+	n, err := r.actual.Write(buf)
+	r.remaining -= int64(n)
+	if err != nil {
+		return 0, err
+	}
+	if r.remaining == 0 {
+		return total, errRangeDone
+	}
+	return total, nil
+}
@@ -0,0 +1,15 @@
+// package kvtest provides a conformance suite for cas.KV implementations
+//
+// Driver authors should call Run from their own tests, that way
+// any driver can prove it behaves exactly like the drivers shipped
+// with dbfs:
+//
+//	func TestConformance(t *testing.T) {
+//		kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+//			return mydriver.Connect(ctx, ...)
+//		})
+//	}
+//
+// Every check uses keys under a random prefix, so it is safe to run
+// the suite against shared buckets.
+package kvtest
@@ -0,0 +1,416 @@
+package kvtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/google/uuid"
+)
+
+type (
+	check struct {
+		name string
+		fn   func(*testing.T, context.Context, cas.KV, string)
+	}
+
+	// cancelReader cancels the context after limit bytes
+	// are read, simulating an aborted upload
+	cancelReader struct {
+		actual io.Reader
+		limit  int64
+		cancel context.CancelFunc
+	}
+)
+
+const (
+	// LargeObjectSize is the size of the object used to check
+	// if drivers can stream objects which don't fit in a single
+	// request/buffer
+	LargeObjectSize = 20_000_000
+)
+
+var (
+	checks = []check{
+		{"WriteRead", checkWriteRead},
+		{"Overwrite", checkOverwrite},
+		{"MissingKey", checkMissingKey},
+		{"EmptyObject", checkEmptyObject},
+		{"LargeObject", checkLargeObject},
+		{"Copy", checkCopy},
+		{"Delete", checkDelete},
+		{"Exists", checkExists},
+		{"Mover", checkMover},
+		{"Lister", checkLister},
+		{"RangeReader", checkRangeReader},
+		{"ModTimer", checkModTimer},
+		{"ConditionalWriter", checkConditionalWriter},
+		{"CanceledWrite", checkCanceledWrite},
+		{"CanceledMidWrite", checkCanceledMidWrite},
+	}
+)
+
+// Run executes all checks against a KV returned by newKV,
+// each check runs as a sub-test and receives a new KV object
+// which is closed once the check finishes.
+func Run(t *testing.T, newKV cas.NewTable) {
+	prefix := path.Join("kvtest", uuid.New().String())
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			kv, err := newKV(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := kv.Close(); err != nil {
+					t.Errorf("Unable to close kv: %v", err)
+				}
+			}()
+			c.fn(t, ctx, kv, path.Join(prefix, c.name))
+		})
+	}
+}
+
+func checkWriteRead(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "obj")
+	mustWrite(ctx, t, kv, key, []byte("abc123"))
+	expectContent(ctx, t, kv, key, []byte("abc123"))
+}
+
+func checkOverwrite(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "obj")
+	mustWrite(ctx, t, kv, key, []byte("first version"))
+	mustWrite(ctx, t, kv, key, []byte("second"))
+	expectContent(ctx, t, kv, key, []byte("second"))
+}
+
+func checkMissingKey(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "missing")
+	expectExists(ctx, t, kv, key, false)
+	buf := &bytes.Buffer{}
+	_, err := kv.Read(ctx, buf, key)
+	if !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Read on a missing key should return cas.ErrNotFound got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Read on a missing key should not write any content, got %v bytes", buf.Len())
+	}
+	err = kv.Copy(ctx, path.Join(prefix, "copy"), key)
+	if !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Copy from a missing key should return cas.ErrNotFound got %v", err)
+	}
+	// S3-like services don't report deletes of missing objects
+	// so both outcomes are accepted
+	err = kv.Delete(ctx, key)
+	if err != nil && !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Delete on a missing key should return nil or cas.ErrNotFound got %v", err)
+	}
+}
+
+func checkEmptyObject(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "empty")
+	mustWrite(ctx, t, kv, key, nil)
+	expectExists(ctx, t, kv, key, true)
+	expectContent(ctx, t, kv, key, nil)
+}
+
+func checkLargeObject(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "large")
+	written := sha256.New()
+	input := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), LargeObjectSize), written)
+	n, err := kv.Write(ctx, key, input)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != LargeObjectSize {
+		t.Errorf("Write should report %v bytes got %v", LargeObjectSize, n)
+	}
+	read := sha256.New()
+	n, err = kv.Read(ctx, read, key)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != LargeObjectSize {
+		t.Errorf("Read should report %v bytes got %v", LargeObjectSize, n)
+	}
+	if !bytes.Equal(written.Sum(nil), read.Sum(nil)) {
+		t.Error("Content read does not match content written")
+	}
+}
+
+func checkCopy(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	from, to := path.Join(prefix, "from"), path.Join(prefix, "to")
+	mustWrite(ctx, t, kv, from, []byte("copied content"))
+	if err := kv.Copy(ctx, to, from); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(ctx, t, kv, to, []byte("copied content"))
+	expectContent(ctx, t, kv, from, []byte("copied content"))
+
+	// copy must replace the destination
+	mustWrite(ctx, t, kv, from, []byte("new content"))
+	if err := kv.Copy(ctx, to, from); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(ctx, t, kv, to, []byte("new content"))
+}
+
+func checkDelete(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "obj")
+	mustWrite(ctx, t, kv, key, []byte("to be removed"))
+	if err := kv.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	expectExists(ctx, t, kv, key, false)
+	if _, err := kv.Read(ctx, ioutil.Discard, key); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Read after delete should return cas.ErrNotFound got %v", err)
+	}
+}
+
+func checkExists(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "obj")
+	expectExists(ctx, t, kv, key, false)
+	mustWrite(ctx, t, kv, key, []byte("exists"))
+	expectExists(ctx, t, kv, key, true)
+	// a prefix of an existing key is not an object
+	expectExists(ctx, t, kv, prefix, false)
+}
+
+func checkMover(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	mover, ok := kv.(cas.Mover)
+	if !ok {
+		t.Skip("KV does not implement cas.Mover")
+	}
+	from, to := path.Join(prefix, "from"), path.Join(prefix, "to")
+	mustWrite(ctx, t, kv, from, []byte("moved content"))
+	if err := mover.Move(ctx, to, from); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(ctx, t, kv, to, []byte("moved content"))
+	expectExists(ctx, t, kv, from, false)
+}
+
+func checkLister(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	lister, ok := kv.(cas.Lister)
+	if !ok {
+		t.Skip("KV does not implement cas.Lister")
+	}
+	for _, k := range []string{"list/a", "list/b/c", "other"} {
+		mustWrite(ctx, t, kv, path.Join(prefix, k), []byte(k))
+	}
+	var keys []string
+	err := lister.List(ctx, path.Join(prefix, "list")+"/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if errors.Is(err, cas.ErrNotSupported) {
+		t.Skip("KV does not support listing")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	expected := []string{path.Join(prefix, "list/a"), path.Join(prefix, "list/b/c")}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("List should return %v got %v", expected, keys)
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	err = lister.List(ctx, prefix+"/", func(string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("List should stop after fn returns an error, got %v after %v calls", err, calls)
+	}
+}
+
+func checkModTimer(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	mt, ok := kv.(cas.ModTimer)
+	if !ok {
+		t.Skip("KV does not implement cas.ModTimer")
+	}
+	// some servers only report whole seconds, and
+	// their clock might be slightly off
+	before := time.Now().Add(-time.Minute)
+	key := path.Join(prefix, "key")
+	mustWrite(ctx, t, kv, key, []byte("content"))
+	modTime, err := mt.ModTime(ctx, key)
+	if errors.Is(err, cas.ErrNotSupported) {
+		t.Skip("KV does not report modification times")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if after := time.Now().Add(time.Minute); modTime.Before(before) || modTime.After(after) {
+		t.Errorf("ModTime should be close to %v got %v", time.Now(), modTime)
+	}
+	if _, err := mt.ModTime(ctx, path.Join(prefix, "missing")); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("ModTime of a missing key should fail with %v got %v", cas.ErrNotFound, err)
+	}
+}
+
+func checkRangeReader(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	rr, ok := kv.(cas.RangeReader)
+	if !ok {
+		t.Skip("KV does not implement cas.RangeReader")
+	}
+	key := path.Join(prefix, "obj")
+	mustWrite(ctx, t, kv, key, []byte("0123456789"))
+	for _, r := range []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, 10, "0123456789"},
+		{3, 4, "3456"},
+		{9, 1, "9"},
+		{5, 0, ""},
+	} {
+		buf := &bytes.Buffer{}
+		n, err := rr.ReadRange(ctx, buf, key, r.offset, r.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != r.length || buf.String() != r.expected {
+			t.Errorf("ReadRange(%v, %v) should return %q got %q (%v bytes)", r.offset, r.length, r.expected, buf.String(), n)
+		}
+	}
+	_, err := rr.ReadRange(ctx, ioutil.Discard, path.Join(prefix, "missing"), 0, 1)
+	if !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("ReadRange on a missing key should return cas.ErrNotFound got %v", err)
+	}
+}
+
+func checkConditionalWriter(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	cw, err := cas.AsConditionalWriter(kv)
+	if errors.Is(err, cas.ErrNotSupported) {
+		t.Skip("KV does not support conditional writes")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	key := path.Join(prefix, "ref")
+	first, err := cw.WriteIf(ctx, key, bytes.NewBufferString("first"), "")
+	if errors.Is(err, cas.ErrNotSupported) {
+		t.Skip("KV does not support conditional writes")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.WriteIf(ctx, key, bytes.NewBufferString("again"), ""); !errors.Is(err, cas.ErrPreconditionFailed) {
+		t.Errorf("WriteIf with an empty version on an existing key should return cas.ErrPreconditionFailed got %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	version, err := cw.ReadVersion(ctx, buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != first || buf.String() != "first" {
+		t.Errorf("ReadVersion should return %q/%q got %q/%q", "first", first, buf.String(), version)
+	}
+	second, err := cw.WriteIf(ctx, key, bytes.NewBufferString("second"), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Errorf("WriteIf should return a new version, got %q", second)
+	}
+	if _, err := cw.WriteIf(ctx, key, bytes.NewBufferString("stale"), first); !errors.Is(err, cas.ErrPreconditionFailed) {
+		t.Errorf("WriteIf with a stale version should return cas.ErrPreconditionFailed got %v", err)
+	}
+	expectContent(ctx, t, kv, key, []byte("second"))
+
+	_, err = cw.ReadVersion(ctx, ioutil.Discard, path.Join(prefix, "missing"))
+	if !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("ReadVersion on a missing key should return cas.ErrNotFound got %v", err)
+	}
+}
+
+func checkCanceledWrite(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "obj")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := kv.Write(canceled, key, bytes.NewBufferString("never written"))
+	if err == nil {
+		t.Fatal("Write with a canceled context should fail")
+	}
+	if cas.IsRetryable(err) {
+		t.Errorf("Canceled operations must not be retryable, got %v", err)
+	}
+	expectExists(ctx, t, kv, key, false)
+}
+
+func checkCanceledMidWrite(t *testing.T, ctx context.Context, kv cas.KV, prefix string) {
+	key := path.Join(prefix, "obj")
+	canceled, cancel := context.WithCancel(ctx)
+	defer cancel()
+	input := &cancelReader{
+		actual: io.LimitReader(rand.New(rand.NewSource(2)), LargeObjectSize),
+		limit:  LargeObjectSize / 2,
+		cancel: cancel,
+	}
+	_, err := kv.Write(canceled, key, input)
+	if err == nil {
+		t.Fatal("Write should fail when the context is canceled during the upload")
+	}
+	// partial objects are never acceptable, cas relies on the
+	// fact that an object is either fully written or absent
+	expectExists(ctx, t, kv, key, false)
+}
+
+func (c *cancelReader) Read(buf []byte) (int, error) {
+	if c.limit <= 0 {
+		c.cancel()
+		return 0, context.Canceled
+	}
+	if int64(len(buf)) > c.limit {
+		buf = buf[:c.limit]
+	}
+	n, err := c.actual.Read(buf)
+	c.limit -= int64(n)
+	return n, err
+}
+
+func mustWrite(ctx context.Context, t *testing.T, kv cas.KV, key string, content []byte) {
+	t.Helper()
+	n, err := kv.Write(ctx, key, bytes.NewBuffer(content))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != int64(len(content)) {
+		t.Errorf("Write on %v should report %v bytes got %v", key, len(content), n)
+	}
+}
+
+func expectContent(ctx context.Context, t *testing.T, kv cas.KV, key string, content []byte) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	n, err := kv.Read(ctx, buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) {
+		t.Errorf("Read on %v should report %v bytes got %v", key, len(content), n)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Read on %v should return %q got %q", key, content, buf.Bytes())
+	}
+}
+
+func expectExists(ctx context.Context, t *testing.T, kv cas.KV, key string, expected bool) {
+	t.Helper()
+	exists, err := kv.Exists(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists != expected {
+		t.Errorf("Exists on %v should be %v got %v", key, expected, exists)
+	}
+}
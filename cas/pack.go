@@ -0,0 +1,681 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// RepackOptions controls how loose objects are grouped into packs
+	RepackOptions struct {
+		// MaxObjectSize is the size of the largest object which is
+		// moved to a pack, larger objects are kept as loose objects.
+		MaxObjectSize int64
+
+		// PackSize is the size at which a new pack is started
+		PackSize int64
+
+		// All rewrites existing packs together with loose objects,
+		// consolidating many small packs into fewer large ones
+		All bool
+	}
+
+	// RepackStats reports the work done by Repack
+	RepackStats struct {
+		Objects int   `json:"objects" yaml:"objects"`
+		Packs   int   `json:"packs" yaml:"packs"`
+		Removed int   `json:"removed" yaml:"removed"`
+		Bytes   int64 `json:"bytes" yaml:"bytes"`
+	}
+
+	// PruneOptions controls how unreachable objects are removed
+	PruneOptions struct {
+		// DryRun only counts the objects which would be removed
+		DryRun bool
+
+		// MinAge keeps unreachable objects written less than MinAge
+		// ago, they might belong to a writer which did not update its
+		// refs yet. Packs are kept whole while they are younger than
+		// MinAge. It must be zero or at least FreshenAge, and the KV
+		// must implement ModTimer if it is not zero
+		MinAge time.Duration
+	}
+
+	// PruneStats reports the work done by Prune
+	PruneStats struct {
+		Loose     int   `json:"loose" yaml:"loose"`
+		Packed    int   `json:"packed" yaml:"packed"`
+		Rewritten int   `json:"rewritten" yaml:"rewritten"`
+		Bytes     int64 `json:"bytes" yaml:"bytes"`
+		// Recent counts the unreachable objects kept because
+		// they are younger than MinAge
+		Recent int `json:"recent" yaml:"recent"`
+	}
+
+	// packSet keeps the content of every pack index found in the KV
+	packSet struct {
+		sync.RWMutex
+		loaded   bool
+		reloaded time.Time
+		objects  map[Ref]packEntry
+		packs    map[string][]packEntry
+
+		// reloadMu serializes reloads triggered by missing objects
+		reloadMu sync.Mutex
+	}
+
+	// packEntry is the location of an object inside a pack
+	packEntry struct {
+		ref    Ref
+		pack   string
+		offset int64
+		length int64
+	}
+
+	// packBuilder accumulates objects in memory until a pack is written
+	packBuilder struct {
+		buf     bytes.Buffer
+		entries []packEntry
+		refs    map[Ref]struct{}
+	}
+
+	// limitWriter fails once more than limit bytes are written
+	limitWriter struct {
+		actual io.Writer
+		limit  int64
+	}
+)
+
+const (
+	// DefaultPackObjectSize is the size of the largest object
+	// moved to a pack by Repack
+	DefaultPackObjectSize = 1 << 20
+
+	// DefaultPackSize is the target size of pack objects
+	DefaultPackSize = 32 << 20
+
+	// FreshenAge is the age after which PutContent writes an existing
+	// object again, instead of only checking that it exists
+	FreshenAge = time.Hour
+
+	// DefaultPruneMinAge is the grace period suggested for Prune
+	DefaultPruneMinAge = 24 * time.Hour
+
+	packMagic      = "dbfspck1"
+	packIndexMagic = "dbfspix1"
+	packSuffix     = ".pack"
+	indexSuffix    = ".idx"
+
+	// packReloadInterval is the minimum time between two reloads
+	// of the pack indexes caused by reads of missing objects
+	packReloadInterval = 5 * time.Second
+)
+
+var (
+	errObjectTooLarge = errors.New("object too large")
+)
+
+// Repack moves loose objects into pack objects, which reduces
+// the number of objects stored in the remote KV.
+//
+// Objects are only removed after the pack containing them is
+// written, so readers always find them. The KV must implement
+// the Lister interface
+func (c *C) Repack(ctx context.Context, opts RepackOptions) (RepackStats, error) {
+	if opts.MaxObjectSize <= 0 {
+		opts.MaxObjectSize = DefaultPackObjectSize
+	}
+	if opts.PackSize <= 0 {
+		opts.PackSize = DefaultPackSize
+	}
+	var stats RepackStats
+	if err := c.loadPacks(ctx); err != nil {
+		return stats, err
+	}
+	var loose []Ref
+	err := c.listRefs(ctx, func(r Ref) error {
+		loose = append(loose, r)
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("unable to list loose objects, cause: %w", err)
+	}
+	var oldPacks []string
+	if opts.All {
+		c.packs.RLock()
+		for name := range c.packs.packs {
+			oldPacks = append(oldPacks, name)
+		}
+		c.packs.RUnlock()
+		sort.Strings(oldPacks)
+	}
+
+	var packed []Ref
+	builder := &packBuilder{}
+	flush := func() error {
+		if len(builder.entries) == 0 {
+			return nil
+		}
+		size := int64(builder.buf.Len())
+		if err := c.writePack(ctx, builder); err != nil {
+			return err
+		}
+		stats.Packs++
+		stats.Bytes += size
+		builder = &packBuilder{}
+		return nil
+	}
+	add := func(ref Ref, content []byte) error {
+		if builder.contains(ref) {
+			return nil
+		}
+		builder.add(ref, content)
+		stats.Objects++
+		if int64(builder.buf.Len()) >= opts.PackSize {
+			return flush()
+		}
+		return nil
+	}
+
+	for _, name := range oldPacks {
+		c.packs.RLock()
+		entries := c.packs.packs[name]
+		c.packs.RUnlock()
+		for _, e := range entries {
+			buf := &bytes.Buffer{}
+			if _, err := ReadRange(ctx, c.dataTable, buf, c.packKey(name), e.offset, e.length); err != nil {
+				return stats, fmt.Errorf("unable to read %v from pack %v, cause: %w", e.ref, name, err)
+			}
+			if err := add(e.ref, buf.Bytes()); err != nil {
+				return stats, err
+			}
+		}
+	}
+	for _, ref := range loose {
+		c.packs.RLock()
+		_, alreadyPacked := c.packs.objects[ref]
+		c.packs.RUnlock()
+		if alreadyPacked && !opts.All {
+			packed = append(packed, ref)
+			continue
+		}
+		buf := &bytes.Buffer{}
+		_, err := c.dataTable.Read(ctx, &limitWriter{actual: buf, limit: opts.MaxObjectSize}, c.loosePath(ref))
+		if errors.Is(err, errObjectTooLarge) {
+			continue
+		} else if errors.Is(err, ErrNotFound) {
+			// removed by someone else
+			continue
+		} else if err != nil {
+			return stats, fmt.Errorf("unable to read loose object %v, cause: %w", ref, err)
+		}
+		if err := add(ref, buf.Bytes()); err != nil {
+			return stats, err
+		}
+		packed = append(packed, ref)
+	}
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	for _, ref := range packed {
+		if err := c.dataTable.Delete(ctx, c.loosePath(ref)); err != nil && !errors.Is(err, ErrNotFound) {
+			return stats, fmt.Errorf("unable to remove loose object %v, cause: %w", ref, err)
+		}
+		stats.Removed++
+	}
+	for _, name := range oldPacks {
+		if err := c.deletePack(ctx, name); err != nil {
+			return stats, err
+		}
+		stats.Removed++
+	}
+	return stats, nil
+}
+
+// Prune removes every object, loose or packed, for which live returns false.
+// Packs with a mix of live and dead objects are rewritten.
+//
+// Writers store objects before any ref points to them, so without a
+// grace period (see PruneOptions.MinAge) objects written while Prune is
+// running are removed and it should only run while no other process
+// writes to the same KV. A small window remains even with MinAge: an
+// object which PutContent freshens after Prune checked its age is still
+// removed. The KV must implement the Lister interface
+func (c *C) Prune(ctx context.Context, live func(Ref) bool, opts PruneOptions) (PruneStats, error) {
+	var stats PruneStats
+	recent, err := c.recentFunc(ctx, opts.MinAge)
+	if err != nil {
+		return stats, err
+	}
+	if err := c.loadPacks(ctx); err != nil {
+		return stats, err
+	}
+	var dead []Ref
+	err = c.listRefs(ctx, func(r Ref) error {
+		if !live(r) {
+			dead = append(dead, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("unable to list loose objects, cause: %w", err)
+	}
+	for _, ref := range dead {
+		if ok, err := recent(c.loosePath(ref)); err != nil {
+			return stats, err
+		} else if ok {
+			stats.Recent++
+			continue
+		}
+		stats.Loose++
+		if opts.DryRun {
+			continue
+		}
+		if err := c.dataTable.Delete(ctx, c.loosePath(ref)); err != nil && !errors.Is(err, ErrNotFound) {
+			return stats, fmt.Errorf("unable to remove %v, cause: %w", ref, err)
+		}
+	}
+
+	c.packs.RLock()
+	names := make([]string, 0, len(c.packs.packs))
+	for name := range c.packs.packs {
+		names = append(names, name)
+	}
+	c.packs.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		c.packs.RLock()
+		entries := c.packs.packs[name]
+		c.packs.RUnlock()
+		young, err := recent(c.packKey(name))
+		if err != nil {
+			return stats, err
+		}
+		var keep []packEntry
+		for _, e := range entries {
+			if live(e.ref) {
+				keep = append(keep, e)
+			} else if young {
+				keep = append(keep, e)
+				stats.Recent++
+			} else {
+				stats.Packed++
+				stats.Bytes += e.length
+			}
+		}
+		if len(keep) == len(entries) || opts.DryRun {
+			continue
+		}
+		if len(keep) > 0 {
+			builder := &packBuilder{}
+			for _, e := range keep {
+				buf := &bytes.Buffer{}
+				if _, err := ReadRange(ctx, c.dataTable, buf, c.packKey(name), e.offset, e.length); err != nil {
+					return stats, fmt.Errorf("unable to read %v from pack %v, cause: %w", e.ref, name, err)
+				}
+				builder.add(e.ref, buf.Bytes())
+			}
+			if err := c.writePack(ctx, builder); err != nil {
+				return stats, err
+			}
+			stats.Rewritten++
+		}
+		if err := c.deletePack(ctx, name); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// recentFunc returns a function which reports if key was written
+// less than minAge ago, keys which don't exist anymore are not recent
+func (c *C) recentFunc(ctx context.Context, minAge time.Duration) (func(key string) (bool, error), error) {
+	if minAge == 0 {
+		return func(string) (bool, error) { return false, nil }, nil
+	}
+	if minAge < FreshenAge {
+		return nil, fmt.Errorf("min age must be at least %v got %v", FreshenAge, minAge)
+	}
+	mt, ok := c.dataTable.(ModTimer)
+	if !ok {
+		return nil, fmt.Errorf("kv does not report modification times, cause: %w", ErrNotSupported)
+	}
+	cutoff := time.Now().Add(-minAge)
+	return func(key string) (bool, error) {
+		modTime, err := mt.ModTime(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("unable to read the modification time of %v, cause: %w", key, err)
+		}
+		return modTime.After(cutoff), nil
+	}, nil
+}
+
+// readPacked copies the object from the pack containing it, found is false
+// if no pack contains the object
+func (c *C) readPacked(ctx context.Context, w io.Writer, ref Ref) (found bool, err error) {
+	e, ok, err := c.lookupPacked(ctx, ref, true)
+	if err != nil || !ok {
+		return false, err
+	}
+	_, err = ReadRange(ctx, c.dataTable, w, c.packKey(e.pack), e.offset, e.length)
+	if errors.Is(err, ErrNotFound) {
+		// the pack might have been rewritten by another process,
+		// reload the indexes and try again
+		if err := c.reloadPacks(ctx); err != nil {
+			return false, err
+		}
+		e, ok, _ = c.lookupPacked(ctx, ref, false)
+		if !ok {
+			return false, nil
+		}
+		_, err = ReadRange(ctx, c.dataTable, w, c.packKey(e.pack), e.offset, e.length)
+	}
+	return true, err
+}
+
+// lookupPacked returns the location of ref, if reload is true
+// pack indexes are reloaded when ref is not found
+func (c *C) lookupPacked(ctx context.Context, ref Ref, reload bool) (packEntry, bool, error) {
+	if err := c.loadPacks(ctx); err != nil {
+		return packEntry{}, false, err
+	}
+	c.packs.RLock()
+	e, ok := c.packs.objects[ref]
+	c.packs.RUnlock()
+	if ok || !reload {
+		return e, ok, nil
+	}
+	if err := c.refreshPacks(ctx); err != nil {
+		return packEntry{}, false, err
+	}
+	c.packs.RLock()
+	e, ok = c.packs.objects[ref]
+	c.packs.RUnlock()
+	return e, ok, nil
+}
+
+// packedRefs calls fn for every object stored in a pack
+func (c *C) packedRefs(ctx context.Context, fn func(Ref) error) error {
+	if err := c.loadPacks(ctx); err != nil {
+		return err
+	}
+	c.packs.RLock()
+	refs := make([]Ref, 0, len(c.packs.objects))
+	for r := range c.packs.objects {
+		refs = append(refs, r)
+	}
+	c.packs.RUnlock()
+	for _, r := range refs {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPacks reads the pack indexes if they were not loaded yet
+func (c *C) loadPacks(ctx context.Context) error {
+	c.packs.RLock()
+	loaded := c.packs.loaded
+	c.packs.RUnlock()
+	if loaded {
+		return nil
+	}
+	return c.reloadPacks(ctx)
+}
+
+// refreshPacks reloads the pack indexes unless they were reloaded in
+// the last packReloadInterval, that way reads of objects which don't
+// exist don't list the packs every time
+func (c *C) refreshPacks(ctx context.Context) error {
+	c.packs.reloadMu.Lock()
+	defer c.packs.reloadMu.Unlock()
+	c.packs.RLock()
+	last := c.packs.reloaded
+	c.packs.RUnlock()
+	if time.Since(last) < packReloadInterval {
+		return nil
+	}
+	return c.reloadPacks(ctx)
+}
+
+// reloadPacks lists the pack indexes in the KV, reading only the ones
+// which were not loaded before.
+//
+// KVs which cannot list keys cannot have packs, because there is no way
+// to find them
+func (c *C) reloadPacks(ctx context.Context) error {
+	lister, ok := c.dataTable.(Lister)
+	if !ok {
+		c.packs.Lock()
+		c.packs.loaded = true
+		c.packs.reloaded = time.Now()
+		c.packs.Unlock()
+		return nil
+	}
+	var names []string
+	err := lister.List(ctx, c.packPath+"/", func(key string) error {
+		if strings.HasSuffix(key, indexSuffix) {
+			names = append(names, strings.TrimSuffix(path.Base(key), indexSuffix))
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotSupported) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to list packs, cause: %w", err)
+	}
+	c.packs.RLock()
+	packs := make(map[string][]packEntry, len(names))
+	for _, name := range names {
+		if entries, ok := c.packs.packs[name]; ok {
+			packs[name] = entries
+		}
+	}
+	c.packs.RUnlock()
+	for _, name := range names {
+		if _, ok := packs[name]; ok {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		_, err := c.dataTable.Read(ctx, buf, c.packIndexKey(name))
+		if errors.Is(err, ErrNotFound) {
+			// removed after the listing
+			continue
+		} else if err != nil {
+			return fmt.Errorf("unable to read index of pack %v, cause: %w", name, err)
+		}
+		entries, err := decodePackIndex(name, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		packs[name] = entries
+	}
+	c.packs.Lock()
+	c.packs.setPacks(packs)
+	c.packs.Unlock()
+	return nil
+}
+
+// writePack writes the pack object and then its index, once the index
+// is written the objects in the pack are visible to readers
+func (c *C) writePack(ctx context.Context, b *packBuilder) error {
+	content := b.buf.Bytes()
+	name := PrecomputeHashBytes(content).String()
+	if _, err := c.dataTable.Write(ctx, c.packKey(name), bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("unable to write pack %v, cause: %w", name, err)
+	}
+	for i := range b.entries {
+		b.entries[i].pack = name
+	}
+	idx := encodePackIndex(b.entries)
+	if _, err := c.dataTable.Write(ctx, c.packIndexKey(name), bytes.NewReader(idx)); err != nil {
+		return fmt.Errorf("unable to write index of pack %v, cause: %w", name, err)
+	}
+	c.packs.Lock()
+	c.packs.add(name, b.entries)
+	c.packs.Unlock()
+	for _, e := range b.entries {
+		c.indexAdd(e.ref)
+	}
+	return nil
+}
+
+// deletePack removes the index before the pack, so readers
+// never find an index pointing to a missing pack
+func (c *C) deletePack(ctx context.Context, name string) error {
+	c.packs.Lock()
+	c.packs.remove(name)
+	c.packs.Unlock()
+	if err := c.dataTable.Delete(ctx, c.packIndexKey(name)); err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("unable to remove index of pack %v, cause: %w", name, err)
+	}
+	if err := c.dataTable.Delete(ctx, c.packKey(name)); err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("unable to remove pack %v, cause: %w", name, err)
+	}
+	return nil
+}
+
+func (c *C) loosePath(ref Ref) string {
+	return path.Join(c.dataPath, ref.HexPath(c.hexDirCount))
+}
+
+func (c *C) packKey(name string) string {
+	return path.Join(c.packPath, name+packSuffix)
+}
+
+func (c *C) packIndexKey(name string) string {
+	return path.Join(c.packPath, name+indexSuffix)
+}
+
+func (p *packSet) setPacks(packs map[string][]packEntry) {
+	p.loaded = true
+	p.reloaded = time.Now()
+	p.packs = packs
+	p.objects = make(map[Ref]packEntry)
+	for _, entries := range packs {
+		for _, e := range entries {
+			p.objects[e.ref] = e
+		}
+	}
+}
+
+func (p *packSet) add(name string, entries []packEntry) {
+	if p.packs == nil {
+		p.packs = make(map[string][]packEntry)
+		p.objects = make(map[Ref]packEntry)
+	}
+	p.packs[name] = entries
+	for _, e := range entries {
+		p.objects[e.ref] = e
+	}
+}
+
+func (p *packSet) remove(name string) {
+	entries := p.packs[name]
+	delete(p.packs, name)
+	orphans := make(map[Ref]struct{})
+	for _, e := range entries {
+		if p.objects[e.ref].pack != name {
+			continue
+		}
+		delete(p.objects, e.ref)
+		orphans[e.ref] = struct{}{}
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	// the objects might be present in other packs
+	for _, otherEntries := range p.packs {
+		for _, oe := range otherEntries {
+			if _, ok := orphans[oe.ref]; ok {
+				p.objects[oe.ref] = oe
+			}
+		}
+	}
+}
+
+func (b *packBuilder) add(ref Ref, content []byte) {
+	if b.buf.Len() == 0 {
+		b.buf.WriteString(packMagic)
+		b.refs = make(map[Ref]struct{})
+	}
+	b.refs[ref] = struct{}{}
+	b.entries = append(b.entries, packEntry{
+		ref:    ref,
+		offset: int64(b.buf.Len()),
+		length: int64(len(content)),
+	})
+	b.buf.Write(content)
+}
+
+func (b *packBuilder) contains(ref Ref) bool {
+	_, ok := b.refs[ref]
+	return ok
+}
+
+// encodePackIndex returns the index of a pack, entries are sorted
+// by ref and each one takes 48 bytes (ref, offset and length)
+func encodePackIndex(entries []packEntry) []byte {
+	sorted := append([]packEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].ref[:], sorted[j].ref[:]) < 0
+	})
+	buf := &bytes.Buffer{}
+	buf.WriteString(packIndexMagic)
+	var n [8]byte
+	uint64Bytes(&n, uint64(len(sorted)))
+	buf.Write(n[:])
+	for _, e := range sorted {
+		buf.Write(e.ref[:])
+		int64Bytes(&n, e.offset)
+		buf.Write(n[:])
+		int64Bytes(&n, e.length)
+		buf.Write(n[:])
+	}
+	return buf.Bytes()
+}
+
+func decodePackIndex(name string, content []byte) ([]packEntry, error) {
+	const entrySize = len(Ref{}) + 16
+	header := len(packIndexMagic) + 8
+	if len(content) < header || string(content[:len(packIndexMagic)]) != packIndexMagic {
+		return nil, fmt.Errorf("index of pack %v is not valid", name)
+	}
+	count := binary.BigEndian.Uint64(content[len(packIndexMagic):header])
+	content = content[header:]
+	if uint64(len(content)) != count*uint64(entrySize) {
+		return nil, fmt.Errorf("index of pack %v is truncated", name)
+	}
+	entries := make([]packEntry, count)
+	for i := range entries {
+		e := &entries[i]
+		e.pack = name
+		copy(e.ref[:], content)
+		e.offset = int64(binary.BigEndian.Uint64(content[32:]))
+		e.length = int64(binary.BigEndian.Uint64(content[40:]))
+		content = content[entrySize:]
+	}
+	return entries, nil
+}
+
+func (l *limitWriter) Write(buf []byte) (int, error) {
+	if int64(len(buf)) > l.limit {
+		return 0, errObjectTooLarge
+	}
+	l.limit -= int64(len(buf))
+	return l.actual.Write(buf)
+}
@@ -0,0 +1,22 @@
+package cas
+
+import "testing"
+
+func TestPackSetRemove(t *testing.T) {
+	a, b, c := PrecomputeHashBytes([]byte("a")), PrecomputeHashBytes([]byte("b")), PrecomputeHashBytes([]byte("c"))
+	var p packSet
+	p.add("first", []packEntry{{ref: a, pack: "first"}, {ref: b, pack: "first"}})
+	p.add("second", []packEntry{{ref: b, pack: "second", offset: 10}, {ref: c, pack: "second"}})
+	p.add("third", []packEntry{{ref: a, pack: "third", offset: 20}})
+	p.remove("second")
+	if e, ok := p.objects[b]; !ok || e.pack != "first" {
+		t.Errorf("Objects in other packs should be kept, got %#v", e)
+	}
+	if _, ok := p.objects[c]; ok {
+		t.Error("Objects only in the removed pack should be removed")
+	}
+	p.remove("third")
+	if e, ok := p.objects[a]; !ok || e.pack != "first" {
+		t.Errorf("Objects in other packs should be kept, got %#v", e)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
@@ -65,6 +66,21 @@ func (r Ref) HexPath(n int) string {
 	return strings.Join(parts, "/")
 }
 
+// ParseRef decodes the hex encoded value of a Ref, as returned by
+// String, separators from HexPath are ignored
+func ParseRef(hexstr string) (Ref, error) {
+	var r Ref
+	hexstr = strings.ReplaceAll(hexstr, "/", "")
+	if hex.DecodedLen(len(hexstr)) != len(r) {
+		return Ref{}, fmt.Errorf("invalid ref %q, expecting %v hex encoded bytes", hexstr, len(r))
+	}
+	_, err := hex.Decode(r[:], []byte(hexstr))
+	if err != nil {
+		return Ref{}, fmt.Errorf("invalid ref %q, cause: %w", hexstr, err)
+	}
+	return r, nil
+}
+
 // String returns the hex encoding of this object
 func (r Ref) String() string {
 	return hex.EncodeToString(r[:])
@@ -105,10 +121,10 @@ func PrecomputeHashBytes(buf []byte) (ref Ref) {
 
 func (r *refCalculator) Read(buf []byte) (int, error) {
 	n, err := r.actual.Read(buf)
+	// readers might return the last bytes together with io.EOF
+	r.hasher.Write(buf[:n])
 	if n == 0 || err != nil {
 		r.hasher.Sum((*r.out)[:0])
-	} else {
-		r.hasher.Write(buf[:n])
 	}
 	return n, err
 }
@@ -0,0 +1,181 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type (
+	// Type identifies the structure stored by a typed object,
+	// like git's blob/tree/commit
+	Type string
+)
+
+const (
+	// TypeRaw is reported for objects written without a type header,
+	// like the chunks of a blob
+	TypeRaw Type = "raw"
+
+	// maxTypeLen limits how many bytes are checked when
+	// looking for a type header
+	maxTypeLen = 32
+
+	// MaxHeaderLen is the size of the largest type header: the type,
+	// a space, 20 digits and the NUL byte
+	MaxHeaderLen = maxTypeLen + 22
+)
+
+// Valid returns true if t can be used in a type header,
+// valid types are made of lowercase ascii letters and dashes
+func (t Type) Valid() bool {
+	if len(t) == 0 || len(t) > maxTypeLen || t == TypeRaw {
+		return false
+	}
+	for _, c := range t {
+		if (c < 'a' || c > 'z') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeTyped prepends the header "<type> <length>\x00" to content,
+// the ref of a typed object is the hash of the encoded value
+func EncodeTyped(t Type, content []byte) ([]byte, error) {
+	if !t.Valid() {
+		return nil, fmt.Errorf("invalid object type %q", t)
+	}
+	header := string(t) + " " + strconv.Itoa(len(content)) + "\x00"
+	buf := make([]byte, 0, len(header)+len(content))
+	buf = append(buf, header...)
+	return append(buf, content...), nil
+}
+
+// DecodeTyped splits buf into the type and content of the object,
+// buffers without a valid header (or with a length which doesn't match
+// the content) are reported as TypeRaw.
+//
+// Raw objects escaped by EncodeRaw are reported as TypeRaw
+// without their header.
+func DecodeTyped(buf []byte) (Type, []byte) {
+	t, end, ok := parseHeader(buf)
+	if !ok {
+		return TypeRaw, buf
+	}
+	size, err := strconv.ParseUint(string(buf[len(t)+1:end]), 10, 63)
+	if err != nil || int(size) != len(buf)-end-1 {
+		return TypeRaw, buf
+	}
+	return t, buf[end+1:]
+}
+
+// HasTypeHeader returns true if prefix starts with something which
+// looks like a type header, without checking the length of the content.
+//
+// It is used to find raw objects which might need escaping while they
+// are read, see EncodeRaw
+func HasTypeHeader(prefix []byte) bool {
+	_, _, ok := parseHeader(prefix)
+	return ok
+}
+
+// EncodeRaw returns the value stored for an untyped object, content
+// which could be mistaken for a typed object is escaped with a "raw"
+// header, so user data can never be read as a commit, dir or tree.
+func EncodeRaw(content []byte) []byte {
+	if _, decoded := DecodeTyped(content); len(decoded) == len(content) {
+		return content
+	}
+	header := string(TypeRaw) + " " + strconv.Itoa(len(content)) + "\x00"
+	buf := make([]byte, 0, len(header)+len(content))
+	buf = append(buf, header...)
+	return append(buf, content...)
+}
+
+// parseHeader returns the type from the header at the start of buf
+// and the position of the NUL byte which ends the header
+func parseHeader(buf []byte) (Type, int, bool) {
+	limit := len(buf)
+	if limit > MaxHeaderLen {
+		limit = MaxHeaderLen
+	}
+	end := bytes.IndexByte(buf[:limit], 0)
+	if end < 0 {
+		return "", 0, false
+	}
+	sep := bytes.IndexByte(buf[:end], ' ')
+	if sep < 0 || sep+1 == end {
+		return "", 0, false
+	}
+	t := Type(buf[:sep])
+	if !t.Valid() && t != TypeRaw {
+		return "", 0, false
+	}
+	for _, c := range buf[sep+1 : end] {
+		if c < '0' || c > '9' {
+			return "", 0, false
+		}
+	}
+	return t, end, true
+}
+
+// PutTyped writes content with a type header
+func (c *C) PutTyped(ctx context.Context, t Type, content []byte) (Ref, error) {
+	buf, err := EncodeTyped(t, content)
+	if err != nil {
+		return Ref{}, err
+	}
+	return c.PutContent(ctx, bytes.NewReader(buf))
+}
+
+// GetTyped reads the object at ref and returns its type and content
+// without the header, untyped objects are returned as TypeRaw
+func (c *C) GetTyped(ctx context.Context, ref Ref) (Type, []byte, error) {
+	buf := &bytes.Buffer{}
+	if err := c.GetContent(ctx, buf, ref); err != nil {
+		return "", nil, err
+	}
+	t, content := DecodeTyped(buf.Bytes())
+	return t, content, nil
+}
+
+// PutRaw writes content without a type header, content which
+// looks like a typed object is escaped by EncodeRaw
+func (c *C) PutRaw(ctx context.Context, content []byte) (Ref, error) {
+	return c.PutContent(ctx, bytes.NewReader(EncodeRaw(content)))
+}
+
+// GetRaw reads the untyped object at ref to w, removing the header
+// added by EncodeRaw. The whole object is kept in memory, so it
+// should only be used for small objects like the chunks of a blob.
+func (c *C) GetRaw(ctx context.Context, w io.Writer, ref Ref) error {
+	buf := &bytes.Buffer{}
+	if err := c.GetContent(ctx, buf, ref); err != nil {
+		return err
+	}
+	content := buf.Bytes()
+	if t, decoded := DecodeTyped(content); t == TypeRaw {
+		content = decoded
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// RawRef computes the ref PutRaw would return, without
+// writing anything
+func RawRef(content []byte) Ref {
+	return PrecomputeHashBytes(EncodeRaw(content))
+}
+
+// TypedRef computes the ref PutTyped would return, without
+// writing anything
+func TypedRef(t Type, content []byte) (Ref, error) {
+	buf, err := EncodeTyped(t, content)
+	if err != nil {
+		return Ref{}, err
+	}
+	return PrecomputeHashBytes(buf), nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/andrebq/dbfs/archive"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/graph"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/refs"
+	cli "github.com/urfave/cli/v2"
+)
+
+type (
+	importedRoot struct {
+		Name string `json:"name,omitempty" yaml:"name,omitempty"`
+		Ref  string `json:"ref" yaml:"ref"`
+		Kind string `json:"kind" yaml:"kind"`
+	}
+
+	importResult struct {
+		Roots         []importedRoot `json:"roots" yaml:"roots"`
+		archive.Stats `yaml:",inline"`
+	}
+)
+
+func exportCmd() *cli.Command {
+	var out, kind string
+	return &cli.Command{
+		Name:      "export",
+		Usage:     "Write every object reachable from the given refs to a single archive file",
+		ArgsUsage: "<ref>...",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Archive file, - writes to stdout",
+				Required:    true,
+				Destination: &out,
+			},
+			&cli.StringFlag{
+				Name:        "kind",
+				Usage:       "Kind of the root objects (commit, dir, tree, chunk or auto to detect it from the object type)",
+				Value:       "auto",
+				Destination: &kind,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() == 0 {
+				return errors.New("export requires at least one ref")
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			var roots []archive.Root
+			for _, arg := range appCtx.Args().Slice() {
+				n, err := resolveNode(appCtx.Context, store, arg, kind)
+				if err != nil {
+					return err
+				}
+				roots = append(roots, archive.Root{Name: refName(arg), Node: n})
+			}
+			w, done, err := createOutput(out)
+			if err != nil {
+				return err
+			}
+			stats, err := archive.Export(appCtx.Context, store, w, roots...)
+			if err = done(err); err != nil {
+				return err
+			}
+			return output.Format(os.Stderr, stats)
+		},
+	}
+}
+
+func importCmd() *cli.Command {
+	var updateRefs, force bool
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "Load the objects from an archive created by export, checking each one against its ref",
+		ArgsUsage: "<file>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "update-refs",
+				Usage:       "Point the refs recorded in the archive to the imported objects",
+				Destination: &updateRefs,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Usage:       "Replace refs which already exist, even if the imported commit does not descend from them",
+				Destination: &force,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 1 {
+				return errors.New("import requires an archive file, use - to read from stdin")
+			}
+			var in io.Reader = os.Stdin
+			if name := appCtx.Args().First(); name != "-" {
+				fd, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				defer fd.Close()
+				in = fd
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			manifest, stats, err := archive.Import(appCtx.Context, store, in)
+			if err != nil {
+				return err
+			}
+			if updateRefs {
+				if err := setArchiveRefs(appCtx.Context, store, manifest, force); err != nil {
+					return err
+				}
+			}
+			res := importResult{Stats: stats}
+			for _, r := range manifest.Roots {
+				res.Roots = append(res.Roots, importedRoot{Name: r.Name, Ref: r.Node.Ref.String(), Kind: r.Node.Kind.String()})
+			}
+			return output.Format(os.Stdout, res)
+		},
+	}
+}
+
+// refName returns the full ref name for arg,
+// or an empty string if arg is a hex encoded ref
+func refName(arg string) string {
+	if _, err := cas.ParseRef(arg); err == nil {
+		return ""
+	}
+	if !strings.HasPrefix(arg, refs.Prefix) {
+		return refs.Prefix + "heads/" + arg
+	}
+	return arg
+}
+
+// setArchiveRefs points the named roots of m to the imported objects.
+// A ref which already exists is only moved forward, to a commit which
+// descends from its current value, unless force is set
+func setArchiveRefs(ctx context.Context, store *cas.C, m archive.Manifest, force bool) error {
+	rs, err := openRefs(store)
+	if err != nil {
+		return err
+	}
+	for _, r := range m.Roots {
+		if r.Name == "" {
+			continue
+		}
+		if err := refs.ValidName(r.Name); err != nil {
+			return err
+		}
+		name, node := r.Name, r.Node
+		_, err := rs.Update(ctx, name, func(current cas.Ref, found bool) (cas.Ref, error) {
+			if !found || force || current == node.Ref {
+				return node.Ref, nil
+			}
+			if node.Kind == graph.KindCommit {
+				ok, err := commit.IsAncestor(ctx, store, current, node.Ref)
+				if err != nil && !errors.Is(err, cas.ErrNotFound) {
+					return cas.Ref{}, err
+				}
+				if ok {
+					return node.Ref, nil
+				}
+			}
+			return cas.Ref{}, fmt.Errorf("ref %v points to %v which is not an ancestor of %v, use --force to replace it", name, current, node.Ref)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createOutput opens name for writing, done must be called with
+// the result of the write, the file is removed if it failed
+func createOutput(name string) (io.Writer, func(error) error, error) {
+	if name == "-" {
+		return os.Stdout, func(err error) error { return err }, nil
+	}
+	fd, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fd, func(err error) error {
+		if err == nil {
+			err = fd.Sync()
+		}
+		if closeErr := fd.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(name)
+		}
+		return err
+	}, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/andrebq/dbfs/blob"
@@ -19,6 +20,7 @@ func blobCmd() *cli.Command {
 		Flags: cfg.AllFlags(),
 		Subcommands: []*cli.Command{
 			blobChunkSubcommand(&cfg),
+			blobUploadSubcommand(&cfg),
 		},
 	}
 }
@@ -42,20 +44,11 @@ func blobChunkSubcommand(cfg *config.Blob) *cli.Command {
 			if err != nil {
 				return err
 			}
-			var file io.Reader
-			switch fileName {
-			case "":
-				return errors.New("fileName flag cannot be empty")
-			case "-":
-				file = os.Stdin
-			default:
-				fd, err := os.Open(fileName)
-				if err != nil {
-					return err
-				}
-				defer fd.Close()
-				file = fd
+			file, err := openInput(fileName)
+			if err != nil {
+				return err
 			}
+			defer file.Close()
 			chunks, err := b.Chunks(appCtx.Context, file)
 			if err != nil {
 				return err
@@ -64,3 +57,51 @@ func blobChunkSubcommand(cfg *config.Blob) *cli.Command {
 		},
 	}
 }
+
+func blobUploadSubcommand(cfg *config.Blob) *cli.Command {
+	var fileName string
+	return &cli.Command{
+		Name:  "upload",
+		Usage: "Take a file input (or stdin by default), store its chunks and write to stdout the root ref of the blob tree",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "file",
+				Aliases:     []string{"i"},
+				Value:       "-",
+				Usage:       "File to read as input (stdin is default)",
+				Destination: &fileName,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			b, err := blob.WithSeed(cfg.Seed)
+			if err != nil {
+				return err
+			}
+			file, err := openInput(fileName)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			root, err := b.Upload(appCtx.Context, store, file)
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, root.String())
+		},
+	}
+}
+
+func openInput(fileName string) (io.ReadCloser, error) {
+	switch fileName {
+	case "":
+		return nil, errors.New("fileName flag cannot be empty")
+	case "-":
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(fileName)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/internal/tuple"
+	"github.com/andrebq/dbfs/snapshot"
+	cli "github.com/urfave/cli/v2"
+)
+
+var (
+	// prettyPrinters decode typed objects into values
+	// which can be written with output.Format
+	prettyPrinters = map[cas.Type]func([]byte) (interface{}, error){
+		blob.TreeType: func(content []byte) (interface{}, error) {
+			var t blob.Tree
+			err := t.UnmarshalBinary(content)
+			return t, err
+		},
+		snapshot.DirType: func(content []byte) (interface{}, error) {
+			var d snapshot.Dir
+			err := d.UnmarshalBinary(content)
+			return d, err
+		},
+		commit.Type: func(content []byte) (interface{}, error) {
+			var cm commit.Commit
+			err := cm.UnmarshalBinary(content)
+			return cm, err
+		},
+	}
+)
+
+func catFileCmd() *cli.Command {
+	var showType, showSize, pretty bool
+	return &cli.Command{
+		Name:      "cat-file",
+		Usage:     "Show the type, size or content of any object",
+		ArgsUsage: "<ref>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "t",
+				Usage:       "Show the object type",
+				Destination: &showType,
+			},
+			&cli.BoolFlag{
+				Name:        "s",
+				Usage:       "Show the object size, without the type header",
+				Destination: &showSize,
+			},
+			&cli.BoolFlag{
+				Name:        "p",
+				Usage:       "Pretty-print the object content based on its type, raw objects are written as-is",
+				Destination: &pretty,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 1 {
+				return errors.New("cat-file requires exactly one ref")
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			ref, err := resolveRef(appCtx.Context, store, appCtx.Args().First())
+			if err != nil {
+				return err
+			}
+			typ, content, err := store.GetTyped(appCtx.Context, ref)
+			if err != nil {
+				return err
+			}
+			switch {
+			case showType:
+				return output.Format(os.Stdout, string(typ))
+			case showSize:
+				return output.Format(os.Stdout, len(content))
+			case pretty:
+				return prettyPrint(typ, content)
+			}
+			return errors.New("one of -t, -s or -p is required")
+		},
+	}
+}
+
+func prettyPrint(typ cas.Type, content []byte) error {
+	if typ == cas.TypeRaw {
+		_, err := os.Stdout.Write(content)
+		return err
+	}
+	decode, ok := prettyPrinters[typ]
+	if !ok {
+		// unknown types are expected to be named tuples
+		decode = func(content []byte) (interface{}, error) {
+			var n tuple.Named
+			err := tuple.UnmarshalBinary(content, &n)
+			return n, err
+		}
+	}
+	v, err := decode(content)
+	if err != nil {
+		return fmt.Errorf("unable to decode %v object, cause: %w", typ, err)
+	}
+	return output.Format(os.Stdout, v)
+}
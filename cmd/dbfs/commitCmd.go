@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/refs"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+type (
+	commitResult struct {
+		Ref    string `json:"ref" yaml:"ref"`
+		Commit string `json:"commit" yaml:"commit"`
+		Tree   string `json:"tree" yaml:"tree"`
+	}
+
+	logEntry struct {
+		Ref    string        `json:"ref" yaml:"ref"`
+		Commit commit.Commit `json:"commit" yaml:"commit"`
+	}
+
+	showResult struct {
+		Ref     string           `json:"ref" yaml:"ref"`
+		Commit  commit.Commit    `json:"commit" yaml:"commit"`
+		Entries []snapshot.Entry `json:"entries" yaml:"entries"`
+	}
+)
+
+func commitCmd() *cli.Command {
+	var cfg config.Blob
+	var ign config.Ignore
+	var name, tree, author, message string
+	return &cli.Command{
+		Name:      "commit",
+		Usage:     "Snapshot a directory (or use an existing snapshot) and record it as a new commit of a ref",
+		ArgsUsage: "[dir]",
+		Flags: append(append(cfg.AllFlags(), ign.AllFlags()...),
+			&cli.StringFlag{
+				Name:        "ref",
+				Usage:       "Ref updated with the new commit, its current value is used as the parent",
+				Value:       refs.Prefix + "heads/main",
+				Destination: &name,
+			},
+			&cli.StringFlag{
+				Name:        "tree",
+				Usage:       "Existing snapshot (or commit) whose root directory is used instead of a directory",
+				Destination: &tree,
+			},
+			&cli.StringFlag{
+				Name:        "author",
+				Usage:       "Author of the commit, defaults to user@hostname",
+				EnvVars:     []string{"DBFS_AUTHOR"},
+				Destination: &author,
+			},
+			&cli.StringFlag{
+				Name:        "message",
+				Aliases:     []string{"m"},
+				Usage:       "Commit message",
+				Required:    true,
+				Destination: &message,
+			},
+		),
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			if (tree == "") == (appCtx.Args().Len() != 1) {
+				return errors.New("commit requires either one directory or the tree flag")
+			}
+			if err := refs.ValidName(name); err != nil {
+				return err
+			}
+			if author == "" {
+				author = defaultAuthor()
+			}
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+
+			var root cas.Ref
+			if tree != "" {
+				root, err = resolveTree(ctx, store, tree)
+			} else {
+				root, err = snapshotDir(ctx, store, cfg, &ign, appCtx.Args().First())
+			}
+			if err != nil {
+				return err
+			}
+			var head cas.Ref
+			_, err = rs.Update(ctx, name, func(current cas.Ref, found bool) (cas.Ref, error) {
+				cm := commit.Commit{
+					Tree:    root,
+					Author:  author,
+					Time:    time.Now().Truncate(time.Second),
+					Message: message,
+				}
+				if found {
+					cm.Parents = []cas.Ref{current}
+				}
+				head, err = commit.Write(ctx, store, cm)
+				return head, err
+			})
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, commitResult{Ref: name, Commit: head.String(), Tree: root.String()})
+		},
+	}
+}
+
+func logCmd() *cli.Command {
+	var limit int
+	return &cli.Command{
+		Name:      "log",
+		Usage:     "List a commit and its ancestors, newest first",
+		ArgsUsage: "[commit or ref name]",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:        "max-count",
+				Aliases:     []string{"n"},
+				Usage:       "Maximum number of commits to list, 0 lists all of them",
+				Destination: &limit,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			head, err := resolveCommitArg(ctx, store, appCtx.Args().First())
+			if err != nil {
+				return err
+			}
+			entries := []logEntry{}
+			err = commit.Log(ctx, store, head, func(ref cas.Ref, cm commit.Commit) error {
+				entries = append(entries, logEntry{Ref: ref.String(), Commit: cm})
+				if limit > 0 && len(entries) >= limit {
+					return commit.Stop
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, entries)
+		},
+	}
+}
+
+func showCmd() *cli.Command {
+	return &cli.Command{
+		Name:      "show",
+		Usage:     "Show a commit and the entries of its root directory",
+		ArgsUsage: "[commit or ref name]",
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			ref, err := resolveCommitArg(ctx, store, appCtx.Args().First())
+			if err != nil {
+				return err
+			}
+			cm, err := commit.Read(ctx, store, ref)
+			if err != nil {
+				return err
+			}
+			d, err := snapshot.ReadDir(ctx, store, cm.Tree)
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, showResult{Ref: ref.String(), Commit: cm, Entries: d.Entries})
+		},
+	}
+}
+
+// resolveCommitArg resolves arg with resolveRef,
+// an empty arg means refs/heads/main
+func resolveCommitArg(ctx context.Context, store *cas.C, arg string) (cas.Ref, error) {
+	if arg == "" {
+		arg = refs.Prefix + "heads/main"
+	}
+	return resolveRef(ctx, store, arg)
+}
+
+// resolveTree resolves arg with resolveRef, if it points
+// to a commit the root directory of the commit is returned
+func resolveTree(ctx context.Context, store *cas.C, arg string) (cas.Ref, error) {
+	ref, err := resolveRef(ctx, store, arg)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	t, _, err := store.GetTyped(ctx, ref)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	if t != commit.Type {
+		return ref, nil
+	}
+	cm, err := commit.Read(ctx, store, ref)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	return cm.Tree, nil
+}
+
+// snapshotDir stores dir and returns the ref of its root directory
+func snapshotDir(ctx context.Context, store *cas.C, cfg config.Blob, ign *config.Ignore, dir string) (cas.Ref, error) {
+	b, err := blob.WithSeed(cfg.Seed)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	opts, err := snapshotOptions(ign)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	root, stats, err := snapshot.Take(ctx, store, b, dir, opts)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	log.Info().Str("dir", dir).Int("files", stats.Files).Int("dirs", stats.Dirs).
+		Int("excluded", stats.Excluded).Int64("bytes", stats.Bytes).Msg("Snapshot stored")
+	return root, nil
+}
+
+func defaultAuthor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return fmt.Sprintf("%v@%v", name, host)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/diff"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/snapshot"
+	cli "github.com/urfave/cli/v2"
+)
+
+func diffCmd() *cli.Command {
+	return &cli.Command{
+		Name:      "diff",
+		Usage:     "Compare two snapshots (changed paths) or two blobs (changed byte ranges)",
+		ArgsUsage: "<refA> <refB>",
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			if appCtx.Args().Len() != 2 {
+				return errors.New("diff requires exactly two refs")
+			}
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			a, typeA, err := resolveDiffArg(ctx, store, appCtx.Args().Get(0))
+			if err != nil {
+				return err
+			}
+			b, typeB, err := resolveDiffArg(ctx, store, appCtx.Args().Get(1))
+			if err != nil {
+				return err
+			}
+			if typeA != typeB {
+				return fmt.Errorf("cannot compare a %v with a %v", typeA, typeB)
+			}
+			switch typeA {
+			case snapshot.DirType:
+				changes := []diff.Change{}
+				err = diff.Dirs(ctx, store, a, b, func(c diff.Change) error {
+					changes = append(changes, c)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				return output.Format(os.Stdout, changes)
+			case blob.TreeType:
+				hunks, err := diff.Blobs(ctx, store, a, b)
+				if err != nil {
+					return err
+				}
+				if hunks == nil {
+					hunks = []diff.Hunk{}
+				}
+				return output.Format(os.Stdout, hunks)
+			}
+			return fmt.Errorf("objects of type %v cannot be compared", typeA)
+		},
+	}
+}
+
+// resolveDiffArg resolves arg with resolveTree and returns the
+// type of the object, untyped trees are reported as blob.TreeType
+func resolveDiffArg(ctx context.Context, store *cas.C, arg string) (cas.Ref, cas.Type, error) {
+	ref, err := resolveTree(ctx, store, arg)
+	if err != nil {
+		return cas.Ref{}, "", err
+	}
+	t, _, err := store.GetTyped(ctx, ref)
+	if err != nil {
+		return cas.Ref{}, "", err
+	}
+	if t == cas.TypeRaw {
+		if _, err := blob.ReadTree(ctx, store, ref); err == nil {
+			t = blob.TreeType
+		}
+	}
+	return ref, t, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/graph"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/refs"
+	cli "github.com/urfave/cli/v2"
+)
+
+type (
+	forgetEntry struct {
+		Ref     string    `json:"ref" yaml:"ref"`
+		Time    time.Time `json:"time" yaml:"time"`
+		Message string    `json:"message" yaml:"message"`
+		Keep    bool      `json:"keep" yaml:"keep"`
+		Reasons []string  `json:"reasons,omitempty" yaml:"reasons,omitempty"`
+	}
+
+	forgetResult struct {
+		Ref     string          `json:"ref" yaml:"ref"`
+		Head    string          `json:"head" yaml:"head"`
+		DryRun  bool            `json:"dryRun" yaml:"dryRun"`
+		Commits []forgetEntry   `json:"commits" yaml:"commits"`
+		Prune   *cas.PruneStats `json:"prune,omitempty" yaml:"prune,omitempty"`
+	}
+)
+
+func forgetCmd() *cli.Command {
+	var policy commit.Policy
+	var dryRun, prune bool
+	var minAge time.Duration
+	return &cli.Command{
+		Name:      "forget",
+		Usage:     "Remove old commits from the linear history of a ref according to a retention policy",
+		ArgsUsage: "[ref name]",
+		Flags: []cli.Flag{
+			&cli.IntFlag{Name: "keep-last", Usage: "Keep the newest n commits", Destination: &policy.Last},
+			&cli.IntFlag{Name: "keep-hourly", Usage: "Keep the newest commit of the last n hours with commits", Destination: &policy.Hourly},
+			&cli.IntFlag{Name: "keep-daily", Usage: "Keep the newest commit of the last n days with commits", Destination: &policy.Daily},
+			&cli.IntFlag{Name: "keep-weekly", Usage: "Keep the newest commit of the last n weeks with commits", Destination: &policy.Weekly},
+			&cli.IntFlag{Name: "keep-monthly", Usage: "Keep the newest commit of the last n months with commits", Destination: &policy.Monthly},
+			&cli.IntFlag{Name: "keep-yearly", Usage: "Keep the newest commit of the last n years with commits", Destination: &policy.Yearly},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "Only report which commits (and objects, with --prune) would be removed",
+				Destination: &dryRun,
+			},
+			&cli.BoolFlag{
+				Name:        "prune",
+				Usage:       "Remove objects which are not reachable from any ref, including snapshot, blob and tar import results no ref points to",
+				Destination: &prune,
+			},
+			minAgeFlag(&minAge),
+		},
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			arg := appCtx.Args().First()
+			if arg == "" {
+				arg = refs.Prefix + "heads/main"
+			}
+			name := refName(arg)
+			if name == "" {
+				return errors.New("forget requires a ref name")
+			}
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+			head, version, err := rs.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			plan, err := commit.Plan(ctx, store, head, policy)
+			if err != nil {
+				return err
+			}
+			res := forgetResult{Ref: name, Head: head.String(), DryRun: dryRun}
+			for _, d := range plan {
+				res.Commits = append(res.Commits, forgetEntry{
+					Ref:     d.Ref.String(),
+					Time:    d.Commit.Time,
+					Message: d.Commit.Message,
+					Keep:    d.Keep,
+					Reasons: d.Reasons,
+				})
+			}
+			if !dryRun {
+				newHead, err := commit.Rewrite(ctx, store, plan)
+				if err != nil {
+					return err
+				}
+				if newHead != head {
+					// fails if the ref changed since it was read
+					if _, err := rs.Set(ctx, name, newHead, version); err != nil {
+						return err
+					}
+				}
+				res.Head = newHead.String()
+			}
+			if prune {
+				roots, err := forgetRoots(ctx, store, rs, name, plan, dryRun)
+				if err != nil {
+					return err
+				}
+				stats, err := pruneUnreachable(ctx, store, roots, cas.PruneOptions{DryRun: dryRun, MinAge: minAge})
+				if err != nil {
+					return err
+				}
+				res.Prune = &stats
+			}
+			return output.Format(os.Stdout, res)
+		},
+	}
+}
+
+// forgetRoots returns the objects which must be kept by prune, which
+// are the values of every ref. In a dry run the ref was not rewritten,
+// so the trees of the kept commits are used instead of its value
+func forgetRoots(ctx context.Context, store *cas.C, rs *refs.Store, name string, plan []commit.Decision, dryRun bool) ([]graph.Node, error) {
+	var roots []graph.Node
+	err := rs.List(ctx, refs.Prefix, func(n string, ref cas.Ref) error {
+		if dryRun && n == name {
+			return nil
+		}
+		node, err := graph.Detect(ctx, store, ref)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, node)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		for _, d := range plan {
+			if d.Keep {
+				roots = append(roots, graph.Node{Ref: d.Commit.Tree, Kind: graph.KindDir})
+			}
+		}
+	}
+	return roots, nil
+}
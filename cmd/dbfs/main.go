@@ -33,7 +33,9 @@ func configureApp() *cli.App {
 		},
 		Flags: combineFlags(storageConfig.AllFlags(), outputFlags.AllFlags()),
 	}
-	app.Commands = append(app.Commands, blobCmd())
+	app.Commands = append(app.Commands, blobCmd(), syncCmd(), repackCmd(), gcCmd(), catFileCmd(), snapshotCmd(), restoreCmd(), refCmd(),
+		commitCmd(), logCmd(), showCmd(), diffCmd(), serveCmd(), webdavCmd(),
+		serve9pCmd(), s3GatewayCmd(), exportCmd(), importCmd(), tarCmd(), watchCmd(), forgetCmd())
 	return app
 }
 
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/graph"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+func repackCmd() *cli.Command {
+	var opts cas.RepackOptions
+	return &cli.Command{
+		Name:  "repack",
+		Usage: "Move small loose objects into pack objects",
+		Flags: []cli.Flag{
+			&cli.Int64Flag{
+				Name:        "max-object-size",
+				Usage:       "Objects larger than this are kept as loose objects",
+				Value:       cas.DefaultPackObjectSize,
+				Destination: &opts.MaxObjectSize,
+			},
+			&cli.Int64Flag{
+				Name:        "pack-size",
+				Usage:       "Target size of each pack",
+				Value:       cas.DefaultPackSize,
+				Destination: &opts.PackSize,
+			},
+			&cli.BoolFlag{
+				Name:        "all",
+				Usage:       "Rewrite existing packs too, consolidating them with the loose objects",
+				Destination: &opts.All,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			stats, err := store.Repack(appCtx.Context, opts)
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, stats)
+		},
+	}
+}
+
+func gcCmd() *cli.Command {
+	var kind string
+	var opts cas.PruneOptions
+	return &cli.Command{
+		Name:      "gc",
+		Usage:     "Remove every object which is not reachable from the given refs, including snapshot, blob and tar import results no ref points to, packs are rewritten as needed",
+		ArgsUsage: "<ref>...",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "kind",
+				Usage:       "Kind of the root objects (commit, dir, tree, chunk or auto to detect it from the object type)",
+				Value:       "auto",
+				Destination: &kind,
+			},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "Only report what would be removed",
+				Destination: &opts.DryRun,
+			},
+			minAgeFlag(&opts.MinAge),
+		},
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() == 0 {
+				return errors.New("at least one ref must be kept")
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			var roots []graph.Node
+			for _, arg := range appCtx.Args().Slice() {
+				n, err := resolveNode(appCtx.Context, store, arg, kind)
+				if err != nil {
+					return err
+				}
+				roots = append(roots, n)
+			}
+			stats, err := pruneUnreachable(appCtx.Context, store, roots, opts)
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, stats)
+		},
+	}
+}
+
+// minAgeFlag configures the grace period used by pruneUnreachable
+func minAgeFlag(dst *time.Duration) cli.Flag {
+	return &cli.DurationFlag{
+		Name: "min-age",
+		Usage: "Keep unreachable objects written less than this long ago, they might belong to a " +
+			"snapshot or commit still in progress (0 disables it, only safe when nothing else writes to the storage)",
+		Value:       cas.DefaultPruneMinAge,
+		Destination: dst,
+	}
+}
+
+// pruneUnreachable removes every object which is not reachable from roots
+// and older than opts.MinAge
+func pruneUnreachable(ctx context.Context, store *cas.C, roots []graph.Node, opts cas.PruneOptions) (cas.PruneStats, error) {
+	live, err := graph.Reachable(ctx, store, roots...)
+	if err != nil {
+		return cas.PruneStats{}, err
+	}
+	msg := "Removing every object not reachable from the roots, including snapshot, blob and tar import results no ref points to"
+	if opts.DryRun {
+		msg = "Dry run, every object not reachable from the roots would be removed, including snapshot, blob and tar import results no ref points to"
+	}
+	log.Info().Int("roots", len(roots)).Int("reachable", len(live)).Str("minAge", opts.MinAge.String()).Msg(msg)
+	return store.Prune(ctx, func(r cas.Ref) bool {
+		_, ok := live[r]
+		return ok
+	}, opts)
+}
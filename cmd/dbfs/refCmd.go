@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/refs"
+	cli "github.com/urfave/cli/v2"
+)
+
+type (
+	refEntry struct {
+		Name string `json:"name" yaml:"name"`
+		Ref  string `json:"ref" yaml:"ref"`
+	}
+)
+
+func refCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "ref",
+		Usage: "Sub-command to manage named refs (eg.: refs/heads/main)",
+		Subcommands: []*cli.Command{
+			refGetSubcommand(),
+			refSetSubcommand(),
+			refListSubcommand(),
+			refDeleteSubcommand(),
+		},
+	}
+}
+
+// openRefs opens the refs kept in the same storage as store
+func openRefs(store *cas.C) (*refs.Store, error) {
+	return refs.Open(store.KV())
+}
+
+// resolveRef accepts a hex encoded ref, a ref name (refs/heads/main)
+// or a short name which is looked up under refs/heads/
+func resolveRef(ctx context.Context, store *cas.C, arg string) (cas.Ref, error) {
+	if ref, err := cas.ParseRef(arg); err == nil {
+		return ref, nil
+	}
+	name := arg
+	if !strings.HasPrefix(name, refs.Prefix) {
+		name = refs.Prefix + "heads/" + name
+	}
+	if refs.ValidName(name) != nil {
+		return cas.Ref{}, fmt.Errorf("%q is neither a ref nor a ref name", arg)
+	}
+	rs, err := openRefs(store)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	ref, _, err := rs.Get(ctx, name)
+	if err != nil {
+		return cas.Ref{}, fmt.Errorf("unable to resolve %v, cause: %w", name, err)
+	}
+	return ref, nil
+}
+
+func refGetSubcommand() *cli.Command {
+	return &cli.Command{
+		Name:      "get",
+		Usage:     "Write to stdout the object pointed by a ref",
+		ArgsUsage: "<name>",
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 1 {
+				return errors.New("ref get requires exactly one name")
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+			ref, _, err := rs.Get(appCtx.Context, appCtx.Args().First())
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(os.Stdout, ref.String())
+			return err
+		},
+	}
+}
+
+func refSetSubcommand() *cli.Command {
+	var old string
+	return &cli.Command{
+		Name:      "set",
+		Usage:     "Point a ref to an object, the object must exist",
+		ArgsUsage: "<name> <ref>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "old",
+				Usage:       "Only update the ref if it currently points to this object, use 'none' to require a new ref",
+				Destination: &old,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 2 {
+				return errors.New("ref set requires a name and a ref")
+			}
+			name := appCtx.Args().First()
+			next, err := cas.ParseRef(appCtx.Args().Get(1))
+			if err != nil {
+				return err
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			if found, err := store.Exists(appCtx.Context, next); err != nil {
+				return err
+			} else if !found {
+				return fmt.Errorf("object %v does not exist", next)
+			}
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+			_, err = rs.Update(appCtx.Context, name, func(current cas.Ref, found bool) (cas.Ref, error) {
+				switch {
+				case old == "":
+				case old == "none" && found:
+					return cas.Ref{}, fmt.Errorf("%v already exists, cause: %w", name, cas.ErrPreconditionFailed)
+				case old != "none" && (!found || current.String() != old):
+					return cas.Ref{}, fmt.Errorf("%v does not point to %v, cause: %w", name, old, cas.ErrPreconditionFailed)
+				}
+				return next, nil
+			})
+			return err
+		},
+	}
+}
+
+func refListSubcommand() *cli.Command {
+	return &cli.Command{
+		Name:      "list",
+		Usage:     "List the refs whose name starts with prefix",
+		ArgsUsage: "[prefix]",
+		Action: func(appCtx *cli.Context) error {
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+			entries := []refEntry{}
+			err = rs.List(appCtx.Context, appCtx.Args().First(), func(name string, ref cas.Ref) error {
+				entries = append(entries, refEntry{Name: name, Ref: ref.String()})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, entries)
+		},
+	}
+}
+
+func refDeleteSubcommand() *cli.Command {
+	return &cli.Command{
+		Name:      "delete",
+		Usage:     "Remove a ref, the objects it points to are kept until gc",
+		ArgsUsage: "<name>",
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 1 {
+				return errors.New("ref delete requires exactly one name")
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+			return rs.Delete(appCtx.Context, appCtx.Args().First())
+		},
+	}
+}
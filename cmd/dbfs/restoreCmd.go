@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+func restoreCmd() *cli.Command {
+	var cfg config.Blob
+	var opts snapshot.RestoreOptions
+	return &cli.Command{
+		Name:      "restore",
+		Usage:     "Recreate the content of a snapshot inside a local directory",
+		ArgsUsage: "<ref> <dir>",
+		Flags: append(cfg.AllFlags(),
+			&cli.StringFlag{
+				Name:        "path",
+				Usage:       "Restore only this path from the snapshot",
+				Destination: &opts.Path,
+			},
+			&cli.BoolFlag{
+				Name:        "verify",
+				Usage:       "Compare the content of existing files instead of their size and modification time",
+				Destination: &opts.Verify,
+			},
+		),
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 2 {
+				return errors.New("restore requires a ref and a directory")
+			}
+			var err error
+			opts.Blob, err = blob.WithSeed(cfg.Seed)
+			if err != nil {
+				return err
+			}
+			opts.OnEntry = func(p string, e snapshot.Entry, skipped bool) {
+				log.Debug().Str("path", p).Bool("skipped", skipped).Msg("Restored")
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			root, err := resolveTree(appCtx.Context, store, appCtx.Args().Get(0))
+			if err != nil {
+				return err
+			}
+			stats, err := snapshot.Restore(appCtx.Context, store, root, appCtx.Args().Get(1), opts)
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, stats)
+		},
+	}
+}
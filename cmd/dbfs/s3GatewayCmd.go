@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/s3gateway"
+	cli "github.com/urfave/cli/v2"
+)
+
+func s3GatewayCmd() *cli.Command {
+	var cfg config.Blob
+	var addr, accessKey, secretKey, region, author string
+	var readOnly bool
+	var snapshots cli.StringSlice
+	return &cli.Command{
+		Name:  "s3-gateway",
+		Usage: "Serve the refs under refs/heads/ (and fixed snapshots) as S3 buckets",
+		Flags: append(cfg.AllFlags(),
+			&cli.StringFlag{
+				Name:        "addr",
+				Usage:       "Address to listen for requests",
+				Value:       "127.0.0.1:9100",
+				EnvVars:     []string{"DBFS_S3_ADDR"},
+				Destination: &addr,
+			},
+			&cli.StringFlag{
+				Name:        "access-key",
+				Usage:       "Access key clients must use to sign requests, empty disables authentication",
+				EnvVars:     []string{"DBFS_S3_ACCESS_KEY"},
+				Destination: &accessKey,
+			},
+			&cli.StringFlag{
+				Name:        "secret-key",
+				Usage:       "Secret key clients must use to sign requests",
+				EnvVars:     []string{"DBFS_S3_SECRET_KEY"},
+				Destination: &secretKey,
+			},
+			&cli.StringFlag{
+				Name:        "region",
+				Usage:       "Region reported as the location of the buckets",
+				Value:       s3gateway.DefaultRegion,
+				Destination: &region,
+			},
+			&cli.StringFlag{
+				Name:        "author",
+				Usage:       "Author of the commits created by uploads, defaults to user@hostname",
+				EnvVars:     []string{"DBFS_AUTHOR"},
+				Destination: &author,
+			},
+			&cli.BoolFlag{
+				Name:        "read-only",
+				Usage:       "Reject requests which change buckets",
+				Destination: &readOnly,
+			},
+			&cli.StringSliceFlag{
+				Name:        "snapshot",
+				Usage:       "Expose a commit or snapshot as a read-only bucket, in the form <bucket>=<commit, snapshot or ref name>",
+				Destination: &snapshots,
+			},
+		),
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			b, err := blob.WithSeed(cfg.Seed)
+			if err != nil {
+				return err
+			}
+			if author == "" {
+				author = defaultAuthor()
+			}
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+			options := []s3gateway.Option{
+				s3gateway.Blob(b),
+				s3gateway.Credentials(accessKey, secretKey),
+				s3gateway.Region(region),
+				s3gateway.Author(author),
+				s3gateway.ReadOnly(readOnly),
+			}
+			for _, s := range snapshots.Value() {
+				parts := strings.SplitN(s, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("invalid snapshot %q, expected <bucket>=<ref>", s)
+				}
+				root, err := resolveTree(ctx, store, parts[1])
+				if err != nil {
+					return err
+				}
+				options = append(options, s3gateway.Snapshot(parts[0], root))
+			}
+			g, err := s3gateway.New(store, rs, options...)
+			if err != nil {
+				return err
+			}
+			return listenAndServe(ctx, addr, g)
+		},
+	}
+}
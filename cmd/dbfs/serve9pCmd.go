@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/andrebq/dbfs/ninep"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+func serve9pCmd() *cli.Command {
+	var addr, owner string
+	return &cli.Command{
+		Name:      "serve-9p",
+		Usage:     "Serve a commit or directory snapshot with the 9P2000 protocol (mount -t 9p -o trans=tcp,port=5640,version=9p2000)",
+		ArgsUsage: "<commit, snapshot or ref name>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "addr",
+				Usage:       "Address to listen for connections",
+				Value:       "127.0.0.1:5640",
+				EnvVars:     []string{"DBFS_9P_ADDR"},
+				Destination: &addr,
+			},
+			&cli.StringFlag{
+				Name:        "owner",
+				Usage:       "User and group reported as the owner of every file",
+				Value:       "dbfs",
+				Destination: &owner,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			if appCtx.Args().Len() != 1 {
+				return errors.New("serve-9p requires exactly one commit, snapshot or ref name")
+			}
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			root, err := resolveTree(ctx, store, appCtx.Args().First())
+			if err != nil {
+				return err
+			}
+			s, err := ninep.New(ctx, store, root, ninep.Owner(owner))
+			if err != nil {
+				return err
+			}
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			log.Info().Str("addr", addr).Str("root", root.String()).Msg("Listening")
+			return s.Serve(ctx, l)
+		},
+	}
+}
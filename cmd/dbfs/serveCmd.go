@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/server"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+func serveCmd() *cli.Command {
+	var cfg config.Blob
+	var addr, token string
+	var readOnly bool
+	var maxBody int64
+	return &cli.Command{
+		Name:  "serve",
+		Usage: "Serve objects and blobs from the storage over HTTP",
+		Flags: append(cfg.AllFlags(),
+			&cli.StringFlag{
+				Name:        "addr",
+				Usage:       "Address to listen for requests",
+				Value:       "127.0.0.1:8080",
+				EnvVars:     []string{"DBFS_SERVE_ADDR"},
+				Destination: &addr,
+			},
+			&cli.StringFlag{
+				Name:        "token",
+				Usage:       "Token clients must send as 'Authorization: Bearer <token>', empty disables authentication",
+				EnvVars:     []string{"DBFS_SERVE_TOKEN"},
+				Destination: &token,
+			},
+			&cli.BoolFlag{
+				Name:        "read-only",
+				Usage:       "Reject requests which store new content",
+				Destination: &readOnly,
+			},
+			&cli.Int64Flag{
+				Name:        "max-body-size",
+				Usage:       "Largest object or key (in bytes) clients can write, blob uploads are not limited",
+				Value:       server.DefaultMaxBodySize,
+				Destination: &maxBody,
+			},
+		),
+		Action: func(appCtx *cli.Context) error {
+			b, err := blob.WithSeed(cfg.Seed)
+			if err != nil {
+				return err
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			handler, err := server.New(store, server.Token(token), server.ReadOnly(readOnly), server.Blob(b),
+				server.MaxBodySize(maxBody))
+			if err != nil {
+				return err
+			}
+			return listenAndServe(appCtx.Context, addr, handler)
+		},
+	}
+}
+
+// listenAndServe runs handler until ctx is done
+func listenAndServe(ctx context.Context, addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Info().Str("addr", addr).Msg("Listening")
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
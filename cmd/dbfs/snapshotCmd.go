@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+type (
+	snapshotResult struct {
+		Ref   string         `json:"ref" yaml:"ref"`
+		Stats snapshot.Stats `json:"stats" yaml:"stats"`
+	}
+)
+
+func snapshotCmd() *cli.Command {
+	var cfg config.Blob
+	return &cli.Command{
+		Name:  "snapshot",
+		Usage: "Sub-command to store and inspect directory snapshots",
+		Flags: cfg.AllFlags(),
+		Subcommands: []*cli.Command{
+			snapshotCreateSubcommand(&cfg),
+			snapshotLsSubcommand(),
+		},
+	}
+}
+
+func snapshotCreateSubcommand(cfg *config.Blob) *cli.Command {
+	var ign config.Ignore
+	return &cli.Command{
+		Name:      "create",
+		Usage:     "Store a directory and write to stdout the ref of the snapshot",
+		ArgsUsage: "<dir>",
+		Flags:     ign.AllFlags(),
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 1 {
+				return errors.New("snapshot create requires exactly one directory")
+			}
+			b, err := blob.WithSeed(cfg.Seed)
+			if err != nil {
+				return err
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			opts, err := snapshotOptions(&ign)
+			if err != nil {
+				return err
+			}
+			ref, stats, err := snapshot.Take(appCtx.Context, store, b, appCtx.Args().First(), opts)
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, snapshotResult{Ref: ref.String(), Stats: stats})
+		},
+	}
+}
+
+func snapshotLsSubcommand() *cli.Command {
+	return &cli.Command{
+		Name:      "ls",
+		Usage:     "List the entries of a directory inside a snapshot",
+		ArgsUsage: "<ref> [path]",
+		Action: func(appCtx *cli.Context) error {
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			root, err := resolveTree(appCtx.Context, store, appCtx.Args().First())
+			if err != nil {
+				return err
+			}
+			e, err := snapshot.Lookup(appCtx.Context, store, root, appCtx.Args().Get(1))
+			if err != nil {
+				return err
+			}
+			if !e.IsDir() {
+				return output.Format(os.Stdout, []snapshot.Entry{e})
+			}
+			d, err := snapshot.ReadDir(appCtx.Context, store, e.Ref)
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, d)
+		},
+	}
+}
+
+// snapshotOptions returns the options used to snapshot local
+// directories, stored and excluded entries are logged at debug level
+func snapshotOptions(ign *config.Ignore) (snapshot.Options, error) {
+	filter, err := ign.Filter()
+	if err != nil {
+		return snapshot.Options{}, err
+	}
+	return snapshot.Options{
+		Filter: filter,
+		OnEntry: func(p string, e snapshot.Entry) {
+			log.Debug().Str("path", p).Str("mode", e.Mode.String()).Int64("size", e.Size).Msg("Stored")
+		},
+		OnExclude: func(p string) {
+			log.Debug().Str("path", p).Msg("Excluded")
+		},
+	}, nil
+}
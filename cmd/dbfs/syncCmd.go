@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/graph"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/transfer"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+type (
+	syncFlags struct {
+		remote      string
+		kind        string
+		concurrency int
+	}
+)
+
+func syncCmd() *cli.Command {
+	var flags syncFlags
+	return &cli.Command{
+		Name:  "sync",
+		Usage: "Copy every object reachable from a ref between the local storage and a remote one",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "remote",
+				Usage:       "URL of the remote storage (minio://<bucket> or any Go Cloud bucket URL)",
+				EnvVars:     []string{"DBFS_SYNC_REMOTE"},
+				Required:    true,
+				Destination: &flags.remote,
+			},
+			&cli.StringFlag{
+				Name:        "kind",
+				Usage:       "Kind of the root object (commit, dir, tree, chunk or auto to detect it from the object type)",
+				Value:       "auto",
+				Destination: &flags.kind,
+			},
+			&cli.IntFlag{
+				Name:        "concurrency",
+				Usage:       "Number of objects copied in parallel",
+				Value:       transfer.DefaultConcurrency,
+				Destination: &flags.concurrency,
+			},
+		},
+		Subcommands: []*cli.Command{
+			syncSubcommand(&flags, "push", "Copy objects missing on the remote from the local storage", true),
+			syncSubcommand(&flags, "pull", "Copy objects missing on the local storage from the remote", false),
+		},
+	}
+}
+
+func syncSubcommand(flags *syncFlags, name, usage string, push bool) *cli.Command {
+	return &cli.Command{
+		Name:      name,
+		Usage:     usage,
+		ArgsUsage: "<ref>",
+		Action: func(appCtx *cli.Context) error {
+			local, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer local.Close()
+			remote, err := storageConfig.OpenURL(appCtx.Context, flags.remote)
+			if err != nil {
+				return err
+			}
+			defer remote.Close()
+			dst, src := remote, local
+			if !push {
+				dst, src = local, remote
+			}
+			root, err := resolveNode(appCtx.Context, src, appCtx.Args().First(), flags.kind)
+			if err != nil {
+				return err
+			}
+			stats, err := transfer.Sync(appCtx.Context, dst, src, root, transfer.Options{
+				Concurrency: flags.concurrency,
+				Progress: func(s transfer.Stats) {
+					log.Debug().Int("checked", s.Checked).Int("copied", s.Copied).
+						Int("skipped", s.Skipped).Int64("bytes", s.Bytes).Msg("Sync progress")
+				},
+			})
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, stats)
+		},
+	}
+}
+
+// resolveNode parses ref, if kind is auto the kind is detected
+// by reading the object from store
+func resolveNode(ctx context.Context, store *cas.C, ref, kind string) (graph.Node, error) {
+	if ref == "" {
+		return graph.Node{}, fmt.Errorf("missing ref argument")
+	}
+	r, err := resolveRef(ctx, store, ref)
+	if err != nil {
+		return graph.Node{}, err
+	}
+	if kind == "auto" {
+		return graph.Detect(ctx, store, r)
+	}
+	k, err := graph.ParseKind(kind)
+	if err != nil {
+		return graph.Node{}, err
+	}
+	return graph.Node{Ref: r, Kind: k}, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/internal/output"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+func tarCmd() *cli.Command {
+	var cfg config.Blob
+	return &cli.Command{
+		Name:  "tar",
+		Usage: "Sub-command to convert between tar streams and snapshots",
+		Flags: cfg.AllFlags(),
+		Subcommands: []*cli.Command{
+			tarImportSubcommand(&cfg),
+			tarExportSubcommand(),
+		},
+	}
+}
+
+func tarImportSubcommand(cfg *config.Blob) *cli.Command {
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "Store the entries of a tar stream and write to stdout the ref of the snapshot",
+		ArgsUsage: "[file]",
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() > 1 {
+				return errors.New("tar import accepts at most one file, stdin is used by default")
+			}
+			var in io.Reader = os.Stdin
+			if name := appCtx.Args().First(); name != "" && name != "-" {
+				fd, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				defer fd.Close()
+				in = fd
+			}
+			b, err := blob.WithSeed(cfg.Seed)
+			if err != nil {
+				return err
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			ref, stats, err := snapshot.ReadTar(appCtx.Context, store, b, in, snapshot.Options{
+				OnEntry: func(p string, e snapshot.Entry) {
+					log.Debug().Str("path", p).Str("mode", e.Mode.String()).Int64("size", e.Size).Msg("Stored")
+				},
+			})
+			if err != nil {
+				return err
+			}
+			return output.Format(os.Stdout, snapshotResult{Ref: ref.String(), Stats: stats})
+		},
+	}
+}
+
+func tarExportSubcommand() *cli.Command {
+	var out string
+	return &cli.Command{
+		Name:      "export",
+		Usage:     "Write a snapshot as a tar stream, the same snapshot always produces the same bytes",
+		ArgsUsage: "<ref>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Tar file, - writes to stdout",
+				Value:       "-",
+				Destination: &out,
+			},
+		},
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 1 {
+				return errors.New("tar export requires exactly one ref")
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			root, err := resolveTree(appCtx.Context, store, appCtx.Args().First())
+			if err != nil {
+				return err
+			}
+			w, done, err := createOutput(out)
+			if err != nil {
+				return err
+			}
+			return done(snapshot.WriteTar(appCtx.Context, store, root, w))
+		},
+	}
+}
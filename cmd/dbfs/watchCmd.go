@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/refs"
+	"github.com/andrebq/dbfs/watch"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+func watchCmd() *cli.Command {
+	var cfg config.Blob
+	var ign config.Ignore
+	var name, author, message string
+	return &cli.Command{
+		Name:      "watch",
+		Usage:     "Monitor a directory and commit its changes to a ref",
+		ArgsUsage: "<dir>",
+		Flags: append(append(cfg.AllFlags(), ign.AllFlags()...),
+			&cli.StringFlag{
+				Name:        "ref",
+				Usage:       "Ref updated with a new commit after each batch of changes",
+				Value:       refs.Prefix + "heads/main",
+				EnvVars:     []string{"DBFS_WATCH_REF"},
+				Destination: &name,
+			},
+			&cli.DurationFlag{
+				Name:  "debounce",
+				Usage: "How long the directory must be quiet before a snapshot is taken",
+				Value: watch.DefaultDebounce,
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "Minimum time between two commits",
+				Value: watch.DefaultInterval,
+			},
+			&cli.StringFlag{
+				Name:        "author",
+				Usage:       "Author of the commits, defaults to user@hostname",
+				EnvVars:     []string{"DBFS_AUTHOR"},
+				Destination: &author,
+			},
+			&cli.StringFlag{
+				Name:        "message",
+				Aliases:     []string{"m"},
+				Usage:       "Message of the commits",
+				Value:       watch.DefaultMessage,
+				Destination: &message,
+			},
+		),
+		Action: func(appCtx *cli.Context) error {
+			if appCtx.Args().Len() != 1 {
+				return errors.New("watch requires exactly one directory")
+			}
+			if author == "" {
+				author = defaultAuthor()
+			}
+			filter, err := ign.Filter()
+			if err != nil {
+				return err
+			}
+			b, err := blob.WithSeed(cfg.Seed)
+			if err != nil {
+				return err
+			}
+			store, err := storageConfig.Open(appCtx.Context)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			rs, err := openRefs(store)
+			if err != nil {
+				return err
+			}
+			dir := appCtx.Args().First()
+			w, err := watch.New(store, b, rs, dir, name,
+				watch.Debounce(appCtx.Duration("debounce")),
+				watch.Interval(appCtx.Duration("interval")),
+				watch.Author(author),
+				watch.Message(message),
+				watch.Filter(filter),
+				watch.OnSnapshot(func(res watch.Result) {
+					ev := log.Info().Str("ref", name).Str("tree", res.Tree.String()).
+						Int("files", res.Stats.Files).Int("reused", res.Stats.Reused).Int("excluded", res.Stats.Excluded).Int64("bytes", res.Stats.Bytes)
+					if res.Commit == (cas.Ref{}) {
+						ev.Msg("No changes")
+						return
+					}
+					ev.Str("commit", res.Commit.String()).Msg("Committed")
+				}))
+			if err != nil {
+				return err
+			}
+			log.Info().Str("dir", dir).Str("ref", name).Msg("Watching")
+			return w.Run(appCtx.Context)
+		},
+	}
+}
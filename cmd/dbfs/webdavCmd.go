@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/internal/config"
+	"github.com/andrebq/dbfs/refs"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/andrebq/dbfs/webdav"
+	"github.com/rs/zerolog/log"
+	cli "github.com/urfave/cli/v2"
+)
+
+func webdavCmd() *cli.Command {
+	var cfg config.Blob
+	var addr, author string
+	var writable bool
+	return &cli.Command{
+		Name:      "webdav",
+		Usage:     "Serve a commit or directory snapshot as a WebDAV share",
+		ArgsUsage: "<commit, snapshot or ref name>",
+		Flags: append(cfg.AllFlags(),
+			&cli.StringFlag{
+				Name:        "addr",
+				Usage:       "Address to listen for requests",
+				Value:       "127.0.0.1:8081",
+				EnvVars:     []string{"DBFS_WEBDAV_ADDR"},
+				Destination: &addr,
+			},
+			&cli.BoolFlag{
+				Name:        "writable",
+				Usage:       "Accept changes, each one is recorded as a new commit of the ref being served",
+				Destination: &writable,
+			},
+			&cli.StringFlag{
+				Name:        "author",
+				Usage:       "Author of the commits created by writable shares, defaults to user@hostname",
+				EnvVars:     []string{"DBFS_AUTHOR"},
+				Destination: &author,
+			},
+		),
+		Action: func(appCtx *cli.Context) error {
+			ctx := appCtx.Context
+			if appCtx.Args().Len() != 1 {
+				return errors.New("webdav requires exactly one commit, snapshot or ref name")
+			}
+			arg := appCtx.Args().First()
+			store, err := storageConfig.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			root, err := resolveTree(ctx, store, arg)
+			if err != nil {
+				return err
+			}
+			var options []webdav.Option
+			if writable {
+				if _, err := cas.ParseRef(arg); err == nil {
+					return errors.New("writable shares require a ref name, otherwise changes could not be recorded")
+				}
+				name := arg
+				if !strings.HasPrefix(name, refs.Prefix) {
+					name = refs.Prefix + "heads/" + name
+				}
+				if author == "" {
+					author = defaultAuthor()
+				}
+				b, err := blob.WithSeed(cfg.Seed)
+				if err != nil {
+					return err
+				}
+				rs, err := openRefs(store)
+				if err != nil {
+					return err
+				}
+				options = append(options, webdav.Writable(b, commitChanges(store, rs, name, author)))
+			}
+			fs, err := webdav.NewFS(ctx, store, root, options...)
+			if err != nil {
+				return err
+			}
+			return listenAndServe(ctx, addr, webdav.Handler(fs))
+		},
+	}
+}
+
+// commitChanges applies every change to the latest tree of the ref
+// name and records the result as a new commit
+func commitChanges(store *cas.C, rs *refs.Store, name, author string) webdav.CommitFunc {
+	return func(ctx context.Context, edit webdav.EditFunc) (cas.Ref, error) {
+		var root cas.Ref
+		head, err := rs.Update(ctx, name, func(current cas.Ref, found bool) (cas.Ref, error) {
+			if !found {
+				return cas.Ref{}, fmt.Errorf("%v was removed, cause: %w", name, cas.ErrNotFound)
+			}
+			t, _, err := store.GetTyped(ctx, current)
+			if err != nil {
+				return cas.Ref{}, err
+			}
+			cm := commit.Commit{
+				Author:  author,
+				Time:    time.Now().Truncate(time.Second),
+				Message: "Changes made over WebDAV",
+			}
+			switch t {
+			case commit.Type:
+				parent, err := commit.Read(ctx, store, current)
+				if err != nil {
+					return cas.Ref{}, err
+				}
+				cm.Tree, cm.Parents = parent.Tree, []cas.Ref{current}
+			case snapshot.DirType:
+				cm.Tree = current
+			default:
+				return cas.Ref{}, fmt.Errorf("%v is a %v, not a commit or directory", current, t)
+			}
+			base := cm.Tree
+			if root, err = edit(base); err != nil || root == base {
+				return current, err
+			}
+			cm.Tree = root
+			return commit.Write(ctx, store, cm)
+		})
+		if err != nil {
+			return cas.Ref{}, fmt.Errorf("unable to update %v, cause: %w", name, err)
+		}
+		log.Info().Str("ref", name).Str("commit", head.String()).Str("tree", root.String()).Msg("Changes committed")
+		return root, nil
+	}
+}
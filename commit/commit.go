@@ -0,0 +1,120 @@
+package commit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// Commit is a version of a dataset
+	Commit struct {
+		// Tree is the root snapshot.Dir of this version
+		Tree    cas.Ref
+		Parents []cas.Ref
+		Author  string
+		Time    time.Time
+		Message string
+	}
+)
+
+const (
+	// Type is the object type used by commits
+	Type cas.Type = "commit"
+)
+
+var (
+	// Stop can be returned by the function passed to Log
+	// to end the walk without an error
+	Stop = errors.New("stop log")
+)
+
+// Write stores cm as a typed object
+func Write(ctx context.Context, c *cas.C, cm Commit) (cas.Ref, error) {
+	buf, err := cm.MarshalBinary()
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	return c.PutTyped(ctx, Type, buf)
+}
+
+// Read loads the commit at ref
+func Read(ctx context.Context, c *cas.C, ref cas.Ref) (Commit, error) {
+	t, content, err := c.GetTyped(ctx, ref)
+	if err != nil {
+		return Commit{}, err
+	}
+	if t != Type {
+		return Commit{}, fmt.Errorf("object %v is a %v not a %v", ref, t, Type)
+	}
+	var cm Commit
+	if err := cm.UnmarshalBinary(content); err != nil {
+		return Commit{}, fmt.Errorf("unable to decode commit %v, cause: %w", ref, err)
+	}
+	return cm, nil
+}
+
+// Log calls fn for head and all its ancestors, newest first.
+// Commits reachable from multiple parents are visited once.
+//
+// If fn returns Stop the walk ends and Log returns nil,
+// any other error is returned to the caller
+func Log(ctx context.Context, c *cas.C, head cas.Ref, fn func(ref cas.Ref, cm Commit) error) error {
+	type item struct {
+		ref cas.Ref
+		cm  Commit
+	}
+	seen := map[cas.Ref]struct{}{head: {}}
+	first, err := Read(ctx, c, head)
+	if err != nil {
+		return err
+	}
+	pending := []item{{head, first}}
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next := pending[0]
+		pending = pending[1:]
+		if err := fn(next.ref, next.cm); errors.Is(err, Stop) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, p := range next.cm.Parents {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			cm, err := Read(ctx, c, p)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, item{p, cm})
+		}
+		// keep the pending commits sorted by time, so merged
+		// histories are interleaved in chronological order
+		sort.SliceStable(pending, func(i, j int) bool {
+			return pending[i].cm.Time.After(pending[j].cm.Time)
+		})
+	}
+	return nil
+}
+
+// IsAncestor returns true if ancestor is head or can be
+// reached from head by following the commit parents
+func IsAncestor(ctx context.Context, c *cas.C, ancestor, head cas.Ref) (bool, error) {
+	var found bool
+	err := Log(ctx, c, head, func(ref cas.Ref, _ Commit) error {
+		if ref == ancestor {
+			found = true
+			return Stop
+		}
+		return nil
+	})
+	return found, err
+}
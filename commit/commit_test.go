@@ -0,0 +1,124 @@
+package commit
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+func mustWrite(ctx context.Context, t *testing.T, c *cas.C, cm Commit) cas.Ref {
+	t.Helper()
+	ref, err := Write(ctx, c, cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func TestWriteRead(t *testing.T) {
+	ctx := context.Background()
+	c, _ := testutil.OpenStore(ctx, t)
+	cm := Commit{
+		Tree:    cas.PrecomputeHashBytes([]byte("tree")),
+		Parents: []cas.Ref{cas.PrecomputeHashBytes([]byte("parent"))},
+		Author:  "someone@example.com",
+		Time:    time.Date(2021, 5, 6, 7, 8, 9, 0, time.FixedZone("", -3*3600)),
+		Message: "first version",
+	}
+	ref := mustWrite(ctx, t, c, cm)
+	if again := mustWrite(ctx, t, c, cm); again != ref {
+		t.Errorf("Writing the same commit should return the same ref, got %v and %v", ref, again)
+	}
+	read, err := Read(ctx, c, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.Time.Equal(cm.Time) {
+		t.Errorf("Time should be %v got %v", cm.Time, read.Time)
+	}
+	if _, offset := read.Time.Zone(); offset != -3*3600 {
+		t.Errorf("Timezone offset should be kept, got %v", offset)
+	}
+	read.Time, cm.Time = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(read, cm) {
+		t.Errorf("Read should return %#v got %#v", cm, read)
+	}
+
+	other, err := c.PutTyped(ctx, "other", []byte("not a commit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(ctx, c, other); err == nil {
+		t.Error("Read should fail on objects which are not commits")
+	}
+}
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	c, _ := testutil.OpenStore(ctx, t)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+
+	// root <- a <- b <- merge
+	//      \- x <------/
+	root := mustWrite(ctx, t, c, Commit{Time: at(0), Message: "root"})
+	a := mustWrite(ctx, t, c, Commit{Time: at(1), Message: "a", Parents: []cas.Ref{root}})
+	x := mustWrite(ctx, t, c, Commit{Time: at(2), Message: "x", Parents: []cas.Ref{root}})
+	b := mustWrite(ctx, t, c, Commit{Time: at(3), Message: "b", Parents: []cas.Ref{a}})
+	merge := mustWrite(ctx, t, c, Commit{Time: at(4), Message: "merge", Parents: []cas.Ref{b, x}})
+
+	var messages []string
+	err := Log(ctx, c, merge, func(_ cas.Ref, cm Commit) error {
+		messages = append(messages, cm.Message)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"merge", "b", "x", "a", "root"}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Log should visit %v got %v", expected, messages)
+	}
+
+	messages = nil
+	err = Log(ctx, c, merge, func(_ cas.Ref, cm Commit) error {
+		messages = append(messages, cm.Message)
+		if len(messages) == 2 {
+			return Stop
+		}
+		return nil
+	})
+	if err != nil || len(messages) != 2 {
+		t.Errorf("Stop should end the log without errors, got %v after %v", err, messages)
+	}
+}
+
+func TestIsAncestor(t *testing.T) {
+	ctx := context.Background()
+	c, _ := testutil.OpenStore(ctx, t)
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	root := mustWrite(ctx, t, c, Commit{Time: start, Message: "root"})
+	a := mustWrite(ctx, t, c, Commit{Time: start.Add(time.Hour), Message: "a", Parents: []cas.Ref{root}})
+	x := mustWrite(ctx, t, c, Commit{Time: start.Add(2 * time.Hour), Message: "x", Parents: []cas.Ref{root}})
+	for _, tc := range []struct {
+		ancestor, head cas.Ref
+		expected       bool
+	}{
+		{root, a, true},
+		{a, a, true},
+		{a, root, false},
+		{a, x, false},
+	} {
+		ok, err := IsAncestor(ctx, c, tc.ancestor, tc.head)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.expected {
+			t.Errorf("IsAncestor(%v, %v) should be %v", tc.ancestor, tc.head, tc.expected)
+		}
+	}
+}
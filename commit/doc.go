@@ -0,0 +1,7 @@
+// package commit records the history of snapshots
+//
+// A commit is a typed "commit" object which points to the root
+// directory of a snapshot, the commits it was derived from (its
+// parents), who created it, when and why. Following the parents
+// of a commit gives the whole history of a dataset, like git.
+package commit
@@ -0,0 +1,107 @@
+package commit
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/tuple"
+)
+
+type (
+	// commitView is the human friendly representation of a Commit
+	commitView struct {
+		Tree    string   `json:"tree" yaml:"tree"`
+		Parents []string `json:"parents" yaml:"parents"`
+		Author  string   `json:"author" yaml:"author"`
+		Time    string   `json:"time" yaml:"time"`
+		Message string   `json:"message" yaml:"message"`
+	}
+)
+
+func (cm Commit) view() commitView {
+	v := commitView{
+		Tree:    cm.Tree.String(),
+		Parents: make([]string, len(cm.Parents)),
+		Author:  cm.Author,
+		Time:    cm.Time.Format(time.RFC3339),
+		Message: cm.Message,
+	}
+	for i, p := range cm.Parents {
+		v.Parents[i] = p.String()
+	}
+	return v
+}
+
+func (cm Commit) MarshalYAML() (interface{}, error) {
+	return cm.view(), nil
+}
+
+func (cm Commit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cm.view())
+}
+
+// MarshalBinary encodes cm as a named tuple, the timezone offset
+// is kept so the time is displayed as seen by the author
+func (cm Commit) MarshalBinary() ([]byte, error) {
+	parents := make([][]byte, len(cm.Parents))
+	for i := range cm.Parents {
+		parents[i] = cm.Parents[i][:]
+	}
+	_, offset := cm.Time.Zone()
+	return tuple.MarshalBinary(tuple.Pairs{}.
+		Add("tree", cm.Tree[:]).
+		Add("parents", parents).
+		Add("author", cm.Author).
+		Add("time", cm.Time.UnixNano()).
+		Add("tz", int64(offset)).
+		Add("message", cm.Message).
+		Named())
+}
+
+func (cm *Commit) UnmarshalBinary(buf []byte) error {
+	var n tuple.Named
+	if err := tuple.UnmarshalBinary(buf, &n); err != nil {
+		return err
+	}
+	tree, err := n.Bytes("tree")
+	if err != nil {
+		return err
+	}
+	if err := copyRef(&cm.Tree, tree); err != nil {
+		return fmt.Errorf("invalid tree, cause: %w", err)
+	}
+	parents, err := n.BytesList("parents")
+	if err != nil {
+		return err
+	}
+	cm.Parents = make([]cas.Ref, len(parents))
+	for i, p := range parents {
+		if err := copyRef(&cm.Parents[i], p); err != nil {
+			return fmt.Errorf("invalid parent, cause: %w", err)
+		}
+	}
+	if cm.Author, err = n.String("author"); err != nil {
+		return err
+	}
+	nanos, err := n.Int64("time")
+	if err != nil {
+		return err
+	}
+	offset, err := n.Int64("tz")
+	if err != nil {
+		return err
+	}
+	cm.Time = time.Unix(0, nanos).In(time.FixedZone("", int(offset)))
+	cm.Message, err = n.String("message")
+	return err
+}
+
+func copyRef(out *cas.Ref, buf []byte) error {
+	if len(buf) != len(out) {
+		return fmt.Errorf("expecting %v bytes got %v", len(out), len(buf))
+	}
+	copy(out[:], buf)
+	return nil
+}
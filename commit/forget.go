@@ -0,0 +1,151 @@
+package commit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+var (
+	// ErrMerge is returned by Plan when the history has a merge
+	// commit, Rewrite can only keep linear histories
+	ErrMerge = errors.New("history has merge commits")
+)
+
+type (
+	// Policy selects which commits are kept by Plan, like restic,
+	// each counter keeps the newest commit of that many distinct
+	// periods. Periods are computed in UTC.
+	Policy struct {
+		Last    int
+		Hourly  int
+		Daily   int
+		Weekly  int
+		Monthly int
+		Yearly  int
+	}
+
+	// Decision is the result of applying a Policy to a commit
+	Decision struct {
+		Ref    cas.Ref
+		Commit Commit
+		Keep   bool
+		// Reasons lists the rules which selected the commit
+		Reasons []string
+	}
+
+	// rule keeps the newest commit of count distinct periods
+	rule struct {
+		name   string
+		count  int
+		period func(d Decision) string
+	}
+)
+
+// Empty returns true if p doesn't keep any commit
+func (p Policy) Empty() bool {
+	return p.Last <= 0 && p.Hourly <= 0 && p.Daily <= 0 &&
+		p.Weekly <= 0 && p.Monthly <= 0 && p.Yearly <= 0
+}
+
+func (p Policy) rules() []rule {
+	layout := func(layout string) func(Decision) string {
+		return func(d Decision) string { return d.Commit.Time.UTC().Format(layout) }
+	}
+	return []rule{
+		// every commit is its own period, even if two
+		// commits have the same time
+		{"last", p.Last, func(d Decision) string { return d.Ref.String() }},
+		{"hourly", p.Hourly, layout("2006-01-02T15")},
+		{"daily", p.Daily, layout("2006-01-02")},
+		{"weekly", p.Weekly, func(d Decision) string {
+			year, week := d.Commit.Time.UTC().ISOWeek()
+			return fmt.Sprintf("%04d-W%02d", year, week)
+		}},
+		{"monthly", p.Monthly, layout("2006-01")},
+		{"yearly", p.Yearly, layout("2006")},
+	}
+}
+
+// Plan applies p to head and its parent chain, the decisions
+// are sorted from head to the oldest commit.
+//
+// Only linear histories are supported, if any commit has more than
+// one parent Plan fails with ErrMerge instead of dropping the other
+// branches
+func Plan(ctx context.Context, c *cas.C, head cas.Ref, p Policy) ([]Decision, error) {
+	if p.Empty() {
+		return nil, errors.New("policy doesn't keep any commit")
+	}
+	var history []Decision
+	for ref := head; ; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		cm, err := Read(ctx, c, ref)
+		if err != nil {
+			return nil, err
+		}
+		if len(cm.Parents) > 1 {
+			return nil, fmt.Errorf("commit %v has %v parents: %w", ref, len(cm.Parents), ErrMerge)
+		}
+		history = append(history, Decision{Ref: ref, Commit: cm})
+		if len(cm.Parents) == 0 {
+			break
+		}
+		ref = cm.Parents[0]
+	}
+	for _, r := range p.rules() {
+		if r.count <= 0 {
+			continue
+		}
+		seen := make(map[string]struct{})
+		for i := range history {
+			if len(seen) >= r.count {
+				break
+			}
+			period := r.period(history[i])
+			if _, ok := seen[period]; ok {
+				continue
+			}
+			seen[period] = struct{}{}
+			history[i].Keep = true
+			history[i].Reasons = append(history[i].Reasons, r.name)
+		}
+	}
+	return history, nil
+}
+
+// Rewrite writes a new chain with only the kept commits from plan and
+// returns its head. Each kept commit gets the next kept commit as its
+// only parent, so the oldest commits keep their ref until the first
+// commit which was removed. Like Plan, it fails with ErrMerge if a
+// commit in plan has more than one parent
+func Rewrite(ctx context.Context, c *cas.C, plan []Decision) (cas.Ref, error) {
+	var parent cas.Ref
+	for i := len(plan) - 1; i >= 0; i-- {
+		d := plan[i]
+		if len(d.Commit.Parents) > 1 {
+			return cas.Ref{}, fmt.Errorf("commit %v has %v parents: %w", d.Ref, len(d.Commit.Parents), ErrMerge)
+		}
+		if !d.Keep {
+			continue
+		}
+		cm := d.Commit
+		cm.Parents = nil
+		if parent != (cas.Ref{}) {
+			cm.Parents = []cas.Ref{parent}
+		}
+		ref, err := Write(ctx, c, cm)
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		parent = ref
+	}
+	if parent == (cas.Ref{}) {
+		return cas.Ref{}, errors.New("plan doesn't keep any commit")
+	}
+	return parent, nil
+}
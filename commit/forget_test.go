@@ -0,0 +1,132 @@
+package commit
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+// dailyHistory writes one commit per day at noon, from 2021-01-01 to
+// 2021-02-09, plus a commit on the morning of the last day
+func dailyHistory(ctx context.Context, t *testing.T, c *cas.C) cas.Ref {
+	var head cas.Ref
+	add := func(when time.Time) {
+		cm := Commit{
+			Tree:    cas.PrecomputeHashBytes([]byte(when.String())),
+			Author:  "someone@example.com",
+			Time:    when,
+			Message: when.Format(time.RFC3339),
+		}
+		if head != (cas.Ref{}) {
+			cm.Parents = []cas.Ref{head}
+		}
+		head = mustWrite(ctx, t, c, cm)
+	}
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 40; day++ {
+		if day == 39 {
+			add(start.AddDate(0, 0, day).Add(-4 * time.Hour))
+		}
+		add(start.AddDate(0, 0, day))
+	}
+	return head
+}
+
+func TestForget(t *testing.T) {
+	ctx := context.Background()
+	c, _ := testutil.OpenStore(ctx, t)
+	head := dailyHistory(ctx, t, c)
+
+	if _, err := Plan(ctx, c, head, Policy{}); err == nil {
+		t.Error("Plan should fail when the policy doesn't keep any commit")
+	}
+
+	plan, err := Plan(ctx, c, head, Policy{Last: 1, Daily: 3, Weekly: 2, Monthly: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 41 {
+		t.Fatalf("Plan should have a decision for every commit, got %v", len(plan))
+	}
+	kept := make(map[string][]string)
+	for _, d := range plan {
+		if d.Keep {
+			kept[d.Commit.Message] = d.Reasons
+		}
+	}
+	expected := map[string][]string{
+		"2021-02-09T12:00:00Z": {"last", "daily", "weekly", "monthly"},
+		"2021-02-08T12:00:00Z": {"daily"},
+		"2021-02-07T12:00:00Z": {"daily", "weekly"},
+		"2021-01-31T12:00:00Z": {"monthly"},
+	}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("Expected kept commits %v got %v", expected, kept)
+	}
+
+	newHead, err := Rewrite(ctx, c, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	var oldest Commit
+	err = Log(ctx, c, newHead, func(ref cas.Ref, cm Commit) error {
+		messages = append(messages, cm.Message)
+		oldest = cm
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLog := []string{"2021-02-09T12:00:00Z", "2021-02-08T12:00:00Z", "2021-02-07T12:00:00Z", "2021-01-31T12:00:00Z"}
+	if !reflect.DeepEqual(messages, expectedLog) {
+		t.Errorf("Expected history %v got %v", expectedLog, messages)
+	}
+	if len(oldest.Parents) != 0 {
+		t.Errorf("Oldest kept commit should not have parents %#v", oldest)
+	}
+
+	plan, err = Plan(ctx, c, head, Policy{Last: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, err := Rewrite(ctx, c, plan); err != nil {
+		t.Fatal(err)
+	} else if same != head {
+		t.Error("Rewriting a history where every commit is kept should return the same head")
+	}
+}
+
+func TestForgetMerge(t *testing.T) {
+	ctx := context.Background()
+	c, _ := testutil.OpenStore(ctx, t)
+	main := dailyHistory(ctx, t, c)
+	side := mustWrite(ctx, t, c, Commit{
+		Tree:    cas.PrecomputeHashBytes([]byte("side")),
+		Author:  "someone@example.com",
+		Time:    time.Date(2021, 2, 10, 9, 0, 0, 0, time.UTC),
+		Message: "side",
+	})
+	merge := Commit{
+		Tree:    cas.PrecomputeHashBytes([]byte("merge")),
+		Parents: []cas.Ref{main, side},
+		Author:  "someone@example.com",
+		Time:    time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC),
+		Message: "merge",
+	}
+	head := mustWrite(ctx, t, c, merge)
+
+	if _, err := Plan(ctx, c, head, Policy{Last: 100}); !errors.Is(err, ErrMerge) {
+		t.Errorf("Plan should fail with ErrMerge, got %v", err)
+	}
+
+	plan := []Decision{{Ref: head, Commit: merge, Keep: true}}
+	if _, err := Rewrite(ctx, c, plan); !errors.Is(err, ErrMerge) {
+		t.Errorf("Rewrite should fail with ErrMerge, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package diff
+
+import (
+	"context"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// Range is a sequence of bytes [Start, End) inside a blob
+	Range struct {
+		Start int64 `json:"start" yaml:"start"`
+		End   int64 `json:"end" yaml:"end"`
+	}
+
+	// Hunk maps a range of the old blob to the range which replaced
+	// it in the new blob. Insertions have an empty Old range and
+	// deletions an empty New range
+	Hunk struct {
+		Old Range `json:"old" yaml:"old"`
+		New Range `json:"new" yaml:"new"`
+	}
+
+	// segment is a chunk, or a whole tree, of a blob
+	segment struct {
+		ref  cas.Ref
+		tree bool
+		Range
+	}
+)
+
+// Len returns the number of bytes in r
+func (r Range) Len() int64 { return r.End - r.Start }
+
+// Blobs compares the blobs whose root trees are a and b and returns
+// the byte ranges which changed, based on the refs of their chunks.
+//
+// Trees present in both blobs are compared by ref and not expanded,
+// so unchanged regions aligned to tree boundaries are not read
+func Blobs(ctx context.Context, c *cas.C, a, b cas.Ref) ([]Hunk, error) {
+	old := []segment{{ref: a, tree: true}}
+	cur := []segment{{ref: b, tree: true}}
+	var err error
+	for {
+		common := make(map[cas.Ref]struct{})
+		inOld := make(map[cas.Ref]struct{}, len(old))
+		for _, s := range old {
+			inOld[s.ref] = struct{}{}
+		}
+		for _, s := range cur {
+			if _, ok := inOld[s.ref]; ok {
+				common[s.ref] = struct{}{}
+			}
+		}
+		var expandedOld, expandedNew bool
+		if old, expandedOld, err = expand(ctx, c, old, common); err != nil {
+			return nil, err
+		}
+		if cur, expandedNew, err = expand(ctx, c, cur, common); err != nil {
+			return nil, err
+		}
+		if !expandedOld && !expandedNew {
+			break
+		}
+	}
+	return hunks(old, cur), nil
+}
+
+// expand replaces trees which are not in common by their children
+func expand(ctx context.Context, c *cas.C, segs []segment, common map[cas.Ref]struct{}) ([]segment, bool, error) {
+	var out []segment
+	var expanded bool
+	for _, s := range segs {
+		if _, ok := common[s.ref]; ok || !s.tree {
+			out = append(out, s)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		t, err := blob.ReadTree(ctx, c, s.ref)
+		if err != nil {
+			return nil, false, err
+		}
+		expanded = true
+		start := s.Start
+		for i, r := range t.Children() {
+			end := start + t.Sizes[i]
+			out = append(out, segment{ref: r, tree: len(t.Branches) > 0, Range: Range{Start: start, End: end}})
+			start = end
+		}
+	}
+	return out, expanded, nil
+}
+
+// hunks aligns the segments of both blobs, segments which are not
+// present in the other blob are grouped into hunks
+func hunks(old, cur []segment) []Hunk {
+	pos := make(map[cas.Ref][]int, len(old))
+	for i, s := range old {
+		pos[s.ref] = append(pos[s.ref], i)
+	}
+	var out []Hunk
+	i, j := 0, 0
+	for i < len(old) || j < len(cur) {
+		if i < len(old) && j < len(cur) && old[i].ref == cur[j].ref {
+			i, j = i+1, j+1
+			continue
+		}
+		// find the next segment of cur which is also in old after i,
+		// everything before it (on both sides) changed
+		nextI, nextJ := len(old), len(cur)
+		for k := j; k < len(cur); k++ {
+			if idx, ok := firstAfter(pos[cur[k].ref], i); ok {
+				nextI, nextJ = idx, k
+				break
+			}
+		}
+		out = append(out, Hunk{
+			Old: span(old, i, nextI),
+			New: span(cur, j, nextJ),
+		})
+		i, j = nextI, nextJ
+	}
+	return out
+}
+
+// span returns the range covered by segs[from:to], empty ranges
+// start where the next segment starts
+func span(segs []segment, from, to int) Range {
+	if from < to {
+		return Range{Start: segs[from].Start, End: segs[to-1].End}
+	}
+	var at int64
+	if from < len(segs) {
+		at = segs[from].Start
+	} else if len(segs) > 0 {
+		at = segs[len(segs)-1].End
+	}
+	return Range{Start: at, End: at}
+}
+
+func firstAfter(indexes []int, min int) (int, bool) {
+	for _, idx := range indexes {
+		if idx >= min {
+			return idx, true
+		}
+	}
+	return 0, false
+}
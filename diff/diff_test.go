@@ -0,0 +1,131 @@
+package diff
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+func take(ctx context.Context, t *testing.T, c *cas.C, b *blob.B, dir string) cas.Ref {
+	ref, _, err := snapshot.Take(ctx, c, b, dir, snapshot.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func TestDirs(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	dir, err := ioutil.TempDir("", "dbfs-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testutil.WriteFile(t, filepath.Join(dir, "same.txt"), "same")
+	testutil.WriteFile(t, filepath.Join(dir, "changed.txt"), "old content")
+	testutil.WriteFile(t, filepath.Join(dir, "removed.txt"), "removed")
+	testutil.WriteFile(t, filepath.Join(dir, "script.sh"), "echo")
+	testutil.WriteFile(t, filepath.Join(dir, "lib", "a.go"), "package lib")
+	testutil.WriteFile(t, filepath.Join(dir, "old", "file"), "gone")
+	before := take(ctx, t, c, b, dir)
+
+	testutil.WriteFile(t, filepath.Join(dir, "changed.txt"), "new content")
+	testutil.WriteFile(t, filepath.Join(dir, "lib", "b.go"), "package lib")
+	testutil.WriteFile(t, filepath.Join(dir, "new", "file"), "new")
+	if err := os.Remove(filepath.Join(dir, "removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "script.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	after := take(ctx, t, c, b, dir)
+
+	var changes []string
+	err = Dirs(ctx, c, before, after, func(ch Change) error {
+		changes = append(changes, string(ch.Op)+" "+ch.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"modified changed.txt",
+		"added lib/b.go",
+		"added new",
+		"removed old",
+		"removed removed.txt",
+		"mode-changed script.sh",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Changes should be\n%v\ngot\n%v", expected, changes)
+	}
+
+	if err := Dirs(ctx, c, after, after, func(ch Change) error {
+		t.Errorf("Identical snapshots should not report changes, got %v", ch)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	content := make([]byte, 5_000_000)
+	rand.New(rand.NewSource(1)).Read(content)
+	changed := append([]byte(nil), content...)
+	copy(changed[2_500_000:], []byte("a few changed bytes"))
+
+	upload := func(buf []byte) cas.Ref {
+		ref, err := b.Upload(ctx, c, bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+	before, after := upload(content), upload(changed)
+
+	hunks, err := Blobs(ctx, c, before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hunks) != 1 {
+		t.Fatalf("A single change should produce one hunk, got %v", hunks)
+	}
+	h := hunks[0]
+	if h.Old.Start > 2_500_000 || h.Old.End < 2_500_019 || h.Old != h.New {
+		t.Errorf("Hunk should cover the changed bytes, got %#v", h)
+	}
+	if h.Old.Len() == int64(len(content)) {
+		t.Errorf("Unchanged chunks should not be part of the hunk, got %#v", h)
+	}
+
+	// appending content keeps the old chunks, except for the last one
+	appended := upload(append(append([]byte(nil), content...), []byte("tail")...))
+	hunks, err = Blobs(ctx, c, before, appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hunks) != 1 || hunks[0].New.End != int64(len(content))+4 {
+		t.Errorf("Appending should change only the tail, got %v", hunks)
+	}
+
+	if hunks, err := Blobs(ctx, c, before, before); err != nil || len(hunks) != 0 {
+		t.Errorf("Identical blobs should not have hunks, got %v %v", hunks, err)
+	}
+}
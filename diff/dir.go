@@ -0,0 +1,102 @@
+package diff
+
+import (
+	"context"
+	"path"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+type (
+	// Op describes how a path changed between two snapshots
+	Op string
+
+	// Change is a path which differs between two snapshots,
+	// Old is empty for added paths and New for removed ones
+	Change struct {
+		Op   Op
+		Path string
+		Old  snapshot.Entry
+		New  snapshot.Entry
+	}
+)
+
+const (
+	Added       = Op("added")
+	Removed     = Op("removed")
+	Modified    = Op("modified")
+	ModeChanged = Op("mode-changed")
+)
+
+// Dirs compares the snapshot directories a and b and calls fn for every
+// path that changed, in lexical order. Added and removed directories
+// are reported once, without their entries.
+//
+// Modification times are ignored, a file is modified only if its
+// content (or symlink target) changed
+func Dirs(ctx context.Context, c *cas.C, a, b cas.Ref, fn func(Change) error) error {
+	return dirs(ctx, c, a, b, "", fn)
+}
+
+func dirs(ctx context.Context, c *cas.C, a, b cas.Ref, base string, fn func(Change) error) error {
+	if a == b {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	oldDir, err := snapshot.ReadDir(ctx, c, a)
+	if err != nil {
+		return err
+	}
+	newDir, err := snapshot.ReadDir(ctx, c, b)
+	if err != nil {
+		return err
+	}
+	old, cur := oldDir.Entries, newDir.Entries
+	for len(old) > 0 || len(cur) > 0 {
+		switch {
+		case len(cur) == 0 || (len(old) > 0 && old[0].Name < cur[0].Name):
+			if err := fn(Change{Op: Removed, Path: path.Join(base, old[0].Name), Old: old[0]}); err != nil {
+				return err
+			}
+			old = old[1:]
+		case len(old) == 0 || cur[0].Name < old[0].Name:
+			if err := fn(Change{Op: Added, Path: path.Join(base, cur[0].Name), New: cur[0]}); err != nil {
+				return err
+			}
+			cur = cur[1:]
+		default:
+			if err := entries(ctx, c, old[0], cur[0], path.Join(base, cur[0].Name), fn); err != nil {
+				return err
+			}
+			old, cur = old[1:], cur[1:]
+		}
+	}
+	return nil
+}
+
+// entries compares two entries with the same name
+func entries(ctx context.Context, c *cas.C, old, cur snapshot.Entry, p string, fn func(Change) error) error {
+	change := Change{Path: p, Old: old, New: cur}
+	switch {
+	case old.Mode.Type() != cur.Mode.Type():
+		change.Op = Modified
+	case old.IsDir():
+		if old.Mode != cur.Mode {
+			change.Op = ModeChanged
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+		return dirs(ctx, c, old.Ref, cur.Ref, p, fn)
+	case old.Ref != cur.Ref || old.Target != cur.Target:
+		change.Op = Modified
+	case old.Mode != cur.Mode:
+		change.Op = ModeChanged
+	default:
+		return nil
+	}
+	return fn(change)
+}
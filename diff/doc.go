@@ -0,0 +1,6 @@
+// package diff compares snapshots and blobs stored in a cas
+//
+// Both comparisons take advantage of content addressing: directories
+// and blob trees with the same ref are identical, so they are skipped
+// without being read.
+package diff
@@ -0,0 +1,36 @@
+package diff
+
+import (
+	"encoding/json"
+
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+type (
+	// changeView is the human friendly representation of a Change
+	changeView struct {
+		Op   Op              `json:"op" yaml:"op"`
+		Path string          `json:"path" yaml:"path"`
+		Old  *snapshot.Entry `json:"old,omitempty" yaml:"old,omitempty"`
+		New  *snapshot.Entry `json:"new,omitempty" yaml:"new,omitempty"`
+	}
+)
+
+func (c Change) view() changeView {
+	v := changeView{Op: c.Op, Path: c.Path}
+	if c.Op != Added {
+		v.Old = &c.Old
+	}
+	if c.Op != Removed {
+		v.New = &c.New
+	}
+	return v
+}
+
+func (c Change) MarshalYAML() (interface{}, error) {
+	return c.view(), nil
+}
+
+func (c Change) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.view())
+}
@@ -0,0 +1,7 @@
+// package kv implements a cas.KV decorator which keeps recently
+// used objects in a bounded directory on the local disk
+//
+// Objects stored by cas are immutable, so entries are never
+// invalidated, they are only evicted (least recently used first)
+// when the cache grows beyond its size limit.
+package kv
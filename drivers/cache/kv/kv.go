@@ -0,0 +1,584 @@
+package kv
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/rs/zerolog"
+)
+
+type (
+	// Bucket serves reads from a local directory and fills it
+	// with objects read from (and optionally written to) the
+	// actual KV
+	Bucket struct {
+		actual cas.KV
+		dir    string
+		cfg    config
+
+		mu      sync.Mutex
+		lru     *list.List
+		entries map[string]*list.Element
+		// size counts the bytes of the entries and of the
+		// staged copies in pending
+		size  int64
+		stats Stats
+		// pending holds the staged copies of objects written to keys
+		// which are not cached, see Write
+		pending map[string]*entry
+		staged  int64
+	}
+
+	// Stats contains the counters of a cache
+	Stats struct {
+		Hits      uint64 `json:"hits" yaml:"hits"`
+		Misses    uint64 `json:"misses" yaml:"misses"`
+		Evictions uint64 `json:"evictions" yaml:"evictions"`
+		Entries   int    `json:"entries" yaml:"entries"`
+		// Size includes the staged copies of objects which
+		// are not cached yet
+		Size int64 `json:"size" yaml:"size"`
+	}
+
+	entry struct {
+		name string
+		size int64
+	}
+
+	config struct {
+		maxSize      int64
+		writeThrough bool
+		prefixes     []string
+		logger       *zerolog.Logger
+	}
+
+	Option func(cfg *config) error
+
+	// failSafeWriter never returns an error to the caller,
+	// failures to write to the cache must not fail operations
+	// on the actual KV
+	failSafeWriter struct {
+		actual io.Writer
+		err    error
+	}
+)
+
+const (
+	DefaultMaxSize = 1_000_000_000
+
+	stagingDir = "staging"
+)
+
+// MaxSize configures the maximum amount of bytes kept by the cache
+func MaxSize(n int64) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return fmt.Errorf("cache size must be positive, got %v", n)
+		}
+		cfg.maxSize = n
+		return nil
+	}
+}
+
+// WriteThrough configures if objects written to the actual KV
+// should also be kept in the cache
+func WriteThrough(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.writeThrough = enabled
+		return nil
+	}
+}
+
+// Prefixes configures which keys are served from the cache,
+// by default only immutable objects (under data/ and packs/) are.
+//
+// Keys outside these prefixes are always read from the actual KV
+func Prefixes(prefixes ...string) Option {
+	return func(cfg *config) error {
+		cfg.prefixes = prefixes
+		return nil
+	}
+}
+
+// Logger logs the cache stats using the given logger when
+// the bucket is closed
+func Logger(logger zerolog.Logger) Option {
+	return func(cfg *config) error {
+		cfg.logger = &logger
+		return nil
+	}
+}
+
+// Wrap returns a KV which caches objects from actual under dir,
+// entries left by a previous instance are reused.
+//
+// Closing the returned bucket also closes actual
+func Wrap(actual cas.KV, dir string, options ...Option) (*Bucket, error) {
+	cfg := config{
+		maxSize:  DefaultMaxSize,
+		prefixes: []string{"data/", "packs/"},
+	}
+	for _, opt := range options {
+		err := opt(&cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b := &Bucket{
+		actual:  actual,
+		dir:     dir,
+		cfg:     cfg,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		pending: make(map[string]*entry),
+	}
+	// anything left in staging is from an interrupted operation
+	if err := os.RemoveAll(filepath.Join(dir, stagingDir)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, stagingDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := b.load(); err != nil {
+		return nil, fmt.Errorf("unable to load cache entries from %v, cause: %w", dir, err)
+	}
+	return b, nil
+}
+
+// Stats returns a snapshot of the cache counters
+func (b *Bucket) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats
+	s.Entries = b.lru.Len()
+	s.Size = b.size
+	return s
+}
+
+func (b *Bucket) Close() error {
+	if b.cfg.logger != nil {
+		s := b.Stats()
+		b.cfg.logger.Info().
+			Uint64("hits", s.Hits).
+			Uint64("misses", s.Misses).
+			Uint64("evictions", s.Evictions).
+			Int("entries", s.Entries).
+			Int64("size", s.Size).
+			Str("dir", b.dir).
+			Msg("Cache stats")
+	}
+	return b.actual.Close()
+}
+
+func (b *Bucket) Copy(ctx context.Context, to, from string) error {
+	err := b.actual.Copy(ctx, to, from)
+	if err != nil {
+		b.forget(to)
+		return err
+	}
+	b.transfer(to, from, false)
+	return nil
+}
+
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	b.forget(key)
+	return b.actual.Delete(ctx, key)
+}
+
+// Move uses the Move operation from the actual KV if it implements
+// cas.Mover, otherwise it is executed as a Copy followed by a Delete
+func (b *Bucket) Move(ctx context.Context, to, from string) error {
+	mover, ok := b.actual.(cas.Mover)
+	if !ok {
+		if err := b.Copy(ctx, to, from); err != nil {
+			return err
+		}
+		return b.Delete(ctx, from)
+	}
+	if err := mover.Move(ctx, to, from); err != nil {
+		b.forget(to)
+		return err
+	}
+	b.transfer(to, from, true)
+	return nil
+}
+
+// List is always served by the actual KV
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	lister, ok := b.actual.(cas.Lister)
+	if !ok {
+		return cas.ErrNotSupported
+	}
+	return lister.List(ctx, prefix, fn)
+}
+
+// ModTime is always served by the actual KV
+func (b *Bucket) ModTime(ctx context.Context, key string) (time.Time, error) {
+	mt, ok := b.actual.(cas.ModTimer)
+	if !ok {
+		return time.Time{}, cas.ErrNotSupported
+	}
+	return mt.ModTime(ctx, key)
+}
+
+// ReadVersion is always served by the actual KV, mutable
+// keys are never cached
+func (b *Bucket) ReadVersion(ctx context.Context, w io.Writer, key string) (string, error) {
+	cw, ok := b.actual.(cas.ConditionalWriter)
+	if !ok {
+		return "", cas.ErrNotSupported
+	}
+	return cw.ReadVersion(ctx, w, key)
+}
+
+// CheckConditionalWrites reports if the actual KV
+// supports conditional writes
+func (b *Bucket) CheckConditionalWrites() error {
+	_, err := cas.AsConditionalWriter(b.actual)
+	return err
+}
+
+// WriteIf is always served by the actual KV
+func (b *Bucket) WriteIf(ctx context.Context, key string, input io.Reader, version string) (string, error) {
+	cw, ok := b.actual.(cas.ConditionalWriter)
+	if !ok {
+		return "", cas.ErrNotSupported
+	}
+	b.forget(key)
+	return cw.WriteIf(ctx, key, input, version)
+}
+
+// Exists is always served by the actual KV, objects removed from it
+// (eg.: by gc) must be written again by cas. Entries for keys which
+// are missing from the actual KV are dropped from the cache
+func (b *Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	found, err := b.actual.Exists(ctx, key)
+	if err == nil && !found {
+		b.forget(key)
+	}
+	return found, err
+}
+
+func (b *Bucket) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	if !b.cacheable(key) {
+		return b.actual.Read(ctx, w, key)
+	}
+	if fd := b.open(key); fd != nil {
+		defer fd.Close()
+		return io.Copy(w, fd)
+	}
+	staging, err := b.staging()
+	if err != nil {
+		return b.actual.Read(ctx, w, key)
+	}
+	fs := failSafeWriter{actual: staging}
+	n, err := b.actual.Read(ctx, io.MultiWriter(w, &fs), key)
+	b.commit(key, staging, n, err == nil && fs.err == nil)
+	return n, err
+}
+
+// ReadRange serves the range from the cached copy of the object,
+// on misses the whole object is fetched so later ranges (eg.: objects
+// in the same pack) are served from the local disk
+func (b *Bucket) ReadRange(ctx context.Context, w io.Writer, key string, offset, length int64) (int64, error) {
+	if !b.cacheable(key) {
+		return cas.ReadRange(ctx, b.actual, w, key, offset, length)
+	}
+	fd := b.open(key)
+	if fd == nil {
+		staging, err := b.staging()
+		if err != nil {
+			return cas.ReadRange(ctx, b.actual, w, key, offset, length)
+		}
+		fs := failSafeWriter{actual: staging}
+		n, err := b.actual.Read(ctx, &fs, key)
+		b.commit(key, staging, n, err == nil && fs.err == nil)
+		if err != nil {
+			return 0, err
+		}
+		if fd = b.open(key); fd == nil {
+			// too large for the cache
+			return cas.ReadRange(ctx, b.actual, w, key, offset, length)
+		}
+	}
+	defer fd.Close()
+	n, err := io.Copy(w, io.NewSectionReader(fd, offset, length))
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Write keeps a copy of the object when write-through is enabled.
+//
+// Objects written to keys outside the cached prefixes are not cached,
+// but their copy is staged until the key is moved or copied, that way
+// objects written by cas to tmp/ are cached once they reach data/
+func (b *Bucket) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	if !b.cfg.writeThrough {
+		b.forget(key)
+		return b.actual.Write(ctx, key, input)
+	}
+	staging, err := b.staging()
+	if err != nil {
+		b.forget(key)
+		return b.actual.Write(ctx, key, input)
+	}
+	fs := failSafeWriter{actual: staging}
+	n, err := b.actual.Write(ctx, key, io.TeeReader(input, &fs))
+	if b.cacheable(key) {
+		b.commit(key, staging, n, err == nil && fs.err == nil)
+	} else {
+		b.stage(key, staging, n, err == nil && fs.err == nil)
+	}
+	return n, err
+}
+
+func (b *Bucket) cacheable(key string) bool {
+	for _, p := range b.cfg.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// open returns the cached file for key or nil if the key
+// is not in the cache, hit/miss counters are updated
+func (b *Bucket) open(key string) *os.File {
+	name := entryName(key)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	el, ok := b.entries[name]
+	if !ok {
+		b.stats.Misses++
+		return nil
+	}
+	fd, err := os.Open(b.entryPath(name))
+	if err != nil {
+		b.remove(el)
+		b.stats.Misses++
+		return nil
+	}
+	b.stats.Hits++
+	b.lru.MoveToFront(el)
+	// keep the access time on disk, so the lru order
+	// survives a restart
+	now := time.Now()
+	os.Chtimes(fd.Name(), now, now)
+	return fd
+}
+
+func (b *Bucket) staging() (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(b.dir, stagingDir), "entry")
+}
+
+// commit moves the staging file to the final location if ok is true,
+// otherwise the staging file is discarded
+func (b *Bucket) commit(key string, staging *os.File, size int64, ok bool) {
+	staging.Close()
+	defer os.Remove(staging.Name())
+	if !ok || size > b.cfg.maxSize {
+		b.forget(key)
+		return
+	}
+	name := entryName(key)
+	final := b.entryPath(name)
+	if err := os.MkdirAll(filepath.Dir(final), 0755); err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.Rename(staging.Name(), final); err != nil {
+		if el, ok := b.entries[name]; ok {
+			b.remove(el)
+		}
+		return
+	}
+	b.add(name, size)
+}
+
+// stage keeps the staging file of a key which is not cached,
+// so transfer can turn it into an entry later.
+//
+// Staged copies count against the size of the cache, entries are
+// evicted to make room for them and the copy is discarded if the
+// other staged copies already use the whole cache
+func (b *Bucket) stage(key string, staging *os.File, size int64, ok bool) {
+	staging.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unstage(key)
+	if !ok || b.staged+size > b.cfg.maxSize {
+		os.Remove(staging.Name())
+		return
+	}
+	b.pending[key] = &entry{name: staging.Name(), size: size}
+	b.staged += size
+	b.size += size
+	b.evict()
+}
+
+// transfer makes the entry (or the staged copy) for from available
+// as to, this allow objects written to temporary keys to be cached
+// after they are moved to their final key
+func (b *Bucket) transfer(to, from string, move bool) {
+	src, dst := entryName(from), entryName(to)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if el, ok := b.entries[dst]; ok {
+		b.remove(el)
+	}
+	var file string
+	var size int64
+	if el, ok := b.entries[src]; ok {
+		file, size = b.entryPath(src), el.Value.(*entry).size
+		if move {
+			b.lru.Remove(el)
+			delete(b.entries, src)
+			b.size -= size
+		}
+	} else if p, ok := b.pending[from]; ok {
+		file, size = p.name, p.size
+		// a staged copy which becomes an entry is not kept as a staged
+		// copy too, otherwise its bytes would be counted twice
+		if move || b.cacheable(to) {
+			delete(b.pending, from)
+			b.staged -= size
+			b.size -= size
+			move = true
+		}
+	} else {
+		return
+	}
+	if !b.cacheable(to) {
+		if move {
+			os.Remove(file)
+		}
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(b.entryPath(dst)), 0755); err != nil {
+		if move {
+			os.Remove(file)
+		}
+		return
+	}
+	if move {
+		if err := os.Rename(file, b.entryPath(dst)); err != nil {
+			os.Remove(file)
+			return
+		}
+	} else if err := os.Link(file, b.entryPath(dst)); err != nil {
+		return
+	}
+	b.add(dst, size)
+}
+
+func (b *Bucket) forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if el, ok := b.entries[entryName(key)]; ok {
+		b.remove(el)
+	}
+	b.unstage(key)
+}
+
+// unstage must be called with the lock held
+func (b *Bucket) unstage(key string) {
+	if p, ok := b.pending[key]; ok {
+		os.Remove(p.name)
+		delete(b.pending, key)
+		b.staged -= p.size
+		b.size -= p.size
+	}
+}
+
+// add must be called with the lock held
+func (b *Bucket) add(name string, size int64) {
+	if el, ok := b.entries[name]; ok {
+		b.size -= el.Value.(*entry).size
+		b.lru.Remove(el)
+	}
+	b.entries[name] = b.lru.PushFront(&entry{name: name, size: size})
+	b.size += size
+	b.evict()
+}
+
+// evict must be called with the lock held
+func (b *Bucket) evict() {
+	for b.size > b.cfg.maxSize && b.lru.Len() > 0 {
+		b.remove(b.lru.Back())
+		b.stats.Evictions++
+	}
+}
+
+// remove must be called with the lock held
+func (b *Bucket) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	b.lru.Remove(el)
+	delete(b.entries, e.name)
+	b.size -= e.size
+	os.Remove(b.entryPath(e.name))
+}
+
+// load rebuilds the lru list from the entries found on disk,
+// using the modification time to order them
+func (b *Bucket) load() error {
+	type found struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var all []found
+	err := filepath.Walk(b.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == stagingDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		all = append(all, found{name: info.Name(), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.Before(all[j].modTime) })
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range all {
+		b.add(f.name, f.size)
+	}
+	return nil
+}
+
+func (b *Bucket) entryPath(name string) string {
+	return filepath.Join(b.dir, name[:2], name)
+}
+
+func entryName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *failSafeWriter) Write(buf []byte) (int, error) {
+	if f.err == nil {
+		_, f.err = f.actual.Write(buf)
+	}
+	return len(buf), nil
+}
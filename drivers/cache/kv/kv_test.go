@@ -0,0 +1,237 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+	gcloud "github.com/andrebq/dbfs/drivers/gcloud/kv"
+	"github.com/rs/zerolog"
+
+	_ "gocloud.dev/blob/memblob"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dbfs-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// cached returns true if b has an entry for key
+func cached(b *Bucket, key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.entries[entryName(key)]
+	return ok
+}
+
+func memoryBucket(ctx context.Context, t *testing.T) *gcloud.Bucket {
+	bucket, err := gcloud.Connect(ctx, "mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket
+}
+
+func TestConformance(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		// cache every key, otherwise the suite would never
+		// hit the cache
+		return Wrap(memoryBucket(ctx, t), dir, Prefixes(""), WriteThrough(true))
+	})
+}
+
+func TestReadFill(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	remote := memoryBucket(ctx, t)
+	logs := &bytes.Buffer{}
+	b, err := Wrap(remote, dir, Logger(zerolog.New(logs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Write(ctx, "data/obj", bytes.NewBufferString("abc123"))
+	for i := 0; i < 3; i++ {
+		buf := &bytes.Buffer{}
+		if _, err := b.Read(ctx, buf, "data/obj"); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != "abc123" {
+			t.Fatalf("Unexpected content %q", buf.String())
+		}
+	}
+	if s := b.Stats(); s.Hits != 2 || s.Misses != 1 || s.Entries != 1 || s.Size != 6 {
+		t.Errorf("Unexpected stats %#v", s)
+	}
+
+	// remove the object from the remote, the cache must still serve it
+	remote.Delete(ctx, "data/obj")
+	buf := &bytes.Buffer{}
+	if _, err := b.Read(ctx, buf, "data/obj"); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "abc123" {
+		t.Fatalf("Unexpected content %q", buf.String())
+	}
+
+	// keys outside of the configured prefixes are never cached
+	remote.Write(ctx, "refs/main", bytes.NewBufferString("v1"))
+	b.Read(ctx, ioutil.Discard, "refs/main")
+	remote.Write(ctx, "refs/main", bytes.NewBufferString("v2"))
+	buf.Reset()
+	if _, err := b.Read(ctx, buf, "refs/main"); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "v2" {
+		t.Errorf("Mutable keys should not be cached, got %q", buf.String())
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), `"hits":3`) {
+		t.Errorf("Stats should be logged on close, got %v", logs.String())
+	}
+}
+
+func TestWriteThroughMove(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	b, err := Wrap(memoryBucket(ctx, t), dir, WriteThrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) { return b, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := c.PutContent(ctx, bytes.NewBufferString("abc123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.GetContent(ctx, ioutil.Discard, ref); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Stats(); s.Hits != 1 || s.Misses != 0 || s.Entries != 1 {
+		t.Errorf("Objects written by cas should be cached, got %#v", s)
+	}
+
+	// keys outside of the configured prefixes are never cached
+	if _, err := b.Write(ctx, "refs/main", bytes.NewBufferString("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Stats(); s.Entries != 1 || len(b.pending) != 1 {
+		t.Errorf("Mutable keys should not be cached, got %#v", s)
+	}
+	b.Delete(ctx, "refs/main")
+	if len(b.pending) != 0 {
+		t.Errorf("Staged copies should be removed with the key, got %v", b.pending)
+	}
+}
+
+func TestExistsAfterRemoteDelete(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	remote := memoryBucket(ctx, t)
+	b, err := Wrap(remote, dir, WriteThrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) { return b, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := c.PutContent(ctx, bytes.NewBufferString("abc123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "data/" + ref.HexPath(4)
+	if err := remote.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := b.Exists(ctx, key); err != nil || found {
+		t.Fatalf("Objects removed from the remote should not exist, got %v %v", found, err)
+	}
+	if cached(b, key) {
+		t.Error("Entries missing from the remote should be dropped")
+	}
+	// writing again must upload the object
+	if _, err := c.PutContent(ctx, bytes.NewBufferString("abc123")); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := remote.Exists(ctx, key); err != nil || !found {
+		t.Errorf("Object should be uploaded again, got %v %v", found, err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	b, err := Wrap(memoryBucket(ctx, t), dir, WriteThrough(true), MaxSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"data/a", "data/b", "data/c"} {
+		if _, err := b.Write(ctx, k, bytes.NewBufferString("1234")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := b.Stats(); s.Evictions != 1 || s.Size != 8 || s.Entries != 2 {
+		t.Errorf("Unexpected stats %#v", s)
+	}
+	if cached(b, "data/a") {
+		t.Error("Least recently used entry should be evicted")
+	}
+
+	// reopen the cache, entries should survive
+	b, err = Wrap(memoryBucket(ctx, t), dir, MaxSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := b.Read(ctx, buf, "data/c"); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "1234" {
+		t.Errorf("Unexpected content %q", buf.String())
+	}
+	if s := b.Stats(); s.Hits != 1 || s.Entries != 2 {
+		t.Errorf("Unexpected stats after reopen %#v", s)
+	}
+}
+
+func TestStagedSize(t *testing.T) {
+	ctx := context.Background()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	b, err := Wrap(memoryBucket(ctx, t), dir, WriteThrough(true), MaxSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"data/a", "tmp/x", "tmp/y", "tmp/z"} {
+		if _, err := b.Write(ctx, k, bytes.NewBufferString("1234")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := b.Stats(); s.Size != 8 || s.Entries != 0 || len(b.pending) != 2 {
+		t.Errorf("Staged copies should count against the cache size, got %#v and %v staged", s, len(b.pending))
+	}
+	if cached(b, "data/a") {
+		t.Error("Entries should be evicted to make room for staged copies")
+	}
+	if err := b.Move(ctx, "data/x", "tmp/x"); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Stats(); s.Size != 8 || s.Entries != 1 || len(b.pending) != 1 {
+		t.Errorf("Moving a staged copy should not change the cache size, got %#v", s)
+	}
+}
@@ -0,0 +1,15 @@
+// package kv implements a cas.KV which splits every object into
+// data and parity shards (Reed-Solomon), each shard is stored in a
+// different child KV.
+//
+// Objects can be read as long as any k shards (out of k+m) are
+// available, so up to m children can be lost without losing data.
+//
+// Every shard starts with a small header which records the layout
+// used to encode the object and the checksum of the shard, corrupted
+// shards are treated as missing.
+//
+// Writes succeed once data+1 shards are stored, Repair rewrites the
+// shards which children missed and removes leftover shards from
+// objects which can no longer be reconstructed.
+package kv
@@ -0,0 +1,593 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/klauspost/reedsolomon"
+)
+
+type (
+	// Bucket stores shards of every object in its children
+	Bucket struct {
+		children []cas.KV
+		enc      reedsolomon.Encoder
+		data     int
+		parity   int
+		quorum   int
+	}
+
+	// header is written before the content of every shard
+	header struct {
+		Magic  [8]byte
+		Data   uint8
+		Parity uint8
+		Index  uint8
+		Size   uint64
+		// Object is the checksum of the whole object, it is used
+		// to discard shards from a different version of the object
+		Object [sha256.Size]byte
+		Sum    [sha256.Size]byte
+	}
+
+	Option func(b *Bucket) error
+
+	// RepairStats contains the result of a Repair call
+	RepairStats struct {
+		Checked  int `json:"checked" yaml:"checked"`
+		Repaired int `json:"repaired" yaml:"repaired"`
+		Removed  int `json:"removed" yaml:"removed"`
+		Failed   int `json:"failed" yaml:"failed"`
+	}
+
+	countWriter struct {
+		actual io.Writer
+		total  int64
+	}
+)
+
+const (
+	// ErrCorrupted is returned when a shard has an invalid header
+	// or its content does not match the checksum from the header
+	ErrCorrupted = cas.Err("shard is corrupted")
+
+	// ErrNotEnoughShards is returned when an object cannot be read
+	// because too many shards are missing or corrupted
+	ErrNotEnoughShards = cas.Err("not enough shards to reconstruct the object")
+
+	headerMagic = "dbfsec01"
+	maxShards   = 255
+)
+
+var (
+	headerSize = binary.Size(header{})
+)
+
+// WriteQuorum configures how many children must acknowledge a write,
+// copy, move or delete to consider it successful, it must be at least
+// the number of data shards. Deletes always require more than parity
+// children, otherwise the leftover shards could still rebuild the object.
+//
+// The default is data+1, children which missed an operation are fixed
+// by Repair.
+func WriteQuorum(n int) Option {
+	return func(b *Bucket) error {
+		if n < b.data || n > len(b.children) {
+			return fmt.Errorf("write quorum must be between %v and %v, got %v", b.data, len(b.children), n)
+		}
+		b.quorum = n
+		return nil
+	}
+}
+
+// Wrap returns a KV which splits objects into data data shards and
+// parity parity shards, children must contain exactly data+parity
+// items and shard i is always stored at children[i].
+//
+// The order of children must not change between calls, otherwise
+// shards won't match their headers and will be treated as corrupted.
+//
+// Closing the returned bucket also closes all children
+func Wrap(children []cas.KV, data, parity int, options ...Option) (*Bucket, error) {
+	if data < 1 || parity < 0 || data+parity > maxShards {
+		return nil, fmt.Errorf("invalid layout %v+%v", data, parity)
+	}
+	if len(children) != data+parity {
+		return nil, fmt.Errorf("layout %v+%v requires %v children, got %v", data, parity, data+parity, len(children))
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bucket{
+		children: children,
+		enc:      enc,
+		data:     data,
+		parity:   parity,
+		quorum:   data + 1,
+	}
+	if b.quorum > len(children) {
+		b.quorum = len(children)
+	}
+	for _, opt := range options {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Close closes all children
+func (b *Bucket) Close() error {
+	var firstErr error
+	for _, c := range b.children {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Write encodes input and writes each shard to its child, the whole
+// object is kept in memory while it is encoded.
+func (b *Bucket) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return 0, err
+	}
+	shards, err := b.encode(content)
+	if err != nil {
+		return 0, fmt.Errorf("unable to encode %v, cause: %w", key, err)
+	}
+	err = b.fanOut("write", key, b.quorum, func(i int, c cas.KV) error {
+		_, err := c.Write(ctx, key, bytes.NewBuffer(shards[i]))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(content)), nil
+}
+
+// Read fetches the shards from all children and reconstructs
+// the original object
+func (b *Bucket) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	shards, headers, errs := b.readShards(ctx, key)
+	size, available := pickVersion(shards, headers)
+	if available < b.data {
+		return 0, b.readErr(key, errs, available)
+	}
+	if size == 0 {
+		return 0, nil
+	}
+	if available < len(shards) {
+		if err := b.enc.ReconstructData(shards); err != nil {
+			return 0, cas.NewKVError(ErrCorrupted, "read", key, err)
+		}
+	}
+	cw := &countWriter{actual: w}
+	err := b.enc.Join(cw, shards, int(size))
+	return cw.total, err
+}
+
+// Exists returns true if enough shards exist to reconstruct the object
+func (b *Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	found := make([]bool, len(b.children))
+	errs := b.each(func(i int, c cas.KV) error {
+		var err error
+		found[i], err = c.Exists(ctx, key)
+		return err
+	})
+	var count, failed int
+	var firstErr error
+	for i := range found {
+		if errs[i] != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+		} else if found[i] {
+			count++
+		}
+	}
+	if count >= b.data {
+		return true, nil
+	}
+	if count+failed >= b.data {
+		// the answer depends on the children which failed
+		return false, firstErr
+	}
+	return false, nil
+}
+
+// ModTime returns the newest modification time among the
+// shards of key
+func (b *Bucket) ModTime(ctx context.Context, key string) (time.Time, error) {
+	times := make([]time.Time, len(b.children))
+	errs := b.each(func(i int, c cas.KV) error {
+		mt, ok := c.(cas.ModTimer)
+		if !ok {
+			return cas.ErrNotSupported
+		}
+		var err error
+		times[i], err = mt.ModTime(ctx, key)
+		return err
+	})
+	return newest(times, errs)
+}
+
+// Delete removes the shards from every child, it succeeds once enough
+// shards are removed to make the object unreadable.
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	quorum := b.quorum
+	if quorum <= b.parity {
+		quorum = b.parity + 1
+	}
+	return b.fanOut("delete", key, quorum, func(_ int, c cas.KV) error {
+		err := c.Delete(ctx, key)
+		if errors.Is(err, cas.ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (b *Bucket) Copy(ctx context.Context, to, from string) error {
+	return b.fanOut("copy", from, b.quorum, func(_ int, c cas.KV) error {
+		return c.Copy(ctx, to, from)
+	})
+}
+
+// Move moves every shard, using cas.Mover when the child
+// implements it
+func (b *Bucket) Move(ctx context.Context, to, from string) error {
+	return b.fanOut("move", from, b.quorum, func(_ int, c cas.KV) error {
+		if mover, ok := c.(cas.Mover); ok {
+			return mover.Move(ctx, to, from)
+		}
+		if err := c.Copy(ctx, to, from); err != nil {
+			return err
+		}
+		return c.Delete(ctx, from)
+	})
+}
+
+// List returns the union of the keys from all children
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	seen := make(map[string]struct{})
+	var listed bool
+	for _, c := range b.children {
+		lister, ok := c.(cas.Lister)
+		if !ok {
+			continue
+		}
+		listed = true
+		err := lister.List(ctx, prefix, func(key string) error {
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+			return fn(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !listed {
+		return cas.ErrNotSupported
+	}
+	return nil
+}
+
+// Repair lists the keys under prefix from every child and fixes objects
+// whose shards are missing, corrupted or stale. Objects which can be
+// reconstructed have their shards written again, leftover shards from
+// objects which cannot be reconstructed (eg.: a delete which did not
+// reach every child) are removed.
+//
+// Repair must not run while objects under prefix are being written,
+// otherwise a partial write could be mistaken for a leftover.
+//
+// All children must implement cas.Lister
+func (b *Bucket) Repair(ctx context.Context, prefix string) (RepairStats, error) {
+	var stats RepairStats
+	keys := make(map[string]struct{})
+	for i, c := range b.children {
+		lister, ok := c.(cas.Lister)
+		if !ok {
+			return stats, fmt.Errorf("child %v cannot list objects, cause: %w", i, cas.ErrNotSupported)
+		}
+		err := lister.List(ctx, prefix, func(key string) error {
+			keys[key] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("unable to list child %v, cause: %w", i, err)
+		}
+	}
+	for key := range keys {
+		stats.Checked++
+		removed, repaired, err := b.repair(ctx, key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			stats.Failed++
+			continue
+		}
+		stats.Removed += removed
+		stats.Repaired += repaired
+	}
+	return stats, nil
+}
+
+// repair fixes the shards of key and returns how many objects were
+// removed and how many shards were written
+func (b *Bucket) repair(ctx context.Context, key string) (int, int, error) {
+	shards, headers, errs := b.readShards(ctx, key)
+	size, available := pickVersion(shards, headers)
+	if available < b.data {
+		for _, err := range errs {
+			if err != nil && !errors.Is(err, cas.ErrNotFound) && !errors.Is(err, ErrCorrupted) {
+				// the missing shards might still exist
+				return 0, 0, err
+			}
+		}
+		err := b.fanOut("delete", key, len(b.children), func(_ int, c cas.KV) error {
+			err := c.Delete(ctx, key)
+			if errors.Is(err, cas.ErrNotFound) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		return 1, 0, nil
+	}
+	if available == len(shards) {
+		return 0, 0, nil
+	}
+	if err := b.enc.ReconstructData(shards); err != nil {
+		return 0, 0, cas.NewKVError(ErrCorrupted, "repair", key, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.enc.Join(buf, shards, int(size)); err != nil {
+		return 0, 0, err
+	}
+	encoded, err := b.encode(buf.Bytes())
+	if err != nil {
+		return 0, 0, err
+	}
+	var repaired int
+	for i, s := range shards {
+		if s != nil {
+			continue
+		}
+		if _, err := b.children[i].Write(ctx, key, bytes.NewBuffer(encoded[i])); err != nil {
+			return 0, repaired, err
+		}
+		repaired++
+	}
+	return 0, repaired, nil
+}
+
+// readShards reads and validates the shards of key from all children,
+// missing or invalid shards are nil and their error is indexed by child
+func (b *Bucket) readShards(ctx context.Context, key string) ([][]byte, []header, []error) {
+	shards := make([][]byte, len(b.children))
+	headers := make([]header, len(b.children))
+	errs := b.each(func(i int, c cas.KV) error {
+		buf := &bytes.Buffer{}
+		if _, err := c.Read(ctx, buf, key); err != nil {
+			return err
+		}
+		h, shard, err := b.decodeShard(i, buf.Bytes())
+		if err != nil {
+			return cas.NewKVError(ErrCorrupted, "read", key, err)
+		}
+		shards[i], headers[i] = shard, h
+		return nil
+	})
+	return shards, headers, errs
+}
+
+// encode returns the shards for content, including their headers
+func (b *Bucket) encode(content []byte) ([][]byte, error) {
+	data := content
+	if len(data) == 0 {
+		// the encoder cannot split empty objects, the header
+		// keeps the actual size so this byte is never returned
+		data = []byte{0}
+	}
+	shards, err := b.enc.Split(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(shards))
+	object := sha256.Sum256(content)
+	for i, s := range shards {
+		h := header{
+			Data:   uint8(b.data),
+			Parity: uint8(b.parity),
+			Index:  uint8(i),
+			Size:   uint64(len(content)),
+			Object: object,
+			Sum:    sha256.Sum256(s),
+		}
+		copy(h.Magic[:], headerMagic)
+		buf := bytes.NewBuffer(make([]byte, 0, headerSize+len(s)))
+		if err := binary.Write(buf, binary.BigEndian, &h); err != nil {
+			return nil, err
+		}
+		buf.Write(s)
+		out[i] = buf.Bytes()
+	}
+	return out, nil
+}
+
+// decodeShard validates the header of a shard read from child idx
+func (b *Bucket) decodeShard(idx int, raw []byte) (header, []byte, error) {
+	var h header
+	if len(raw) < headerSize {
+		return h, nil, errors.New("shard is smaller than its header")
+	}
+	if err := binary.Read(bytes.NewReader(raw[:headerSize]), binary.BigEndian, &h); err != nil {
+		return h, nil, err
+	}
+	if string(h.Magic[:]) != headerMagic {
+		return h, nil, errors.New("invalid shard header")
+	}
+	if int(h.Data) != b.data || int(h.Parity) != b.parity || int(h.Index) != idx {
+		return h, nil, fmt.Errorf("shard layout %v+%v index %v does not match %v+%v index %v",
+			h.Data, h.Parity, h.Index, b.data, b.parity, idx)
+	}
+	shard := raw[headerSize:]
+	if sha256.Sum256(shard) != h.Sum {
+		return h, nil, errors.New("shard checksum mismatch")
+	}
+	return h, shard, nil
+}
+
+// pickVersion keeps only the shards which belong to the version of the
+// object with more shards available, shards from other versions
+// (eg.: a child which missed an overwrite) are discarded.
+//
+// It returns the size of the object and how many shards are available
+func pickVersion(shards [][]byte, headers []header) (uint64, int) {
+	votes := make(map[[sha256.Size]byte]int)
+	var best [sha256.Size]byte
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		votes[headers[i].Object]++
+		if votes[headers[i].Object] > votes[best] {
+			best = headers[i].Object
+		}
+	}
+	var size uint64
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		if headers[i].Object != best {
+			shards[i] = nil
+			continue
+		}
+		size = headers[i].Size
+	}
+	return size, votes[best]
+}
+
+// readErr returns the error reported when less than data
+// shards are available
+func (b *Bucket) readErr(key string, errs []error, available int) error {
+	var notFound int
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		if errors.Is(err, cas.ErrNotFound) {
+			notFound++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if notFound == len(b.children) {
+		return cas.NewKVError(cas.ErrNotFound, "read", key, errs[0])
+	}
+	if firstErr == nil {
+		firstErr = errs[0]
+	}
+	return cas.NewKVError(ErrNotEnoughShards, "read", key,
+		fmt.Errorf("%v of %v required shards available, first error: %w", available, b.data, firstErr))
+}
+
+// fanOut runs fn on all children and returns an error if less
+// than quorum children succeeded
+func (b *Bucket) fanOut(op, key string, quorum int, fn func(int, cas.KV) error) error {
+	errs := b.each(fn)
+	var ok, notFound int
+	var firstErr error
+	for _, err := range errs {
+		if err == nil {
+			ok++
+			continue
+		}
+		if errors.Is(err, cas.ErrNotFound) {
+			notFound++
+		}
+		if firstErr == nil || errors.Is(firstErr, cas.ErrNotFound) {
+			firstErr = err
+		}
+	}
+	if ok >= quorum {
+		return nil
+	}
+	if notFound == len(b.children) {
+		return firstErr
+	}
+	return fmt.Errorf("%v %v: quorum not reached, %v of %v shards succeeded, cause: %w", op, key, ok, quorum, firstErr)
+}
+
+// each runs fn concurrently on all children and returns the errors
+// indexed by child
+func (b *Bucket) each(fn func(int, cas.KV) error) []error {
+	errs := make([]error, len(b.children))
+	var wg sync.WaitGroup
+	for i, c := range b.children {
+		wg.Add(1)
+		go func(i int, c cas.KV) {
+			defer wg.Done()
+			errs[i] = fn(i, c)
+		}(i, c)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (c *countWriter) Write(buf []byte) (int, error) {
+	n, err := c.actual.Write(buf)
+	c.total += int64(n)
+	return n, err
+}
+
+// newest returns the latest of times, skipping the entries whose
+// error matches cas.ErrNotFound. Any other error is returned, since
+// the copy which could not be checked might be the newest one
+func newest(times []time.Time, errs []error) (time.Time, error) {
+	var latest time.Time
+	var found bool
+	for i, err := range errs {
+		if errors.Is(err, cas.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return time.Time{}, err
+		}
+		found = true
+		if times[i].After(latest) {
+			latest = times[i]
+		}
+	}
+	if !found {
+		return time.Time{}, errs[0]
+	}
+	return latest, nil
+}
@@ -0,0 +1,205 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+	gcloud "github.com/andrebq/dbfs/drivers/gcloud/kv"
+
+	_ "gocloud.dev/blob/memblob"
+)
+
+type (
+	// lostKV simulates a backend which is not reachable
+	lostKV struct {
+		cas.KV
+	}
+)
+
+var errLost = cas.NewKVError(cas.ErrTransient, "test", "", errors.New("connection refused"))
+
+func (lostKV) Read(context.Context, io.Writer, string) (int64, error)  { return 0, errLost }
+func (lostKV) Exists(context.Context, string) (bool, error)            { return false, errLost }
+func (lostKV) Write(context.Context, string, io.Reader) (int64, error) { return 0, errLost }
+func (lostKV) Delete(context.Context, string) error                    { return errLost }
+
+func memoryBuckets(ctx context.Context, t *testing.T, n int) []cas.KV {
+	var buckets []cas.KV
+	for i := 0; i < n; i++ {
+		b, err := gcloud.Connect(ctx, "mem://")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+func randomContent(size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(buf)
+	return buf
+}
+
+func TestConformance(t *testing.T) {
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		return Wrap(memoryBuckets(ctx, t, 6), 4, 2)
+	})
+}
+
+func TestLostBackends(t *testing.T) {
+	ctx := context.Background()
+	children := memoryBuckets(ctx, t, 6)
+	b, err := Wrap(children, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := randomContent(100_003)
+	if _, err := b.Write(ctx, "obj", bytes.NewBuffer(content)); err != nil {
+		t.Fatal(err)
+	}
+	// every shard is smaller than the object
+	for i, c := range children {
+		buf := &bytes.Buffer{}
+		c.Read(ctx, buf, "obj")
+		if buf.Len() >= len(content)/2 {
+			t.Errorf("Shard %v is too large: %v bytes", i, buf.Len())
+		}
+	}
+
+	// lose one backend and corrupt another
+	children[0].Write(ctx, "obj", bytes.NewBufferString("bit rot"))
+	b.children[3] = lostKV{KV: children[3]}
+	buf := &bytes.Buffer{}
+	n, err := b.Read(ctx, buf, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) || !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Object was not reconstructed, got %v bytes", n)
+	}
+	if exists, err := b.Exists(ctx, "obj"); err != nil || !exists {
+		t.Errorf("Object should exist with %v shards, got %v %v", 4, exists, err)
+	}
+
+	// one more failure and the object is lost
+	children[5].Delete(ctx, "obj")
+	_, err = b.Read(ctx, &bytes.Buffer{}, "obj")
+	if !errors.Is(err, ErrNotEnoughShards) {
+		t.Errorf("Expecting ErrNotEnoughShards got %v", err)
+	}
+}
+
+func TestStaleShards(t *testing.T) {
+	ctx := context.Background()
+	children := memoryBuckets(ctx, t, 3)
+	b, err := Wrap(children, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := randomContent(1000)
+	b.Write(ctx, "obj", bytes.NewBuffer(old))
+	stale := &bytes.Buffer{}
+	children[1].Read(ctx, stale, "obj")
+
+	updated := randomContent(1001)
+	b.Write(ctx, "obj", bytes.NewBuffer(updated))
+	// simulate a child which missed the last write
+	children[1].Write(ctx, "obj", stale)
+
+	buf := &bytes.Buffer{}
+	if _, err := b.Read(ctx, buf, "obj"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), updated) {
+		t.Error("Shards from an older version should be ignored")
+	}
+}
+
+func TestCAS(t *testing.T) {
+	ctx := context.Background()
+	store, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return Wrap(memoryBuckets(ctx, t, 5), 3, 2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	content := randomContent(1_000_000)
+	ref, err := store.PutContent(ctx, bytes.NewBuffer(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := store.GetContent(ctx, buf, ref); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Error("Unexpected content")
+	}
+}
+
+func TestInvalidLayout(t *testing.T) {
+	ctx := context.Background()
+	if _, err := Wrap(memoryBuckets(ctx, t, 3), 4, 2); err == nil {
+		t.Error("Layout must match the number of children")
+	}
+	if _, err := Wrap(memoryBuckets(ctx, t, 3), 2, 1, WriteQuorum(1)); err == nil {
+		t.Error("Write quorum cannot be less than the number of data shards")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	children := memoryBuckets(ctx, t, 5)
+	b, err := Wrap(append([]cas.KV(nil), children...), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := randomContent(10_000)
+	// a child which is down misses the write and the delete,
+	// both succeed with the default quorum
+	b.children[4] = lostKV{KV: children[4]}
+	if _, err := b.Write(ctx, "data/kept", bytes.NewBuffer(content)); err != nil {
+		t.Fatal(err)
+	}
+	b.children[4] = children[4]
+	if _, err := b.Write(ctx, "data/deleted", bytes.NewBuffer(content)); err != nil {
+		t.Fatal(err)
+	}
+	b.children[3] = lostKV{KV: children[3]}
+	if err := b.Delete(ctx, "data/deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(ctx, &bytes.Buffer{}, "data/deleted"); err == nil {
+		t.Fatal("Deleted object should not be readable")
+	}
+	b.children[3] = children[3]
+
+	stats, err := b.Repair(ctx, "data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (RepairStats{Checked: 2, Repaired: 1, Removed: 1}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	for i, c := range children {
+		if exists, _ := c.Exists(ctx, "data/deleted"); exists {
+			t.Errorf("Child %v still has a leftover shard", i)
+		}
+	}
+	// the repaired shard is enough to read the object with
+	// parity children lost
+	b.children[0] = lostKV{KV: children[0]}
+	b.children[1] = lostKV{KV: children[1]}
+	buf := &bytes.Buffer{}
+	if _, err := b.Read(ctx, buf, "data/kept"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Error("Unexpected content after repair")
+	}
+}
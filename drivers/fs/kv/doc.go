@@ -0,0 +1,9 @@
+// package kv implements the cas.KV interface directly on top of
+// a local directory
+//
+// Every key is a file below the root directory. Writes go to a
+// temporary file which is renamed once complete, so readers never
+// see partial objects. Conditional writes (cas.ConditionalWriter)
+// take a lock file next to the key before the rename, the lock is
+// created (or taken over when stale) with an atomic link or rename.
+package kv
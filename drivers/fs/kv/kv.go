@@ -0,0 +1,440 @@
+package kv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// Bucket stores keys as files below a root directory
+	Bucket struct {
+		root string
+		cfg  config
+	}
+
+	config struct {
+		lockTimeout time.Duration
+		dirMode     os.FileMode
+		fileMode    os.FileMode
+	}
+
+	Option func(cfg *config) error
+
+	// ctxReader fails reads once ctx is done
+	ctxReader struct {
+		ctx    context.Context
+		actual io.Reader
+	}
+)
+
+const (
+	// DefaultLockTimeout is the age after which a lock file
+	// is considered abandoned by a crashed writer
+	DefaultLockTimeout = 30 * time.Second
+
+	// hiddenMarker is part of the name of temporary and lock files,
+	// which are never reported as keys
+	hiddenMarker = ".dbfs-"
+	lockSuffix   = hiddenMarker + "lock"
+	breakSuffix  = "-break"
+	lockPoll     = 10 * time.Millisecond
+)
+
+// LockTimeout configures when a lock file left behind by
+// a conditional write is removed by another writer
+func LockTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return fmt.Errorf("lock timeout must be positive got %v", d)
+		}
+		cfg.lockTimeout = d
+		return nil
+	}
+}
+
+// Open returns a bucket which stores its keys below root,
+// root is created if it does not exist
+func Open(root string, options ...Option) (*Bucket, error) {
+	cfg := config{
+		lockTimeout: DefaultLockTimeout,
+		dirMode:     0755,
+		fileMode:    0644,
+	}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, cfg.dirMode); err != nil {
+		return nil, err
+	}
+	return &Bucket{root: root, cfg: cfg}, nil
+}
+
+func (b *Bucket) Close() error { return nil }
+
+func (b *Bucket) Copy(ctx context.Context, to, from string) error {
+	src, err := b.path(from)
+	if err != nil {
+		return err
+	}
+	fd, err := os.Open(src)
+	if err != nil {
+		return classify("copy", from, err)
+	}
+	defer fd.Close()
+	_, err = b.Write(ctx, to, fd)
+	return err
+}
+
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	file, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return classify("delete", key, err)
+}
+
+func (b *Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	file, err := b.path(key)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, classify("exists", key, err)
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+// ModTime returns the modification time of the file holding key
+func (b *Bucket) ModTime(ctx context.Context, key string) (time.Time, error) {
+	file, err := b.path(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, classify("stat", key, err)
+	}
+	return info.ModTime(), nil
+}
+
+func (b *Bucket) Move(ctx context.Context, to, from string) error {
+	src, err := b.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := b.path(to)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return classify("move", from, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), b.cfg.dirMode); err != nil {
+		return classify("move", to, err)
+	}
+	return classify("move", from, os.Rename(src, dst))
+}
+
+func (b *Bucket) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	file, err := b.path(key)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return 0, classify("read", key, err)
+	}
+	defer fd.Close()
+	n, err := io.Copy(w, &ctxReader{ctx: ctx, actual: fd})
+	return n, classify("read", key, err)
+}
+
+func (b *Bucket) ReadRange(ctx context.Context, w io.Writer, key string, offset, length int64) (int64, error) {
+	file, err := b.path(key)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return 0, classify("read", key, err)
+	}
+	defer fd.Close()
+	n, err := io.Copy(w, &ctxReader{ctx: ctx, actual: io.NewSectionReader(fd, offset, length)})
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, classify("read", key, err)
+}
+
+// Write stores the content in a temporary file which is renamed
+// to key once all content is written
+func (b *Bucket) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	file, err := b.path(key)
+	if err != nil {
+		return 0, err
+	}
+	tmp, n, err := b.writeTemp(ctx, file, input)
+	if err != nil {
+		return 0, classify("write", key, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return 0, classify("write", key, err)
+	}
+	return n, nil
+}
+
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	// walk only the directory which contains every key with prefix
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	start := b.root
+	if dir != "." && dir != "/" {
+		var err error
+		if start, err = b.path(dir); err != nil {
+			return err
+		}
+	}
+	err := filepath.Walk(start, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.Contains(info.Name(), hiddenMarker) {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(key)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ReadVersion returns the sha256 of the content as its version
+func (b *Bucket) ReadVersion(ctx context.Context, w io.Writer, key string) (string, error) {
+	h := sha256.New()
+	if _, err := b.Read(ctx, io.MultiWriter(w, h), key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteIf holds a lock file next to key while the current version
+// is checked and the new content is renamed over the old one
+func (b *Bucket) WriteIf(ctx context.Context, key string, input io.Reader, version string) (string, error) {
+	file, err := b.path(key)
+	if err != nil {
+		return "", err
+	}
+	// the content is written before the lock is taken,
+	// to keep the lock for the shortest time possible
+	h := sha256.New()
+	tmp, _, err := b.writeTemp(ctx, file, io.TeeReader(input, h))
+	if err != nil {
+		return "", classify("write", key, err)
+	}
+	defer os.Remove(tmp)
+	unlock, err := b.lock(ctx, file)
+	if err != nil {
+		return "", classify("write", key, err)
+	}
+	defer unlock()
+	current, err := b.ReadVersion(ctx, ioutil.Discard, key)
+	if errors.Is(err, cas.ErrNotFound) {
+		current, err = "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		return "", cas.NewKVError(cas.ErrPreconditionFailed, "write", key,
+			fmt.Errorf("expecting version %q found %q", version, current))
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return "", classify("write", key, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lock takes the lock file for file, waiting for other writers
+// to release it.
+//
+// A new lock file is hard linked to the lock name, which fails if
+// the lock is held. Locks older than the lock timeout are taken over
+// by renaming the new lock file over them, see takeOver
+func (b *Bucket) lock(ctx context.Context, file string) (func(), error) {
+	name := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+lockSuffix)
+	fd, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+hiddenMarker+"lock-")
+	if err != nil {
+		return nil, err
+	}
+	own := fd.Name()
+	fd.Close()
+	defer os.Remove(own)
+	ownInfo, err := os.Stat(own)
+	if err != nil {
+		return nil, err
+	}
+	unlock := func() {
+		// a lock which was taken over by another writer is not removed
+		if info, err := os.Stat(name); err == nil && os.SameFile(info, ownInfo) {
+			os.Remove(name)
+		}
+	}
+	for {
+		err := os.Link(own, name)
+		if err == nil {
+			return unlock, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+		if ok, err := b.takeOver(name, own); err != nil {
+			return nil, err
+		} else if ok {
+			return unlock, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// takeOver replaces the lock at name with own if the lock is stale.
+//
+// Only the writer which links own to the break file can take over the
+// lock, the others keep waiting and then find a fresh lock. A break
+// file is only removed by someone else if the writer holding it did not
+// finish the take over within the lock timeout
+func (b *Bucket) takeOver(name, own string) (bool, error) {
+	if !b.stale(name) {
+		return false, nil
+	}
+	brk := name + breakSuffix
+	if err := os.Link(own, brk); os.IsExist(err) {
+		if b.stale(brk) {
+			os.Remove(brk)
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer os.Remove(brk)
+	// the lock might have been released, or taken over,
+	// before the break file was linked
+	if !b.stale(name) {
+		return false, nil
+	}
+	if err := os.Rename(own, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *Bucket) stale(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && time.Since(info.ModTime()) > b.cfg.lockTimeout
+}
+
+// writeTemp writes input to a temporary file in the same directory
+// as file, so it can be renamed to file
+func (b *Bucket) writeTemp(ctx context.Context, file string, input io.Reader) (string, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), b.cfg.dirMode); err != nil {
+		return "", 0, err
+	}
+	fd, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+hiddenMarker+"tmp-")
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := io.Copy(fd, &ctxReader{ctx: ctx, actual: input})
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(fd.Name(), b.cfg.fileMode)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", 0, err
+	}
+	return fd.Name(), n, nil
+}
+
+// path returns the file used to store key, keys
+// cannot escape the root directory
+func (b *Bucket) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || strings.Contains(key, "\\") || (clean != "/"+key && clean+"/" != "/"+key) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(b.root, filepath.FromSlash(clean)), nil
+}
+
+func (r *ctxReader) Read(buf []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.actual.Read(buf)
+}
+
+// classify maps file system errors into one of the cas.Err kinds
+func classify(op, key string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return err
+	case os.IsNotExist(err):
+		return cas.NewKVError(cas.ErrNotFound, op, key, err)
+	case os.IsPermission(err):
+		return cas.NewKVError(cas.ErrPermissionDenied, op, key, err)
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dbfs-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestConformance(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		return Open(dir)
+	})
+}
+
+func TestInvalidKeys(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	b, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "../escape", "a/../../b", "/abs", "a\\b"} {
+		if _, err := b.Write(context.Background(), key, bytes.NewBufferString("x")); err == nil {
+			t.Errorf("Write on %q should fail", key)
+		}
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	b, err := Open(dir, LockTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	lock := filepath.Join(dir, ".ref"+lockSuffix)
+	if err := ioutil.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.WriteIf(short, "ref", bytes.NewBufferString("x"), ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WriteIf should wait for the lock, got %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WriteIf(ctx, "ref", bytes.NewBufferString("x"), ""); err != nil {
+		t.Errorf("WriteIf should remove a stale lock, got %v", err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("Lock should be removed after WriteIf, got %v", err)
+	}
+}
+
+func TestStaleLockTakeOver(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	b, err := Open(dir, LockTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	lock := filepath.Join(dir, ".ref"+lockSuffix)
+	if err := ioutil.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// every writer sees the stale lock, only one of them
+	// can create the ref
+	const writers = 16
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			_, err := b.WriteIf(ctx, "ref", bytes.NewBufferString(strconv.Itoa(i)), "")
+			errs <- err
+		}(i)
+	}
+	var written int
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err == nil {
+			written++
+		} else if !errors.Is(err, cas.ErrPreconditionFailed) {
+			t.Errorf("WriteIf should fail with a precondition error, got %v", err)
+		}
+	}
+	if written != 1 {
+		t.Errorf("Only one writer should take over the lock, got %v", written)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("Lock should be removed after WriteIf, got %v", err)
+	}
+}
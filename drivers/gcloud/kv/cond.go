@@ -0,0 +1,140 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/andrebq/dbfs/cas"
+	"gocloud.dev/blob"
+)
+
+// CheckConditionalWrites returns cas.ErrNotSupported unless
+// the bucket is a gs:// or mem:// bucket
+func (b *Bucket) CheckConditionalWrites() error {
+	switch b.scheme {
+	case "gs", "mem":
+		return nil
+	}
+	return fmt.Errorf("conditional writes are not available for %v:// buckets, cause: %w", b.scheme, cas.ErrNotSupported)
+}
+
+// ReadVersion returns the object generation on gs:// buckets,
+// mem:// buckets use the hash of the content
+func (b *Bucket) ReadVersion(ctx context.Context, w io.Writer, key string) (string, error) {
+	switch b.scheme {
+	case "gs":
+		return b.readGeneration(ctx, w, key)
+	case "mem":
+		b.condLock.Lock()
+		defer b.condLock.Unlock()
+		return b.readHash(ctx, w, key)
+	}
+	return "", cas.NewKVError(cas.ErrNotSupported, "read", key,
+		fmt.Errorf("conditional writes are not available for %v:// buckets", b.scheme))
+}
+
+// WriteIf uses generation preconditions on gs:// buckets. mem:// buckets
+// are only visible to this process, so a lock is enough
+func (b *Bucket) WriteIf(ctx context.Context, key string, input io.Reader, version string) (string, error) {
+	switch b.scheme {
+	case "gs":
+		return b.writeGeneration(ctx, key, input, version)
+	case "mem":
+		b.condLock.Lock()
+		defer b.condLock.Unlock()
+		current, err := b.readHash(ctx, ioutil.Discard, key)
+		if errors.Is(err, cas.ErrNotFound) {
+			current, err = "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if current != version {
+			return "", cas.NewKVError(cas.ErrPreconditionFailed, "write", key,
+				fmt.Errorf("expecting version %q found %q", version, current))
+		}
+		buf := &bytes.Buffer{}
+		if _, err := b.Write(ctx, key, io.TeeReader(input, buf)); err != nil {
+			return "", err
+		}
+		return contentVersion(buf.Bytes()), nil
+	}
+	return "", cas.NewKVError(cas.ErrNotSupported, "write", key,
+		fmt.Errorf("conditional writes are not available for %v:// buckets", b.scheme))
+}
+
+func (b *Bucket) readHash(ctx context.Context, w io.Writer, key string) (string, error) {
+	buf := &bytes.Buffer{}
+	if _, err := b.Read(ctx, buf, key); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return contentVersion(buf.Bytes()), nil
+}
+
+func (b *Bucket) readGeneration(ctx context.Context, w io.Writer, key string) (string, error) {
+	reader, err := b.actual.NewReader(ctx, key, nil)
+	if err != nil {
+		return "", classify("read", key, err)
+	}
+	defer reader.Close()
+	var sr *storage.Reader
+	if !reader.As(&sr) {
+		return "", fmt.Errorf("unable to access the storage.Reader of %v", key)
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		return "", classify("read", key, err)
+	}
+	return strconv.FormatInt(sr.Attrs.Generation, 10), nil
+}
+
+func (b *Bucket) writeGeneration(ctx context.Context, key string, input io.Reader, version string) (string, error) {
+	cond := storage.Conditions{DoesNotExist: true}
+	if version != "" {
+		gen, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid generation %q, cause: %w", version, err)
+		}
+		cond = storage.Conditions{GenerationMatch: gen}
+	}
+	var sw *storage.Writer
+	writer, err := b.actual.NewWriter(ctx, key, &blob.WriterOptions{
+		BeforeWrite: func(as func(interface{}) bool) error {
+			var oh **storage.ObjectHandle
+			if !as(&oh) {
+				return errors.New("unable to access the storage.ObjectHandle")
+			}
+			*oh = (*oh).If(cond)
+			if !as(&sw) {
+				return errors.New("unable to access the storage.Writer")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return "", classify("write", key, err)
+	}
+	if _, err := io.Copy(writer, input); err != nil {
+		writer.Close()
+		return "", classify("write", key, err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", classify("write", key, err)
+	}
+	return strconv.FormatInt(sw.Attrs().Generation, 10), nil
+}
+
+func contentVersion(content []byte) string {
+	h := sha256.Sum256(content)
+	return hex.EncodeToString(h[:])
+}
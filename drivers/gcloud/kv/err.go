@@ -0,0 +1,42 @@
+package kv
+
+import (
+	"context"
+	"errors"
+
+	"github.com/andrebq/dbfs/cas"
+	"gocloud.dev/gcerrors"
+)
+
+// classify maps errors returned by Go Cloud into one of the
+// cas.Err kinds, errors which cannot be classified are returned
+// without any change.
+//
+// Context cancellation is never classified, otherwise callers
+// could end up retrying an operation that was explicitly aborted
+func classify(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if kind := codeKind(gcerrors.Code(err)); kind != "" {
+		return cas.NewKVError(kind, op, key, err)
+	}
+	return err
+}
+
+func codeKind(code gcerrors.ErrorCode) cas.Err {
+	switch code {
+	case gcerrors.NotFound:
+		return cas.ErrNotFound
+	case gcerrors.PermissionDenied:
+		return cas.ErrPermissionDenied
+	case gcerrors.FailedPrecondition:
+		return cas.ErrPreconditionFailed
+	case gcerrors.ResourceExhausted, gcerrors.DeadlineExceeded, gcerrors.Internal:
+		return cas.ErrTransient
+	}
+	return ""
+}
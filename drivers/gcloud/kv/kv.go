@@ -2,49 +2,111 @@ package kv
 
 import (
 	"context"
+	"errors"
 	"io"
+	"net/url"
+	"sync"
+	"time"
 
+	"github.com/andrebq/dbfs/cas"
 	"gocloud.dev/blob"
 )
 
 type (
 	Bucket struct {
 		actual *blob.Bucket
+		scheme string
+
+		// condLock serializes conditional writes on buckets which
+		// only live inside this process (mem://)
+		condLock sync.Mutex
 	}
 )
 
 // Connect to a Go Cloud blob bucket
-func Connect(ctx context.Context, url string) (*Bucket, error) {
-	bucket, err := blob.OpenBucket(ctx, url)
+func Connect(ctx context.Context, bucketURL string) (*Bucket, error) {
+	u, err := url.Parse(bucketURL)
 	if err != nil {
 		return nil, err
 	}
-	return &Bucket{actual: bucket}, nil
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{actual: bucket, scheme: u.Scheme}, nil
 }
 
 func (b *Bucket) Close() error { return b.actual.Close() }
 func (b *Bucket) Copy(ctx context.Context, to, from string) error {
-	return b.actual.Copy(ctx, to, from, nil)
+	return classify("copy", from, b.actual.Copy(ctx, to, from, nil))
 }
 func (b *Bucket) Delete(ctx context.Context, key string) error {
-	return b.actual.Delete(ctx, key)
+	return classify("delete", key, b.actual.Delete(ctx, key))
 }
 func (b *Bucket) Write(ctx context.Context, path string, input io.Reader) (int64, error) {
 	writer, err := b.actual.NewWriter(ctx, path, nil)
 	if err != nil {
-		return 0, err
+		return 0, classify("write", path, err)
 	}
-	defer writer.Close()
-	return io.Copy(writer, input)
+	n, err := io.Copy(writer, input)
+	if err != nil {
+		writer.Close()
+		return n, classify("write", path, err)
+	}
+	// the object is only commited once the writer is closed
+	// so errors from Close must be reported to the caller
+	return n, classify("write", path, writer.Close())
 }
 func (b *Bucket) Read(ctx context.Context, w io.Writer, path string) (int64, error) {
 	reader, err := b.actual.NewReader(ctx, path, nil)
 	if err != nil {
-		return 0, err
+		return 0, classify("read", path, err)
 	}
 	defer reader.Close()
-	return io.Copy(w, reader)
+	n, err := io.Copy(w, reader)
+	return n, classify("read", path, err)
+}
+func (b *Bucket) ReadRange(ctx context.Context, w io.Writer, path string, offset, length int64) (int64, error) {
+	reader, err := b.actual.NewRangeReader(ctx, path, offset, length, nil)
+	if err != nil {
+		return 0, classify("read", path, err)
+	}
+	defer reader.Close()
+	n, err := io.Copy(w, reader)
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, classify("read", path, err)
 }
 func (b *Bucket) Exists(ctx context.Context, path string) (bool, error) {
-	return b.actual.Exists(ctx, path)
+	exists, err := b.actual.Exists(ctx, path)
+	err = classify("exists", path, err)
+	if errors.Is(err, cas.ErrNotFound) {
+		return false, nil
+	}
+	return exists, err
+}
+func (b *Bucket) ModTime(ctx context.Context, path string) (time.Time, error) {
+	attrs, err := b.actual.Attributes(ctx, path)
+	if err != nil {
+		return time.Time{}, classify("stat", path, err)
+	}
+	return attrs.ModTime, nil
+}
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	iter := b.actual.List(&blob.ListOptions{Prefix: prefix})
+	for {
+		obj, err := iter.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return classify("list", prefix, err)
+		}
+		if obj.IsDir {
+			continue
+		}
+		if err := fn(obj.Key); err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,121 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+	"github.com/andrebq/dbfs/refs"
+	"gocloud.dev/gcerrors"
+
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/memblob"
+)
+
+func TestMemblobConformance(t *testing.T) {
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		return Connect(ctx, "mem://")
+	})
+}
+
+func TestFileblobConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbfs-fileblob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		return Connect(ctx, "file://"+dir)
+	})
+}
+
+func TestCodeKind(t *testing.T) {
+	for code, kind := range map[gcerrors.ErrorCode]cas.Err{
+		gcerrors.NotFound:           cas.ErrNotFound,
+		gcerrors.PermissionDenied:   cas.ErrPermissionDenied,
+		gcerrors.FailedPrecondition: cas.ErrPreconditionFailed,
+		gcerrors.ResourceExhausted:  cas.ErrTransient,
+		gcerrors.DeadlineExceeded:   cas.ErrTransient,
+		gcerrors.Internal:           cas.ErrTransient,
+		gcerrors.Unknown:            "",
+		gcerrors.InvalidArgument:    "",
+		gcerrors.Canceled:           "",
+	} {
+		if actual := codeKind(code); actual != kind {
+			t.Errorf("Code %v should be %q got %q", code, kind, actual)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ctx := context.Background()
+	b, err := Connect(ctx, "mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if exists, err := b.Exists(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Error("Object should not exist")
+	}
+	_, err = b.Read(ctx, &bytes.Buffer{}, "missing")
+	if !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Read should return cas.ErrNotFound got %v", err)
+	}
+	if gcerrors.Code(errors.Unwrap(err)) != gcerrors.NotFound {
+		t.Errorf("Original error should be kept as the cause, got %v", errors.Unwrap(err))
+	}
+	if err := b.Copy(ctx, "other", "missing"); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Copy should return cas.ErrNotFound got %v", err)
+	}
+	if err := b.Delete(ctx, "missing"); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Delete should return cas.ErrNotFound got %v", err)
+	}
+}
+
+func TestCanceledIsNotClassified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b, err := Connect(context.Background(), "mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, err = b.Write(ctx, "key", bytes.NewBufferString("abc"))
+	if err == nil {
+		t.Fatal("Write with a canceled context should fail")
+	}
+	if errors.Is(err, cas.ErrTransient) {
+		t.Errorf("Canceled operations must not be retryable, got %v", err)
+	}
+}
+
+func TestConditionalWritesSupport(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dbfs-fileblob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := Connect(ctx, "file://"+dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refs.Open(file); !errors.Is(err, cas.ErrNotSupported) {
+		t.Errorf("Opening refs on a file:// bucket should return cas.ErrNotSupported, got %v", err)
+	}
+	mem, err := Connect(ctx, "mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refs.Open(mem); err != nil {
+		t.Errorf("mem:// buckets support conditional writes, got %v", err)
+	}
+}
@@ -0,0 +1,6 @@
+// package kv implements the cas.KV interface on top of the
+// key/value API exposed by a dbfs server (dbfs serve)
+//
+// Clients only need the URL of the server and its token, the
+// credentials of the actual bucket stay with the server.
+package kv
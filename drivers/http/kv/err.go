@@ -0,0 +1,50 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+// classify maps transport errors into one of the cas.Err kinds,
+// context cancellation is never classified
+func classify(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return cas.NewKVError(cas.ErrTransient, op, key, err)
+	}
+	return err
+}
+
+func statusKind(status int) cas.Err {
+	switch status {
+	case http.StatusNotFound:
+		return cas.ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return cas.ErrPermissionDenied
+	case http.StatusPreconditionFailed:
+		return cas.ErrPreconditionFailed
+	case http.StatusNotImplemented:
+		return cas.ErrNotSupported
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return cas.ErrTransient
+	}
+	return ""
+}
@@ -0,0 +1,297 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/server"
+)
+
+type (
+	// Bucket sends every operation to a dbfs server
+	Bucket struct {
+		base *url.URL
+		cfg  config
+	}
+
+	config struct {
+		token  string
+		client *http.Client
+	}
+
+	Option func(cfg *config) error
+
+	// statusError is the cause of errors returned by the server
+	statusError struct {
+		status  int
+		message string
+	}
+)
+
+// Token configures the token sent as "Authorization: Bearer <token>"
+func Token(token string) Option {
+	return func(cfg *config) error {
+		cfg.token = token
+		return nil
+	}
+}
+
+// TokenPtr reads the token from value when Connect is called
+func TokenPtr(value *string) Option {
+	return func(cfg *config) error {
+		cfg.token = *value
+		return nil
+	}
+}
+
+// Client replaces http.DefaultClient
+func Client(client *http.Client) Option {
+	return func(cfg *config) error {
+		cfg.client = client
+		return nil
+	}
+}
+
+// Connect returns a bucket which sends requests to the server at
+// endpoint (eg.: http://localhost:8080), no request is made
+func Connect(ctx context.Context, endpoint string, options ...Option) (*Bucket, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %q must use http or https", endpoint)
+	}
+	cfg := config{client: http.DefaultClient}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return &Bucket{base: base, cfg: cfg}, nil
+}
+
+func (b *Bucket) Close() error { return nil }
+
+func (b *Bucket) Copy(ctx context.Context, to, from string) error {
+	res, err := b.do(ctx, http.MethodPost, b.keyURL(to, url.Values{"copy": {from}}), nil, nil)
+	return finish("copy", from, res, err)
+}
+
+func (b *Bucket) Move(ctx context.Context, to, from string) error {
+	res, err := b.do(ctx, http.MethodPost, b.keyURL(to, url.Values{"move": {from}}), nil, nil)
+	return finish("move", from, res, err)
+}
+
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	res, err := b.do(ctx, http.MethodDelete, b.keyURL(key, nil), nil, nil)
+	return finish("delete", key, res, err)
+}
+
+func (b *Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	res, err := b.do(ctx, http.MethodHead, b.keyURL(key, nil), nil, nil)
+	if err := finish("exists", key, res, err); errors.Is(err, cas.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ModTime reads the Last-Modified header sent by the server, which
+// is only set if the KV used by the server implements cas.ModTimer
+func (b *Bucket) ModTime(ctx context.Context, key string) (time.Time, error) {
+	res, err := b.do(ctx, http.MethodHead, b.keyURL(key, nil), nil, nil)
+	if err := finish("stat", key, res, err); err != nil {
+		return time.Time{}, err
+	}
+	lastModified := res.Header.Get("Last-Modified")
+	if lastModified == "" {
+		return time.Time{}, cas.ErrNotSupported
+	}
+	modTime, err := http.ParseTime(lastModified)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid Last-Modified header for %v, cause: %w", key, err)
+	}
+	return modTime, nil
+}
+
+// ExistsBatch checks all keys with a single request
+func (b *Bucket) ExistsBatch(ctx context.Context, keys []string) ([]bool, error) {
+	body, err := json.Marshal(server.ExistsRequest{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.do(ctx, http.MethodPost, b.url("/kv-exists", nil), bytes.NewReader(body), nil)
+	if err := check("exists", "", res, err); err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var out server.ExistsResult
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, classify("exists", "", err)
+	}
+	if len(out.Exists) != len(keys) {
+		return nil, fmt.Errorf("server returned %v results for %v keys", len(out.Exists), len(keys))
+	}
+	return out.Exists, nil
+}
+
+func (b *Bucket) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	res, err := b.do(ctx, http.MethodGet, b.keyURL(key, nil), nil, nil)
+	if err := check("read", key, res, err); err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	n, err := io.Copy(w, res.Body)
+	return n, classify("read", key, err)
+}
+
+func (b *Bucket) ReadRange(ctx context.Context, w io.Writer, key string, offset, length int64) (int64, error) {
+	if length == 0 {
+		// http cannot express an empty range
+		exists, err := b.Exists(ctx, key)
+		if err == nil && !exists {
+			err = cas.NewKVError(cas.ErrNotFound, "read", key, errors.New("key does not exist"))
+		}
+		return 0, err
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	res, err := b.do(ctx, http.MethodGet, b.keyURL(key, nil), nil, header)
+	if err := check("read", key, res, err); err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	n, err := io.Copy(w, res.Body)
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, classify("read", key, err)
+}
+
+// Write streams input to the server, the server only stores the
+// object if the whole body is received
+func (b *Bucket) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	res, err := b.do(ctx, http.MethodPut, b.keyURL(key, nil), input, nil)
+	if err := check("write", key, res, err); err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var out server.WriteResult
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return 0, classify("write", key, err)
+	}
+	return out.Size, nil
+}
+
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	res, err := b.do(ctx, http.MethodGet, b.url("/kv-list", url.Values{"prefix": {prefix}}), nil, nil)
+	if err := check("list", prefix, res, err); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if err := fn(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return classify("list", prefix, scanner.Err())
+}
+
+func (b *Bucket) ReadVersion(ctx context.Context, w io.Writer, key string) (string, error) {
+	res, err := b.do(ctx, http.MethodGet, b.keyURL(key, url.Values{"version": {""}}), nil, nil)
+	if err := check("read", key, res, err); err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return "", classify("read", key, err)
+	}
+	return strings.Trim(res.Header.Get("ETag"), `"`), nil
+}
+
+func (b *Bucket) WriteIf(ctx context.Context, key string, input io.Reader, version string) (string, error) {
+	header := http.Header{"If-None-Match": {"*"}}
+	if version != "" {
+		header = http.Header{"If-Match": {`"` + version + `"`}}
+	}
+	res, err := b.do(ctx, http.MethodPut, b.keyURL(key, nil), input, header)
+	if err := check("write", key, res, err); err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return strings.Trim(res.Header.Get("ETag"), `"`), nil
+}
+
+func (b *Bucket) do(ctx context.Context, method, target string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.cfg.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.cfg.token)
+	}
+	return b.cfg.client.Do(req)
+}
+
+func (b *Bucket) keyURL(key string, query url.Values) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return b.url("/kv/"+strings.Join(segments, "/"), query)
+}
+
+func (b *Bucket) url(p string, query url.Values) string {
+	u := *b.base
+	u.Path += p
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// check returns an error if the request failed or the server
+// returned an error status, the body is closed in that case
+func check(op, key string, res *http.Response, err error) error {
+	if err != nil {
+		return classify(op, key, err)
+	}
+	if res.StatusCode < 300 {
+		return nil
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	cause := &statusError{status: res.StatusCode, message: strings.TrimSpace(string(msg))}
+	if kind := statusKind(res.StatusCode); kind != "" {
+		return cas.NewKVError(kind, op, key, cause)
+	}
+	return cause
+}
+
+// finish is check for requests whose body is not used
+func finish(op, key string, res *http.Response, err error) error {
+	if err := check(op, key, res, err); err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return res.Body.Close()
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("server returned %v: %v", e.status, e.message)
+}
@@ -0,0 +1,87 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/server"
+)
+
+func newServer(ctx context.Context, t *testing.T, options ...server.Option) *httptest.Server {
+	c, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return testutil.MemoryBucket(ctx, t), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(c, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(s)
+}
+
+func TestConformance(t *testing.T) {
+	ctx := context.Background()
+	// kvtest writes every kind of object under its own prefix
+	srv := newServer(ctx, t, server.Token("secret"), server.WritablePrefixes("kvtest/"))
+	defer srv.Close()
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		return Connect(ctx, srv.URL, Token("secret"))
+	})
+}
+
+func TestRemoteCAS(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t)
+	defer srv.Close()
+	c, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return Connect(ctx, srv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := c.PutContent(ctx, bytes.NewBufferString("hello remote"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := c.GetContent(ctx, buf, ref); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "hello remote" {
+		t.Fatalf("unexpected content %q", buf.String())
+	}
+}
+
+func TestAccess(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t, server.Token("secret"))
+	defer srv.Close()
+
+	b, err := Connect(ctx, srv.URL, Token("wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write(ctx, "key", bytes.NewBufferString("x")); !errors.Is(err, cas.ErrPermissionDenied) {
+		t.Fatalf("write with a wrong token should fail with %v, got %v", cas.ErrPermissionDenied, err)
+	}
+
+	ro := newServer(ctx, t, server.ReadOnly(true))
+	defer ro.Close()
+	b, err = Connect(ctx, ro.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write(ctx, "key", bytes.NewBufferString("x")); !errors.Is(err, cas.ErrPermissionDenied) {
+		t.Fatalf("write on a read-only server should fail with %v, got %v", cas.ErrPermissionDenied, err)
+	}
+	if _, err := b.Read(ctx, &bytes.Buffer{}, "key"); !errors.Is(err, cas.ErrNotFound) {
+		t.Fatalf("read of a missing key should fail with %v, got %v", cas.ErrNotFound, err)
+	}
+}
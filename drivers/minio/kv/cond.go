@@ -0,0 +1,99 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/minio/minio-go/v7"
+)
+
+type (
+	// condTransport adds the precondition headers for conditional
+	// writes, minio-go does not allow them in PutObjectOptions
+	condTransport struct {
+		actual http.RoundTripper
+	}
+
+	condKey struct{}
+)
+
+func (c *condTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	version, ok := req.Context().Value(condKey{}).(string)
+	if !ok || req.Method != http.MethodPut {
+		return c.actual.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if version == "" {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", `"`+version+`"`)
+	}
+	return c.actual.RoundTrip(req)
+}
+
+// CheckConditionalWrites returns cas.ErrNotSupported unless the
+// endpoint is known to honour conditional PUT requests (AWS S3) or
+// conditional writes were enabled with ConditionalWritesPtr.
+//
+// Servers which ignore the headers would accept every WriteIf,
+// silently turning compare-and-swap into a plain write.
+func (b *Bucket) CheckConditionalWrites() error {
+	if b.condWrites {
+		return nil
+	}
+	return fmt.Errorf("conditional writes are not enabled for %v, cause: %w", b.endpoint, cas.ErrNotSupported)
+}
+
+// isAWS returns true for AWS S3 endpoints
+func isAWS(endpoint string) bool {
+	host := strings.ToLower(endpoint)
+	if idx := strings.LastIndexByte(host, ':'); idx >= 0 {
+		host = host[:idx]
+	}
+	return strings.HasSuffix(host, ".amazonaws.com")
+}
+
+// ReadVersion returns the ETag of the object as its version
+func (b *Bucket) ReadVersion(ctx context.Context, w io.Writer, key string) (string, error) {
+	obj, err := b.cli.GetObject(ctx, b.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return "", classify("read", key, err)
+	}
+	defer obj.Close()
+	// Stat reads the headers of the response, so ETag
+	// matches the content copied to w
+	info, err := obj.Stat()
+	if err != nil {
+		return "", classify("read", key, err)
+	}
+	if _, err := io.Copy(w, obj); err != nil {
+		return "", classify("read", key, err)
+	}
+	return info.ETag, nil
+}
+
+// WriteIf sends the content with If-Match (or If-None-Match) headers,
+// the server must support conditional PUT requests, see
+// CheckConditionalWrites.
+//
+// The content is kept in memory so it is sent in a single request,
+// conditional writes are meant for small mutable keys
+func (b *Bucket) WriteIf(ctx context.Context, key string, r io.Reader, version string) (string, error) {
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, r); err != nil {
+		return "", err
+	}
+	ctx = context.WithValue(ctx, condKey{}, version)
+	info, err := b.cli.PutObject(ctx, b.bucket, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), minio.PutObjectOptions{
+		DisableMultipart: true,
+	})
+	if err != nil {
+		return "", classify("write", key, err)
+	}
+	return info.ETag, nil
+}
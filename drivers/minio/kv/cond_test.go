@@ -0,0 +1,41 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+func TestCheckConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	enabled, disabled := true, false
+	for _, tc := range []struct {
+		endpoint   string
+		condWrites *bool
+		supported  bool
+	}{
+		{"localhost:9000", nil, false},
+		{"localhost:9000", &enabled, true},
+		{"s3.amazonaws.com", nil, true},
+		{"s3.eu-west-1.amazonaws.com:443", nil, true},
+		{"s3.amazonaws.com", &disabled, false},
+		{"amazonaws.com.example.org", nil, false},
+	} {
+		endpoint := tc.endpoint
+		b, err := Connect(ctx, EndpointPtr(&endpoint), ConditionalWritesPtr(tc.condWrites))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.CheckConditionalWrites()
+		if tc.supported && err != nil {
+			t.Errorf("%v should support conditional writes, got %v", tc.endpoint, err)
+		} else if !tc.supported && !errors.Is(err, cas.ErrNotSupported) {
+			t.Errorf("%v should not support conditional writes, got %v", tc.endpoint, err)
+		}
+		if _, err := cas.AsConditionalWriter(b); (err == nil) != tc.supported {
+			t.Errorf("AsConditionalWriter for %v returned %v", tc.endpoint, err)
+		}
+	}
+}
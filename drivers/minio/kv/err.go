@@ -0,0 +1,75 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/minio/minio-go/v7"
+)
+
+// classify maps errors returned by minio into one of the
+// cas.Err kinds, errors which cannot be classified are returned
+// without any change.
+//
+// Context cancellation is never classified, otherwise callers
+// could end up retrying an operation that was explicitly aborted
+func classify(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if kind := errKind(err); kind != "" {
+		return cas.NewKVError(kind, op, key, err)
+	}
+	return err
+}
+
+func errKind(err error) cas.Err {
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		switch resp.Code {
+		case "NoSuchKey", "NoSuchBucket", "NoSuchVersion":
+			return cas.ErrNotFound
+		case "AccessDenied", "AllAccessDisabled", "AccountProblem",
+			"InvalidAccessKeyId", "SignatureDoesNotMatch":
+			return cas.ErrPermissionDenied
+		case "PreconditionFailed":
+			return cas.ErrPreconditionFailed
+		case "SlowDown", "SlowDownRead", "SlowDownWrite", "RequestTimeout",
+			"RequestTimeTooSkewed", "InternalError", "ServiceUnavailable",
+			"XMinioServerNotInitialized":
+			return cas.ErrTransient
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return cas.ErrNotFound
+		case http.StatusForbidden, http.StatusUnauthorized:
+			return cas.ErrPermissionDenied
+		case http.StatusPreconditionFailed:
+			return cas.ErrPreconditionFailed
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return cas.ErrTransient
+		}
+		return ""
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return cas.ErrTransient
+	}
+	if errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return cas.ErrTransient
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/minio/minio-go/v7"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"no-such-key", minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}, cas.ErrNotFound},
+		{"not-found-status", minio.ErrorResponse{StatusCode: 404}, cas.ErrNotFound},
+		{"access-denied", minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, cas.ErrPermissionDenied},
+		{"bad-signature", minio.ErrorResponse{Code: "SignatureDoesNotMatch", StatusCode: 403}, cas.ErrPermissionDenied},
+		{"precondition", minio.ErrorResponse{Code: "PreconditionFailed", StatusCode: 412}, cas.ErrPreconditionFailed},
+		{"slow-down", minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}, cas.ErrTransient},
+		{"unavailable", minio.ErrorResponse{StatusCode: 503}, cas.ErrTransient},
+		{"wrapped", fmt.Errorf("wrapper: %w", minio.ErrorResponse{Code: "NoSuchKey"}), cas.ErrNotFound},
+		{"conn-reset", &url.Error{Op: "Put", URL: "http://localhost", Err: syscall.ECONNRESET}, cas.ErrTransient},
+		{"unexpected-eof", io.ErrUnexpectedEOF, cas.ErrTransient},
+	} {
+		err := classify("read", "key", tc.err)
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%v: expecting %v got %v", tc.name, tc.kind, err)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: original error should be kept as cause, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestClassifyPassThrough(t *testing.T) {
+	for _, err := range []error{
+		context.Canceled,
+		&url.Error{Op: "Get", URL: "http://localhost", Err: context.DeadlineExceeded},
+		minio.ErrorResponse{Code: "InvalidArgument", StatusCode: 400},
+		errors.New("something else"),
+	} {
+		out := classify("read", "key", err)
+		if out != err {
+			t.Errorf("Error %v should not be classified, got %v", err, out)
+		}
+	}
+	if classify("read", "key", nil) != nil {
+		t.Error("nil should not be classified")
+	}
+}
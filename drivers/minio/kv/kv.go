@@ -2,19 +2,25 @@ package kv
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/andrebq/dbfs/cas"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 type (
 	Bucket struct {
-		cli    *minio.Client
-		bucket string
-		region string
+		cli        *minio.Client
+		bucket     string
+		region     string
+		endpoint   string
+		condWrites bool
 	}
 
 	countReader struct {
@@ -29,6 +35,9 @@ type (
 		secretToken     string
 		bucket          string
 		region          string
+		// condWrites is nil unless conditional writes
+		// were explicitly enabled or disabled
+		condWrites *bool
 	}
 
 	Option func(cfg *config) error
@@ -45,6 +54,7 @@ func FromEnv() []Option {
 		TokenFromEnv,
 		BucketFromEnv,
 		RegionFromEnv,
+		ConditionalWritesFromEnv,
 	}
 }
 
@@ -76,6 +86,13 @@ func TokenPtr(value *string) Option {
 	}
 }
 
+func EndpointPtr(value *string) Option {
+	return func(cfg *config) error {
+		cfg.endpoint = *value
+		return nil
+	}
+}
+
 func BucketPtr(value *string) Option {
 	return func(cfg *config) error {
 		cfg.bucket = *value
@@ -83,6 +100,15 @@ func BucketPtr(value *string) Option {
 	}
 }
 
+// ConditionalWritesPtr configures if the endpoint honours If-Match and
+// If-None-Match headers on PUT requests, which is required by WriteIf
+func ConditionalWritesPtr(value *bool) Option {
+	return func(cfg *config) error {
+		cfg.condWrites = value
+		return nil
+	}
+}
+
 // EndpointFromEnv reads the endpoint in the following order,
 // if not set:
 //
@@ -193,6 +219,27 @@ func RegionFromEnv(cfg *config) error {
 	return err
 }
 
+// ConditionalWritesFromEnv reads DBFS_MINIO_CONDITIONAL_WRITES,
+// if not set.
+//
+// If nothing is set, conditional writes are only enabled for
+// AWS S3 endpoints
+func ConditionalWritesFromEnv(cfg *config) error {
+	if cfg.condWrites != nil {
+		return nil
+	}
+	value, err := firstNonEmptyEnv("DBFS_MINIO_CONDITIONAL_WRITES")
+	if err != nil {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for DBFS_MINIO_CONDITIONAL_WRITES, cause: %w", err)
+	}
+	cfg.condWrites = &enabled
+	return nil
+}
+
 func firstNonEmptyEnv(names ...string) (string, error) {
 	for _, n := range names {
 		v := os.Getenv(n)
@@ -216,14 +263,29 @@ func Connect(ctx context.Context, options ...Option) (*Bucket, error) {
 			return nil, err
 		}
 	}
+	transport, err := minio.DefaultTransport(false)
+	if err != nil {
+		return nil, err
+	}
 	minioCli, err := minio.New(cfg.endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(cfg.accessKeyID, cfg.secretAccessKey, cfg.secretToken),
-		Region: cfg.region,
+		Creds:     credentials.NewStaticV4(cfg.accessKeyID, cfg.secretAccessKey, cfg.secretToken),
+		Region:    cfg.region,
+		Transport: &condTransport{actual: transport},
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &Bucket{cli: minioCli, bucket: cfg.bucket, region: cfg.region}, nil
+	condWrites := isAWS(cfg.endpoint)
+	if cfg.condWrites != nil {
+		condWrites = *cfg.condWrites
+	}
+	return &Bucket{
+		cli:        minioCli,
+		bucket:     cfg.bucket,
+		region:     cfg.region,
+		endpoint:   cfg.endpoint,
+		condWrites: condWrites,
+	}, nil
 }
 
 func (b *Bucket) Close() error { return nil }
@@ -235,33 +297,80 @@ func (b *Bucket) Copy(ctx context.Context, to, from string) error {
 		Bucket: b.bucket,
 		Object: from,
 	})
-	return err
+	return classify("copy", from, err)
 }
 func (b *Bucket) Delete(ctx context.Context, from string) error {
-	return b.cli.RemoveObject(ctx, b.bucket, from, minio.RemoveObjectOptions{})
+	return classify("delete", from, b.cli.RemoveObject(ctx, b.bucket, from, minio.RemoveObjectOptions{}))
 }
 func (b *Bucket) Read(ctx context.Context, w io.Writer, from string) (int64, error) {
 	obj, err := b.cli.GetObject(ctx, b.bucket, from, minio.GetObjectOptions{})
 	if err != nil {
+		return 0, classify("read", from, err)
+	}
+	defer obj.Close()
+	n, err := io.Copy(w, obj)
+	return n, classify("read", from, err)
+}
+func (b *Bucket) ReadRange(ctx context.Context, w io.Writer, from string, offset, length int64) (int64, error) {
+	if length == 0 {
+		// minio cannot express an empty range
+		_, err := b.cli.StatObject(ctx, b.bucket, from, minio.StatObjectOptions{})
+		return 0, classify("read", from, err)
+	}
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
 		return 0, err
 	}
+	obj, err := b.cli.GetObject(ctx, b.bucket, from, opts)
+	if err != nil {
+		return 0, classify("read", from, err)
+	}
 	defer obj.Close()
-	return io.Copy(w, obj)
+	n, err := io.Copy(w, obj)
+	if err == nil && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, classify("read", from, err)
 }
 func (b *Bucket) Write(ctx context.Context, to string, r io.Reader) (int64, error) {
 	cr := countReader{actual: r}
 	_, err := b.cli.PutObject(ctx, b.bucket, to, &cr, -1, minio.PutObjectOptions{})
 	if err != nil {
-		return 0, err
+		return 0, classify("write", to, err)
 	}
 	return cr.total, err
 }
 func (b *Bucket) Exists(ctx context.Context, path string) (bool, error) {
 	stat, err := b.cli.StatObject(ctx, b.bucket, path, minio.StatObjectOptions{})
 	if err != nil {
+		err = classify("exists", path, err)
+		if errors.Is(err, cas.ErrNotFound) {
+			return false, nil
+		}
 		return false, err
 	}
-	return !stat.IsDeleteMarker && stat.Size > 0 && stat.Err == nil, nil
+	return !stat.IsDeleteMarker && stat.Err == nil, nil
+}
+func (b *Bucket) ModTime(ctx context.Context, path string) (time.Time, error) {
+	stat, err := b.cli.StatObject(ctx, b.bucket, path, minio.StatObjectOptions{})
+	if err != nil {
+		return time.Time{}, classify("stat", path, err)
+	}
+	return stat.LastModified, nil
+}
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	// cancel the listing if fn returns early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range b.cli.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return classify("list", prefix, obj.Err)
+		}
+		if err := fn(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (cr *countReader) Read(b []byte) (int, error) {
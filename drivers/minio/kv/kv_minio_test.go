@@ -0,0 +1,36 @@
+//go:build minio_driver
+// +build minio_driver
+
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+)
+
+func TestMinioConformance(t *testing.T) {
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		return Connect(ctx, FromEnv()...)
+	})
+}
+
+func TestMinioNotFound(t *testing.T) {
+	ctx := context.Background()
+	b, err := Connect(ctx, FromEnv()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := b.Exists(ctx, "tmp/does-not-exist"); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Error("Object should not exist")
+	}
+	if _, err := b.Read(ctx, &bytes.Buffer{}, "tmp/does-not-exist"); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Read should return cas.ErrNotFound got %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+// package kv implements a cas.KV which mirrors every write
+// to a list of child KV objects (replicas)
+//
+// Writes succeed once a configurable quorum of replicas
+// acknowledges them, reads are served by the first healthy
+// replica which holds a valid copy of the object. Replicas
+// which are missing objects are repaired in the background.
+//
+// Deletes of objects under ImmutablePrefixes (eg.: by gc) must
+// reach every replica, otherwise repairs would bring them back.
+package kv
@@ -0,0 +1,602 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/spool"
+	"github.com/rs/zerolog"
+)
+
+type (
+	// Bucket fans out operations to all its replicas
+	Bucket struct {
+		replicas []*replica
+		cfg      config
+
+		repairs chan repairJob
+		done    chan struct{}
+		wg      sync.WaitGroup
+	}
+
+	// RepairStats contains the result of a Repair call
+	RepairStats struct {
+		Checked  int `json:"checked" yaml:"checked"`
+		Repaired int `json:"repaired" yaml:"repaired"`
+		Failed   int `json:"failed" yaml:"failed"`
+	}
+
+	replica struct {
+		idx int
+		kv  cas.KV
+
+		mu        sync.Mutex
+		downUntil time.Time
+	}
+
+	repairJob struct {
+		target *replica
+		key    string
+	}
+
+	config struct {
+		quorum         int
+		spoolLimit     int64
+		cooldown       time.Duration
+		repairQueue    int
+		repairInterval time.Duration
+		verify         func(key string) (cas.Ref, bool)
+		logger         zerolog.Logger
+	}
+
+	Option func(cfg *config) error
+)
+
+const (
+	// ErrCorrupted is returned when the content of an object
+	// does not match the ref encoded in its key
+	ErrCorrupted = cas.Err("object content does not match its ref")
+
+	DefaultSpoolLimit  = 16_000_000
+	DefaultCooldown    = 30 * time.Second
+	DefaultRepairQueue = 1000
+)
+
+var (
+	// ImmutablePrefixes are the keys repaired in the background, other
+	// keys (eg.: refs/ and tmp/) can be updated or deleted, so copying
+	// them between replicas could bring back old values
+	ImmutablePrefixes = []string{"data/", "packs/"}
+)
+
+// WriteQuorum configures how many replicas must acknowledge
+// an operation before it is considered successful.
+//
+// The default is a majority of the replicas
+func WriteQuorum(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return fmt.Errorf("write quorum must be at least 1, got %v", n)
+		}
+		cfg.quorum = n
+		return nil
+	}
+}
+
+// Cooldown configures for how long a replica which failed is moved to
+// the end of the read order
+func Cooldown(d time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.cooldown = d
+		return nil
+	}
+}
+
+// SpoolLimit configures how many bytes are kept in memory before
+// spooling objects to a temporary file
+func SpoolLimit(n int64) Option {
+	return func(cfg *config) error {
+		cfg.spoolLimit = n
+		return nil
+	}
+}
+
+// RepairEvery periodically runs Repair on every prefix in
+// ImmutablePrefixes in the background
+func RepairEvery(interval time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.repairInterval = interval
+		return nil
+	}
+}
+
+// Verify replaces the function used to compute the expected ref
+// from a key, by default keys under data/ are verified.
+func Verify(fn func(key string) (cas.Ref, bool)) Option {
+	return func(cfg *config) error {
+		cfg.verify = fn
+		return nil
+	}
+}
+
+// Logger configures the logger used to report background repairs
+func Logger(logger zerolog.Logger) Option {
+	return func(cfg *config) error {
+		cfg.logger = logger
+		return nil
+	}
+}
+
+// RefFromKey extracts the ref from keys created by cas
+// (data/<hex path>)
+func RefFromKey(key string) (cas.Ref, bool) {
+	if !strings.HasPrefix(key, "data/") {
+		return cas.Ref{}, false
+	}
+	ref, err := cas.ParseRef(strings.TrimPrefix(key, "data/"))
+	return ref, err == nil
+}
+
+// Wrap returns a KV which replicates data to all the given replicas,
+// the order of the list is the order used for reads.
+//
+// Closing the returned bucket also closes all replicas
+func Wrap(replicas []cas.KV, options ...Option) (*Bucket, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("at least one replica is required")
+	}
+	cfg := config{
+		quorum:      len(replicas)/2 + 1,
+		spoolLimit:  DefaultSpoolLimit,
+		cooldown:    DefaultCooldown,
+		repairQueue: DefaultRepairQueue,
+		verify:      RefFromKey,
+		logger:      zerolog.Nop(),
+	}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.quorum > len(replicas) {
+		return nil, fmt.Errorf("write quorum %v is larger than the number of replicas %v", cfg.quorum, len(replicas))
+	}
+	b := &Bucket{
+		cfg:     cfg,
+		repairs: make(chan repairJob, cfg.repairQueue),
+		done:    make(chan struct{}),
+	}
+	for i, kv := range replicas {
+		b.replicas = append(b.replicas, &replica{idx: i, kv: kv})
+	}
+	b.wg.Add(1)
+	go b.repairLoop()
+	return b, nil
+}
+
+// Close stops background repairs and closes all replicas
+func (b *Bucket) Close() error {
+	close(b.done)
+	b.wg.Wait()
+	var firstErr error
+	for _, r := range b.replicas {
+		if err := r.kv.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *Bucket) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	content, err := spool.Read(input, b.cfg.spoolLimit)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	err = b.fanOut(ctx, "write", key, b.cfg.quorum, func(r *replica) error {
+		_, err := r.kv.Write(ctx, key, content.NewReader())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return content.Size(), nil
+}
+
+// Delete removes key from the replicas. Keys under ImmutablePrefixes
+// must be removed from every replica, otherwise repairs would copy
+// them back from a replica which missed the delete, so the delete
+// should be retried once all replicas are available
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	quorum := b.cfg.quorum
+	if immutable(key) {
+		quorum = len(b.replicas)
+	}
+	return b.fanOut(ctx, "delete", key, quorum, func(r *replica) error {
+		err := r.kv.Delete(ctx, key)
+		if errors.Is(err, cas.ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// Copy executes the copy on every replica, replicas which don't have
+// the source object receive a copy from one of their peers
+func (b *Bucket) Copy(ctx context.Context, to, from string) error {
+	return b.fanOut(ctx, "copy", from, b.cfg.quorum, func(r *replica) error {
+		err := r.kv.Copy(ctx, to, from)
+		if errors.Is(err, cas.ErrNotFound) {
+			return b.copyFromPeers(ctx, r, to, from)
+		}
+		return err
+	})
+}
+
+// Move executes the move on every replica, using cas.Mover
+// when the replica implements it
+func (b *Bucket) Move(ctx context.Context, to, from string) error {
+	return b.fanOut(ctx, "move", from, b.cfg.quorum, func(r *replica) error {
+		var err error
+		if mover, ok := r.kv.(cas.Mover); ok {
+			err = mover.Move(ctx, to, from)
+		} else if err = r.kv.Copy(ctx, to, from); err == nil {
+			err = r.kv.Delete(ctx, from)
+		}
+		if errors.Is(err, cas.ErrNotFound) {
+			return b.copyFromPeers(ctx, r, to, from)
+		}
+		return err
+	})
+}
+
+// Exists returns true if at least a quorum of replicas
+// has the object, that way objects which lost too many copies
+// are written again by cas.
+func (b *Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	results := make([]bool, len(b.replicas))
+	errs := b.each(func(r *replica) error {
+		var err error
+		results[r.idx], err = r.kv.Exists(ctx, key)
+		return err
+	})
+	var found, missing int
+	var firstErr error
+	for i := range b.replicas {
+		switch {
+		case errs[i] != nil:
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+		case results[i]:
+			found++
+		default:
+			missing++
+		}
+	}
+	if found >= b.cfg.quorum {
+		return true, nil
+	}
+	if missing > len(b.replicas)-b.cfg.quorum {
+		return false, nil
+	}
+	return false, firstErr
+}
+
+// ModTime returns the newest modification time of key among the
+// replicas which have it, so an object is only as old as its most
+// recent copy
+func (b *Bucket) ModTime(ctx context.Context, key string) (time.Time, error) {
+	times := make([]time.Time, len(b.replicas))
+	errs := b.each(func(r *replica) error {
+		mt, ok := r.kv.(cas.ModTimer)
+		if !ok {
+			return cas.ErrNotSupported
+		}
+		var err error
+		times[r.idx], err = mt.ModTime(ctx, key)
+		return err
+	})
+	return newest(times, errs)
+}
+
+// Read returns the object from the first healthy replica which has
+// a valid copy of it. Replicas which are missing the object, or have
+// a corrupted copy of it, are repaired in the background if the key
+// is under one of the ImmutablePrefixes.
+func (b *Bucket) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	var stale []*replica
+	var firstErr error
+	for _, r := range b.readOrder() {
+		content, err := b.readVerified(ctx, r, key)
+		if err == nil {
+			defer content.Close()
+			if immutable(key) {
+				for _, s := range stale {
+					b.scheduleRepair(s, key)
+				}
+			}
+			return io.Copy(w, content.NewReader())
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return 0, err
+		}
+		if errors.Is(err, cas.ErrNotFound) || errors.Is(err, ErrCorrupted) {
+			stale = append(stale, r)
+			if firstErr == nil || errors.Is(firstErr, cas.ErrNotFound) {
+				firstErr = err
+			}
+			continue
+		}
+		r.markDown(b.cfg.cooldown)
+		if firstErr == nil || errors.Is(firstErr, cas.ErrNotFound) {
+			firstErr = err
+		}
+	}
+	return 0, firstErr
+}
+
+// List returns the union of the keys from all replicas
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	seen := make(map[string]struct{})
+	var listed bool
+	for _, r := range b.replicas {
+		lister, ok := r.kv.(cas.Lister)
+		if !ok {
+			continue
+		}
+		listed = true
+		err := lister.List(ctx, prefix, func(key string) error {
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+			return fn(key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !listed {
+		return cas.ErrNotSupported
+	}
+	return nil
+}
+
+// Repair lists the keys under prefix from every replica and copies
+// missing objects to the replicas that don't have them.
+//
+// All replicas must implement cas.Lister
+func (b *Bucket) Repair(ctx context.Context, prefix string) (RepairStats, error) {
+	var stats RepairStats
+	keys := make([]map[string]struct{}, len(b.replicas))
+	union := make(map[string]struct{})
+	for i, r := range b.replicas {
+		lister, ok := r.kv.(cas.Lister)
+		if !ok {
+			return stats, fmt.Errorf("replica %v cannot list objects, cause: %w", i, cas.ErrNotSupported)
+		}
+		keys[i] = make(map[string]struct{})
+		err := lister.List(ctx, prefix, func(key string) error {
+			keys[i][key] = struct{}{}
+			union[key] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("unable to list replica %v, cause: %w", i, err)
+		}
+	}
+	for key := range union {
+		stats.Checked++
+		for i, r := range b.replicas {
+			if _, ok := keys[i][key]; ok {
+				continue
+			}
+			if err := b.repair(ctx, r, key); err != nil {
+				if ctx.Err() != nil {
+					return stats, ctx.Err()
+				}
+				stats.Failed++
+				b.cfg.logger.Error().Err(err).Str("key", key).Int("replica", i).Msg("Unable to repair object")
+				continue
+			}
+			stats.Repaired++
+		}
+	}
+	return stats, nil
+}
+
+// fanOut runs fn on all replicas and returns an error if
+// less than quorum replicas succeeded
+func (b *Bucket) fanOut(ctx context.Context, op, key string, quorum int, fn func(*replica) error) error {
+	errs := b.each(fn)
+	var ok int
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			ok++
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !errors.Is(err, cas.ErrNotFound) {
+			b.replicas[i].markDown(b.cfg.cooldown)
+		}
+	}
+	if ok >= quorum {
+		return nil
+	}
+	return fmt.Errorf("%v %v: quorum not reached, %v of %v replicas succeeded, cause: %w", op, key, ok, quorum, firstErr)
+}
+
+// each runs fn concurrently on all replicas and returns
+// the errors indexed by replica
+func (b *Bucket) each(fn func(*replica) error) []error {
+	errs := make([]error, len(b.replicas))
+	var wg sync.WaitGroup
+	for _, r := range b.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			errs[r.idx] = fn(r)
+		}(r)
+	}
+	wg.Wait()
+	return errs
+}
+
+// readOrder returns healthy replicas first, keeping the
+// configured order
+func (b *Bucket) readOrder() []*replica {
+	var healthy, down []*replica
+	now := time.Now()
+	for _, r := range b.replicas {
+		if r.isDown(now) {
+			down = append(down, r)
+		} else {
+			healthy = append(healthy, r)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// readVerified reads key from r and checks if its content
+// matches the ref encoded in the key
+func (b *Bucket) readVerified(ctx context.Context, r *replica, key string) (*spool.S, error) {
+	w := spool.NewWriter(b.cfg.spoolLimit)
+	hasher := cas.NewRollingRef()
+	defer hasher.Close()
+	_, err := r.kv.Read(ctx, io.MultiWriter(w, hasher), key)
+	if err != nil {
+		w.Discard()
+		return nil, err
+	}
+	if expected, ok := b.cfg.verify(key); ok && hasher.Ref() != expected {
+		w.Discard()
+		return nil, cas.NewKVError(ErrCorrupted, "read", key, fmt.Errorf("replica %v returned %v", r.idx, hasher.Ref()))
+	}
+	return w.Spool()
+}
+
+// copyFromPeers reads from from any replica other than target
+// and writes it to target under to
+func (b *Bucket) copyFromPeers(ctx context.Context, target *replica, to, from string) error {
+	var firstErr error
+	for _, r := range b.readOrder() {
+		if r == target {
+			continue
+		}
+		content, err := b.readVerified(ctx, r, from)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		_, err = target.kv.Write(ctx, to, content.NewReader())
+		content.Close()
+		return err
+	}
+	if firstErr == nil {
+		firstErr = cas.NewKVError(cas.ErrNotFound, "copy", from, errors.New("no replica has the object"))
+	}
+	return firstErr
+}
+
+func (b *Bucket) repair(ctx context.Context, target *replica, key string) error {
+	return b.copyFromPeers(ctx, target, key, key)
+}
+
+func (b *Bucket) scheduleRepair(target *replica, key string) {
+	select {
+	case b.repairs <- repairJob{target: target, key: key}:
+	default:
+		b.cfg.logger.Warn().Str("key", key).Int("replica", target.idx).Msg("Repair queue is full, skipping object")
+	}
+}
+
+func (b *Bucket) repairLoop() {
+	defer b.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-b.done
+		cancel()
+	}()
+	var tick <-chan time.Time
+	if b.cfg.repairInterval > 0 {
+		ticker := time.NewTicker(b.cfg.repairInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-b.done:
+			return
+		case job := <-b.repairs:
+			if err := b.repair(ctx, job.target, job.key); err != nil {
+				b.cfg.logger.Error().Err(err).Str("key", job.key).Int("replica", job.target.idx).Msg("Unable to repair object")
+			}
+		case <-tick:
+			for _, prefix := range ImmutablePrefixes {
+				stats, err := b.Repair(ctx, prefix)
+				if err != nil {
+					b.cfg.logger.Error().Err(err).Str("prefix", prefix).Msg("Periodic repair failed")
+					continue
+				}
+				b.cfg.logger.Info().Str("prefix", prefix).Int("checked", stats.Checked).Int("repaired", stats.Repaired).Int("failed", stats.Failed).Msg("Periodic repair finished")
+			}
+		}
+	}
+}
+
+func immutable(key string) bool {
+	for _, p := range ImmutablePrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *replica) markDown(cooldown time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.downUntil = time.Now().Add(cooldown)
+}
+
+func (r *replica) isDown(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return now.Before(r.downUntil)
+}
+
+// newest returns the latest of times, skipping the entries whose
+// error matches cas.ErrNotFound. Any other error is returned, since
+// the copy which could not be checked might be the newest one
+func newest(times []time.Time, errs []error) (time.Time, error) {
+	var latest time.Time
+	var found bool
+	for i, err := range errs {
+		if errors.Is(err, cas.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return time.Time{}, err
+		}
+		found = true
+		if times[i].After(latest) {
+			latest = times[i]
+		}
+	}
+	if !found {
+		return time.Time{}, errs[0]
+	}
+	return latest, nil
+}
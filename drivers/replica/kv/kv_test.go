@@ -0,0 +1,234 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+	gcloud "github.com/andrebq/dbfs/drivers/gcloud/kv"
+
+	_ "gocloud.dev/blob/memblob"
+)
+
+type (
+	// brokenKV fails every write
+	brokenKV struct {
+		cas.KV
+	}
+
+	// undeletableKV fails every delete
+	undeletableKV struct {
+		cas.KV
+	}
+)
+
+func (b brokenKV) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	return 0, cas.NewKVError(cas.ErrTransient, "write", key, errors.New("service unavailable"))
+}
+
+func (u undeletableKV) Delete(ctx context.Context, key string) error {
+	return cas.NewKVError(cas.ErrTransient, "delete", key, errors.New("service unavailable"))
+}
+
+func memoryBuckets(ctx context.Context, t *testing.T, n int) []cas.KV {
+	var buckets []cas.KV
+	for i := 0; i < n; i++ {
+		b, err := gcloud.Connect(ctx, "mem://")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+func dataKey(content string) string {
+	ref := cas.PrecomputeHashBytes([]byte(content))
+	return path.Join("data", ref.HexPath(4))
+}
+
+func readString(ctx context.Context, t *testing.T, kv cas.KV, key string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if _, err := kv.Read(ctx, buf, key); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestConformance(t *testing.T) {
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		return Wrap(memoryBuckets(ctx, t, 3))
+	})
+}
+
+func TestCAS(t *testing.T) {
+	ctx := context.Background()
+	replicas := memoryBuckets(ctx, t, 2)
+	store, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return Wrap(replicas)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ref, err := store.PutContent(ctx, bytes.NewBufferString("abc123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range replicas {
+		if got := readString(ctx, t, r, path.Join("data", ref.HexPath(4))); got != "abc123" {
+			t.Errorf("Replica %v should contain the object, got %q", i, got)
+		}
+	}
+}
+
+func TestWriteQuorum(t *testing.T) {
+	ctx := context.Background()
+	replicas := memoryBuckets(ctx, t, 3)
+	replicas[2] = brokenKV{KV: replicas[2]}
+	b, err := Wrap(replicas, WriteQuorum(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Write(ctx, "obj", bytes.NewBufferString("abc")); err != nil {
+		t.Errorf("Write should succeed with 2 of 3 replicas, got %v", err)
+	}
+
+	replicas = memoryBuckets(ctx, t, 3)
+	replicas[1] = brokenKV{KV: replicas[1]}
+	replicas[2] = brokenKV{KV: replicas[2]}
+	b, err = Wrap(replicas, WriteQuorum(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, err = b.Write(ctx, "obj", bytes.NewBufferString("abc"))
+	if !errors.Is(err, cas.ErrTransient) {
+		t.Errorf("Write should fail with the replica error when quorum is not reached, got %v", err)
+	}
+}
+
+func TestDeleteImmutable(t *testing.T) {
+	ctx := context.Background()
+	replicas := memoryBuckets(ctx, t, 3)
+	replicas[2] = undeletableKV{KV: replicas[2]}
+	b, err := Wrap(replicas, WriteQuorum(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, key := range []string{dataKey("a"), "tmp/upload"} {
+		if _, err := b.Write(ctx, key, bytes.NewBufferString("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete(ctx, "tmp/upload"); err != nil {
+		t.Errorf("Mutable keys should be deleted with a quorum, got %v", err)
+	}
+	if err := b.Delete(ctx, dataKey("a")); !errors.Is(err, cas.ErrTransient) {
+		t.Errorf("Immutable keys must be deleted from every replica, got %v", err)
+	}
+}
+
+func TestReadFallbackAndRepair(t *testing.T) {
+	ctx := context.Background()
+	replicas := memoryBuckets(ctx, t, 3)
+	b, err := Wrap(replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	missing, corrupted := dataKey("missing on first"), dataKey("corrupted on first")
+	b.Write(ctx, missing, bytes.NewBufferString("missing on first"))
+	b.Write(ctx, corrupted, bytes.NewBufferString("corrupted on first"))
+	replicas[0].Delete(ctx, missing)
+	replicas[0].Write(ctx, corrupted, bytes.NewBufferString("bit rot"))
+
+	if got := readString(ctx, t, b, missing); got != "missing on first" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if got := readString(ctx, t, b, corrupted); got != "corrupted on first" {
+		t.Errorf("Unexpected content %q", got)
+	}
+
+	// repairs happen in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		buf := &bytes.Buffer{}
+		replicas[0].Read(ctx, buf, corrupted)
+		if exists, _ := replicas[0].Exists(ctx, missing); exists && buf.String() == "corrupted on first" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("First replica was not repaired")
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	replicas := memoryBuckets(ctx, t, 2)
+	for _, content := range []string{"a", "b", "c"} {
+		replicas[0].Write(ctx, dataKey(content), bytes.NewBufferString(content))
+	}
+	replicas[1].Write(ctx, dataKey("d"), bytes.NewBufferString("d"))
+	b, err := Wrap(replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	stats, err := b.Repair(ctx, "data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Checked != 4 || stats.Repaired != 4 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+	for _, content := range []string{"a", "b", "c", "d"} {
+		for i, r := range replicas {
+			if got := readString(ctx, t, r, dataKey(content)); got != content {
+				t.Errorf("Replica %v should have %q got %q", i, content, got)
+			}
+		}
+	}
+}
+
+func TestPeriodicRepair(t *testing.T) {
+	ctx := context.Background()
+	replicas := memoryBuckets(ctx, t, 2)
+	replicas[0].Write(ctx, dataKey("a"), bytes.NewBufferString("a"))
+	// left behind by a delete, or an update, which failed on one replica
+	replicas[0].Write(ctx, "tmp/upload", bytes.NewBufferString("tmp"))
+	replicas[0].Write(ctx, "refs/heads/main", bytes.NewBufferString("old"))
+	b, err := Wrap(replicas, RepairEvery(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if exists, _ := replicas[1].Exists(ctx, dataKey("a")); exists {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if exists, _ := replicas[1].Exists(ctx, dataKey("a")); !exists {
+		t.Fatal("Objects under data/ should be repaired")
+	}
+	// give another round a chance to run
+	time.Sleep(50 * time.Millisecond)
+	for _, key := range []string{"tmp/upload", "refs/heads/main"} {
+		if exists, _ := replicas[1].Exists(ctx, key); exists {
+			t.Errorf("Mutable key %v should not be repaired", key)
+		}
+	}
+}
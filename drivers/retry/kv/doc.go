@@ -0,0 +1,6 @@
+// package kv implements a cas.KV decorator which retries operations
+// that failed with transient errors (see cas.ErrTransient)
+//
+// Since cas objects are content-addressed, every operation executed
+// by cas is idempotent and can be retried safely.
+package kv
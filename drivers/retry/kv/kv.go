@@ -0,0 +1,370 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/spool"
+	"github.com/rs/zerolog"
+)
+
+type (
+	// Bucket retries operations on the actual KV using
+	// exponential backoff with jitter
+	Bucket struct {
+		actual cas.KV
+		cfg    config
+	}
+
+	// RetryHook is called before waiting for the next attempt
+	RetryHook func(op, key string, attempt int, wait time.Duration, err error)
+
+	config struct {
+		maxAttempts  int
+		initialDelay time.Duration
+		maxDelay     time.Duration
+		spoolLimit   int64
+		retryable    func(error) bool
+		hooks        []RetryHook
+	}
+
+	Option func(cfg *config) error
+
+	// skipWriter discards the first skip bytes and writes the
+	// remaining ones to actual, it is used to resume reads
+	// without writing the same bytes twice to the output
+	skipWriter struct {
+		actual io.Writer
+		skip   int64
+	}
+)
+
+const (
+	errListPartial = cas.Err("listing failed after keys were returned")
+
+	DefaultMaxAttempts  = 5
+	DefaultInitialDelay = 100 * time.Millisecond
+	DefaultMaxDelay     = 5 * time.Second
+	// DefaultSpoolLimit is the amount of bytes from a Write
+	// which are kept in memory, larger objects are
+	// spooled to a temporary file
+	DefaultSpoolLimit = 16_000_000
+)
+
+// MaxAttempts configures how many times an operation is executed
+// before giving up, it includes the first attempt.
+func MaxAttempts(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return fmt.Errorf("max attempts must be at least 1, got %v", n)
+		}
+		cfg.maxAttempts = n
+		return nil
+	}
+}
+
+// Backoff configures the delay before the first retry and the
+// upper limit for the delay between attempts
+func Backoff(initial, max time.Duration) Option {
+	return func(cfg *config) error {
+		if initial <= 0 || max < initial {
+			return fmt.Errorf("invalid backoff interval [%v, %v]", initial, max)
+		}
+		cfg.initialDelay = initial
+		cfg.maxDelay = max
+		return nil
+	}
+}
+
+// SpoolLimit configures how many bytes from a Write are kept in memory
+// before spooling the content to a temporary file
+func SpoolLimit(n int64) Option {
+	return func(cfg *config) error {
+		cfg.spoolLimit = n
+		return nil
+	}
+}
+
+// RetryIf replaces the function used to decide if an error should be
+// retried, by default only errors classified as cas.ErrTransient are.
+func RetryIf(fn func(error) bool) Option {
+	return func(cfg *config) error {
+		cfg.retryable = fn
+		return nil
+	}
+}
+
+// OnRetry adds a hook which is called before every retry
+func OnRetry(hook RetryHook) Option {
+	return func(cfg *config) error {
+		cfg.hooks = append(cfg.hooks, hook)
+		return nil
+	}
+}
+
+// Logger logs every retry as a warning using the given logger
+func Logger(logger zerolog.Logger) Option {
+	return OnRetry(func(op, key string, attempt int, wait time.Duration, err error) {
+		logger.Warn().Err(err).
+			Str("op", op).
+			Str("key", key).
+			Int("attempt", attempt).
+			Dur("wait", wait).
+			Msg("Retrying kv operation")
+	})
+}
+
+// Wrap returns a KV which retries operations executed against actual
+//
+// Closing the returned bucket also closes actual
+func Wrap(actual cas.KV, options ...Option) (*Bucket, error) {
+	cfg := config{
+		maxAttempts:  DefaultMaxAttempts,
+		initialDelay: DefaultInitialDelay,
+		maxDelay:     DefaultMaxDelay,
+		spoolLimit:   DefaultSpoolLimit,
+		retryable:    cas.IsRetryable,
+	}
+	for _, opt := range options {
+		err := opt(&cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Bucket{actual: actual, cfg: cfg}, nil
+}
+
+func (b *Bucket) Close() error { return b.actual.Close() }
+
+func (b *Bucket) Copy(ctx context.Context, to, from string) error {
+	return b.do(ctx, "copy", from, func(int) error {
+		return b.actual.Copy(ctx, to, from)
+	})
+}
+
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	return b.do(ctx, "delete", key, func(attempt int) error {
+		err := b.actual.Delete(ctx, key)
+		if attempt > 1 && errors.Is(err, cas.ErrNotFound) {
+			// a previous attempt removed the object
+			// but failed before reporting it
+			return nil
+		}
+		return err
+	})
+}
+
+func (b *Bucket) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := b.do(ctx, "exists", key, func(int) error {
+		var err error
+		exists, err = b.actual.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (b *Bucket) ModTime(ctx context.Context, key string) (time.Time, error) {
+	mt, ok := b.actual.(cas.ModTimer)
+	if !ok {
+		return time.Time{}, cas.ErrNotSupported
+	}
+	var modTime time.Time
+	err := b.do(ctx, "stat", key, func(int) error {
+		var err error
+		modTime, err = mt.ModTime(ctx, key)
+		return err
+	})
+	return modTime, err
+}
+
+// Move uses the Move operation from the actual KV if it implements
+// cas.Mover, otherwise it is executed as a Copy followed by a Delete
+func (b *Bucket) Move(ctx context.Context, to, from string) error {
+	mover, ok := b.actual.(cas.Mover)
+	if !ok {
+		if err := b.Copy(ctx, to, from); err != nil {
+			return err
+		}
+		return b.Delete(ctx, from)
+	}
+	return b.do(ctx, "move", from, func(attempt int) error {
+		err := mover.Move(ctx, to, from)
+		if attempt > 1 && errors.Is(err, cas.ErrNotFound) {
+			// check if a previous attempt moved the object
+			if exists, existsErr := b.actual.Exists(ctx, to); existsErr == nil && exists {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+// List retries the listing only if it failed before any key was
+// passed to fn, otherwise fn would receive the same key twice
+func (b *Bucket) List(ctx context.Context, prefix string, fn func(string) error) error {
+	lister, ok := b.actual.(cas.Lister)
+	if !ok {
+		return cas.ErrNotSupported
+	}
+	var called bool
+	var partialErr error
+	err := b.do(ctx, "list", prefix, func(int) error {
+		err := lister.List(ctx, prefix, func(key string) error {
+			called = true
+			return fn(key)
+		})
+		if err != nil && called {
+			partialErr = err
+			return errListPartial
+		}
+		return err
+	})
+	if errors.Is(err, errListPartial) {
+		return partialErr
+	}
+	return err
+}
+
+// Read retries failed reads, bytes which were already written to w
+// are skipped by the next attempts
+func (b *Bucket) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	sw := skipWriter{actual: w}
+	var total int64
+	err := b.do(ctx, "read", key, func(int) error {
+		sw.skip = total
+		n, err := b.actual.Read(ctx, &sw, key)
+		if n > total {
+			total = n
+		}
+		return err
+	})
+	return total, err
+}
+
+// ReadRange resumes interrupted reads from the last byte written to w
+func (b *Bucket) ReadRange(ctx context.Context, w io.Writer, key string, offset, length int64) (int64, error) {
+	var total int64
+	err := b.do(ctx, "read", key, func(int) error {
+		n, err := cas.ReadRange(ctx, b.actual, w, key, offset+total, length-total)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+// ReadVersion retries failed reads, unlike Read the output is
+// buffered so w only receives the content of a single version
+func (b *Bucket) ReadVersion(ctx context.Context, w io.Writer, key string) (string, error) {
+	cw, ok := b.actual.(cas.ConditionalWriter)
+	if !ok {
+		return "", cas.ErrNotSupported
+	}
+	var version string
+	buf := &bytes.Buffer{}
+	err := b.do(ctx, "read", key, func(int) error {
+		buf.Reset()
+		var err error
+		version, err = cw.ReadVersion(ctx, buf, key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write(buf.Bytes())
+	return version, err
+}
+
+// CheckConditionalWrites reports if the actual KV
+// supports conditional writes
+func (b *Bucket) CheckConditionalWrites() error {
+	_, err := cas.AsConditionalWriter(b.actual)
+	return err
+}
+
+// WriteIf is never retried, after a failure it is not possible
+// to know if the write was applied, retrying it would report
+// a precondition failure on success
+func (b *Bucket) WriteIf(ctx context.Context, key string, input io.Reader, version string) (string, error) {
+	cw, ok := b.actual.(cas.ConditionalWriter)
+	if !ok {
+		return "", cas.ErrNotSupported
+	}
+	return cw.WriteIf(ctx, key, input, version)
+}
+
+// Write reads the whole input before sending it to the actual KV,
+// that way it can be sent again in case of failures
+func (b *Bucket) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	content, err := spool.Read(input, b.cfg.spoolLimit)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	var n int64
+	err = b.do(ctx, "write", key, func(int) error {
+		var err error
+		n, err = b.actual.Write(ctx, key, content.NewReader())
+		return err
+	})
+	return n, err
+}
+
+func (b *Bucket) do(ctx context.Context, op, key string, fn func(attempt int) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(attempt)
+		if err == nil || !b.cfg.retryable(err) || attempt >= b.cfg.maxAttempts {
+			break
+		}
+		wait := b.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			// no point in waiting if the context won't
+			// allow another attempt
+			break
+		}
+		for _, h := range b.cfg.hooks {
+			h(op, key, attempt, wait, err)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%v %v: %w, last error: %v", op, key, ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+// delay computes the exponential backoff for the given attempt
+// using "equal jitter", so the wait is never less than half
+// of the computed delay
+func (b *Bucket) delay(attempt int) time.Duration {
+	d := b.cfg.initialDelay
+	for i := 1; i < attempt && d < b.cfg.maxDelay; i++ {
+		d *= 2
+	}
+	if d > b.cfg.maxDelay {
+		d = b.cfg.maxDelay
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (s *skipWriter) Write(buf []byte) (int, error) {
+	if s.skip >= int64(len(buf)) {
+		s.skip -= int64(len(buf))
+		return len(buf), nil
+	}
+	n, err := s.actual.Write(buf[s.skip:])
+	n += int(s.skip)
+	s.skip = 0
+	return n, err
+}
@@ -0,0 +1,178 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/cas/kvtest"
+	gcloud "github.com/andrebq/dbfs/drivers/gcloud/kv"
+
+	_ "gocloud.dev/blob/memblob"
+)
+
+type (
+	// flakyKV fails the first failures calls to any operation
+	// with err, after writing half of the content on reads
+	flakyKV struct {
+		cas.KV
+		failures int
+		calls    int
+		err      error
+	}
+)
+
+var (
+	errFlaky = cas.NewKVError(cas.ErrTransient, "test", "key", errors.New("connection reset"))
+	errFatal = cas.NewKVError(cas.ErrPermissionDenied, "test", "key", errors.New("access denied"))
+)
+
+func (f *flakyKV) fail() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakyKV) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	if err := f.fail(); err != nil {
+		buf := &bytes.Buffer{}
+		f.KV.Read(ctx, buf, key)
+		n, _ := w.Write(buf.Bytes()[:buf.Len()/2])
+		return int64(n), err
+	}
+	return f.KV.Read(ctx, w, key)
+}
+
+func (f *flakyKV) Write(ctx context.Context, key string, input io.Reader) (int64, error) {
+	if err := f.fail(); err != nil {
+		// consume part of the input, just like a
+		// connection reset during the upload
+		io.CopyN(ioutil.Discard, input, 3)
+		return 0, err
+	}
+	return f.KV.Write(ctx, key, input)
+}
+
+func (f *flakyKV) Exists(ctx context.Context, key string) (bool, error) {
+	if err := f.fail(); err != nil {
+		return false, err
+	}
+	return f.KV.Exists(ctx, key)
+}
+
+func newFlaky(t *testing.T, failures int, err error) *flakyKV {
+	bucket, err2 := gcloud.Connect(context.Background(), "mem://")
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	return &flakyKV{KV: bucket, failures: failures, err: err}
+}
+
+func fastRetries(t *testing.T, actual cas.KV, options ...Option) *Bucket {
+	b, err := Wrap(actual, append([]Option{Backoff(time.Millisecond, 2*time.Millisecond)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestConformance(t *testing.T) {
+	kvtest.Run(t, func(ctx context.Context) (cas.KV, error) {
+		bucket, err := gcloud.Connect(ctx, "mem://")
+		if err != nil {
+			return nil, err
+		}
+		return Wrap(bucket, Backoff(time.Millisecond, 2*time.Millisecond))
+	})
+}
+
+func TestRetryTransient(t *testing.T) {
+	ctx := context.Background()
+	flaky := newFlaky(t, 2, errFlaky)
+	var retries int
+	b := fastRetries(t, flaky, OnRetry(func(op, key string, attempt int, wait time.Duration, err error) {
+		retries++
+	}))
+
+	if _, err := b.Write(ctx, "obj", bytes.NewBufferString("abc123")); err != nil {
+		t.Fatal(err)
+	}
+	if retries != 2 {
+		t.Errorf("Expecting 2 retries got %v", retries)
+	}
+
+	flaky.calls = 0
+	buf := &bytes.Buffer{}
+	n, err := b.Read(ctx, buf, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 || buf.String() != "abc123" {
+		t.Errorf("Read after retries should return the whole content once, got %v bytes: %q", n, buf.String())
+	}
+}
+
+func TestFatalErrorsAreNotRetried(t *testing.T) {
+	flaky := newFlaky(t, 2, errFatal)
+	b := fastRetries(t, flaky)
+	_, err := b.Exists(context.Background(), "obj")
+	if !errors.Is(err, cas.ErrPermissionDenied) {
+		t.Errorf("Expecting permission denied got %v", err)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("Fatal errors should not be retried, got %v calls", flaky.calls)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	flaky := newFlaky(t, 10, errFlaky)
+	b := fastRetries(t, flaky, MaxAttempts(3))
+	_, err := b.Exists(context.Background(), "obj")
+	if !errors.Is(err, cas.ErrTransient) {
+		t.Errorf("Expecting the last transient error got %v", err)
+	}
+	if flaky.calls != 3 {
+		t.Errorf("Expecting 3 calls got %v", flaky.calls)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	flaky := newFlaky(t, 10, errFlaky)
+	b, err := Wrap(flaky, Backoff(time.Second, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = b.Exists(ctx, "obj")
+	if !errors.Is(err, cas.ErrTransient) {
+		t.Errorf("Expecting the last transient error got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Retry should give up when the deadline does not allow another attempt, took %v", elapsed)
+	}
+}
+
+func TestSpoolToDisk(t *testing.T) {
+	ctx := context.Background()
+	flaky := newFlaky(t, 1, errFlaky)
+	b := fastRetries(t, flaky, SpoolLimit(4))
+	content := []byte("larger than the spool limit")
+	if _, err := b.Write(ctx, "obj", bytes.NewBuffer(content)); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := b.Read(ctx, buf, "obj"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("Expecting %q got %q", content, buf.Bytes())
+	}
+}
@@ -3,12 +3,17 @@ module github.com/andrebq/dbfs
 go 1.14
 
 require (
+	9fans.net/go v0.0.4
+	cloud.google.com/go/storage v1.15.0
 	github.com/chmduquesne/rollinghash v4.0.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/google/uuid v1.2.0
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/minio/minio-go/v7 v7.0.10
 	github.com/rs/zerolog v1.22.0
 	github.com/urfave/cli/v2 v2.3.0
 	github.com/vmihailenco/msgpack/v4 v4.3.12
 	gocloud.dev v0.23.0
+	golang.org/x/net v0.0.0-20210505214959-0714010a04ed
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,5 @@
+// package graph knows how objects stored in cas reference each other
+//
+// It is used by any feature which needs to find every object
+// reachable from a root (sync, garbage collection, exports)
+package graph
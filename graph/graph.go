@@ -0,0 +1,218 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+type (
+	// Kind identifies how the content of an object should be decoded
+	Kind uint8
+
+	// Node is an object in the graph
+	Node struct {
+		Ref  cas.Ref
+		Kind Kind
+	}
+)
+
+const (
+	// KindChunk is raw content, it never references other objects
+	KindChunk Kind = iota
+	// KindTree is a blob.Tree
+	KindTree
+	// KindDir is a snapshot.Dir
+	KindDir
+	// KindCommit is a commit.Commit
+	KindCommit
+)
+
+var (
+	// SkipChildren can be returned by the function passed to Walk
+	// to avoid visiting the children of a node
+	SkipChildren = errors.New("skip children")
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindChunk:
+		return "chunk"
+	case KindTree:
+		return "tree"
+	case KindDir:
+		return "dir"
+	case KindCommit:
+		return "commit"
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+// ParseKind returns the Kind whose String value is name
+func ParseKind(name string) (Kind, error) {
+	for _, k := range []Kind{KindChunk, KindTree, KindDir, KindCommit} {
+		if k.String() == name {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown kind %q", name)
+}
+
+// KindOf returns the Kind used to walk objects of type t
+func KindOf(t cas.Type) (Kind, error) {
+	switch t {
+	case cas.TypeRaw:
+		return KindChunk, nil
+	case blob.TreeType:
+		return KindTree, nil
+	case snapshot.DirType:
+		return KindDir, nil
+	case commit.Type:
+		return KindCommit, nil
+	}
+	return 0, fmt.Errorf("objects of type %v cannot be walked", t)
+}
+
+// Detect reads the object at ref and returns the Node for it
+// based on its type header
+func Detect(ctx context.Context, c *cas.C, ref cas.Ref) (Node, error) {
+	t, _, err := c.GetTyped(ctx, ref)
+	if err != nil {
+		return Node{}, fmt.Errorf("unable to read %v, cause: %w", ref, err)
+	}
+	k, err := KindOf(t)
+	if err != nil {
+		return Node{}, err
+	}
+	return Node{Ref: ref, Kind: k}, nil
+}
+
+// Leaf returns true if objects of this kind never reference
+// other objects
+func (k Kind) Leaf() bool {
+	return k == KindChunk
+}
+
+// Children decodes content, including its type header, and
+// returns the nodes referenced by n
+func Children(n Node, content []byte) ([]Node, error) {
+	_, content = cas.DecodeTyped(content)
+	switch n.Kind {
+	case KindChunk:
+		return nil, nil
+	case KindTree:
+		var t blob.Tree
+		if err := t.UnmarshalBinary(content); err != nil {
+			return nil, fmt.Errorf("unable to decode tree %v, cause: %w", n.Ref, err)
+		}
+		kind := KindChunk
+		if len(t.Branches) > 0 {
+			kind = KindTree
+		}
+		var out []Node
+		for _, r := range t.Children() {
+			out = append(out, Node{Ref: r, Kind: kind})
+		}
+		return out, nil
+	case KindDir:
+		var d snapshot.Dir
+		if err := d.UnmarshalBinary(content); err != nil {
+			return nil, fmt.Errorf("unable to decode dir %v, cause: %w", n.Ref, err)
+		}
+		var out []Node
+		for _, e := range d.Entries {
+			switch {
+			case e.IsDir():
+				out = append(out, Node{Ref: e.Ref, Kind: KindDir})
+			case e.IsRegular():
+				out = append(out, Node{Ref: e.Ref, Kind: KindTree})
+			}
+		}
+		return out, nil
+	case KindCommit:
+		var cm commit.Commit
+		if err := cm.UnmarshalBinary(content); err != nil {
+			return nil, fmt.Errorf("unable to decode commit %v, cause: %w", n.Ref, err)
+		}
+		out := []Node{{Ref: cm.Tree, Kind: KindDir}}
+		for _, p := range cm.Parents {
+			out = append(out, Node{Ref: p, Kind: KindCommit})
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown kind %v for %v", n.Kind, n.Ref)
+}
+
+// Read returns the content of n from c
+func Read(ctx context.Context, c *cas.C, n Node) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := c.GetContent(ctx, buf, n.Ref); err != nil {
+		return nil, fmt.Errorf("unable to read %v %v, cause: %w", n.Kind, n.Ref, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Walk calls fn for root and every node reachable from it, parents
+// are visited before their children and every node is visited once.
+//
+// If fn returns SkipChildren, the children of that node are not visited,
+// any other error stops the walk.
+func Walk(ctx context.Context, c *cas.C, root Node, fn func(Node) error) error {
+	seen := make(map[cas.Ref]struct{})
+	pending := []Node{root}
+	for len(pending) > 0 {
+		n := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := seen[n.Ref]; ok {
+			continue
+		}
+		seen[n.Ref] = struct{}{}
+		err := fn(n)
+		if errors.Is(err, SkipChildren) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if n.Kind.Leaf() {
+			continue
+		}
+		content, err := Read(ctx, c, n)
+		if err != nil {
+			return err
+		}
+		children, err := Children(n, content)
+		if err != nil {
+			return err
+		}
+		// push in reverse order, so children are visited
+		// in the order they appear in the parent
+		for i := len(children) - 1; i >= 0; i-- {
+			pending = append(pending, children[i])
+		}
+	}
+	return nil
+}
+
+// Reachable returns the refs of every node reachable from roots
+func Reachable(ctx context.Context, c *cas.C, roots ...Node) (map[cas.Ref]struct{}, error) {
+	live := make(map[cas.Ref]struct{})
+	for _, r := range roots {
+		err := Walk(ctx, c, r, func(n Node) error {
+			if _, ok := live[n.Ref]; ok {
+				return SkipChildren
+			}
+			live[n.Ref] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return live, nil
+}
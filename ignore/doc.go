@@ -0,0 +1,20 @@
+// package ignore decides which files are stored by a snapshot using
+// gitignore-style rules
+//
+// Rules are read from .dbfsignore files found in any directory, they
+// use the same syntax as .gitignore:
+//
+//	# comment
+//	*.o           any file or directory named *.o, at any depth
+//	/build        only build at the same level as the .dbfsignore
+//	docs/*.pdf    patterns with a slash are relative to the .dbfsignore
+//	tmp/          only directories
+//	**/cache      cache at any depth, a/**/b matches zero or more directories
+//	!keep.o       include again something excluded by an earlier rule
+//
+// The last rule matching a path wins and rules from deeper directories
+// take precedence over rules from their parents. Rules given with
+// Exclude and Include take precedence over every file. Once a directory
+// is excluded its entries are never listed, so they cannot be included
+// again.
+package ignore
@@ -0,0 +1,179 @@
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+type (
+	// Filter implements snapshot.Filter, each directory gets its
+	// own Filter with the rules from the ignore files above it
+	Filter struct {
+		cfg      *config
+		patterns []pattern
+	}
+
+	config struct {
+		fileName string
+		caches   bool
+		// extra holds the rules from Exclude and Include
+		extra []pattern
+	}
+
+	Option func(cfg *config) error
+)
+
+const (
+	// DefaultFileName is the name of the files with ignore rules
+	DefaultFileName = ".dbfsignore"
+
+	// cacheTagSignature starts every CACHEDIR.TAG file,
+	// see https://bford.info/cachedir/
+	cacheTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+var (
+	// CacheDirs are the directories skipped by ExcludeCaches
+	CacheDirs = []string{".git", ".hg", ".svn", "node_modules", "__pycache__"}
+)
+
+// FileName changes the name of the files with ignore rules,
+// an empty name disables them
+func FileName(name string) Option {
+	return func(cfg *config) error {
+		cfg.fileName = name
+		return nil
+	}
+}
+
+// Exclude adds rules which take precedence over the ones from files,
+// patterns are relative to the snapshot root
+func Exclude(patterns ...string) Option {
+	return func(cfg *config) error {
+		return cfg.add(patterns, false)
+	}
+}
+
+// Include adds rules which include again entries excluded by
+// ignore files or by Exclude, patterns are relative to the
+// snapshot root. Entries inside an excluded directory are not
+// listed, so Include cannot bring them back; include the directory
+// itself instead
+func Include(patterns ...string) Option {
+	return func(cfg *config) error {
+		return cfg.add(patterns, true)
+	}
+}
+
+// ExcludeCaches skips the directories in CacheDirs and any directory
+// with a CACHEDIR.TAG file, ignore files can include them again
+func ExcludeCaches() Option {
+	return func(cfg *config) error {
+		cfg.caches = true
+		return nil
+	}
+}
+
+// New returns the filter for the root of a snapshot
+func New(options ...Option) (*Filter, error) {
+	cfg := &config{fileName: DefaultFileName}
+	for _, opt := range options {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &Filter{cfg: cfg}, nil
+}
+
+// Enter reads the ignore file inside fullpath, if there is one
+func (f *Filter) Enter(fullpath, p string) (snapshot.Filter, error) {
+	if f.cfg.fileName == "" {
+		return f, nil
+	}
+	fd, err := os.Open(filepath.Join(fullpath, f.cfg.fileName))
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	patterns, err := parse(fd, p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %v, cause: %w", fd.Name(), err)
+	}
+	if len(patterns) == 0 {
+		return f, nil
+	}
+	child := &Filter{cfg: f.cfg, patterns: make([]pattern, 0, len(f.patterns)+len(patterns))}
+	child.patterns = append(child.patterns, f.patterns...)
+	child.patterns = append(child.patterns, patterns...)
+	return child, nil
+}
+
+// Exclude returns true if the last rule matching p excludes it
+func (f *Filter) Exclude(fullpath, p string, info os.FileInfo) bool {
+	isDir := info.IsDir()
+	excluded := f.cfg.caches && isDir && isCache(fullpath, info.Name())
+	for _, list := range [][]pattern{f.patterns, f.cfg.extra} {
+		for _, pat := range list {
+			if pat.match(p, isDir) {
+				excluded = !pat.negate
+			}
+		}
+	}
+	return excluded
+}
+
+func (cfg *config) add(patterns []string, include bool) error {
+	for _, line := range patterns {
+		if include {
+			line = "!" + line
+		}
+		p, ok, err := parsePattern(line, "")
+		if err != nil {
+			return err
+		} else if ok {
+			cfg.extra = append(cfg.extra, p)
+		}
+	}
+	return nil
+}
+
+// parse reads the rules of an ignore file from the directory base
+func parse(r io.Reader, base string) ([]pattern, error) {
+	var patterns []pattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p, ok, err := parsePattern(scanner.Text(), base)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+func isCache(fullpath, name string) bool {
+	for _, n := range CacheDirs {
+		if n == name {
+			return true
+		}
+	}
+	fd, err := os.Open(filepath.Join(fullpath, "CACHEDIR.TAG"))
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	buf := make([]byte, len(cacheTagSignature))
+	if _, err := io.ReadFull(fd, buf); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, []byte(cacheTagSignature))
+}
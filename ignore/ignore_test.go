@@ -0,0 +1,126 @@
+package ignore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+func TestPattern(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		base  string
+		rel   string
+		isDir bool
+		match bool
+	}{
+		{line: "*.o", rel: "main.o", match: true},
+		{line: "*.o", rel: "src/deep/main.o", match: true},
+		{line: "*.o", rel: "main.c"},
+		{line: "/build", rel: "build", isDir: true, match: true},
+		{line: "/build", rel: "src/build", isDir: true},
+		{line: "build/", rel: "src/build", isDir: true, match: true},
+		{line: "build/", rel: "src/build"},
+		{line: "docs/*.pdf", rel: "docs/manual.pdf", match: true},
+		{line: "docs/*.pdf", rel: "src/docs/manual.pdf"},
+		{line: "docs/*.pdf", rel: "docs/old/manual.pdf"},
+		{line: "**/cache", rel: "cache", isDir: true, match: true},
+		{line: "**/cache", rel: "a/b/cache", isDir: true, match: true},
+		{line: "a/**/b", rel: "a/b", match: true},
+		{line: "a/**/b", rel: "a/x/y/b", match: true},
+		{line: "a/**", rel: "a"},
+		{line: "a/**", rel: "a/x/y", match: true},
+		{line: "*.log", base: "src", rel: "src/debug.log", match: true},
+		{line: "*.log", base: "src", rel: "debug.log"},
+		{line: "/out", base: "src", rel: "src/out", match: true},
+		{line: "/out", base: "src", rel: "src/pkg/out"},
+		{line: "\\#notes", rel: "#notes", match: true},
+		{line: "trailing   ", rel: "trailing", match: true},
+	} {
+		p, ok, err := parsePattern(tc.line, tc.base)
+		if err != nil || !ok {
+			t.Fatalf("Unable to parse %q: %v", tc.line, err)
+		}
+		if actual := p.match(tc.rel, tc.isDir); actual != tc.match {
+			t.Errorf("Pattern %q (base %q) on %q (dir: %v) should return %v", tc.line, tc.base, tc.rel, tc.isDir, tc.match)
+		}
+	}
+	for _, line := range []string{"", "   ", "# comment", "/"} {
+		if _, ok, err := parsePattern(line, ""); err != nil || ok {
+			t.Errorf("Line %q should be ignored, got %v %v", line, ok, err)
+		}
+	}
+	if _, _, err := parsePattern("[a-", ""); err == nil {
+		t.Error("Invalid patterns should be reported")
+	}
+}
+
+func TestTake(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	dir, err := ioutil.TempDir("", "dbfs-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		".dbfsignore":               "*.log\n/build/\n",
+		"app.log":                   "excluded",
+		"build/out":                 "excluded",
+		"main.go":                   "package main",
+		"src/.dbfsignore":           "!keep.log\n",
+		"src/keep.log":              "kept by src/.dbfsignore",
+		"src/other.log":             "excluded",
+		"src/build/out":             "kept, /build only applies to the root",
+		"node_modules/pkg/index.js": "excluded by caches",
+		".git/HEAD":                 "excluded by caches",
+		"tmp/CACHEDIR.TAG":          cacheTagSignature + "\n",
+		"tmp/data":                  "excluded by caches",
+		"vendor/lib.go":             "excluded by the command line",
+		"vendor/modules.txt":        "included by the command line",
+		"docs/readme.md":            "kept",
+	} {
+		testutil.WriteFile(t, filepath.Join(dir, filepath.FromSlash(name)), content)
+	}
+	f, err := New(ExcludeCaches(), Exclude("/vendor/*"), Include("vendor/modules.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var excluded []string
+	root, stats, err := snapshot.Take(ctx, c, b, dir, snapshot.Options{
+		Filter:    f,
+		OnExclude: func(p string) { excluded = append(excluded, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	err = snapshot.Walk(ctx, c, root, func(p string, e snapshot.Entry) error {
+		if !e.IsDir() {
+			stored = append(stored, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedStored := []string{".dbfsignore", "docs/readme.md", "main.go", "src/.dbfsignore", "src/build/out", "src/keep.log", "vendor/modules.txt"}
+	if !reflect.DeepEqual(stored, expectedStored) {
+		t.Errorf("Expected files %v got %v", expectedStored, stored)
+	}
+	expectedExcluded := []string{".git", "app.log", "build", "node_modules", "src/other.log", "tmp", "vendor/lib.go"}
+	if !reflect.DeepEqual(excluded, expectedExcluded) || stats.Excluded != len(expectedExcluded) {
+		t.Errorf("Expected excluded paths %v got %v (%v)", expectedExcluded, excluded, stats.Excluded)
+	}
+
+	if _, err := New(Exclude("[a-")); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("Invalid patterns should be reported, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package ignore
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type (
+	// pattern is a single gitignore rule
+	pattern struct {
+		// base is the directory of the file which contains the
+		// rule, relative to the snapshot root
+		base     string
+		negate   bool
+		dirOnly  bool
+		anchored bool
+		segments []string
+	}
+)
+
+// parsePattern parses a line from an ignore file, ok is false for
+// blank lines and comments
+func parsePattern(line, base string) (p pattern, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false, nil
+	}
+	p.base = base
+	switch {
+	case strings.HasPrefix(line, "\\#"), strings.HasPrefix(line, "\\!"):
+		line = line[1:]
+	case strings.HasPrefix(line, "!"):
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// a slash at the beginning or in the middle makes the
+	// pattern relative to the directory of the ignore file
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false, nil
+	}
+	p.segments = strings.Split(line, "/")
+	for _, s := range p.segments {
+		if _, err := path.Match(s, ""); err != nil {
+			return pattern{}, false, fmt.Errorf("invalid pattern %q, cause: %w", line, err)
+		}
+	}
+	return p, true, nil
+}
+
+// match returns true if p matches the entry at rel,
+// a slash separated path relative to the snapshot root
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches each name with a segment of the pattern,
+// ** matches zero or more names, or one or more at the end
+func matchSegments(segments, names []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			rest := segments[1:]
+			if len(rest) == 0 {
+				return len(names) > 0
+			}
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(rest, names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(segments[0], names[0]); !ok {
+			return false
+		}
+		segments, names = segments[1:], names[1:]
+	}
+	return len(names) == 0
+}
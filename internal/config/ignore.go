@@ -0,0 +1,56 @@
+package config
+
+import (
+	"github.com/andrebq/dbfs/ignore"
+	"github.com/urfave/cli/v2"
+)
+
+type (
+	Ignore struct {
+		Exclude       cli.StringSlice
+		Include       cli.StringSlice
+		ExcludeCaches bool
+		NoIgnoreFiles bool
+	}
+)
+
+func (i *Ignore) AllFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:        "exclude",
+			Usage:       "Skip entries matching this gitignore-style pattern, relative to the snapshot root",
+			Destination: &i.Exclude,
+		},
+		&cli.StringSliceFlag{
+			Name:        "include",
+			Usage:       "Store entries matching this pattern even if other rules exclude them, entries inside an excluded directory are never included again",
+			Destination: &i.Include,
+		},
+		&cli.BoolFlag{
+			Name:        "exclude-caches",
+			Usage:       "Skip VCS and dependency directories (.git, node_modules, ...) and directories with a CACHEDIR.TAG",
+			EnvVars:     []string{"DBFS_EXCLUDE_CACHES"},
+			Destination: &i.ExcludeCaches,
+		},
+		&cli.BoolFlag{
+			Name:        "no-ignore-files",
+			Usage:       "Don't read the rules from " + ignore.DefaultFileName + " files",
+			Destination: &i.NoIgnoreFiles,
+		},
+	}
+}
+
+// Filter returns the filter used by snapshots
+func (i *Ignore) Filter() (*ignore.Filter, error) {
+	options := []ignore.Option{
+		ignore.Exclude(i.Exclude.Value()...),
+		ignore.Include(i.Include.Value()...),
+	}
+	if i.ExcludeCaches {
+		options = append(options, ignore.ExcludeCaches())
+	}
+	if i.NoIgnoreFiles {
+		options = append(options, ignore.FileName(""))
+	}
+	return ignore.New(options...)
+}
@@ -1,17 +1,37 @@
 package config
 
-import "github.com/urfave/cli/v2"
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/andrebq/dbfs/cas"
+	fskv "github.com/andrebq/dbfs/drivers/fs/kv"
+	gcloudkv "github.com/andrebq/dbfs/drivers/gcloud/kv"
+	httpkv "github.com/andrebq/dbfs/drivers/http/kv"
+	miniokv "github.com/andrebq/dbfs/drivers/minio/kv"
+	"github.com/urfave/cli/v2"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/memblob"
+)
 
 type (
-	// Storage configures the
+	// Storage configures the kv used to store cas objects
 	Storage struct {
 		Driver string
-		Minio  struct {
+		URL    string
+		// Token authenticates against dbfs servers
+		Token string
+		Minio struct {
 			Endpoint string
 			Username string
 			Password string
 			Token    string
 			Bucket   string
+			Region   string
+			// ConditionalWrites is set when the endpoint
+			// honours conditional PUT requests
+			ConditionalWrites bool
 		}
 	}
 )
@@ -19,10 +39,15 @@ type (
 func (s *Storage) AllFlags() []cli.Flag {
 	return []cli.Flag{
 		s.DriverFlag(),
+		s.URLFlag(),
+		s.TokenFlag(),
 		s.MinioEndpointFlag(),
 		s.MinioUsernameFlag(),
 		s.MinioPasswordFlag(),
 		s.MinioSessionTokenFlag(),
+		s.MinioBucketFlag(),
+		s.MinioRegionFlag(),
+		s.MinioConditionalWritesFlag(),
 	}
 }
 
@@ -31,12 +56,30 @@ func (s *Storage) DriverFlag() cli.Flag {
 		Hidden:      true,
 		Name:        "storage-driver",
 		EnvVars:     []string{"DBFS_STORAGE_DRIVER"},
-		Usage:       "Driver to use for storage, only minio is supported",
+		Usage:       "Driver to use for storage, either minio, gocloud, fs or http",
 		Value:       "minio",
 		Destination: &s.Driver,
 	}
 }
 
+func (s *Storage) URLFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "storage-url",
+		EnvVars:     []string{"DBFS_STORAGE_URL"},
+		Usage:       "Go Cloud bucket URL (eg.: file:///var/lib/dbfs) when storage-driver is gocloud, a directory when it is fs, or the url of a dbfs server when it is http",
+		Destination: &s.URL,
+	}
+}
+
+func (s *Storage) TokenFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "storage-token",
+		EnvVars:     []string{"DBFS_STORAGE_TOKEN"},
+		Usage:       "Token sent to the dbfs server when storage-driver is http",
+		Destination: &s.Token,
+	}
+}
+
 func (s *Storage) MinioEndpointFlag() cli.Flag {
 	return &cli.StringFlag{
 		Name:        "minio-endpoint",
@@ -74,6 +117,103 @@ func (s *Storage) MinioSessionTokenFlag() cli.Flag {
 		EnvVars: []string{"DBFS_MINIO_SESSION_TOKEN", "DBFS_BUCKET_SESSION_TOKEN",
 			"AWS_SESSION_TOKEN", "MINIO_TOKEN"},
 		Usage:       "Token to authenticante against the minio server",
-		Destination: &s.Minio.Username,
+		Destination: &s.Minio.Token,
+	}
+}
+
+func (s *Storage) MinioBucketFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "minio-bucket",
+		EnvVars:     []string{"DBFS_MINIO_BUCKET_NAME", "DBFS_BUCKET_NAME", "DBFS_MINIO_BUCKET", "DBFS_BUCKET"},
+		Usage:       "Bucket where dbfs objects are stored",
+		Value:       "dbfs",
+		Destination: &s.Minio.Bucket,
+	}
+}
+
+func (s *Storage) MinioRegionFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "minio-region",
+		EnvVars:     []string{"DBFS_MINIO_BUCKET_REGION", "DBFS_BUCKET_REGION", "AWS_DEFAULT_REGION"},
+		Usage:       "Region of the minio bucket",
+		Value:       "us-east-1",
+		Destination: &s.Minio.Region,
+	}
+}
+
+func (s *Storage) MinioConditionalWritesFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:        "minio-conditional-writes",
+		EnvVars:     []string{"DBFS_MINIO_CONDITIONAL_WRITES"},
+		Usage:       "Set if the minio server honours If-Match/If-None-Match on PUT, required to update refs (detected for AWS S3 endpoints)",
+		Destination: &s.Minio.ConditionalWrites,
+	}
+}
+
+// Open the cas configured by the storage flags
+func (s *Storage) Open(ctx context.Context) (*cas.C, error) {
+	switch s.Driver {
+	case "minio":
+		return s.openMinio(ctx, s.Minio.Bucket)
+	case "gocloud":
+		if s.URL == "" {
+			return nil, fmt.Errorf("storage-url is required for the gocloud driver")
+		}
+		return s.OpenURL(ctx, s.URL)
+	case "fs":
+		if s.URL == "" {
+			return nil, fmt.Errorf("storage-url is required for the fs driver")
+		}
+		return s.OpenURL(ctx, "fs://"+s.URL)
+	case "http":
+		if s.URL == "" {
+			return nil, fmt.Errorf("storage-url is required for the http driver")
+		}
+		return s.openHTTP(ctx, s.URL)
 	}
+	return nil, fmt.Errorf("storage driver %q is not supported", s.Driver)
+}
+
+// OpenURL opens a cas from the given url, minio://<bucket> urls
+// reuse the minio endpoint and credentials from the storage flags,
+// fs://<dir> urls use a local directory, dbfs+http(s)://<host>
+// urls use a dbfs server, any other scheme is handled by Go Cloud.
+func (s *Storage) OpenURL(ctx context.Context, url string) (*cas.C, error) {
+	if strings.HasPrefix(url, "minio://") {
+		return s.openMinio(ctx, strings.TrimPrefix(url, "minio://"))
+	} else if strings.HasPrefix(url, "fs://") {
+		return cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+			return fskv.Open(strings.TrimPrefix(url, "fs://"))
+		})
+	} else if strings.HasPrefix(url, "dbfs+http://") || strings.HasPrefix(url, "dbfs+https://") {
+		return s.openHTTP(ctx, strings.TrimPrefix(url, "dbfs+"))
+	}
+	return cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return gcloudkv.Connect(ctx, url)
+	})
+}
+
+func (s *Storage) openHTTP(ctx context.Context, endpoint string) (*cas.C, error) {
+	return cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return httpkv.Connect(ctx, endpoint, httpkv.TokenPtr(&s.Token))
+	})
+}
+
+func (s *Storage) openMinio(ctx context.Context, bucket string) (*cas.C, error) {
+	return cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		var condWrites *bool
+		if s.Minio.ConditionalWrites {
+			// keep the detection for AWS endpoints unless
+			// the flag is set
+			condWrites = &s.Minio.ConditionalWrites
+		}
+		return miniokv.Connect(ctx,
+			miniokv.EndpointPtr(&s.Minio.Endpoint),
+			miniokv.AccessKeyIDPtr(&s.Minio.Username),
+			miniokv.SecretAccessKeyPtr(&s.Minio.Password),
+			miniokv.TokenPtr(&s.Minio.Token),
+			miniokv.BucketPtr(&bucket),
+			miniokv.RegionPtr(&s.Minio.Region),
+			miniokv.ConditionalWritesPtr(condWrites))
+	})
 }
@@ -0,0 +1,120 @@
+// package spool keeps a copy of a stream which can be read
+// multiple times, small streams are kept in memory while larger
+// ones are written to a temporary file
+package spool
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type (
+	// S holds the content read from a stream
+	S struct {
+		mem  *bytes.Reader
+		fd   *os.File
+		size int64
+	}
+
+	// W keeps everything written to it, once the amount of bytes
+	// written exceeds its memory limit the content is moved
+	// to a temporary file.
+	W struct {
+		buf   bytes.Buffer
+		fd    *os.File
+		limit int64
+		size  int64
+		err   error
+	}
+)
+
+// Read consumes input and keeps its content, up to memLimit bytes
+// are kept in memory.
+//
+// Callers must call Close to release the temporary file
+func Read(input io.Reader, memLimit int64) (*S, error) {
+	w := NewWriter(memLimit)
+	if _, err := io.Copy(w, input); err != nil {
+		w.Discard()
+		return nil, err
+	}
+	return w.Spool()
+}
+
+// NewWriter returns a writer which keeps up to memLimit bytes
+// in memory
+func NewWriter(memLimit int64) *W {
+	return &W{limit: memLimit}
+}
+
+func (w *W) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.fd == nil && w.size+int64(len(p)) > w.limit {
+		w.fd, w.err = ioutil.TempFile("", "dbfs-spool")
+		if w.err != nil {
+			return 0, w.err
+		}
+		_, w.err = w.fd.Write(w.buf.Bytes())
+		w.buf = bytes.Buffer{}
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+	var n int
+	if w.fd != nil {
+		n, w.err = w.fd.Write(p)
+	} else {
+		n, w.err = w.buf.Write(p)
+	}
+	w.size += int64(n)
+	return n, w.err
+}
+
+// Spool returns the content written so far, w must not
+// be used after this call
+func (w *W) Spool() (*S, error) {
+	if w.err != nil {
+		w.Discard()
+		return nil, w.err
+	}
+	if w.fd != nil {
+		return &S{fd: w.fd, size: w.size}, nil
+	}
+	return &S{mem: bytes.NewReader(w.buf.Bytes()), size: w.size}, nil
+}
+
+// Discard releases the resources used by w, it must not
+// be used after this call
+func (w *W) Discard() {
+	if w.fd != nil {
+		w.fd.Close()
+		os.Remove(w.fd.Name())
+	}
+	w.buf = bytes.Buffer{}
+}
+
+// Size returns the number of bytes kept
+func (s *S) Size() int64 { return s.size }
+
+// NewReader returns a reader over the whole content, readers
+// are independent from each other and can be used concurrently
+func (s *S) NewReader() io.Reader {
+	if s.fd != nil {
+		return io.NewSectionReader(s.fd, 0, s.size)
+	}
+	return io.NewSectionReader(s.mem, 0, s.size)
+}
+
+// Close releases the resources used by s
+func (s *S) Close() error {
+	if s.fd == nil {
+		return nil
+	}
+	err := s.fd.Close()
+	os.Remove(s.fd.Name())
+	return err
+}
@@ -0,0 +1,44 @@
+package testutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+)
+
+const (
+	// BlobSeed seeds the chunker returned by OpenStore,
+	// so chunk boundaries don't change between runs
+	BlobSeed = int64(0x24717b279f5337)
+)
+
+// OpenStore returns a cas backed by a MemoryBucket and
+// a chunker seeded with BlobSeed
+func OpenStore(ctx context.Context, t interface{ Fatal(...interface{}) }) (*cas.C, *blob.B) {
+	c, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) {
+		return MemoryBucket(ctx, t), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := blob.WithSeed(BlobSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, b
+}
+
+// WriteFile writes content to name, parent directories
+// are created if needed
+func WriteFile(t interface{ Fatal(...interface{}) }, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	_ "gocloud.dev/blob/memblob"
 )
 
-// TestBucket returns a bucket that holds its content
+// MemoryBucket returns a bucket that holds its content
 // in the process memory space
 func MemoryBucket(ctx context.Context, t interface{ Fatal(...interface{}) }) *kv.Bucket {
 	bucketKV, err := kv.Connect(ctx, "mem://")
@@ -40,8 +40,15 @@ func MarshalBinary(c Content) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// UnmarshalBinary decodes a Named tuple encoded with MarshalBinary
+func UnmarshalBinary(buf []byte, n *Named) error {
+	return msgpack.NewDecoder(bytes.NewReader(buf)).Decode(n)
+}
+
 func (p Pairs) Named() Named {
-	p.pairs = nil
+	// sort a copy, otherwise calling Add on p would change
+	// the returned tuple
+	p.pairs = append([]Indexed(nil), p.pairs...)
 	sort.Sort(p)
 	return Named{pairs: p.pairs}
 }
@@ -74,6 +81,14 @@ func (n Named) MarshalJSON() ([]byte, error) {
 	})
 }
 
+func (n Named) MarshalYAML() (interface{}, error) {
+	return struct {
+		Pairs []Indexed `yaml:"pairs"`
+	}{
+		Pairs: n.pairs,
+	}, nil
+}
+
 func (n *Named) UnmarshalJSON(val []byte) error {
 	tmp := struct {
 		Pairs []Indexed `json:"pairs"`
@@ -103,7 +118,7 @@ func (n Named) EncodeMsgpack(enc *msgpack.Encoder) error {
 func (n *Named) DecodeMsgpack(dec *msgpack.Decoder) error {
 	sz, err := dec.DecodeArrayLen()
 	if err != nil {
-		return nil
+		return err
 	}
 	if sz < 0 {
 		return errors.New("negative length")
@@ -0,0 +1,63 @@
+package tuple
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNamedRoundTrip(t *testing.T) {
+	ref := [4]byte{1, 2, 3, 4}
+	child := Pairs{}.Add("name", "child").Named()
+	p := Pairs{}.
+		Add("size", int64(10)).
+		Add("refs", [][4]byte{ref}).
+		Add("name", "root").
+		Add("children", []Named{child})
+	named := p.Named()
+
+	// adding more fields must not change a tuple returned by Named
+	_ = p.Add("extra", 1)
+	if len(named.pairs) != 4 {
+		t.Fatalf("Named tuple should have 4 fields got %v", len(named.pairs))
+	}
+	if named.pairs[0][0] != "children" || named.pairs[3][0] != "size" {
+		t.Errorf("Fields should be sorted by name, got %v", named.pairs)
+	}
+
+	buf, err := MarshalBinary(named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := MarshalBinary(Pairs{}.Add("name", "root").Add("children", []Named{child}).
+		Add("size", int64(10)).Add("refs", [][4]byte{ref}).Named())
+	if !bytes.Equal(buf, again) {
+		t.Error("Encoding must not depend on the order fields were added")
+	}
+
+	var decoded Named
+	if err := UnmarshalBinary(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := decoded.Int64("size"); err != nil || size != 10 {
+		t.Errorf("Unexpected size %v %v", size, err)
+	}
+	if name, err := decoded.String("name"); err != nil || name != "root" {
+		t.Errorf("Unexpected name %v %v", name, err)
+	}
+	if refs, err := decoded.BytesList("refs"); err != nil || len(refs) != 1 || !bytes.Equal(refs[0], ref[:]) {
+		t.Errorf("Unexpected refs %v %v", refs, err)
+	}
+	children, err := decoded.NamedList("children")
+	if err != nil || len(children) != 1 {
+		t.Fatalf("Unexpected children %v %v", children, err)
+	}
+	if name, _ := children[0].String("name"); name != "child" {
+		t.Errorf("Unexpected child name %v", name)
+	}
+	if missing, err := decoded.Int64("missing"); err != nil || missing != 0 {
+		t.Errorf("Missing fields should be reported as zero, got %v %v", missing, err)
+	}
+	if _, err := decoded.Int64("name"); err == nil {
+		t.Error("Reading a string as an integer should fail")
+	}
+}
@@ -0,0 +1,168 @@
+package tuple
+
+import "fmt"
+
+// Get returns the value of the field name
+func (n Named) Get(name string) (interface{}, bool) {
+	for _, p := range n.pairs {
+		if len(p) == 2 && p[0] == name {
+			return p[1], true
+		}
+	}
+	return nil, false
+}
+
+// Int64 returns the value of the field name as an int64,
+// any integer type is accepted. Missing fields are reported as 0
+func (n Named) Int64(name string) (int64, error) {
+	v, ok := n.Get(name)
+	if !ok || v == nil {
+		return 0, nil
+	}
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case int32:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int:
+		return int64(v), nil
+	case uint64:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("field %v should be an integer got %T", name, v)
+}
+
+// String returns the value of the field name as a string,
+// missing fields are reported as an empty string
+func (n Named) String(name string) (string, error) {
+	v, ok := n.Get(name)
+	if !ok || v == nil {
+		return "", nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %v should be a string got %T", name, v)
+	}
+	return str, nil
+}
+
+// Bytes returns the value of the field name as a byte slice,
+// missing fields are reported as nil
+func (n Named) Bytes(name string) ([]byte, error) {
+	v, ok := n.Get(name)
+	if !ok || v == nil {
+		return nil, nil
+	}
+	return toBytes(name, v)
+}
+
+// List returns the value of the field name as a list, missing
+// fields are reported as an empty list
+func (n Named) List(name string) ([]interface{}, error) {
+	v, ok := n.Get(name)
+	if !ok || v == nil {
+		return nil, nil
+	}
+	lst, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("field %v should be a list got %T", name, v)
+	}
+	return lst, nil
+}
+
+// BytesList returns the value of the field name as a list of byte slices
+func (n Named) BytesList(name string) ([][]byte, error) {
+	lst, err := n.List(name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(lst))
+	for i, v := range lst {
+		out[i], err = toBytes(name, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Int64List returns the value of the field name as a list of integers
+func (n Named) Int64List(name string) ([]int64, error) {
+	lst, err := n.List(name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int64, len(lst))
+	for i, v := range lst {
+		out[i], err = Named{pairs: []Indexed{{name, v}}}.Int64(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Named returns the value of the field name as a Named tuple
+func (n Named) Named(name string) (Named, error) {
+	lst, err := n.List(name)
+	if err != nil {
+		return Named{}, err
+	}
+	return namedFromList(name, lst)
+}
+
+// NamedList returns the value of the field name as a list of Named tuples
+func (n Named) NamedList(name string) ([]Named, error) {
+	lst, err := n.List(name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Named, len(lst))
+	for i, v := range lst {
+		item, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("field %v should be a list of tuples got %T", name, v)
+		}
+		out[i], err = namedFromList(name, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// namedFromList converts a decoded list of pairs back into
+// a Named tuple
+func namedFromList(name string, lst []interface{}) (Named, error) {
+	n := Named{pairs: make([]Indexed, len(lst))}
+	for i, v := range lst {
+		pair, ok := v.([]interface{})
+		if !ok || len(pair) != 2 {
+			return Named{}, fmt.Errorf("field %v should be a tuple got %T", name, v)
+		}
+		n.pairs[i] = Indexed(pair)
+	}
+	return n, nil
+}
+
+func toBytes(name string, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("field %v should contain bytes got %T", name, v)
+}
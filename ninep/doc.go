@@ -0,0 +1,11 @@
+// package ninep serves snapshot trees with the 9P2000 protocol
+//
+// Linux hosts can mount a share with the in-kernel v9fs client:
+//
+//	mount -t 9p -o trans=tcp,port=5640,version=9p2000,ro 127.0.0.1 /mnt/dbfs
+//
+// Shares are read-only, directories are read from their snapshot
+// objects and files are read with blob.Reader, so only the chunks
+// covering the requested bytes are downloaded. Symbolic links are
+// not exposed since 9P2000 cannot represent them.
+package ninep
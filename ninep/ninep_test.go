@@ -0,0 +1,236 @@
+package ninep
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+func sampleTree(ctx context.Context, t *testing.T, content []byte) (*cas.C, cas.Ref) {
+	c, b := testutil.OpenStore(ctx, t)
+	fileRef, err := b.Upload(ctx, c, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallRef, err := b.Upload(ctx, c, bytes.NewBufferString("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "large.bin", Mode: 0644, Size: int64(len(content)), ModTime: time.Now(), Ref: fileRef},
+		{Name: "link", Mode: os.ModeSymlink | 0777, Target: "large.bin"},
+		{Name: "small.txt", Mode: 0600, Size: 5, ModTime: time.Now(), Ref: smallRef},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "docs", Mode: os.ModeDir | 0755, Size: int64(len(content)) + 5, ModTime: time.Now(), Ref: docs},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, root
+}
+
+func mount(ctx context.Context, t *testing.T, c *cas.C, root cas.Ref, aname string) *client.Fsys {
+	s, err := New(ctx, c, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ctx, l)
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := conn.Attach(nil, "test", aname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	content := make([]byte, 3_000_000)
+	rand.New(rand.NewSource(1)).Read(content)
+	c, root := sampleTree(ctx, t, content)
+	fsys := mount(ctx, t, c, root, "")
+
+	dir, err := fsys.Open("docs", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dir.Dirreadall()
+	dir.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "large.bin" || names[1] != "small.txt" {
+		t.Fatalf("unexpected entries %v", names)
+	}
+
+	st, err := fsys.Stat("docs/large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Length != uint64(len(content)) || st.Mode != 0644 {
+		t.Errorf("unexpected stat %v", st)
+	}
+	if st, err := fsys.Stat("docs"); err != nil {
+		t.Fatal(err)
+	} else if st.Mode&plan9.DMDIR == 0 {
+		t.Errorf("docs should be a directory, got %v", st.Mode)
+	}
+
+	f, err := fsys.Open("docs/large.bin", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 300_000)
+	if _, err := f.ReadAt(buf, 2_000_000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, content[2_000_000:2_300_000]) {
+		t.Error("ReadAt returned the wrong bytes")
+	}
+	if n, err := f.ReadAt(buf, int64(len(content))-10); err != io.EOF || n != 10 {
+		t.Errorf("reading past the end should return the remaining bytes and EOF, got %v %v", n, err)
+	}
+	f.Close()
+
+	if _, err := fsys.Open("docs/link", plan9.OREAD); err == nil {
+		t.Error("symbolic links should not be exposed")
+	}
+	if _, err := fsys.Open("docs/missing", plan9.OREAD); err == nil {
+		t.Error("opening a missing file should fail")
+	}
+	if _, err := fsys.Open("docs/small.txt", plan9.OWRITE); err == nil {
+		t.Error("opening a file for writing should fail")
+	}
+	if _, err := fsys.Create("docs/new.txt", plan9.OWRITE, 0644); err == nil {
+		t.Error("creating a file should fail")
+	}
+}
+
+func TestAttachName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, root := sampleTree(ctx, t, []byte("content"))
+	fsys := mount(ctx, t, c, root, "docs")
+	f, err := fsys.Open("../small.txt", plan9.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 100)
+	n, err := f.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "small" {
+		t.Errorf("unexpected content %q", buf[:n])
+	}
+}
+
+// gatedKV blocks reads while gate is set
+type gatedKV struct {
+	cas.KV
+	mu   sync.Mutex
+	gate chan struct{}
+}
+
+func (g *gatedKV) Read(ctx context.Context, w io.Writer, key string) (int64, error) {
+	g.mu.Lock()
+	gate := g.gate
+	g.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	return g.KV.Read(ctx, w, key)
+}
+
+func TestFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store, root := sampleTree(ctx, t, []byte("content"))
+	gated := &gatedKV{KV: store.KV()}
+	c, err := cas.Open(ctx, func(ctx context.Context) (cas.KV, error) { return gated, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(ctx, c, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	go s.ServeConn(ctx, remote)
+
+	rpc := func(tx *plan9.Fcall) *plan9.Fcall {
+		t.Helper()
+		if err := plan9.WriteFcall(local, tx); err != nil {
+			t.Fatal(err)
+		}
+		rx, err := plan9.ReadFcall(local)
+		if err != nil {
+			t.Fatal(err)
+		} else if rx.Type == plan9.Rerror {
+			t.Fatal(rx.Ename)
+		}
+		return rx
+	}
+	rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: DefaultMsize, Version: plan9.VERSION9P})
+	rpc(&plan9.Fcall{Type: plan9.Tattach, Tag: 1, Fid: 0, Afid: plan9.NOFID, Uname: "test"})
+	rpc(&plan9.Fcall{Type: plan9.Twalk, Tag: 1, Fid: 0, Newfid: 1, Wname: []string{"docs", "small.txt"}})
+	rpc(&plan9.Fcall{Type: plan9.Topen, Tag: 1, Fid: 1, Mode: plan9.OREAD})
+
+	// the read is blocked when the flush arrives
+	gate := make(chan struct{})
+	gated.mu.Lock()
+	gated.gate = gate
+	gated.mu.Unlock()
+	for _, tx := range []*plan9.Fcall{
+		{Type: plan9.Tread, Tag: 2, Fid: 1, Count: 100},
+		{Type: plan9.Tflush, Tag: 3, Oldtag: 2},
+	} {
+		if err := plan9.WriteFcall(local, tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.AfterFunc(100*time.Millisecond, func() { close(gate) })
+	var order []uint16
+	for len(order) < 2 {
+		rx, err := plan9.ReadFcall(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, rx.Tag)
+	}
+	if order[0] != 2 || order[1] != 3 {
+		t.Errorf("Rflush should be sent after the reply of the flushed request, got tags %v", order)
+	}
+}
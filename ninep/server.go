@@ -0,0 +1,544 @@
+package ninep
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"9fans.net/go/plan9"
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// Server serves a directory snapshot to 9P2000 clients
+	Server struct {
+		c    *cas.C
+		root cas.Ref
+		cfg  config
+	}
+
+	config struct {
+		msize uint32
+		owner string
+	}
+
+	Option func(cfg *config) error
+
+	// conn holds the state of a single client connection
+	conn struct {
+		ctx   context.Context
+		s     *Server
+		rwc   io.ReadWriteCloser
+		msize uint32
+
+		wmu sync.Mutex
+
+		mu   sync.Mutex
+		fids map[uint32]*fid
+		// tags holds the requests which were not replied yet,
+		// the channel is closed after the reply is sent
+		tags map[uint16]chan struct{}
+	}
+
+	// fid is a reference to an entry of the snapshot, p is the
+	// slash separated path from the root of the snapshot and
+	// top is the directory selected by the attach name
+	fid struct {
+		mu   sync.Mutex
+		p    string
+		top  string
+		e    snapshot.Entry
+		open bool
+
+		// set when a file is opened
+		r *blob.Reader
+
+		// set when a directory is opened, stats holds one
+		// packed stat per entry, next is the index of the
+		// entry returned by a read at offset
+		stats  [][]byte
+		next   int
+		offset uint64
+	}
+
+	// protoError is sent to clients as the Ename of a Rerror,
+	// the messages match the ones Linux maps to errno values
+	protoError string
+)
+
+const (
+	// DefaultMsize is the largest message accepted by the server,
+	// clients can negotiate smaller messages
+	DefaultMsize = 256 * 1024
+
+	errNotFound  = protoError("No such file or directory")
+	errReadOnly  = protoError("Read-only file system")
+	errNotDir    = protoError("Not a directory")
+	errFidInUse  = protoError("fid already in use")
+	errUnknowFid = protoError("unknown fid")
+	errOpen      = protoError("fid is open")
+	errNotOpen   = protoError("fid is not open")
+	errNoAuth    = protoError("authentication not required")
+	errBadOffset = protoError("bad offset in directory read")
+	errBadMsg    = protoError("unsupported message")
+)
+
+// Msize changes the largest message accepted by the server
+func Msize(n uint32) Option {
+	return func(cfg *config) error {
+		if n < 8192 {
+			return fmt.Errorf("msize must be at least 8192, got %v", n)
+		}
+		cfg.msize = n
+		return nil
+	}
+}
+
+// Owner is reported as the user and group of every file
+func Owner(name string) Option {
+	return func(cfg *config) error {
+		cfg.owner = name
+		return nil
+	}
+}
+
+// New returns a server for the directory snapshot root
+func New(ctx context.Context, c *cas.C, root cas.Ref, options ...Option) (*Server, error) {
+	cfg := config{msize: DefaultMsize, owner: "dbfs"}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := snapshot.ReadDir(ctx, c, root); err != nil {
+		return nil, err
+	}
+	return &Server{c: c, root: root, cfg: cfg}, nil
+}
+
+// Serve accepts connections from l until ctx is done,
+// l is closed before Serve returns
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(ctx, c); err != nil {
+				log.Debug().Err(err).Str("remote", c.RemoteAddr().String()).Msg("9P connection closed")
+			}
+		}()
+	}
+}
+
+// ServeConn handles the requests from rwc until the client
+// disconnects or ctx is done, rwc is closed before ServeConn returns
+func (s *Server) ServeConn(ctx context.Context, rwc io.ReadWriteCloser) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		rwc.Close()
+	}()
+	c := &conn{ctx: ctx, s: s, rwc: rwc, msize: s.cfg.msize,
+		fids: make(map[uint32]*fid),
+		tags: make(map[uint16]chan struct{}),
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		tx, err := plan9.ReadFcall(rwc)
+		if errors.Is(err, io.EOF) || ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if tx.Type == plan9.Tversion {
+			// version resets the session, so it can't
+			// run concurrently with other requests
+			wg.Wait()
+			if err := c.reply(tx, c.version(tx)); err != nil {
+				return err
+			}
+			continue
+		}
+		done := c.start(tx.Tag)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.finish(tx.Tag, done)
+			rx, err := c.handle(tx)
+			if err != nil {
+				rx = &plan9.Fcall{Type: plan9.Rerror, Ename: ename(err)}
+			}
+			if err := c.reply(tx, rx); err != nil {
+				rwc.Close()
+			}
+		}()
+	}
+}
+
+// start records tag as in flight
+func (c *conn) start(tag uint16) chan struct{} {
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.tags[tag] = done
+	c.mu.Unlock()
+	return done
+}
+
+// finish is called after the reply for tag is sent, clients might
+// already be using tag again so only done is removed
+func (c *conn) finish(tag uint16, done chan struct{}) {
+	c.mu.Lock()
+	if c.tags[tag] == done {
+		delete(c.tags, tag)
+	}
+	c.mu.Unlock()
+	close(done)
+}
+
+// flush waits until the request using oldtag is replied, requests
+// are not canceled so the client gets their reply before Rflush
+func (c *conn) flush(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	c.mu.Lock()
+	done, ok := c.tags[tx.Oldtag]
+	c.mu.Unlock()
+	if ok && tx.Oldtag != tx.Tag {
+		select {
+		case <-done:
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		}
+	}
+	return &plan9.Fcall{Type: plan9.Rflush}, nil
+}
+
+func (c *conn) reply(tx, rx *plan9.Fcall) error {
+	rx.Tag = tx.Tag
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return plan9.WriteFcall(c.rwc, rx)
+}
+
+func (c *conn) version(tx *plan9.Fcall) *plan9.Fcall {
+	c.mu.Lock()
+	c.fids = make(map[uint32]*fid)
+	c.mu.Unlock()
+	c.msize = c.s.cfg.msize
+	if tx.Msize < c.msize {
+		c.msize = tx.Msize
+	}
+	version := "unknown"
+	if strings.HasPrefix(tx.Version, plan9.VERSION9P) {
+		// extensions (.u, .L) are not supported, clients
+		// fall back to the base protocol
+		version = plan9.VERSION9P
+	}
+	return &plan9.Fcall{Type: plan9.Rversion, Msize: c.msize, Version: version}
+}
+
+func (c *conn) handle(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	switch tx.Type {
+	case plan9.Tauth:
+		return nil, errNoAuth
+	case plan9.Tattach:
+		return c.attach(tx)
+	case plan9.Tflush:
+		return c.flush(tx)
+	case plan9.Twalk:
+		return c.walk(tx)
+	case plan9.Topen:
+		return c.open(tx)
+	case plan9.Tread:
+		return c.read(tx)
+	case plan9.Tstat:
+		return c.stat(tx)
+	case plan9.Tclunk:
+		if _, err := c.takeFid(tx.Fid); err != nil {
+			return nil, err
+		}
+		return &plan9.Fcall{Type: plan9.Rclunk}, nil
+	case plan9.Tremove:
+		// remove clunks the fid even if it fails
+		if _, err := c.takeFid(tx.Fid); err != nil {
+			return nil, err
+		}
+		return nil, errReadOnly
+	case plan9.Tcreate, plan9.Twrite, plan9.Twstat:
+		return nil, errReadOnly
+	}
+	return nil, errBadMsg
+}
+
+func (c *conn) attach(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if tx.Afid != plan9.NOFID {
+		return nil, errNoAuth
+	}
+	// the attach name selects a directory inside the snapshot
+	p := strings.Join(snapshot.SplitPath(tx.Aname), "/")
+	e, err := c.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, errNotDir
+	}
+	f := &fid{p: p, top: p, e: e}
+	if err := c.addFid(tx.Fid, f); err != nil {
+		return nil, err
+	}
+	return &plan9.Fcall{Type: plan9.Rattach, Qid: f.qid()}, nil
+}
+
+func (c *conn) walk(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	f, err := c.fid(tx.Fid)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	p, top, e, open := f.p, f.top, f.e, f.open
+	f.mu.Unlock()
+	if open {
+		return nil, errOpen
+	}
+	rx := &plan9.Fcall{Type: plan9.Rwalk}
+	for _, name := range tx.Wname {
+		if !e.IsDir() {
+			err = errNotDir
+			break
+		}
+		if name == ".." {
+			// the attached directory is its own parent
+			if p != top {
+				p = strings.TrimPrefix(path.Dir("/"+p), "/")
+			}
+		} else {
+			p = path.Join(p, name)
+		}
+		if e, err = c.lookup(p); err != nil {
+			break
+		}
+		rx.Wqid = append(rx.Wqid, (&fid{p: p, top: top, e: e}).qid())
+	}
+	if err != nil {
+		if len(rx.Wqid) == 0 {
+			return nil, err
+		}
+		// partial walks are reported with the qids
+		// walked so far, newfid is not changed
+		return rx, nil
+	}
+	nf := &fid{p: p, top: top, e: e}
+	if tx.Newfid == tx.Fid {
+		c.mu.Lock()
+		c.fids[tx.Fid] = nf
+		c.mu.Unlock()
+	} else if err := c.addFid(tx.Newfid, nf); err != nil {
+		return nil, err
+	}
+	return rx, nil
+}
+
+func (c *conn) open(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if tx.Mode&3 == plan9.OWRITE || tx.Mode&3 == plan9.ORDWR || tx.Mode&(plan9.OTRUNC|plan9.ORCLOSE) != 0 {
+		return nil, errReadOnly
+	}
+	f, err := c.fid(tx.Fid)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open {
+		return nil, errOpen
+	}
+	if f.e.IsDir() {
+		d, err := snapshot.ReadDir(c.ctx, c.s.c, f.e.Ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range d.Entries {
+			if e.IsSymlink() {
+				continue
+			}
+			child := &fid{p: path.Join(f.p, e.Name), top: f.top, e: e}
+			st, err := c.dir(child).Bytes()
+			if err != nil {
+				return nil, err
+			}
+			f.stats = append(f.stats, st)
+		}
+	} else {
+		if f.r, err = blob.NewReader(c.ctx, c.s.c, f.e.Ref); err != nil {
+			return nil, err
+		}
+	}
+	f.open = true
+	return &plan9.Fcall{Type: plan9.Ropen, Qid: f.qid(), Iounit: c.msize - plan9.IOHDRSZ}, nil
+}
+
+func (c *conn) read(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	f, err := c.fid(tx.Fid)
+	if err != nil {
+		return nil, err
+	}
+	count := tx.Count
+	if max := c.msize - plan9.IOHDRSZ; count > max {
+		count = max
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.open {
+		return nil, errNotOpen
+	}
+	rx := &plan9.Fcall{Type: plan9.Rread}
+	if !f.e.IsDir() {
+		buf := make([]byte, count)
+		n, err := f.r.ReadAt(buf, int64(tx.Offset))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		rx.Data = buf[:n]
+		return rx, nil
+	}
+
+	// directories can only be read from the start or from
+	// where the previous read stopped, and only whole
+	// entries are returned
+	if tx.Offset == 0 {
+		f.next, f.offset = 0, 0
+	} else if tx.Offset != f.offset {
+		return nil, errBadOffset
+	}
+	for f.next < len(f.stats) && len(rx.Data)+len(f.stats[f.next]) <= int(count) {
+		rx.Data = append(rx.Data, f.stats[f.next]...)
+		f.next++
+	}
+	f.offset += uint64(len(rx.Data))
+	return rx, nil
+}
+
+func (c *conn) stat(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	f, err := c.fid(tx.Fid)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	st, err := c.dir(f).Bytes()
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &plan9.Fcall{Type: plan9.Rstat, Stat: st}, nil
+}
+
+// lookup returns the entry at p, symbolic links are not exposed
+func (c *conn) lookup(p string) (snapshot.Entry, error) {
+	e, err := snapshot.Lookup(c.ctx, c.s.c, c.s.root, p)
+	if err != nil {
+		return snapshot.Entry{}, err
+	}
+	if e.IsSymlink() {
+		return snapshot.Entry{}, errNotFound
+	}
+	return e, nil
+}
+
+func (c *conn) dir(f *fid) *plan9.Dir {
+	d := &plan9.Dir{
+		Qid:   f.qid(),
+		Mode:  plan9.Perm(f.e.Mode.Perm()),
+		Atime: uint32(f.e.ModTime.Unix()),
+		Mtime: uint32(f.e.ModTime.Unix()),
+		Name:  f.e.Name,
+		Uid:   c.s.cfg.owner,
+		Gid:   c.s.cfg.owner,
+		Muid:  c.s.cfg.owner,
+	}
+	if f.e.IsDir() {
+		d.Mode |= plan9.DMDIR
+	} else {
+		d.Length = uint64(f.e.Size)
+	}
+	if f.p == f.top {
+		d.Name = "/"
+	}
+	return d
+}
+
+func (c *conn) fid(id uint32) (*fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, errUnknowFid
+	}
+	return f, nil
+}
+
+func (c *conn) addFid(id uint32, f *fid) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.fids[id]; ok {
+		return errFidInUse
+	}
+	c.fids[id] = f
+	return nil
+}
+
+func (c *conn) takeFid(id uint32) (*fid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, errUnknowFid
+	}
+	delete(c.fids, id)
+	return f, nil
+}
+
+// qid identifies files by their path, the version
+// changes with the content of the entry
+func (f *fid) qid() plan9.Qid {
+	h := fnv.New64a()
+	h.Write([]byte(f.p))
+	q := plan9.Qid{Path: h.Sum64(), Vers: binary.BigEndian.Uint32(f.e.Ref[:4]), Type: plan9.QTFILE}
+	if f.e.IsDir() {
+		q.Type = plan9.QTDIR
+	}
+	return q
+}
+
+// ename converts err into the message sent to the client
+func ename(err error) string {
+	var pe protoError
+	switch {
+	case errors.As(err, &pe):
+		return string(pe)
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, cas.ErrNotFound):
+		return string(errNotFound)
+	}
+	return err.Error()
+}
+
+func (e protoError) Error() string { return string(e) }
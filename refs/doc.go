@@ -0,0 +1,8 @@
+// package refs keeps named pointers (eg.: refs/heads/main) to objects
+// stored in a cas
+//
+// Refs are the only mutable keys in the storage, they live in the same
+// KV as the objects and are updated with compare-and-swap semantics,
+// so concurrent writers never lose each other's updates. The KV must
+// implement cas.ConditionalWriter.
+package refs
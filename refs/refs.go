@@ -0,0 +1,166 @@
+package refs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// Store reads and updates the refs kept in a KV
+	Store struct {
+		kv cas.KV
+		cw cas.ConditionalWriter
+	}
+
+	// UpdateFunc computes the new value of a ref from its current
+	// value, found is false if the ref does not exist yet
+	UpdateFunc func(current cas.Ref, found bool) (cas.Ref, error)
+)
+
+const (
+	// Prefix is required for every ref name
+	Prefix = "refs/"
+
+	// MaxUpdateAttempts limits how many times Update retries
+	// after a concurrent change to the same ref
+	MaxUpdateAttempts = 16
+)
+
+// Open returns a Store which keeps its refs in kv
+func Open(kv cas.KV) (*Store, error) {
+	cw, err := cas.AsConditionalWriter(kv)
+	if err != nil {
+		return nil, fmt.Errorf("refs require conditional writes, cause: %w", err)
+	}
+	return &Store{kv: kv, cw: cw}, nil
+}
+
+// ValidName returns an error if name cannot be used as a ref,
+// names start with Prefix and are made of non-empty segments of
+// ascii letters, digits, '-', '_' and '.' which don't start with '.'
+func ValidName(name string) error {
+	if !strings.HasPrefix(name, Prefix) {
+		return fmt.Errorf("invalid ref name %q, it must start with %q", name, Prefix)
+	}
+	for _, seg := range strings.Split(name[len(Prefix):], "/") {
+		if seg == "" || seg[0] == '.' {
+			return fmt.Errorf("invalid ref name %q, empty segment or segment starting with '.'", name)
+		}
+		for _, c := range seg {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') &&
+				c != '-' && c != '_' && c != '.' {
+				return fmt.Errorf("invalid ref name %q, unexpected character %q", name, c)
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns the object pointed by name and the version of the ref,
+// which can be passed to Set. Missing refs return an error matching
+// cas.ErrNotFound
+func (s *Store) Get(ctx context.Context, name string) (cas.Ref, string, error) {
+	if err := ValidName(name); err != nil {
+		return cas.Ref{}, "", err
+	}
+	buf := &bytes.Buffer{}
+	version, err := s.cw.ReadVersion(ctx, buf, name)
+	if err != nil {
+		return cas.Ref{}, "", err
+	}
+	ref, err := decode(buf.Bytes())
+	if err != nil {
+		return cas.Ref{}, "", fmt.Errorf("unable to decode %v, cause: %w", name, err)
+	}
+	return ref, version, nil
+}
+
+// Set points name to ref, only if the ref is still at version.
+// An empty version requires that name does not exist yet.
+//
+// If the ref was changed by someone else, the error
+// matches cas.ErrPreconditionFailed
+func (s *Store) Set(ctx context.Context, name string, ref cas.Ref, version string) (string, error) {
+	if err := ValidName(name); err != nil {
+		return "", err
+	}
+	return s.cw.WriteIf(ctx, name, strings.NewReader(ref.String()+"\n"), version)
+}
+
+// Update reads the current value of name, computes the new value
+// with fn and writes it back. If the ref changes between the read
+// and the write, the process starts again.
+//
+// fn might be called multiple times and must not have side-effects,
+// errors returned by fn are returned without changes
+func (s *Store) Update(ctx context.Context, name string, fn UpdateFunc) (cas.Ref, error) {
+	var err error
+	for attempt := 0; attempt < MaxUpdateAttempts; attempt++ {
+		current, version, getErr := s.Get(ctx, name)
+		found := getErr == nil
+		if getErr != nil && !errors.Is(getErr, cas.ErrNotFound) {
+			return cas.Ref{}, getErr
+		}
+		var next cas.Ref
+		next, err = fn(current, found)
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		if found && next == current {
+			return current, nil
+		}
+		_, err = s.Set(ctx, name, next, version)
+		if err == nil {
+			return next, nil
+		} else if !errors.Is(err, cas.ErrPreconditionFailed) {
+			return cas.Ref{}, err
+		}
+	}
+	return cas.Ref{}, fmt.Errorf("unable to update %v after %v attempts, cause: %w", name, MaxUpdateAttempts, err)
+}
+
+// Delete removes name.
+//
+// Deletes are not conditional, a concurrent update to the same
+// ref might be lost
+func (s *Store) Delete(ctx context.Context, name string) error {
+	if err := ValidName(name); err != nil {
+		return err
+	}
+	return s.kv.Delete(ctx, name)
+}
+
+// List calls fn for every ref whose name starts with prefix,
+// the order of the names depends on the KV
+func (s *Store) List(ctx context.Context, prefix string, fn func(name string, ref cas.Ref) error) error {
+	lister, ok := s.kv.(cas.Lister)
+	if !ok {
+		return cas.ErrNotSupported
+	}
+	if !strings.HasPrefix(prefix, Prefix) {
+		prefix = Prefix + prefix
+	}
+	return lister.List(ctx, prefix, func(name string) error {
+		if ValidName(name) != nil {
+			// not a ref, eg.: a temporary file left by a driver
+			return nil
+		}
+		ref, _, err := s.Get(ctx, name)
+		if errors.Is(err, cas.ErrNotFound) {
+			// removed after the listing started
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(name, ref)
+	})
+}
+
+func decode(content []byte) (cas.Ref, error) {
+	return cas.ParseRef(strings.TrimSpace(string(content)))
+}
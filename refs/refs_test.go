@@ -0,0 +1,148 @@
+package refs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	fs "github.com/andrebq/dbfs/drivers/fs/kv"
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+func TestSetGet(t *testing.T) {
+	ctx := context.Background()
+	s, err := Open(testutil.MemoryBucket(ctx, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := cas.PrecomputeHashBytes([]byte("first"))
+	second := cas.PrecomputeHashBytes([]byte("second"))
+
+	if _, _, err := s.Get(ctx, "refs/heads/main"); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Get on a missing ref should return cas.ErrNotFound got %v", err)
+	}
+	version, err := s.Set(ctx, "refs/heads/main", first, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set(ctx, "refs/heads/main", second, ""); !errors.Is(err, cas.ErrPreconditionFailed) {
+		t.Errorf("Creating an existing ref should fail, got %v", err)
+	}
+	if _, err := s.Set(ctx, "refs/heads/main", second, version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set(ctx, "refs/heads/main", first, version); !errors.Is(err, cas.ErrPreconditionFailed) {
+		t.Errorf("Set with a stale version should fail, got %v", err)
+	}
+	if ref, _, err := s.Get(ctx, "refs/heads/main"); err != nil {
+		t.Fatal(err)
+	} else if ref != second {
+		t.Errorf("Ref should point to %v got %v", second, ref)
+	}
+
+	if _, err := s.Set(ctx, "refs/tags/v1", first, ""); err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]cas.Ref{}
+	err = s.List(ctx, "heads/", func(name string, ref cas.Ref) error {
+		found[name] = ref
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found["refs/heads/main"] != second {
+		t.Errorf("List should return only refs/heads/main got %v", found)
+	}
+
+	if err := s.Delete(ctx, "refs/heads/main"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get(ctx, "refs/heads/main"); !errors.Is(err, cas.ErrNotFound) {
+		t.Errorf("Get after Delete should return cas.ErrNotFound got %v", err)
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"refs/heads/main":    true,
+		"refs/tags/v1.0_rc":  true,
+		"heads/main":         false,
+		"refs/":              false,
+		"refs/heads//main":   false,
+		"refs/heads/.hidden": false,
+		"refs/heads/../x":    false,
+		"refs/heads/a b":     false,
+	} {
+		if err := ValidName(name); (err == nil) != valid {
+			t.Errorf("ValidName(%q) should be %v got %v", name, valid, err)
+		}
+	}
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbfs-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	// the counter is kept in the first bytes of the ref, lost
+	// updates would make the final value smaller than expected
+	const writers, updates = 4, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kv, err := fs.Open(dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+			s, err := Open(kv)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < updates; j++ {
+				_, err := s.Update(ctx, "refs/counter", func(current cas.Ref, found bool) (cas.Ref, error) {
+					binary.BigEndian.PutUint64(current[:], binary.BigEndian.Uint64(current[:])+1)
+					return current, nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	kv, err := fs.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _, err := s.Get(ctx, "refs/counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint64(ref[:]); n != writers*updates {
+		t.Errorf("Counter should be %v got %v", writers*updates, n)
+	}
+}
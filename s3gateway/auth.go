@@ -0,0 +1,220 @@
+package s3gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+type (
+	// signature holds what is needed to verify the chunks
+	// of a streaming upload
+	signature struct {
+		key   []byte
+		date  string
+		scope string
+		seed  string
+	}
+
+	// chunkedReader decodes aws-chunked bodies, when sig is not
+	// nil the signature of every chunk is verified
+	chunkedReader struct {
+		r    *bufio.Reader
+		sig  *signature
+		prev string
+		buf  []byte
+		done bool
+	}
+)
+
+const (
+	signAlgorithm      = "AWS4-HMAC-SHA256"
+	streamingPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	amzDateFormat      = "20060102T150405Z"
+	emptySHA256        = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxClockSkew       = 15 * time.Minute
+	maxChunkSize       = 16 << 20
+	chunkSignaturePart = ";chunk-signature="
+)
+
+// verify checks the AWS signature version 4 of req, only
+// signatures sent in the Authorization header are accepted
+func (g *Gateway) verify(req *http.Request) (*signature, error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signAlgorithm+" ") {
+		return nil, errAccessDenied
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, signAlgorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return nil, errAccessDenied
+	}
+	if credential[0] != g.cfg.accessKey {
+		return nil, errInvalidAccessKey
+	}
+	scope := credential[1]
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[3] != "aws4_request" {
+		return nil, errAccessDenied
+	}
+
+	date := req.Header.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, date)
+	if err != nil {
+		return nil, errAccessDenied
+	}
+	if skew := time.Since(t); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errTimeSkewed
+	}
+
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = unsignedPayload
+	}
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	var headers strings.Builder
+	for _, name := range signed {
+		headers.WriteString(name)
+		headers.WriteByte(':')
+		if name == "host" {
+			headers.WriteString(req.Host)
+		} else {
+			values := req.Header[http.CanonicalHeaderKey(name)]
+			for i, v := range values {
+				if i > 0 {
+					headers.WriteByte(',')
+				}
+				headers.WriteString(strings.Join(strings.Fields(v), " "))
+			}
+		}
+		headers.WriteByte('\n')
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		s3utils.EncodePath(req.URL.Path),
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		headers.String(),
+		fields["SignedHeaders"],
+		payload,
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+g.cfg.secretKey), scopeParts[0])
+	for _, part := range scopeParts[1:] {
+		key = hmacSHA256(key, part)
+	}
+	toSign := strings.Join([]string{signAlgorithm, date, scope, sha256Hex([]byte(canonical))}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(key, toSign))
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return nil, errSignatureMismatch
+	}
+	return &signature{key: key, date: date, scope: scope, seed: expected}, nil
+}
+
+// body returns the content of req, aws-chunked bodies are decoded
+func body(req *http.Request, sig *signature) io.Reader {
+	if req.Header.Get("X-Amz-Content-Sha256") != streamingPayload {
+		return req.Body
+	}
+	cr := &chunkedReader{r: bufio.NewReader(req.Body), sig: sig}
+	if sig != nil {
+		cr.prev = sig.seed
+	}
+	return cr
+}
+
+// contentLength returns the size of the decoded body, or -1 if unknown
+func contentLength(req *http.Request) int64 {
+	if req.Header.Get("X-Amz-Content-Sha256") != streamingPayload {
+		return req.ContentLength
+	}
+	n, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+func (c *chunkedReader) Read(buf []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next reads the chunk "<hex size>;chunk-signature=<sig>\r\n<data>\r\n",
+// the last chunk has no data
+func (c *chunkedReader) next() error {
+	header, err := c.r.ReadString('\n')
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	header = strings.TrimSuffix(header, "\r\n")
+	sep := strings.Index(header, chunkSignaturePart)
+	if sep < 0 {
+		return errBadChunk
+	}
+	size, err := strconv.ParseInt(header[:sep], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errBadChunk
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return unexpectedEOF(err)
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return errBadChunk
+	}
+	data = data[:size]
+	if c.sig != nil {
+		toSign := strings.Join([]string{signAlgorithm + "-PAYLOAD", c.sig.date, c.sig.scope, c.prev, emptySHA256, sha256Hex(data)}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.sig.key, toSign))
+		if !hmac.Equal([]byte(expected), []byte(header[sep+len(chunkSignaturePart):])) {
+			return errSignatureMismatch
+		}
+		c.prev = expected
+	}
+	c.buf = data
+	c.done = size == 0
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
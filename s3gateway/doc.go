@@ -0,0 +1,16 @@
+// package s3gateway exposes named refs and snapshots as S3 buckets
+//
+// Each ref under refs/heads/ whose short name is a valid bucket name is
+// served as a bucket, the paths of its tree are the object keys. Fixed
+// snapshots can also be exposed as read-only buckets.
+//
+// GetObject (with ranges), HeadObject, ListObjectsV2, ListBuckets and
+// PutObject are supported. PutObject chunks the content with blob and
+// records the new tree as a commit of the ref (or as the new value of
+// the ref, when it points to a directory snapshot). Multipart uploads
+// are not supported.
+//
+// When credentials are configured, requests must be signed with AWS
+// signature version 4 in the Authorization header, presigned urls
+// are not supported.
+package s3gateway
@@ -0,0 +1,70 @@
+package s3gateway
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// apiError is sent to clients as a S3 error response
+	apiError struct {
+		status  int
+		code    string
+		message string
+	}
+
+	errorResponse struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string   `xml:"Code"`
+		Message  string   `xml:"Message"`
+		Resource string   `xml:"Resource"`
+	}
+)
+
+var (
+	errAccessDenied      = &apiError{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errInvalidAccessKey  = &apiError{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist"}
+	errSignatureMismatch = &apiError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match"}
+	errTimeSkewed        = &apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server time is too large"}
+	errBadChunk          = &apiError{http.StatusBadRequest, "IncompleteBody", "Invalid chunked upload"}
+	errBadDigest         = &apiError{http.StatusBadRequest, "BadDigest", "The content does not match the digest sent by the client"}
+	errNoSuchBucket      = &apiError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey         = &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errInvalidKey        = &apiError{http.StatusBadRequest, "InvalidArgument", "Keys must be clean slash separated paths"}
+	errReadOnly          = &apiError{http.StatusForbidden, "AccessDenied", "The bucket is read-only"}
+	errNotImplemented    = &apiError{http.StatusNotImplemented, "NotImplemented", "The operation is not supported by the gateway"}
+	errMethodNotAllowed  = &apiError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed for this resource"}
+	errInvalidArgument   = &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+)
+
+func (e *apiError) Error() string { return e.code + ": " + e.message }
+
+// writeError sends err as a S3 error, errors which are not
+// an apiError are reported as InternalError
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	var ae *apiError
+	if !errors.As(err, &ae) {
+		if errors.Is(err, cas.ErrNotFound) {
+			ae = errNoSuchKey
+		} else {
+			log.Error().Err(err).Str("method", req.Method).Str("path", req.URL.Path).Msg("Request failed")
+			ae = &apiError{http.StatusInternalServerError, "InternalError", err.Error()}
+		}
+	}
+	if req.Method == http.MethodHead {
+		w.WriteHeader(ae.status)
+		return
+	}
+	writeXML(w, ae.status, errorResponse{Code: ae.code, Message: ae.message, Resource: req.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
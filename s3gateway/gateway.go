@@ -0,0 +1,311 @@
+package s3gateway
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/refs"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+type (
+	// Gateway is a http.Handler which implements a subset
+	// of the S3 API on top of refs and snapshots
+	Gateway struct {
+		c    *cas.C
+		refs *refs.Store
+		cfg  config
+	}
+
+	config struct {
+		blob      *blob.B
+		accessKey string
+		secretKey string
+		region    string
+		author    string
+		readOnly  bool
+		snapshots map[string]cas.Ref
+	}
+
+	Option func(cfg *config) error
+
+	// bucket is the tree served under a bucket name,
+	// snapshots have no ref and are read-only
+	bucket struct {
+		name    string
+		ref     string
+		tree    cas.Ref
+		created time.Time
+	}
+
+	listBucketsResult struct {
+		XMLName xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   owner        `xml:"Owner"`
+		Buckets []bucketInfo `xml:"Buckets>Bucket"`
+	}
+
+	owner struct {
+		ID          string `xml:"ID"`
+		DisplayName string `xml:"DisplayName"`
+	}
+
+	bucketInfo struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+
+	locationResult struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+		Location string   `xml:",chardata"`
+	}
+)
+
+const (
+	// DefaultRegion is reported to clients asking for the bucket location
+	DefaultRegion = "us-east-1"
+
+	headsPrefix = refs.Prefix + "heads/"
+	timeFormat  = "2006-01-02T15:04:05.000Z"
+)
+
+// Blob configures how uploaded objects are chunked,
+// without it the gateway is read-only
+func Blob(b *blob.B) Option {
+	return func(cfg *config) error {
+		cfg.blob = b
+		return nil
+	}
+}
+
+// Credentials requires requests signed with the given keys
+func Credentials(accessKey, secretKey string) Option {
+	return func(cfg *config) error {
+		if (accessKey == "") != (secretKey == "") {
+			return errors.New("both access key and secret key are required")
+		}
+		cfg.accessKey = accessKey
+		cfg.secretKey = secretKey
+		return nil
+	}
+}
+
+// Region is reported as the location of every bucket
+func Region(region string) Option {
+	return func(cfg *config) error {
+		cfg.region = region
+		return nil
+	}
+}
+
+// Author is used in the commits created by PutObject
+func Author(author string) Option {
+	return func(cfg *config) error {
+		cfg.author = author
+		return nil
+	}
+}
+
+// ReadOnly rejects requests which change buckets
+func ReadOnly(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.readOnly = enabled
+		return nil
+	}
+}
+
+// Snapshot exposes the directory snapshot root as a read-only bucket
+func Snapshot(name string, root cas.Ref) Option {
+	return func(cfg *config) error {
+		if err := s3utils.CheckValidBucketName(name); err != nil {
+			return err
+		}
+		cfg.snapshots[name] = root
+		return nil
+	}
+}
+
+// New returns a gateway serving the refs in rs and the
+// snapshots configured with the Snapshot option
+func New(c *cas.C, rs *refs.Store, options ...Option) (*Gateway, error) {
+	cfg := config{region: DefaultRegion, author: "dbfs", snapshots: map[string]cas.Ref{}}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &Gateway{c: c, refs: rs, cfg: cfg}, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var sig *signature
+	if g.cfg.accessKey != "" {
+		var err error
+		if sig, err = g.verify(req); err != nil {
+			writeError(w, req, err)
+			return
+		}
+	}
+	name, key := strings.TrimPrefix(req.URL.Path, "/"), ""
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name, key = name[:i], name[i+1:]
+	}
+	var err error
+	switch {
+	case name == "":
+		err = g.listBuckets(w, req)
+	case key == "":
+		err = g.bucketRequest(w, req, name)
+	default:
+		err = g.objectRequest(w, req, name, key, sig)
+	}
+	if err != nil {
+		writeError(w, req, err)
+	}
+}
+
+func (g *Gateway) listBuckets(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+	ctx := req.Context()
+	out := listBucketsResult{Owner: owner{ID: g.cfg.author, DisplayName: g.cfg.author}}
+	for name := range g.cfg.snapshots {
+		out.Buckets = append(out.Buckets, bucketInfo{Name: name, CreationDate: time.Unix(0, 0).UTC().Format(timeFormat)})
+	}
+	err := g.refs.List(ctx, headsPrefix, func(name string, head cas.Ref) error {
+		short := strings.TrimPrefix(name, headsPrefix)
+		if _, ok := g.cfg.snapshots[short]; ok || s3utils.CheckValidBucketName(short) != nil {
+			return nil
+		}
+		_, created, err := g.tree(ctx, head)
+		if err != nil {
+			// refs to other objects are not buckets
+			return nil
+		}
+		out.Buckets = append(out.Buckets, bucketInfo{Name: short, CreationDate: created.UTC().Format(timeFormat)})
+		return nil
+	})
+	if err != nil && !errors.Is(err, cas.ErrNotSupported) {
+		return err
+	}
+	sort.Slice(out.Buckets, func(i, j int) bool { return out.Buckets[i].Name < out.Buckets[j].Name })
+	writeXML(w, http.StatusOK, out)
+	return nil
+}
+
+func (g *Gateway) bucketRequest(w http.ResponseWriter, req *http.Request, name string) error {
+	b, err := g.bucket(req.Context(), name)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodHead:
+		return nil
+	case http.MethodGet:
+		switch {
+		case hasParam(q, "location"):
+			writeXML(w, http.StatusOK, locationResult{Location: g.cfg.region})
+			return nil
+		case q.Get("list-type") == "2":
+			return g.listObjects(w, req, b)
+		}
+		return errNotImplemented
+	}
+	return errNotImplemented
+}
+
+// bucket resolves a bucket name, snapshots take precedence over refs
+func (g *Gateway) bucket(ctx context.Context, name string) (bucket, error) {
+	if root, ok := g.cfg.snapshots[name]; ok {
+		return bucket{name: name, tree: root}, nil
+	}
+	if s3utils.CheckValidBucketName(name) != nil {
+		return bucket{}, errNoSuchBucket
+	}
+	ref := headsPrefix + name
+	head, _, err := g.refs.Get(ctx, ref)
+	if errors.Is(err, cas.ErrNotFound) {
+		return bucket{}, errNoSuchBucket
+	} else if err != nil {
+		return bucket{}, err
+	}
+	tree, created, err := g.tree(ctx, head)
+	if err != nil {
+		return bucket{}, err
+	}
+	return bucket{name: name, ref: ref, tree: tree, created: created}, nil
+}
+
+// tree returns the root directory of head, which must be a commit
+// or a directory snapshot, and the time of the commit
+func (g *Gateway) tree(ctx context.Context, head cas.Ref) (cas.Ref, time.Time, error) {
+	t, _, err := g.c.GetTyped(ctx, head)
+	if err != nil {
+		return cas.Ref{}, time.Time{}, err
+	}
+	switch t {
+	case snapshot.DirType:
+		return head, time.Unix(0, 0), nil
+	case commit.Type:
+		cm, err := commit.Read(ctx, g.c, head)
+		if err != nil {
+			return cas.Ref{}, time.Time{}, err
+		}
+		return cm.Tree, cm.Time, nil
+	}
+	return cas.Ref{}, time.Time{}, fmt.Errorf("%v is a %v, not a commit or directory", head, t)
+}
+
+// update changes the tree of b with fn and records the new tree as a
+// commit of the ref, refs pointing to directory snapshots are replaced
+func (g *Gateway) update(ctx context.Context, b bucket, message string, fn func(tree cas.Ref) (cas.Ref, error)) error {
+	if b.ref == "" || g.cfg.readOnly {
+		return errReadOnly
+	}
+	_, err := g.refs.Update(ctx, b.ref, func(current cas.Ref, found bool) (cas.Ref, error) {
+		if !found {
+			return cas.Ref{}, errNoSuchBucket
+		}
+		t, _, err := g.c.GetTyped(ctx, current)
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		if t == snapshot.DirType {
+			return fn(current)
+		} else if t != commit.Type {
+			return cas.Ref{}, fmt.Errorf("%v is a %v, not a commit or directory", current, t)
+		}
+		cm, err := commit.Read(ctx, g.c, current)
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		tree, err := fn(cm.Tree)
+		if err != nil || tree == cm.Tree {
+			return current, err
+		}
+		return commit.Write(ctx, g.c, commit.Commit{
+			Tree:    tree,
+			Parents: []cas.Ref{current},
+			Author:  g.cfg.author,
+			Time:    time.Now().Truncate(time.Second),
+			Message: message,
+		})
+	})
+	return err
+}
+
+func hasParam(q map[string][]string, name string) bool {
+	_, ok := q[name]
+	return ok
+}
@@ -0,0 +1,217 @@
+package s3gateway
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/refs"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type env struct {
+	c      *cas.C
+	rs     *refs.Store
+	client *minio.Client
+	large  []byte
+}
+
+func newEnv(ctx context.Context, t *testing.T) (*env, func()) {
+	c, b := testutil.OpenStore(ctx, t)
+	rs, err := refs.Open(c.KV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := make([]byte, 3_000_000)
+	rand.New(rand.NewSource(1)).Read(large)
+	largeRef, err := b.Upload(ctx, c, bytes.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "large.bin", Mode: 0644, Size: int64(len(large)), ModTime: time.Now(), Ref: largeRef},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "docs", Mode: os.ModeDir | 0755, Size: int64(len(large)), ModTime: time.Now(), Ref: docs},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := commit.Write(ctx, c, commit.Commit{Tree: root, Author: "test", Time: time.Now(), Message: "initial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Set(ctx, "refs/heads/main", head, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := New(c, rs, Blob(b), Credentials("access", "secret-key"), Snapshot("frozen", root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(g)
+	u, _ := url.Parse(srv.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret-key", ""),
+		Region: DefaultRegion,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &env{c: c, rs: rs, client: client, large: large}, srv.Close
+}
+
+func TestGetObject(t *testing.T) {
+	ctx := context.Background()
+	e, done := newEnv(ctx, t)
+	defer done()
+
+	buckets, err := e.client.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[0].Name != "frozen" || buckets[1].Name != "main" {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+
+	info, err := e.client.StatObject(ctx, "main", "docs/large.bin", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(e.large)) {
+		t.Errorf("unexpected size %v", info.Size)
+	}
+
+	opts := minio.GetObjectOptions{}
+	opts.SetRange(1_000_000, 1_000_099)
+	obj, err := e.client.GetObject(ctx, "frozen", "docs/large.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, e.large[1_000_000:1_000_100]) {
+		t.Error("range returned the wrong bytes")
+	}
+
+	if _, err := e.client.StatObject(ctx, "main", "docs/missing", minio.StatObjectOptions{}); minio.ToErrorResponse(err).StatusCode != 404 {
+		t.Errorf("missing keys should return 404, got %v", err)
+	}
+	if _, err := e.client.BucketExists(ctx, "missing"); err != nil {
+		t.Errorf("BucketExists should not fail, got %v", err)
+	}
+
+	bad, err := minio.New(e.client.EndpointURL().Host, &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "wrong-key", ""),
+		Region: DefaultRegion,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bad.ListBuckets(ctx); minio.ToErrorResponse(err).Code != "SignatureDoesNotMatch" {
+		t.Errorf("wrong keys should be rejected, got %v", err)
+	}
+}
+
+func TestPutObject(t *testing.T) {
+	ctx := context.Background()
+	e, done := newEnv(ctx, t)
+	defer done()
+
+	content := []byte("uploaded through the gateway")
+	_, err := e.client.PutObject(ctx, "main", "notes/todo.txt", bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := e.client.GetObject(ctx, "main", "notes/todo.txt", minio.GetObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("unexpected content %q", got)
+	}
+
+	head, _, err := e.rs.Get(ctx, "refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := commit.Read(ctx, e.c, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Parents) != 1 || cm.Message != "Put notes/todo.txt" {
+		t.Errorf("put should create a commit on top of the previous one, got %v", cm)
+	}
+
+	if _, err := e.client.PutObject(ctx, "frozen", "new.txt", bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{}); err == nil {
+		t.Error("snapshot buckets should be read-only")
+	}
+	if _, err := e.client.PutObject(ctx, "main", "notes/todo.txt/child", bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{}); minio.ToErrorResponse(err).StatusCode != 409 {
+		t.Errorf("keys crossing files should conflict, got %v", err)
+	}
+
+	if err := e.client.RemoveObject(ctx, "main", "notes/todo.txt", minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.client.StatObject(ctx, "main", "notes/todo.txt", minio.StatObjectOptions{}); minio.ToErrorResponse(err).StatusCode != 404 {
+		t.Errorf("removed key should return 404, got %v", err)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	ctx := context.Background()
+	e, done := newEnv(ctx, t)
+	defer done()
+	for _, key := range []string{"a/1", "a/2", "a-b", "b/c/d", "z"} {
+		if _, err := e.client.PutObject(ctx, "main", key, bytes.NewBufferString(key), int64(len(key)), minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(opts minio.ListObjectsOptions) []string {
+		var keys []string
+		for obj := range e.client.ListObjects(ctx, "main", opts) {
+			if obj.Err != nil {
+				t.Fatal(obj.Err)
+			}
+			keys = append(keys, obj.Key)
+		}
+		// the client returns the objects of a page before its prefixes
+		sort.Strings(keys)
+		return keys
+	}
+	if keys, expected := list(minio.ListObjectsOptions{Recursive: true}), []string{"a-b", "a/1", "a/2", "b/c/d", "docs/large.bin", "z"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v got %v", expected, keys)
+	}
+	if keys, expected := list(minio.ListObjectsOptions{}), []string{"a-b", "a/", "b/", "docs/", "z"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v got %v", expected, keys)
+	}
+	if keys, expected := list(minio.ListObjectsOptions{Prefix: "a/", Recursive: true}), []string{"a/1", "a/2"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v got %v", expected, keys)
+	}
+	if keys, expected := list(minio.ListObjectsOptions{Recursive: true, MaxKeys: 2}), []string{"a-b", "a/1", "a/2", "b/c/d", "docs/large.bin", "z"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("paginated listing expected %v got %v", expected, keys)
+	}
+}
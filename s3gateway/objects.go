@@ -0,0 +1,314 @@
+package s3gateway
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+type (
+	listObjectsResult struct {
+		XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name                  string         `xml:"Name"`
+		Prefix                string         `xml:"Prefix"`
+		Delimiter             string         `xml:"Delimiter,omitempty"`
+		StartAfter            string         `xml:"StartAfter,omitempty"`
+		ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+		MaxKeys               int            `xml:"MaxKeys"`
+		KeyCount              int            `xml:"KeyCount"`
+		IsTruncated           bool           `xml:"IsTruncated"`
+		Contents              []objectInfo   `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}
+
+	objectInfo struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+
+	commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+
+	// object is a regular file found while listing a bucket
+	object struct {
+		key string
+		e   snapshot.Entry
+	}
+
+	countReader struct {
+		actual io.Reader
+		total  int64
+	}
+)
+
+const (
+	maxListKeys = 1000
+)
+
+var (
+	errKeyConflict    = &apiError{http.StatusConflict, "XMinioObjectExistsAsDirectory", "A directory or file already exists in the path of the key"}
+	errContentSHA256  = &apiError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The content does not match x-amz-content-sha256"}
+	errIncompleteBody = &apiError{http.StatusBadRequest, "IncompleteBody", "The body is shorter than the content length"}
+)
+
+func (g *Gateway) objectRequest(w http.ResponseWriter, req *http.Request, name, key string, sig *signature) error {
+	b, err := g.bucket(req.Context(), name)
+	if err != nil {
+		return err
+	}
+	clean := strings.Join(snapshot.SplitPath(key), "/")
+	if key != clean && key != clean+"/" || clean == "" {
+		return errInvalidKey
+	}
+	q := req.URL.Query()
+	if hasParam(q, "uploads") || hasParam(q, "uploadId") || len(q) > 0 && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return errNotImplemented
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return g.getObject(w, req, b, key)
+	case http.MethodPut:
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			return errNotImplemented
+		}
+		return g.putObject(w, req, b, key, sig)
+	case http.MethodDelete:
+		return g.deleteObject(w, req, b, key)
+	}
+	return errMethodNotAllowed
+}
+
+func (g *Gateway) getObject(w http.ResponseWriter, req *http.Request, b bucket, key string) error {
+	ctx := req.Context()
+	e, err := snapshot.Lookup(ctx, g.c, b.tree, key)
+	if errors.Is(err, os.ErrNotExist) || err == nil && (!e.IsRegular() || strings.HasSuffix(key, "/")) {
+		return errNoSuchKey
+	} else if err != nil {
+		return err
+	}
+	r, err := blob.NewReader(ctx, g.c, e.Ref)
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag(e.Ref))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, req, "", e.ModTime, r)
+	return nil
+}
+
+// putObject stores the content and commits the new tree, keys
+// ending with a slash create empty directories
+func (g *Gateway) putObject(w http.ResponseWriter, req *http.Request, b bucket, key string, sig *signature) error {
+	if b.ref == "" || g.cfg.readOnly || g.cfg.blob == nil {
+		return errReadOnly
+	}
+	ctx := req.Context()
+	content := &countReader{actual: body(req, sig)}
+	var sha, md hash.Hash
+	var input io.Reader = content
+	if payload := req.Header.Get("X-Amz-Content-Sha256"); len(payload) == sha256.Size*2 {
+		sha = sha256.New()
+		input = io.TeeReader(input, sha)
+	}
+	if req.Header.Get("Content-Md5") != "" {
+		md = md5.New()
+		input = io.TeeReader(input, md)
+	}
+	ref, err := g.cfg.blob.Upload(ctx, g.c, input)
+	if err != nil {
+		return err
+	}
+	if n := contentLength(req); n >= 0 && n != content.total {
+		return errIncompleteBody
+	}
+	if sha != nil && hex.EncodeToString(sha.Sum(nil)) != req.Header.Get("X-Amz-Content-Sha256") {
+		return errContentSHA256
+	}
+	if md != nil && base64.StdEncoding.EncodeToString(md.Sum(nil)) != req.Header.Get("Content-Md5") {
+		return errBadDigest
+	}
+
+	isDir := strings.HasSuffix(key, "/")
+	if isDir && content.total > 0 {
+		return errInvalidArgument
+	}
+	empty, err := snapshot.WriteDir(ctx, g.c, snapshot.Dir{})
+	if err != nil {
+		return err
+	}
+	err = g.update(ctx, b, "Put "+key, func(tree cas.Ref) (cas.Ref, error) {
+		return snapshot.Edit(ctx, g.c, tree, key, func(d *snapshot.Dir, name string) error {
+			current, found := d.Find(name)
+			switch {
+			case isDir && found && current.IsDir():
+				return nil
+			case found && (current.IsDir() || isDir):
+				return errKeyConflict
+			case isDir:
+				d.Set(snapshot.Entry{Name: name, Mode: os.ModeDir | 0755, ModTime: time.Now(), Ref: empty})
+			default:
+				d.Set(snapshot.Entry{Name: name, Mode: 0644, Size: content.total, ModTime: time.Now(), Ref: ref})
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, syscall.ENOTDIR) {
+		return errKeyConflict
+	} else if err != nil {
+		return err
+	}
+	if isDir {
+		ref = empty
+	}
+	w.Header().Set("ETag", etag(ref))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// deleteObject removes key, like S3 missing keys are not an error
+func (g *Gateway) deleteObject(w http.ResponseWriter, req *http.Request, b bucket, key string) error {
+	ctx := req.Context()
+	err := g.update(ctx, b, "Delete "+key, func(tree cas.Ref) (cas.Ref, error) {
+		e, err := snapshot.Lookup(ctx, g.c, tree, key)
+		if errors.Is(err, os.ErrNotExist) || err == nil && e.IsDir() != strings.HasSuffix(key, "/") {
+			return tree, nil
+		} else if err != nil {
+			return cas.Ref{}, err
+		}
+		return snapshot.Edit(ctx, g.c, tree, key, func(d *snapshot.Dir, name string) error {
+			d.Remove(name)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// listObjects implements ListObjectsV2, keys are the paths of the
+// regular files in the tree
+func (g *Gateway) listObjects(w http.ResponseWriter, req *http.Request, b bucket) error {
+	q := req.URL.Query()
+	out := listObjectsResult{
+		Name:              b.name,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		MaxKeys:           maxListKeys,
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		if n < out.MaxKeys {
+			out.MaxKeys = n
+		}
+	}
+	marker := out.StartAfter
+	if out.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(out.ContinuationToken)
+		if err != nil {
+			return errInvalidArgument
+		}
+		marker = string(token)
+	}
+
+	objects, err := g.objects(req, b, out.Prefix)
+	if err != nil {
+		return err
+	}
+	var last string
+	for _, obj := range objects {
+		item := obj.key
+		rest := strings.TrimPrefix(obj.key, out.Prefix)
+		if i := strings.Index(rest, out.Delimiter); out.Delimiter != "" && i >= 0 {
+			item = out.Prefix + rest[:i+len(out.Delimiter)]
+		}
+		if item <= marker || item == last {
+			continue
+		}
+		if out.KeyCount == out.MaxKeys {
+			out.IsTruncated = true
+			out.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		if item == obj.key {
+			out.Contents = append(out.Contents, objectInfo{
+				Key:          obj.key,
+				LastModified: obj.e.ModTime.UTC().Format(timeFormat),
+				ETag:         etag(obj.e.Ref),
+				Size:         obj.e.Size,
+				StorageClass: "STANDARD",
+			})
+		} else {
+			out.CommonPrefixes = append(out.CommonPrefixes, commonPrefix{Prefix: item})
+		}
+		out.KeyCount++
+		last = item
+	}
+	writeXML(w, http.StatusOK, out)
+	return nil
+}
+
+// objects returns the regular files whose key starts with prefix
+// sorted by key, directories outside the prefix are not visited
+func (g *Gateway) objects(req *http.Request, b bucket, prefix string) ([]object, error) {
+	var objects []object
+	err := snapshot.Walk(req.Context(), g.c, b.tree, func(p string, e snapshot.Entry) error {
+		switch {
+		case e.IsDir():
+			if !strings.HasPrefix(p+"/", prefix) && !strings.HasPrefix(prefix, p+"/") {
+				return snapshot.SkipDir
+			}
+		case e.IsRegular() && strings.HasPrefix(p, prefix):
+			objects = append(objects, object{key: p, e: e})
+		}
+		return nil
+	})
+	// depth first order is not the order of the keys,
+	// eg.: "a-b" comes before "a/b"
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	return objects, err
+}
+
+func etag(ref cas.Ref) string {
+	return `"` + ref.String() + `"`
+}
+
+func (cr *countReader) Read(buf []byte) (int, error) {
+	n, err := cr.actual.Read(buf)
+	cr.total += int64(n)
+	return n, err
+}
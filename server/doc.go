@@ -0,0 +1,17 @@
+// package server exposes a cas over HTTP
+//
+// Objects are served at /objects/<ref> and blobs, reassembled from
+// their chunks, at /blobs/<ref>. Both are immutable, so responses carry
+// the ref as their ETag and can be cached forever. New content is sent
+// with PUT or POST to /objects and /blobs, which return the new ref.
+//
+// The keys of the underlying KV are available at /kv/<key>, with
+// /kv-list and /kv-exists, which allows drivers/http/kv to open
+// the same cas remotely. Only tmp/ and refs/ can be written and
+// deleted directly (see WritablePrefixes), objects written or moved
+// to data/ must match their ref and data/ and packs/ are never deleted,
+// so maintenance (repack, gc) must run next to the bucket.
+//
+// Clients only need the URL of the server (and its token, if one is
+// configured), they never see the credentials of the bucket.
+package server
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// ExistsRequest is the body of POST /kv-exists
+	ExistsRequest struct {
+		Keys []string `json:"keys"`
+	}
+
+	// ExistsResult is the response of POST /kv-exists,
+	// Exists[i] is true if Keys[i] exists
+	ExistsResult struct {
+		Exists []bool `json:"exists"`
+	}
+
+	// WriteResult is the response of PUT /kv/<key>
+	WriteResult struct {
+		Size int64 `json:"size"`
+	}
+
+	// countReader counts the bytes read from actual
+	countReader struct {
+		actual io.Reader
+		n      int64
+	}
+)
+
+// kv serves the keys of the underlying KV, it is used by
+// drivers/http/kv to run a cas.C remotely
+func (s *Server) kv(w http.ResponseWriter, req *http.Request) error {
+	key := strings.TrimPrefix(req.URL.Path, "/kv/")
+	if key == "" {
+		return httpError{status: http.StatusBadRequest, err: errors.New("missing key")}
+	}
+	kv := s.c.KV()
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		if _, ok := req.URL.Query()["version"]; ok {
+			return s.readVersion(w, req, key)
+		}
+		if rng := req.Header.Get("Range"); rng != "" {
+			return s.readRange(w, req, key, rng)
+		}
+		lw := &lazyWriter{w: w, status: http.StatusOK}
+		_, err := kv.Read(ctx, lw, key)
+		return lw.finish(err)
+	case http.MethodHead:
+		found, err := kv.Exists(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}
+		if mt, ok := kv.(cas.ModTimer); ok {
+			// used by drivers/http/kv to implement cas.ModTimer
+			modTime, err := mt.ModTime(ctx, key)
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		}
+		return nil
+	}
+
+	if s.cfg.readOnly {
+		return httpError{status: http.StatusForbidden, err: errors.New("server is read-only")}
+	}
+	switch req.Method {
+	case http.MethodPut:
+		s.limitBody(w, req)
+		if dataKey(key) {
+			n, err := s.putData(ctx, key, req.Body)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, http.StatusCreated, WriteResult{Size: n})
+		}
+		if err := s.checkWritable(key); err != nil {
+			return err
+		}
+		if req.Header.Get("If-Match") != "" || req.Header.Get("If-None-Match") != "" {
+			return s.writeIf(w, req, key)
+		}
+		n, err := kv.Write(ctx, key, req.Body)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusCreated, WriteResult{Size: n})
+	case http.MethodDelete:
+		if err := s.checkWritable(key); err != nil {
+			return err
+		}
+		return kv.Delete(ctx, key)
+	case http.MethodPost:
+		q := req.URL.Query()
+		switch {
+		case q.Get("copy") != "":
+			return s.copy(ctx, key, q.Get("copy"), false)
+		case q.Get("move") != "":
+			if err := s.checkWritable(q.Get("move")); err != nil {
+				return err
+			}
+			return s.copy(ctx, key, q.Get("move"), true)
+		}
+		return httpError{status: http.StatusBadRequest, err: errors.New("POST requires copy or move")}
+	}
+	return methodNotAllowed(req)
+}
+
+// copy copies (or moves) from to key, objects copied to data/
+// are checked against their ref
+func (s *Server) copy(ctx context.Context, key, from string, move bool) error {
+	kv := s.c.KV()
+	if dataKey(key) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := kv.Read(ctx, pw, from)
+			pw.CloseWithError(err)
+		}()
+		_, err := s.putData(ctx, key, pr)
+		pr.CloseWithError(err)
+		if err != nil || !move {
+			return err
+		}
+		return kv.Delete(ctx, from)
+	}
+	if err := s.checkWritable(key); err != nil {
+		return err
+	}
+	if !move {
+		return kv.Copy(ctx, key, from)
+	}
+	if mover, ok := kv.(cas.Mover); ok {
+		return mover.Move(ctx, key, from)
+	}
+	if err := kv.Copy(ctx, key, from); err != nil {
+		return err
+	}
+	return kv.Delete(ctx, from)
+}
+
+// putData stores the content under its own ref, which
+// must be the ref encoded in key
+func (s *Server) putData(ctx context.Context, key string, content io.Reader) (int64, error) {
+	expected, err := cas.ParseRef(strings.TrimPrefix(key, "data/"))
+	if err != nil {
+		return 0, httpError{status: http.StatusForbidden, err: fmt.Errorf("%v is not the key of an object, cause: %w", key, err)}
+	}
+	cr := &countReader{actual: content}
+	ref, err := s.c.PutContent(ctx, cr)
+	if err != nil {
+		return 0, err
+	}
+	if ref != expected {
+		return 0, httpError{status: http.StatusBadRequest, err: fmt.Errorf("content has ref %v not %v", ref, expected)}
+	}
+	return cr.n, nil
+}
+
+// checkWritable returns an error unless clients can
+// change key directly
+func (s *Server) checkWritable(key string) error {
+	for _, p := range protectedPrefixes {
+		if strings.HasPrefix(key, p) {
+			return httpError{status: http.StatusForbidden, err: fmt.Errorf("%v holds content addressed objects and cannot be changed", key)}
+		}
+	}
+	for _, p := range s.cfg.writable {
+		if strings.HasPrefix(key, p) {
+			return nil
+		}
+	}
+	return httpError{status: http.StatusForbidden, err: fmt.Errorf("%v cannot be changed through /kv", key)}
+}
+
+func dataKey(key string) bool {
+	return strings.HasPrefix(key, "data/")
+}
+
+func (s *Server) readRange(w http.ResponseWriter, req *http.Request, key, rng string) error {
+	first, last, err := parseRange(rng)
+	if err != nil {
+		return err
+	}
+	lw := &lazyWriter{w: w, status: http.StatusPartialContent}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", first, last))
+	w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	_, err = cas.ReadRange(req.Context(), s.c.KV(), lw, key, first, last-first+1)
+	return lw.finish(err)
+}
+
+func (s *Server) readVersion(w http.ResponseWriter, req *http.Request, key string) error {
+	cw, err := cas.AsConditionalWriter(s.c.KV())
+	if err != nil {
+		return err
+	}
+	// the version is only known after the content is read
+	buf := &strings.Builder{}
+	version, err := cw.ReadVersion(req.Context(), buf, key)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+version+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	_, err = w.Write([]byte(buf.String()))
+	return err
+}
+
+func (s *Server) writeIf(w http.ResponseWriter, req *http.Request, key string) error {
+	cw, err := cas.AsConditionalWriter(s.c.KV())
+	if err != nil {
+		return err
+	}
+	var version string
+	if match := req.Header.Get("If-Match"); match != "" {
+		version = strings.Trim(match, `"`)
+	} else if req.Header.Get("If-None-Match") != "*" {
+		return httpError{status: http.StatusBadRequest, err: errors.New("If-None-Match only accepts *")}
+	}
+	next, err := cw.WriteIf(req.Context(), key, req.Body, version)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+next+`"`)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (s *Server) list(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return methodNotAllowed(req)
+	}
+	lister, ok := s.c.KV().(cas.Lister)
+	if !ok {
+		return cas.ErrNotSupported
+	}
+	lw := &lazyWriter{w: w, status: http.StatusOK}
+	err := lister.List(req.Context(), req.URL.Query().Get("prefix"), func(key string) error {
+		_, err := lw.Write([]byte(key + "\n"))
+		return err
+	})
+	return lw.finish(err)
+}
+
+func (s *Server) exists(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return methodNotAllowed(req)
+	}
+	var body ExistsRequest
+	if err := json.NewDecoder(s.limitBody(w, req)).Decode(&body); err != nil {
+		var he httpError
+		if errors.As(err, &he) {
+			return err
+		}
+		return httpError{status: http.StatusBadRequest, err: err}
+	}
+	var out ExistsResult
+	kv := s.c.KV()
+	if be, ok := kv.(cas.BatchExister); ok {
+		var err error
+		if out.Exists, err = be.ExistsBatch(req.Context(), body.Keys); err != nil {
+			return err
+		}
+	} else {
+		out.Exists = make([]bool, len(body.Keys))
+		for i, k := range body.Keys {
+			var err error
+			if out.Exists[i], err = kv.Exists(req.Context(), k); err != nil {
+				return err
+			}
+		}
+	}
+	return writeJSON(w, http.StatusOK, out)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (c *countReader) Read(buf []byte) (int, error) {
+	n, err := c.actual.Read(buf)
+	c.n += int64(n)
+	return n, err
+}
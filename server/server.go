@@ -0,0 +1,389 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// Server is a http.Handler which serves the objects of a cas
+	Server struct {
+		c   *cas.C
+		cfg config
+		mux *http.ServeMux
+	}
+
+	config struct {
+		token    string
+		readOnly bool
+		blob     *blob.B
+		writable []string
+		maxBody  int64
+	}
+
+	Option func(cfg *config) error
+
+	// PutResult is the body returned after new content is stored
+	PutResult struct {
+		Ref string `json:"ref"`
+	}
+
+	// httpError is returned by handlers to report a status
+	// code other than 500
+	httpError struct {
+		status int
+		err    error
+	}
+
+	// limitedBody reports bodies larger than limit with
+	// http.StatusRequestEntityTooLarge
+	limitedBody struct {
+		io.ReadCloser
+		limit int64
+		read  int64
+	}
+
+	// lazyWriter delays the response status until the first write,
+	// so errors found before any content is produced still get
+	// a proper status code
+	lazyWriter struct {
+		w       http.ResponseWriter
+		status  int
+		started bool
+	}
+)
+
+const (
+	// immutable content can be cached by clients forever
+	cacheImmutable = "public, max-age=31536000, immutable"
+
+	// DefaultMaxBodySize limits the size of objects and keys written
+	// by clients, it is larger than the largest chunk of a blob
+	DefaultMaxBodySize = 64 << 20
+)
+
+var (
+	// DefaultWritablePrefixes are the keys which clients can change
+	// through /kv, they are enough to run a cas.C (and refs) remotely
+	DefaultWritablePrefixes = []string{"tmp/", "refs/"}
+
+	// protectedPrefixes hold content addressed objects
+	protectedPrefixes = []string{"data/", "packs/"}
+)
+
+// Token requires every request to send "Authorization: Bearer <token>"
+func Token(token string) Option {
+	return func(cfg *config) error {
+		cfg.token = token
+		return nil
+	}
+}
+
+// ReadOnly rejects requests which would store new content
+func ReadOnly(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.readOnly = enabled
+		return nil
+	}
+}
+
+// WritablePrefixes configures which keys can be written and deleted
+// through /kv, by default only tmp/ and refs/.
+//
+// Objects under data/ and packs/ are never changed directly, new
+// objects are only accepted under data/ if their content matches
+// the ref in their key
+func WritablePrefixes(prefixes ...string) Option {
+	return func(cfg *config) error {
+		cfg.writable = prefixes
+		return nil
+	}
+}
+
+// MaxBodySize limits how many bytes are accepted when objects and
+// keys are written, blobs are chunked as they are read so their size
+// is not limited.
+func MaxBodySize(n int64) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return fmt.Errorf("max body size must be positive, got %v", n)
+		}
+		cfg.maxBody = n
+		return nil
+	}
+}
+
+// Blob configures the chunker used to store new blobs, without it
+// blob uploads are rejected
+func Blob(b *blob.B) Option {
+	return func(cfg *config) error {
+		cfg.blob = b
+		return nil
+	}
+}
+
+// New returns a Server for c, closing c is the responsibility
+// of the caller
+func New(c *cas.C, options ...Option) (*Server, error) {
+	s := &Server{c: c, mux: http.NewServeMux(), cfg: config{
+		writable: DefaultWritablePrefixes,
+		maxBody:  DefaultMaxBodySize,
+	}}
+	for _, opt := range options {
+		if err := opt(&s.cfg); err != nil {
+			return nil, err
+		}
+	}
+	s.mux.Handle("/objects", s.handle(s.objects))
+	s.mux.Handle("/objects/", s.handle(s.objects))
+	s.mux.Handle("/blobs", s.handle(s.blobs))
+	s.mux.Handle("/blobs/", s.handle(s.blobs))
+	s.mux.Handle("/kv/", s.handle(s.kv))
+	s.mux.Handle("/kv-list", s.handle(s.list))
+	s.mux.Handle("/kv-exists", s.handle(s.exists))
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.cfg.token != "" && !s.authorized(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, req)
+}
+
+func (s *Server) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(s.cfg.token)) == 1
+}
+
+// handle converts the errors returned by fn into responses
+func (s *Server) handle(fn func(w http.ResponseWriter, req *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := fn(w, req)
+		if err == nil {
+			return
+		}
+		status := http.StatusInternalServerError
+		var he httpError
+		switch {
+		case errors.As(err, &he):
+			status = he.status
+		case errors.Is(err, cas.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, cas.ErrPermissionDenied):
+			status = http.StatusForbidden
+		case errors.Is(err, cas.ErrPreconditionFailed):
+			status = http.StatusPreconditionFailed
+		case errors.Is(err, cas.ErrNotSupported):
+			status = http.StatusNotImplemented
+		case errors.Is(err, cas.ErrTransient):
+			status = http.StatusServiceUnavailable
+		}
+		if status == http.StatusInternalServerError {
+			log.Error().Err(err).Str("method", req.Method).Str("path", req.URL.Path).Msg("Request failed")
+		}
+		// headers set for the content do not apply to the error
+		for _, h := range []string{"Content-Length", "Content-Range", "ETag", "Cache-Control"} {
+			w.Header().Del(h)
+		}
+		http.Error(w, err.Error(), status)
+	})
+}
+
+func (s *Server) objects(w http.ResponseWriter, req *http.Request) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/objects"), "/")
+	switch {
+	case name == "" && (req.Method == http.MethodPut || req.Method == http.MethodPost):
+		return s.putObject(w, req, nil)
+	case name == "":
+		return methodNotAllowed(req)
+	}
+	ref, err := cas.ParseRef(name)
+	if err != nil {
+		return httpError{status: http.StatusBadRequest, err: err}
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return s.getObject(w, req, ref)
+	case http.MethodHead:
+		return s.headObject(w, req, ref)
+	case http.MethodPut:
+		return s.putObject(w, req, &ref)
+	}
+	return methodNotAllowed(req)
+}
+
+func (s *Server) getObject(w http.ResponseWriter, req *http.Request, ref cas.Ref) error {
+	immutableHeaders(w, ref)
+	if req.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if rng := req.Header.Get("Range"); rng != "" {
+		first, last, err := parseRange(rng)
+		if err != nil {
+			return err
+		}
+		lw := &lazyWriter{w: w, status: http.StatusPartialContent}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", first, last))
+		w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+		_, err = s.c.GetRange(req.Context(), lw, ref, first, last-first+1)
+		return lw.finish(err)
+	}
+	lw := &lazyWriter{w: w, status: http.StatusOK}
+	return lw.finish(s.c.GetContent(req.Context(), lw, ref))
+}
+
+func (s *Server) headObject(w http.ResponseWriter, req *http.Request, ref cas.Ref) error {
+	found, err := s.c.Exists(req.Context(), ref)
+	if err != nil {
+		return err
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	immutableHeaders(w, ref)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// putObject stores the body, if expected is not nil the
+// ref of the body must match it
+func (s *Server) putObject(w http.ResponseWriter, req *http.Request, expected *cas.Ref) error {
+	if s.cfg.readOnly {
+		return httpError{status: http.StatusForbidden, err: errors.New("server is read-only")}
+	}
+	ref, err := s.c.PutContent(req.Context(), s.limitBody(w, req))
+	if err != nil {
+		return err
+	}
+	if expected != nil && *expected != ref {
+		return httpError{status: http.StatusBadRequest, err: fmt.Errorf("content has ref %v not %v", ref, *expected)}
+	}
+	return created(w, "/objects/", ref)
+}
+
+func (s *Server) blobs(w http.ResponseWriter, req *http.Request) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/blobs"), "/")
+	if name == "" {
+		if req.Method != http.MethodPut && req.Method != http.MethodPost {
+			return methodNotAllowed(req)
+		}
+		return s.putBlob(w, req)
+	}
+	ref, err := cas.ParseRef(name)
+	if err != nil {
+		return httpError{status: http.StatusBadRequest, err: err}
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return methodNotAllowed(req)
+	}
+	r, err := blob.NewReader(req.Context(), s.c, ref)
+	if err != nil {
+		return err
+	}
+	immutableHeaders(w, ref)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", time.Time{}, r)
+	return nil
+}
+
+func (s *Server) putBlob(w http.ResponseWriter, req *http.Request) error {
+	if s.cfg.readOnly {
+		return httpError{status: http.StatusForbidden, err: errors.New("server is read-only")}
+	}
+	if s.cfg.blob == nil {
+		return httpError{status: http.StatusNotImplemented, err: errors.New("server cannot chunk blobs")}
+	}
+	ref, err := s.cfg.blob.Upload(req.Context(), s.c, req.Body)
+	if err != nil {
+		return err
+	}
+	return created(w, "/blobs/", ref)
+}
+
+// limitBody returns the body of req limited to the max body size
+func (s *Server) limitBody(w http.ResponseWriter, req *http.Request) io.ReadCloser {
+	req.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, req.Body, s.cfg.maxBody), limit: s.cfg.maxBody}
+	return req.Body
+}
+
+// parseRange returns the first and last byte of rng, only the
+// single range "bytes=<first>-<last>" is supported
+func parseRange(rng string) (int64, int64, error) {
+	var first, last int64
+	if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || first < 0 || last < first {
+		return 0, 0, httpError{status: http.StatusRequestedRangeNotSatisfiable, err: fmt.Errorf("unsupported range %q", rng)}
+	}
+	return first, last, nil
+}
+
+func immutableHeaders(w http.ResponseWriter, ref cas.Ref) {
+	w.Header().Set("ETag", `"`+ref.String()+`"`)
+	w.Header().Set("Cache-Control", cacheImmutable)
+}
+
+func created(w http.ResponseWriter, prefix string, ref cas.Ref) error {
+	w.Header().Set("Location", prefix+ref.String())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(PutResult{Ref: ref.String()})
+}
+
+func methodNotAllowed(req *http.Request) error {
+	return httpError{status: http.StatusMethodNotAllowed, err: fmt.Errorf("method %v is not allowed on %v", req.Method, req.URL.Path)}
+}
+
+func (l *limitedBody) Read(buf []byte) (int, error) {
+	n, err := l.ReadCloser.Read(buf)
+	l.read += int64(n)
+	if err != nil && err != io.EOF && l.read >= l.limit {
+		// http.MaxBytesReader fails once the limit is reached
+		err = httpError{status: http.StatusRequestEntityTooLarge, err: fmt.Errorf("body is larger than %v bytes, cause: %w", l.limit, err)}
+	}
+	return n, err
+}
+
+func (e httpError) Error() string { return e.err.Error() }
+func (e httpError) Unwrap() error { return e.err }
+
+func (l *lazyWriter) Write(buf []byte) (int, error) {
+	if !l.started {
+		l.started = true
+		l.w.WriteHeader(l.status)
+	}
+	return l.w.Write(buf)
+}
+
+// finish reports err to the client, if the response already
+// started the connection is aborted so the client sees a
+// truncated response instead of a successful one
+func (l *lazyWriter) finish(err error) error {
+	if err == nil {
+		if !l.started {
+			l.w.WriteHeader(l.status)
+		}
+		return nil
+	}
+	if l.started {
+		panic(http.ErrAbortHandler)
+	}
+	return err
+}
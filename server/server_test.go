@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+func newServer(ctx context.Context, t *testing.T, options ...Option) *httptest.Server {
+	c, b := testutil.OpenStore(ctx, t)
+	s, err := New(c, append([]Option{Blob(b)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(s)
+}
+
+func do(t *testing.T, method, url string, body []byte, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, content
+}
+
+func put(t *testing.T, url string, body []byte) string {
+	t.Helper()
+	res, content := do(t, http.MethodPost, url, body)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST %v should return 201 got %v: %s", url, res.StatusCode, content)
+	}
+	var out PutResult
+	if err := json.Unmarshal(content, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Ref
+}
+
+func TestObjects(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t)
+	defer srv.Close()
+
+	ref := put(t, srv.URL+"/objects", []byte("0123456789"))
+	if expected := cas.PrecomputeHashBytes([]byte("0123456789")).String(); ref != expected {
+		t.Errorf("Ref should be %v got %v", expected, ref)
+	}
+
+	res, content := do(t, http.MethodGet, srv.URL+"/objects/"+ref, nil)
+	if res.StatusCode != http.StatusOK || string(content) != "0123456789" {
+		t.Errorf("GET should return the content, got %v %q", res.StatusCode, content)
+	}
+	if etag := res.Header.Get("ETag"); etag != `"`+ref+`"` {
+		t.Errorf("ETag should be the ref, got %v", etag)
+	}
+	if cc := res.Header.Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("Objects should be immutable, got %v", cc)
+	}
+
+	res, content = do(t, http.MethodGet, srv.URL+"/objects/"+ref, nil, "Range", "bytes=2-4")
+	if res.StatusCode != http.StatusPartialContent || string(content) != "234" {
+		t.Errorf("Range should return 206 and the requested bytes, got %v %q", res.StatusCode, content)
+	}
+	res, _ = do(t, http.MethodGet, srv.URL+"/objects/"+ref, nil, "If-None-Match", `"`+ref+`"`)
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("Matching ETag should return 304 got %v", res.StatusCode)
+	}
+
+	if res, _ := do(t, http.MethodHead, srv.URL+"/objects/"+ref, nil); res.StatusCode != http.StatusOK {
+		t.Errorf("HEAD on an existing object should return 200 got %v", res.StatusCode)
+	}
+	missing := cas.PrecomputeHashBytes([]byte("missing")).String()
+	if res, _ := do(t, http.MethodHead, srv.URL+"/objects/"+missing, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD on a missing object should return 404 got %v", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodGet, srv.URL+"/objects/"+missing, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET on a missing object should return 404 got %v", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodGet, srv.URL+"/objects/not-a-ref", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Invalid refs should return 400 got %v", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodPut, srv.URL+"/objects/"+missing, []byte("other")); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT with the wrong ref should return 400 got %v", res.StatusCode)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t, MaxBodySize(10))
+	defer srv.Close()
+
+	for _, path := range []string{"/objects", "/kv/tmp/upload"} {
+		if res, _ := do(t, http.MethodPut, srv.URL+path, []byte("0123456789")); res.StatusCode != http.StatusCreated {
+			t.Errorf("PUT %v within the limit should return 201 got %v", path, res.StatusCode)
+		}
+		if res, _ := do(t, http.MethodPut, srv.URL+path, []byte("0123456789a")); res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("PUT %v past the limit should return 413 got %v", path, res.StatusCode)
+		}
+	}
+	// blobs are chunked while they are read
+	if res, _ := do(t, http.MethodPut, srv.URL+"/blobs", make([]byte, 1000)); res.StatusCode != http.StatusCreated {
+		t.Errorf("Blobs should not be limited, got %v", res.StatusCode)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t)
+	defer srv.Close()
+
+	content := make([]byte, 3_000_000)
+	rand.New(rand.NewSource(1)).Read(content)
+	ref := put(t, srv.URL+"/blobs", content)
+
+	res, body := do(t, http.MethodGet, srv.URL+"/blobs/"+ref, nil)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("GET should return the whole blob, got %v with %v bytes", res.StatusCode, len(body))
+	}
+	res, body = do(t, http.MethodGet, srv.URL+"/blobs/"+ref, nil, "Range", "bytes=1000000-2000000")
+	if res.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[1_000_000:2_000_001]) {
+		t.Errorf("Range should return the requested bytes, got %v with %v bytes", res.StatusCode, len(body))
+	}
+}
+
+func TestAccess(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t, Token("secret"), ReadOnly(true))
+	defer srv.Close()
+
+	if res, _ := do(t, http.MethodPost, srv.URL+"/objects", []byte("abc")); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Requests without a token should return 401 got %v", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodPost, srv.URL+"/objects", []byte("abc"), "Authorization", "Bearer wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Requests with the wrong token should return 401 got %v", res.StatusCode)
+	}
+	if res, _ := do(t, http.MethodPost, srv.URL+"/objects", []byte("abc"), "Authorization", "Bearer secret"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("Writes to a read-only server should return 403 got %v", res.StatusCode)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t)
+	defer srv.Close()
+
+	const clients = 16
+	refs := make([]string, clients)
+	errs := make([]error, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := http.Post(srv.URL+"/objects", "application/octet-stream", strings.NewReader("object "+strconv.Itoa(i)))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer res.Body.Close()
+			var out PutResult
+			errs[i] = json.NewDecoder(res.Body).Decode(&out)
+			refs[i] = out.Ref
+		}(i)
+	}
+	wg.Wait()
+	for i, ref := range refs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if _, content := do(t, http.MethodGet, srv.URL+"/objects/"+ref, nil); string(content) != "object "+strconv.Itoa(i) {
+			t.Errorf("Object %v should contain %q got %q", ref, "object "+strconv.Itoa(i), content)
+		}
+	}
+}
+
+func TestRawKeys(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(ctx, t)
+	defer srv.Close()
+
+	ref := cas.PrecomputeHashBytes([]byte("content"))
+	dataKey := "/kv/data/" + ref.HexPath(4)
+	for _, c := range []struct {
+		method, path string
+		body         string
+		status       int
+	}{
+		{http.MethodPut, "/kv/tmp/upload", "content", http.StatusCreated},
+		{http.MethodPut, "/kv/other/key", "content", http.StatusForbidden},
+		{http.MethodPut, "/kv/packs/x.pack", "content", http.StatusForbidden},
+		{http.MethodPut, "/kv/data/" + cas.PrecomputeHashBytes([]byte("other")).HexPath(4), "content", http.StatusBadRequest},
+		{http.MethodPost, "/kv/data/" + cas.PrecomputeHashBytes([]byte("other")).HexPath(4) + "?move=tmp/upload", "", http.StatusBadRequest},
+		{http.MethodPost, "/kv/other/key?copy=tmp/upload", "", http.StatusForbidden},
+		{http.MethodPost, dataKey + "?move=tmp/upload", "", http.StatusOK},
+		{http.MethodPost, "/kv/tmp/copy?move=" + strings.TrimPrefix(dataKey, "/kv/"), "", http.StatusForbidden},
+		{http.MethodDelete, dataKey, "", http.StatusForbidden},
+		{http.MethodDelete, "/kv/packs/x.pack", "", http.StatusForbidden},
+		{http.MethodPut, dataKey, "content", http.StatusCreated},
+	} {
+		if res, body := do(t, c.method, srv.URL+c.path, []byte(c.body)); res.StatusCode != c.status {
+			t.Errorf("%v %v should return %v got %v: %s", c.method, c.path, c.status, res.StatusCode, body)
+		}
+	}
+	if res, content := do(t, http.MethodGet, srv.URL+dataKey, nil); res.StatusCode != http.StatusOK || string(content) != "content" {
+		t.Errorf("Verified objects should be stored, got %v %q", res.StatusCode, content)
+	}
+	if res, _ := do(t, http.MethodHead, srv.URL+"/kv/tmp/upload", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Moved objects should be removed, got %v", res.StatusCode)
+	}
+}
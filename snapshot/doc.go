@@ -0,0 +1,8 @@
+// package snapshot stores whole directory hierarchies in a cas
+//
+// Regular files are uploaded with blob, every directory becomes a
+// typed "dir" object listing its entries (name, mode, size, mtime,
+// symlink target and ref). Directory objects reference the objects
+// of their sub-directories, so one ref describes the whole tree and
+// unchanged sub-directories share the same objects across snapshots.
+package snapshot
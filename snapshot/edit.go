@@ -0,0 +1,89 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/andrebq/dbfs/cas"
+)
+
+// Edit returns the root of a new snapshot where fn changed the entry
+// at p, fn receives the directory holding the entry and its name.
+//
+// Every directory from root to p is rewritten with updated sizes,
+// missing directories are created, the directory holding the entry
+// gets a new modification time. If p crosses an entry which is not
+// a directory the error matches syscall.ENOTDIR
+func Edit(ctx context.Context, c *cas.C, root cas.Ref, p string, fn func(d *Dir, name string) error) (cas.Ref, error) {
+	names := SplitPath(p)
+	if len(names) == 0 {
+		return cas.Ref{}, errors.New("the root directory cannot be edited")
+	}
+	ref, _, err := edit(ctx, c, root, names, fn)
+	return ref, err
+}
+
+// edit returns the new ref of the directory and the number of bytes below it
+func edit(ctx context.Context, c *cas.C, ref cas.Ref, names []string, fn func(d *Dir, name string) error) (cas.Ref, int64, error) {
+	var d Dir
+	if ref != (cas.Ref{}) {
+		var err error
+		if d, err = ReadDir(ctx, c, ref); err != nil {
+			return cas.Ref{}, 0, err
+		}
+	}
+	var err error
+	if len(names) == 1 {
+		err = fn(&d, names[0])
+	} else {
+		e, found := d.Find(names[0])
+		if !found {
+			e = Entry{Name: names[0], Mode: os.ModeDir | 0755}
+		} else if !e.IsDir() {
+			return cas.Ref{}, 0, fmt.Errorf("%v: %w", names[0], syscall.ENOTDIR)
+		}
+		e.Ref, e.Size, err = edit(ctx, c, e.Ref, names[1:], fn)
+		if !found || len(names) == 2 {
+			e.ModTime = time.Now()
+		}
+		d.Set(e)
+	}
+	if err != nil {
+		return cas.Ref{}, 0, err
+	}
+	var size int64
+	for _, e := range d.Entries {
+		size += e.Size
+	}
+	ref, err = WriteDir(ctx, c, d)
+	return ref, size, err
+}
+
+// Set adds or replaces the entry with the same name as e
+func (d *Dir) Set(e Entry) {
+	i := sort.Search(len(d.Entries), func(i int) bool { return d.Entries[i].Name >= e.Name })
+	if i < len(d.Entries) && d.Entries[i].Name == e.Name {
+		d.Entries[i] = e
+		return
+	}
+	d.Entries = append(d.Entries, Entry{})
+	copy(d.Entries[i+1:], d.Entries[i:])
+	d.Entries[i] = e
+}
+
+// Remove deletes the entry with the given name, it returns
+// false if d has no such entry
+func (d *Dir) Remove(name string) bool {
+	for i, e := range d.Entries {
+		if e.Name == name {
+			d.Entries = append(d.Entries[:i], d.Entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/internal/tuple"
+)
+
+type (
+	// entryView is the human friendly representation of an Entry
+	entryView struct {
+		Name    string `json:"name" yaml:"name"`
+		Mode    string `json:"mode" yaml:"mode"`
+		Size    int64  `json:"size" yaml:"size"`
+		ModTime string `json:"mtime" yaml:"mtime"`
+		Target  string `json:"target,omitempty" yaml:"target,omitempty"`
+		Ref     string `json:"ref,omitempty" yaml:"ref,omitempty"`
+	}
+)
+
+func (e Entry) view() entryView {
+	v := entryView{
+		Name:    e.Name,
+		Mode:    e.Mode.String(),
+		Size:    e.Size,
+		ModTime: e.ModTime.UTC().Format(time.RFC3339Nano),
+		Target:  e.Target,
+	}
+	if e.hasRef() {
+		v.Ref = e.Ref.String()
+	}
+	return v
+}
+
+func (e Entry) MarshalYAML() (interface{}, error) {
+	return e.view(), nil
+}
+
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.view())
+}
+
+func (d Dir) MarshalYAML() (interface{}, error) {
+	return d.Entries, nil
+}
+
+func (d Dir) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Entries)
+}
+
+func (e Entry) hasRef() bool {
+	return e.IsDir() || e.IsRegular()
+}
+
+func (e Entry) named() tuple.Named {
+	p := tuple.Pairs{}.
+		Add("name", e.Name).
+		Add("mode", int64(e.Mode)).
+		Add("size", e.Size).
+		Add("mtime", e.ModTime.UnixNano())
+	if e.IsSymlink() {
+		p = p.Add("target", e.Target)
+	}
+	if e.hasRef() {
+		p = p.Add("ref", e.Ref[:])
+	}
+	return p.Named()
+}
+
+// MarshalBinary encodes d as a named tuple, entries are
+// sorted by name so the encoding is canonical
+func (d Dir) MarshalBinary() ([]byte, error) {
+	entries := append([]Entry(nil), d.Entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	named := make([]tuple.Named, len(entries))
+	for i, e := range entries {
+		if i > 0 && entries[i-1].Name == e.Name {
+			return nil, fmt.Errorf("duplicated entry %v", e.Name)
+		}
+		named[i] = e.named()
+	}
+	return tuple.MarshalBinary(tuple.Pairs{}.Add("entries", named).Named())
+}
+
+func (d *Dir) UnmarshalBinary(buf []byte) error {
+	var n tuple.Named
+	if err := tuple.UnmarshalBinary(buf, &n); err != nil {
+		return err
+	}
+	list, err := n.NamedList("entries")
+	if err != nil {
+		return err
+	}
+	entries := make([]Entry, len(list))
+	for i, item := range list {
+		if err := entries[i].fromNamed(item); err != nil {
+			return err
+		}
+		if i > 0 && entries[i-1].Name >= entries[i].Name {
+			return fmt.Errorf("entries are not sorted by name at %v", entries[i].Name)
+		}
+	}
+	d.Entries = entries
+	return nil
+}
+
+func (e *Entry) fromNamed(n tuple.Named) error {
+	var err error
+	if e.Name, err = n.String("name"); err != nil {
+		return err
+	}
+	mode, err := n.Int64("mode")
+	if err != nil {
+		return err
+	}
+	e.Mode = os.FileMode(mode)
+	if e.Size, err = n.Int64("size"); err != nil {
+		return err
+	}
+	mtime, err := n.Int64("mtime")
+	if err != nil {
+		return err
+	}
+	e.ModTime = time.Unix(0, mtime)
+	if e.Target, err = n.String("target"); err != nil {
+		return err
+	}
+	ref, err := n.Bytes("ref")
+	if err != nil {
+		return err
+	}
+	if e.hasRef() {
+		if len(ref) != len(e.Ref) {
+			return fmt.Errorf("entry %v has an invalid ref", e.Name)
+		}
+		copy(e.Ref[:], ref)
+	}
+	if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsRune(e.Name, '/') {
+		return fmt.Errorf("invalid entry name %q", e.Name)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// RestoreOptions controls how a snapshot is restored
+	RestoreOptions struct {
+		// Path selects the entry inside the snapshot which is restored,
+		// directories are restored into the target directory, other
+		// entries are restored as a child of the target directory
+		Path string
+
+		// Verify compares existing files by chunking them instead of
+		// trusting their size and modification time. Blob is required
+		// when Verify is true
+		Verify bool
+		Blob   *blob.B
+
+		// OnEntry, if not nil, is called after each entry is
+		// restored (or skipped), p is relative to the target directory
+		OnEntry func(p string, e Entry, skipped bool)
+	}
+
+	// RestoreStats contains the counters of a restore
+	RestoreStats struct {
+		Files    int   `json:"files" yaml:"files"`
+		Dirs     int   `json:"dirs" yaml:"dirs"`
+		Symlinks int   `json:"symlinks" yaml:"symlinks"`
+		Skipped  int   `json:"skipped" yaml:"skipped"`
+		Bytes    int64 `json:"bytes" yaml:"bytes"`
+	}
+
+	restorer struct {
+		c     *cas.C
+		opts  RestoreOptions
+		stats RestoreStats
+	}
+)
+
+// Restore recreates the snapshot root (or the entry at opts.Path) inside dir.
+//
+// Files are written to a temporary file which is renamed once its
+// content, mode and modification time are set, so an interrupted restore
+// never leaves half-written files behind. Files which already match the
+// snapshot are not written again. Files present in dir but not in the
+// snapshot are kept
+func Restore(ctx context.Context, c *cas.C, root cas.Ref, dir string, opts RestoreOptions) (RestoreStats, error) {
+	r := &restorer{c: c, opts: opts}
+	if opts.Verify && opts.Blob == nil {
+		return r.stats, errors.New("blob is required to verify existing files")
+	}
+	e, err := Lookup(ctx, c, root, opts.Path)
+	if err != nil {
+		return r.stats, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return r.stats, err
+	}
+	if e.IsDir() {
+		err = r.dirEntries(ctx, e, dir, "")
+	} else {
+		e.Name = path.Base("/" + path.Clean(opts.Path))
+		err = r.entry(ctx, e, filepath.Join(dir, e.Name), e.Name)
+	}
+	return r.stats, err
+}
+
+// dirEntries restores the entries of the directory e inside target
+func (r *restorer) dirEntries(ctx context.Context, e Entry, target, rel string) error {
+	d, err := ReadDir(ctx, r.c, e.Ref)
+	if err != nil {
+		return err
+	}
+	for _, child := range d.Entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.entry(ctx, child, filepath.Join(target, child.Name), path.Join(rel, child.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *restorer) entry(ctx context.Context, e Entry, target, rel string) error {
+	var skipped bool
+	var err error
+	switch {
+	case e.IsDir():
+		err = r.dir(ctx, e, target, rel)
+	case e.IsRegular():
+		skipped, err = r.file(ctx, e, target)
+	case e.IsSymlink():
+		skipped, err = r.symlink(e, target)
+	default:
+		return fmt.Errorf("%v has an unsupported mode %v", rel, e.Mode)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to restore %v, cause: %w", rel, err)
+	}
+	if skipped {
+		r.stats.Skipped++
+	}
+	if r.opts.OnEntry != nil {
+		r.opts.OnEntry(rel, e, skipped)
+	}
+	return nil
+}
+
+func (r *restorer) dir(ctx context.Context, e Entry, target, rel string) error {
+	info, err := os.Lstat(target)
+	if err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the owner must be able to write the directory while
+	// its entries are restored, the actual mode is set later
+	if err := os.MkdirAll(target, e.Mode.Perm()|0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, e.Mode.Perm()|0700); err != nil {
+		return err
+	}
+	if err := r.dirEntries(ctx, e, target, rel); err != nil {
+		return err
+	}
+	r.stats.Dirs++
+	// restoring entries changes the modification time of the
+	// directory, so it must be set after them
+	if err := os.Chmod(target, e.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, e.ModTime, e.ModTime)
+}
+
+func (r *restorer) file(ctx context.Context, e Entry, target string) (bool, error) {
+	info, err := os.Lstat(target)
+	if err == nil && info.IsDir() {
+		return false, errors.New("a directory exists at the same path")
+	} else if err == nil && info.Mode().IsRegular() {
+		same, err := r.sameFile(ctx, e, target, info)
+		if err != nil {
+			return false, err
+		}
+		if same {
+			if info.Mode().Perm() != e.Mode.Perm() {
+				if err := os.Chmod(target, e.Mode.Perm()); err != nil {
+					return false, err
+				}
+			}
+			return true, os.Chtimes(target, e.ModTime, e.ModTime)
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".dbfs-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := blob.Read(ctx, r.c, tmp, e.Ref)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if n != e.Size {
+		return false, fmt.Errorf("blob has %v bytes but the entry has %v", n, e.Size)
+	}
+	if err := os.Chmod(tmp.Name(), e.Mode.Perm()); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(tmp.Name(), e.ModTime, e.ModTime); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return false, err
+	}
+	r.stats.Files++
+	r.stats.Bytes += n
+	return false, nil
+}
+
+// sameFile returns true if the file at target has the content of e
+func (r *restorer) sameFile(ctx context.Context, e Entry, target string, info os.FileInfo) (bool, error) {
+	if info.Size() != e.Size {
+		return false, nil
+	}
+	if !r.opts.Verify {
+		return info.ModTime().Equal(e.ModTime), nil
+	}
+	fd, err := os.Open(target)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	chunks, err := r.opts.Blob.Chunks(ctx, fd)
+	if err != nil {
+		return false, err
+	}
+	ref, err := blob.TreeRef(chunks)
+	if err != nil {
+		return false, err
+	}
+	return ref == e.Ref, nil
+}
+
+func (r *restorer) symlink(e Entry, target string) (bool, error) {
+	info, err := os.Lstat(target)
+	if err == nil && info.IsDir() {
+		return false, errors.New("a directory exists at the same path")
+	} else if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if current, err := os.Readlink(target); err == nil && current == e.Target {
+			return true, nil
+		}
+	}
+	// symlinks cannot be overwritten, so the new link is created
+	// with a temporary name and renamed over the old entry
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".dbfs-")
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	if err := os.Symlink(e.Target, tmp.Name()); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	r.stats.Symlinks++
+	return false, nil
+}
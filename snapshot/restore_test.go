@@ -0,0 +1,146 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+func expectFile(t *testing.T, name, content string, mode os.FileMode) {
+	t.Helper()
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != content {
+		t.Errorf("%v should contain %q got %q", name, content, buf)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("%v should have mode %v got %v", name, mode, info.Mode())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	src := sampleTree(t)
+	defer os.RemoveAll(src)
+	root, _, err := Take(ctx, c, b, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ioutil.TempDir("", "dbfs-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	stats, err := Restore(ctx, c, root, dst, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 3 || stats.Symlinks != 1 || stats.Dirs != 3 || stats.Skipped != 0 {
+		t.Errorf("Unexpected stats %#v", stats)
+	}
+	expectFile(t, filepath.Join(dst, "a.txt"), "file a", 0644)
+	expectFile(t, filepath.Join(dst, "src", "main.go"), "package main", 0755)
+	expectFile(t, filepath.Join(dst, "src", "link"), "file a", 0644)
+	if target, err := os.Readlink(filepath.Join(dst, "src", "link")); err != nil {
+		t.Fatal(err)
+	} else if target != "../a.txt" {
+		t.Errorf("Unexpected symlink target %v", target)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "a.txt")); err != nil {
+		t.Fatal(err)
+	} else if !info.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)) {
+		t.Errorf("Unexpected mtime %v", info.ModTime())
+	}
+	if info, err := os.Stat(filepath.Join(dst, "empty")); err != nil {
+		t.Fatal(err)
+	} else if !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("Unexpected empty dir %v", info.Mode())
+	}
+	srcInfo, _ := os.Stat(filepath.Join(src, "src"))
+	if info, err := os.Stat(filepath.Join(dst, "src")); err != nil {
+		t.Fatal(err)
+	} else if !info.ModTime().Equal(srcInfo.ModTime()) {
+		t.Errorf("Directory mtime should be restored, expected %v got %v", srcInfo.ModTime(), info.ModTime())
+	}
+
+	// a second restore skips everything
+	stats, err = Restore(ctx, c, root, dst, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 0 || stats.Symlinks != 0 || stats.Skipped != 4 {
+		t.Errorf("Matching files should be skipped: %#v", stats)
+	}
+
+	// same size and mtime hide the change unless files are verified
+	name := filepath.Join(dst, "src", "main.go")
+	info, _ := os.Stat(name)
+	if err := ioutil.WriteFile(name, []byte("package MAIN"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, info.ModTime(), info.ModTime())
+	if _, err := Restore(ctx, c, root, dst, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, name, "package MAIN", 0755)
+	stats, err = Restore(ctx, c, root, dst, RestoreOptions{Verify: true, Blob: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 1 {
+		t.Errorf("Only the changed file should be restored: %#v", stats)
+	}
+	expectFile(t, name, "package main", 0755)
+
+	entries, err := ioutil.ReadDir(filepath.Join(dst, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Temporary files should not be left behind: %v", entries)
+	}
+}
+
+func TestPartialRestore(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	src := sampleTree(t)
+	defer os.RemoveAll(src)
+	root, _, err := Take(ctx, c, b, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.TempDir("", "dbfs-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if _, err := Restore(ctx, c, root, filepath.Join(dst, "dir"), RestoreOptions{Path: "docs"}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, filepath.Join(dst, "dir", "readme"), "read me", 0644)
+
+	if _, err := Restore(ctx, c, root, filepath.Join(dst, "file"), RestoreOptions{Path: "src/main.go"}); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, filepath.Join(dst, "file", "main.go"), "package main", 0755)
+
+	if _, err := Restore(ctx, c, root, dst, RestoreOptions{Path: "missing"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Restore of a missing path should fail with not exist, got %v", err)
+	}
+}
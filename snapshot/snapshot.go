@@ -0,0 +1,343 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	// Entry is an item inside a directory
+	Entry struct {
+		Name    string
+		Mode    os.FileMode
+		Size    int64
+		ModTime time.Time
+		// Target is the destination of symbolic links
+		Target string
+		// Ref is the blob root for regular files and the
+		// Dir object for directories, symbolic links don't
+		// have a ref
+		Ref cas.Ref
+	}
+
+	// Dir lists the entries of a directory sorted by name
+	Dir struct {
+		Entries []Entry
+	}
+
+	// Options controls how a snapshot is taken
+	Options struct {
+		// OnEntry, if not nil, is called after each entry
+		// is stored, p is relative to the snapshot root
+		OnEntry func(p string, e Entry)
+
+		// Previous, if set, is an older snapshot of the same directory.
+		// Files whose size and modification time match the entry in
+		// Previous reuse its ref instead of being read again
+		Previous cas.Ref
+
+		// Changed, if not nil, is called with the path of directories
+		// found in Previous, if it returns false the directory is not
+		// listed and the entry from Previous is reused
+		Changed func(p string) bool
+
+		// Filter, if not nil, decides which entries are stored,
+		// OnExclude is called with the path of excluded entries
+		Filter    Filter
+		OnExclude func(p string)
+	}
+
+	// Filter decides which entries are stored by Take
+	Filter interface {
+		// Enter returns the Filter used for the entries of the
+		// directory at fullpath, p is relative to the snapshot root
+		Enter(fullpath, p string) (Filter, error)
+
+		// Exclude returns true if the entry at fullpath should
+		// not be stored, p is relative to the snapshot root
+		Exclude(fullpath, p string, info os.FileInfo) bool
+	}
+
+	// Stats contains the counters of a snapshot
+	Stats struct {
+		Files    int   `json:"files" yaml:"files"`
+		Dirs     int   `json:"dirs" yaml:"dirs"`
+		Symlinks int   `json:"symlinks" yaml:"symlinks"`
+		Skipped  int   `json:"skipped" yaml:"skipped"`
+		Reused   int   `json:"reused" yaml:"reused"`
+		Excluded int   `json:"excluded" yaml:"excluded"`
+		Bytes    int64 `json:"bytes" yaml:"bytes"`
+	}
+
+	taker struct {
+		c     *cas.C
+		b     *blob.B
+		opts  Options
+		stats Stats
+	}
+
+	countReader struct {
+		actual io.Reader
+		total  int64
+	}
+)
+
+const (
+	// DirType is the cas.Type used to store Dir objects
+	DirType cas.Type = "dir"
+)
+
+var (
+	// SkipDir can be returned by the function passed to Walk
+	// to avoid visiting the entries of a directory
+	SkipDir = errors.New("skip dir")
+)
+
+// Take stores the directory dir and everything below it, the returned
+// ref points to the Dir object of dir.
+//
+// Only regular files, directories and symbolic links are stored, other
+// files (devices, sockets, pipes) are counted as skipped
+func Take(ctx context.Context, c *cas.C, b *blob.B, dir string, opts Options) (cas.Ref, Stats, error) {
+	t := &taker{c: c, b: b, opts: opts}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return cas.Ref{}, t.stats, err
+	}
+	if !info.IsDir() {
+		return cas.Ref{}, t.stats, fmt.Errorf("%v is not a directory", dir)
+	}
+	ref, _, err := t.dir(ctx, dir, "", opts.Previous, opts.Filter)
+	return ref, t.stats, err
+}
+
+// dir stores the directory at fullpath and returns the ref of its
+// Dir object and the number of bytes stored below it, prevRef is
+// the Dir object of the same directory in opts.Previous and f is
+// the filter of the parent directory
+func (t *taker) dir(ctx context.Context, fullpath, rel string, prevRef cas.Ref, f Filter) (cas.Ref, int64, error) {
+	infos, err := ioutil.ReadDir(fullpath)
+	if err != nil {
+		return cas.Ref{}, 0, err
+	}
+	if f != nil {
+		if f, err = f.Enter(fullpath, rel); err != nil {
+			return cas.Ref{}, 0, err
+		}
+	}
+	var prev Dir
+	if prevRef != (cas.Ref{}) {
+		prev, err = ReadDir(ctx, t.c, prevRef)
+		if err != nil {
+			return cas.Ref{}, 0, err
+		}
+	}
+	var d Dir
+	var total int64
+	for _, info := range infos {
+		if err := ctx.Err(); err != nil {
+			return cas.Ref{}, 0, err
+		}
+		child, childRel := filepath.Join(fullpath, info.Name()), path.Join(rel, info.Name())
+		if f != nil && f.Exclude(child, childRel, info) {
+			t.stats.Excluded++
+			if t.opts.OnExclude != nil {
+				t.opts.OnExclude(childRel)
+			}
+			continue
+		}
+		var old *Entry
+		if found, ok := prev.Find(info.Name()); ok {
+			old = &found
+		}
+		e, ok, err := t.entry(ctx, child, childRel, info, old, f)
+		if err != nil {
+			return cas.Ref{}, 0, err
+		}
+		if !ok {
+			t.stats.Skipped++
+			continue
+		}
+		d.Entries = append(d.Entries, e)
+		total += e.Size
+		if t.opts.OnEntry != nil {
+			t.opts.OnEntry(childRel, e)
+		}
+	}
+	ref, err := WriteDir(ctx, t.c, d)
+	t.stats.Dirs++
+	return ref, total, err
+}
+
+// entry stores the file at fullpath, old is the entry with the same
+// name in opts.Previous, or nil if there is none
+func (t *taker) entry(ctx context.Context, fullpath, rel string, info os.FileInfo, old *Entry, f Filter) (Entry, bool, error) {
+	e := Entry{
+		Name:    info.Name(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	var err error
+	switch {
+	case info.Mode().IsDir() && old != nil && old.IsDir() && t.opts.Changed != nil && !t.opts.Changed(rel):
+		e.Ref, e.Size = old.Ref, old.Size
+		t.stats.Reused++
+	case info.Mode().IsDir():
+		var prevRef cas.Ref
+		if old != nil && old.IsDir() {
+			prevRef = old.Ref
+		}
+		e.Ref, e.Size, err = t.dir(ctx, fullpath, rel, prevRef, f)
+	case info.Mode().IsRegular() && old != nil && old.IsRegular() && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()):
+		e.Ref, e.Size = old.Ref, old.Size
+		t.stats.Files++
+		t.stats.Reused++
+	case info.Mode().IsRegular():
+		e.Ref, e.Size, err = t.file(ctx, fullpath)
+		t.stats.Files++
+		t.stats.Bytes += e.Size
+	case info.Mode()&os.ModeSymlink != 0:
+		e.Target, err = os.Readlink(fullpath)
+		t.stats.Symlinks++
+	default:
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("unable to store %v, cause: %w", rel, err)
+	}
+	return e, true, nil
+}
+
+func (t *taker) file(ctx context.Context, fullpath string) (cas.Ref, int64, error) {
+	fd, err := os.Open(fullpath)
+	if err != nil {
+		return cas.Ref{}, 0, err
+	}
+	defer fd.Close()
+	// the size is computed from the bytes uploaded, files
+	// might change after they were listed
+	cr := &countReader{actual: fd}
+	ref, err := t.b.Upload(ctx, t.c, cr)
+	return ref, cr.total, err
+}
+
+// WriteDir stores d, entries are sorted by name before
+// they are encoded
+func WriteDir(ctx context.Context, c *cas.C, d Dir) (cas.Ref, error) {
+	buf, err := d.MarshalBinary()
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	return c.PutTyped(ctx, DirType, buf)
+}
+
+// ReadDir reads the Dir object at ref
+func ReadDir(ctx context.Context, c *cas.C, ref cas.Ref) (Dir, error) {
+	typ, content, err := c.GetTyped(ctx, ref)
+	if err != nil {
+		return Dir{}, err
+	}
+	if typ != DirType {
+		return Dir{}, fmt.Errorf("object %v is a %v not a %v", ref, typ, DirType)
+	}
+	var d Dir
+	if err := d.UnmarshalBinary(content); err != nil {
+		return Dir{}, fmt.Errorf("unable to decode dir %v, cause: %w", ref, err)
+	}
+	return d, nil
+}
+
+// Lookup returns the entry at p (a slash separated path) inside the
+// snapshot root. The root itself is returned as a directory entry
+// without name
+func Lookup(ctx context.Context, c *cas.C, root cas.Ref, p string) (Entry, error) {
+	current := Entry{Mode: os.ModeDir | 0755, Ref: root}
+	for _, name := range SplitPath(p) {
+		if !current.IsDir() {
+			return Entry{}, fmt.Errorf("%v: %w", p, os.ErrNotExist)
+		}
+		d, err := ReadDir(ctx, c, current.Ref)
+		if err != nil {
+			return Entry{}, err
+		}
+		e, ok := d.Find(name)
+		if !ok {
+			return Entry{}, fmt.Errorf("%v: %w", p, os.ErrNotExist)
+		}
+		current = e
+	}
+	return current, nil
+}
+
+// Walk calls fn for every entry below the directory at ref, parents are
+// visited before their entries. If fn returns SkipDir for a directory
+// its entries are not visited, any other error stops the walk.
+//
+// Paths passed to fn are slash separated and relative to ref
+func Walk(ctx context.Context, c *cas.C, ref cas.Ref, fn func(p string, e Entry) error) error {
+	return walk(ctx, c, ref, "", fn)
+}
+
+func walk(ctx context.Context, c *cas.C, ref cas.Ref, prefix string, fn func(string, Entry) error) error {
+	d, err := ReadDir(ctx, c, ref)
+	if err != nil {
+		return err
+	}
+	for _, e := range d.Entries {
+		p := path.Join(prefix, e.Name)
+		err := fn(p, e)
+		if errors.Is(err, SkipDir) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			if err := walk(ctx, c, e.Ref, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SplitPath returns the names in p, empty names and "." are ignored
+func SplitPath(p string) []string {
+	var names []string
+	for _, n := range strings.Split(path.Clean("/"+p), "/") {
+		if n != "" && n != "." {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// Find returns the entry with the given name
+func (d Dir) Find(name string) (Entry, bool) {
+	i := sort.Search(len(d.Entries), func(i int) bool { return d.Entries[i].Name >= name })
+	if i < len(d.Entries) && d.Entries[i].Name == name {
+		return d.Entries[i], true
+	}
+	return Entry{}, false
+}
+
+func (e Entry) IsDir() bool     { return e.Mode.IsDir() }
+func (e Entry) IsRegular() bool { return e.Mode.IsRegular() }
+func (e Entry) IsSymlink() bool { return e.Mode&os.ModeSymlink != 0 }
+
+func (cr *countReader) Read(buf []byte) (int, error) {
+	n, err := cr.actual.Read(buf)
+	cr.total += int64(n)
+	return n, err
+}
@@ -0,0 +1,283 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+func sampleTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dbfs-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, filepath.Join(dir, "a.txt"), "file a")
+	testutil.WriteFile(t, filepath.Join(dir, "src", "main.go"), "package main")
+	testutil.WriteFile(t, filepath.Join(dir, "docs", "readme"), "read me")
+	if err := os.Chmod(filepath.Join(dir, "src", "main.go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../a.txt", filepath.Join(dir, "src", "link")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestTake(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	dir := sampleTree(t)
+	defer os.RemoveAll(dir)
+
+	root, stats, err := Take(ctx, c, b, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedStats := Stats{Files: 3, Dirs: 4, Symlinks: 1, Bytes: int64(len("file a") + len("package main") + len("read me"))}
+	if stats != expectedStats {
+		t.Errorf("Expected stats %#v got %#v", expectedStats, stats)
+	}
+
+	var paths []string
+	err = Walk(ctx, c, root, func(p string, e Entry) error {
+		paths = append(paths, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPaths := []string{"a.txt", "docs", "docs/readme", "empty", "src", "src/link", "src/main.go"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Walk should visit %v got %v", expectedPaths, paths)
+	}
+
+	a, err := Lookup(ctx, c, root, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.ModTime.Equal(time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)) || a.Size != 6 || a.Mode != 0644 {
+		t.Errorf("Unexpected entry for a.txt: %#v", a)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := blob.Read(ctx, c, buf, a.Ref); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "file a" {
+		t.Errorf("Unexpected content for a.txt: %q", buf.String())
+	}
+	if main, err := Lookup(ctx, c, root, "/src/./main.go"); err != nil {
+		t.Fatal(err)
+	} else if main.Mode.Perm() != 0755 {
+		t.Errorf("Unexpected mode for main.go: %v", main.Mode)
+	}
+	if link, err := Lookup(ctx, c, root, "src/link"); err != nil {
+		t.Fatal(err)
+	} else if !link.IsSymlink() || link.Target != "../a.txt" {
+		t.Errorf("Unexpected symlink entry %#v", link)
+	}
+	if empty, err := Lookup(ctx, c, root, "empty"); err != nil {
+		t.Fatal(err)
+	} else if !empty.IsDir() || empty.Mode.Perm() != 0700 {
+		t.Errorf("Unexpected entry for empty dir %#v", empty)
+	}
+	if _, err := Lookup(ctx, c, root, "a.txt/other"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lookup below a file should fail with os.ErrNotExist got %v", err)
+	}
+	if _, err := Lookup(ctx, c, root, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Lookup of a missing entry should fail with os.ErrNotExist got %v", err)
+	}
+}
+
+func TestUnchangedSubtrees(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	dir := sampleTree(t)
+	defer os.RemoveAll(dir)
+
+	first, _, err := Take(ctx, c, b, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := Take(ctx, c, b, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != again {
+		t.Fatal("Snapshots of the same tree should have the same ref")
+	}
+
+	testutil.WriteFile(t, filepath.Join(dir, "src", "main.go"), "package changed")
+	second, _, err := Take(ctx, c, b, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("Snapshot should change after a file changes")
+	}
+	for _, p := range []string{"docs", "empty"} {
+		before, err := Lookup(ctx, c, first, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := Lookup(ctx, c, second, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before.Ref != after.Ref {
+			t.Errorf("Unchanged directory %v should keep its ref", p)
+		}
+	}
+}
+
+func TestTakePrevious(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	dir := sampleTree(t)
+	defer os.RemoveAll(dir)
+
+	first, _, err := Take(ctx, c, b, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, stats, err := Take(ctx, c, b, dir, Options{Previous: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Fatal("Snapshots of the same tree should have the same ref")
+	}
+	if stats.Files != 3 || stats.Reused != 3 || stats.Bytes != 0 {
+		t.Errorf("Every file should be reused: %#v", stats)
+	}
+
+	testutil.WriteFile(t, filepath.Join(dir, "src", "main.go"), "package changed")
+	testutil.WriteFile(t, filepath.Join(dir, "docs", "readme"), "changed, but not reported")
+	second, stats, err := Take(ctx, c, b, dir, Options{
+		Previous: first,
+		Changed:  func(p string) bool { return p != "docs" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := int64(len("package changed")); stats.Bytes != expected || stats.Reused != 2 {
+		t.Errorf("Only main.go should be read, expected %v bytes got %#v", expected, stats)
+	}
+	main, err := Lookup(ctx, c, second, "src/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := blob.Read(ctx, c, buf, main.Ref); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "package changed" {
+		t.Errorf("Changed file should be stored again, got %q", buf.String())
+	}
+	before, err := Lookup(ctx, c, first, "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := Lookup(ctx, c, second, "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Ref != after.Ref {
+		t.Error("Directories reported as unchanged should reuse the previous entry")
+	}
+}
+
+func TestEdit(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	dir := sampleTree(t)
+	defer os.RemoveAll(dir)
+	root, _, err := Take(ctx, c, b, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileRef, err := b.Upload(ctx, c, bytes.NewBufferString("new file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited, err := Edit(ctx, c, root, "new/dir/file.txt", func(d *Dir, name string) error {
+		d.Set(Entry{Name: name, Mode: 0644, Size: 8, Ref: fileRef})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := Lookup(ctx, c, edited, "new/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	} else if e.Ref != fileRef {
+		t.Errorf("unexpected entry %v", e)
+	}
+	if e, err := Lookup(ctx, c, edited, "new"); err != nil {
+		t.Fatal(err)
+	} else if !e.IsDir() || e.Size != 8 {
+		t.Errorf("missing directories should be created with the size of their content, got %v", e)
+	}
+	before, _ := Lookup(ctx, c, root, "docs")
+	after, _ := Lookup(ctx, c, edited, "docs")
+	if before.Ref != after.Ref {
+		t.Error("directories outside the edited path should keep their ref")
+	}
+
+	edited, err = Edit(ctx, c, edited, "new/dir/file.txt", func(d *Dir, name string) error {
+		d.Remove(name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(ctx, c, edited, "new/dir/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removed entry should not exist, got %v", err)
+	}
+	if _, err := Edit(ctx, c, edited, "a.txt/child", func(d *Dir, name string) error { return nil }); !errors.Is(err, syscall.ENOTDIR) {
+		t.Error("editing below a file should fail")
+	}
+}
+
+func TestDirEncoding(t *testing.T) {
+	d := Dir{Entries: []Entry{
+		{Name: "b", Mode: 0644, Size: 10, ModTime: time.Unix(0, 1234), Ref: cas.PrecomputeHashBytes([]byte("b"))},
+		{Name: "a", Mode: os.ModeSymlink | 0777, ModTime: time.Unix(10, 0), Target: "b"},
+	}}
+	buf, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Dir
+	if err := decoded.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Entries) != 2 || decoded.Entries[0].Name != "a" || decoded.Entries[1].Name != "b" {
+		t.Fatalf("Entries should be sorted by name: %#v", decoded.Entries)
+	}
+	if !decoded.Entries[1].ModTime.Equal(d.Entries[0].ModTime) || decoded.Entries[1].Ref != d.Entries[0].Ref {
+		t.Errorf("Unexpected entry after decoding: %#v", decoded.Entries[1])
+	}
+	if decoded.Entries[0].Target != "b" || !decoded.Entries[0].IsSymlink() {
+		t.Errorf("Unexpected symlink after decoding: %#v", decoded.Entries[0])
+	}
+
+	d.Entries = append(d.Entries, Entry{Name: "a"})
+	if _, err := d.MarshalBinary(); err == nil {
+		t.Error("Duplicated names should be rejected")
+	}
+}
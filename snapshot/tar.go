@@ -0,0 +1,250 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+)
+
+type (
+	tarReader struct {
+		c     *cas.C
+		b     *blob.B
+		opts  Options
+		stats Stats
+		root  *tarNode
+	}
+
+	// tarNode keeps the entries read from a tar stream until
+	// the whole stream is consumed, tar files may list the
+	// entries of a directory in any order
+	tarNode struct {
+		entry    Entry
+		children map[string]*tarNode
+	}
+)
+
+var (
+	// implicitModTime is used for directories which only
+	// appear as the parent of other entries
+	implicitModTime = time.Unix(0, 0).UTC()
+)
+
+// ReadTar stores the entries of the tar stream r and returns the ref
+// of the Dir object which contains them.
+//
+// Directories missing from the stream are created with mode 0755,
+// hard links are stored as a copy of the file they point to and
+// later entries replace earlier ones with the same name. Entries
+// other than regular files, directories and symbolic links are
+// counted as skipped
+func ReadTar(ctx context.Context, c *cas.C, b *blob.B, r io.Reader, opts Options) (cas.Ref, Stats, error) {
+	t := &tarReader{c: c, b: b, opts: opts, root: &tarNode{entry: Entry{Mode: os.ModeDir | 0755}}}
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return cas.Ref{}, t.stats, err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return cas.Ref{}, t.stats, fmt.Errorf("unable to read tar, cause: %w", err)
+		}
+		if err := t.entry(ctx, tr, hdr); err != nil {
+			return cas.Ref{}, t.stats, fmt.Errorf("unable to store %v, cause: %w", hdr.Name, err)
+		}
+	}
+	ref, _, err := t.write(ctx, t.root)
+	return ref, t.stats, err
+}
+
+// WriteTar writes the entries of the snapshot root to w. The output only
+// depends on the snapshot: entries are sorted by name, owners are not
+// recorded and the format is chosen from the entry, so the same root
+// always produces the same bytes
+func WriteTar(ctx context.Context, c *cas.C, root cas.Ref, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := Walk(ctx, c, root, func(p string, e Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(tarHeader(p, e)); err != nil {
+			return fmt.Errorf("unable to write %v, cause: %w", p, err)
+		}
+		if !e.IsRegular() {
+			return nil
+		}
+		n, err := blob.Read(ctx, c, tw, e.Ref)
+		if err != nil {
+			return fmt.Errorf("unable to write %v, cause: %w", p, err)
+		} else if n != e.Size {
+			return fmt.Errorf("blob of %v has %v bytes but the entry has %v", p, n, e.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (t *tarReader) entry(ctx context.Context, tr *tar.Reader, hdr *tar.Header) error {
+	names := SplitPath(hdr.Name)
+	if len(names) == 0 {
+		// the root directory, its metadata is not stored
+		return nil
+	}
+	e := Entry{
+		Name:    names[len(names)-1],
+		Mode:    hdr.FileInfo().Mode(),
+		ModTime: hdr.ModTime,
+	}
+	var err error
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+	case tar.TypeReg, tar.TypeRegA:
+		cr := &countReader{actual: tr}
+		e.Ref, err = t.b.Upload(ctx, t.c, cr)
+		e.Size = cr.total
+		t.stats.Files++
+		t.stats.Bytes += e.Size
+	case tar.TypeSymlink:
+		e.Target = hdr.Linkname
+		t.stats.Symlinks++
+	case tar.TypeLink:
+		target, ok := t.root.lookup(SplitPath(hdr.Linkname))
+		if !ok || !target.entry.IsRegular() {
+			return fmt.Errorf("hard link to %v which is not a regular file", hdr.Linkname)
+		}
+		e.Ref, e.Size = target.entry.Ref, target.entry.Size
+		t.stats.Files++
+	default:
+		t.stats.Skipped++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	parent, err := t.root.mkdirAll(names[:len(names)-1])
+	if err != nil {
+		return err
+	}
+	parent.set(e)
+	if t.opts.OnEntry != nil {
+		t.opts.OnEntry(path.Join(names...), e)
+	}
+	return nil
+}
+
+// write stores n and everything below it, returning the ref of its
+// Dir object and the number of bytes stored below it
+func (t *tarReader) write(ctx context.Context, n *tarNode) (cas.Ref, int64, error) {
+	var d Dir
+	var total int64
+	for _, child := range n.children {
+		e := child.entry
+		if e.IsDir() {
+			var err error
+			e.Ref, e.Size, err = t.write(ctx, child)
+			if err != nil {
+				return cas.Ref{}, 0, err
+			}
+		}
+		d.Entries = append(d.Entries, e)
+		total += e.Size
+	}
+	ref, err := WriteDir(ctx, t.c, d)
+	t.stats.Dirs++
+	return ref, total, err
+}
+
+func (n *tarNode) lookup(names []string) (*tarNode, bool) {
+	for _, name := range names {
+		child, ok := n.children[name]
+		if !ok {
+			return nil, false
+		}
+		n = child
+	}
+	return n, true
+}
+
+// mkdirAll returns the directory at names, creating it if needed
+func (n *tarNode) mkdirAll(names []string) (*tarNode, error) {
+	for i, name := range names {
+		child, ok := n.children[name]
+		if !ok {
+			child = n.set(Entry{Name: name, Mode: os.ModeDir | 0755, ModTime: implicitModTime})
+		} else if !child.entry.IsDir() {
+			return nil, fmt.Errorf("%v is not a directory, cause: %w", path.Join(names[:i+1]...), syscall.ENOTDIR)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// set adds e to n, if a directory replaces another
+// directory the entries of the old one are kept
+func (n *tarNode) set(e Entry) *tarNode {
+	if n.children == nil {
+		n.children = make(map[string]*tarNode)
+	}
+	child, ok := n.children[e.Name]
+	if !ok || !child.entry.IsDir() || !e.IsDir() {
+		child = &tarNode{}
+		n.children[e.Name] = child
+	}
+	child.entry = e
+	return child
+}
+
+// tarHeader returns the header used by WriteTar for the entry at p
+func tarHeader(p string, e Entry) *tar.Header {
+	hdr := &tar.Header{
+		Name:    p,
+		Mode:    tarMode(e.Mode),
+		ModTime: e.ModTime,
+	}
+	switch {
+	case e.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case e.IsSymlink():
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Target
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.Size
+	}
+	if e.ModTime.Nanosecond() != 0 {
+		// only PAX keeps sub-second modification times,
+		// other formats would round them
+		hdr.Format = tar.FormatPAX
+	}
+	return hdr
+}
+
+// tarMode converts m to the unix mode bits stored by tar
+func tarMode(m os.FileMode) int64 {
+	mode := int64(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
@@ -0,0 +1,124 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+func TestReadTar(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/bin/tool", Mode: 04755}, content: "binary"},
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0700}},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "usr/bin/alias", Linkname: "usr/bin/tool"}},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "tool", Linkname: "usr/bin/tool"}},
+		{hdr: tar.Header{Typeflag: tar.TypeFifo, Name: "pipe"}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "../escape.txt", Mode: 0644}, content: "old"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "escape.txt", Mode: 0600}, content: "new"},
+	} {
+		e.hdr.ModTime = mtime
+		e.hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root, stats, err := ReadTar(ctx, c, b, buf, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedStats := Stats{Files: 4, Dirs: 3, Symlinks: 1, Skipped: 1, Bytes: int64(len("binary") + len("old") + len("new"))}
+	if stats != expectedStats {
+		t.Errorf("Expected stats %#v got %#v", expectedStats, stats)
+	}
+	if usr, err := Lookup(ctx, c, root, "usr"); err != nil {
+		t.Fatal(err)
+	} else if usr.Mode != os.ModeDir|0700 || usr.Size != 2*int64(len("binary")) {
+		t.Errorf("Directory entry should keep its children: %#v", usr)
+	}
+	if bin, err := Lookup(ctx, c, root, "usr/bin"); err != nil {
+		t.Fatal(err)
+	} else if bin.Mode != os.ModeDir|0755 || !bin.ModTime.Equal(implicitModTime) {
+		t.Errorf("Unexpected implicit directory %#v", bin)
+	}
+	tool, err := Lookup(ctx, c, root, "usr/bin/tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tool.Mode != os.ModeSetuid|0755 || !tool.ModTime.Equal(mtime) {
+		t.Errorf("Unexpected entry for tool %#v", tool)
+	}
+	if alias, err := Lookup(ctx, c, root, "usr/bin/alias"); err != nil {
+		t.Fatal(err)
+	} else if alias.Ref != tool.Ref || alias.Size != tool.Size {
+		t.Errorf("Hard link should have the content of its target %#v", alias)
+	}
+	if link, err := Lookup(ctx, c, root, "tool"); err != nil {
+		t.Fatal(err)
+	} else if !link.IsSymlink() || link.Target != "usr/bin/tool" {
+		t.Errorf("Unexpected symlink entry %#v", link)
+	}
+	escape, err := Lookup(ctx, c, root, "escape.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := &bytes.Buffer{}
+	if _, err := blob.Read(ctx, c, content, escape.Ref); err != nil {
+		t.Fatal(err)
+	} else if content.String() != "new" || escape.Mode != 0600 {
+		t.Errorf("Later entries should replace earlier ones, got %q %v", content.String(), escape.Mode)
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	c, b := testutil.OpenStore(ctx, t)
+	dir := sampleTree(t)
+	defer os.RemoveAll(dir)
+
+	root, _, err := Take(ctx, c, b, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &bytes.Buffer{}
+	if err := WriteTar(ctx, c, root, first); err != nil {
+		t.Fatal(err)
+	}
+	second := &bytes.Buffer{}
+	if err := WriteTar(ctx, c, root, second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("Exporting the same snapshot twice should produce the same bytes")
+	}
+
+	imported, _, err := ReadTar(ctx, c, b, first, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != root {
+		t.Errorf("Importing an exported snapshot should produce the same root, expected %v got %v", root, imported)
+	}
+}
@@ -0,0 +1,10 @@
+// package transfer copies the objects reachable from a root ref
+// between two cas stores, like git push/fetch
+//
+// Only objects missing on the destination are copied. Children are
+// always copied before their parents, so the destination never has
+// an object whose children are missing. That invariant allows the
+// transfer to skip whole sub-graphs once their root is found on the
+// destination and makes interrupted transfers resumable: running the
+// same transfer again only copies what is still missing.
+package transfer
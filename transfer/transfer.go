@@ -0,0 +1,200 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/graph"
+)
+
+type (
+	// Options controls how objects are copied
+	Options struct {
+		// Concurrency is the number of leaf objects copied in parallel,
+		// if zero DefaultConcurrency is used
+		Concurrency int
+
+		// Progress, if not nil, is called after every object is
+		// checked or copied
+		Progress func(Stats)
+	}
+
+	// Stats contains the counters of a transfer
+	Stats struct {
+		Checked int   `json:"checked" yaml:"checked"`
+		Copied  int   `json:"copied" yaml:"copied"`
+		Skipped int   `json:"skipped" yaml:"skipped"`
+		Bytes   int64 `json:"bytes" yaml:"bytes"`
+	}
+
+	syncer struct {
+		dst, src *cas.C
+		opts     Options
+
+		mu    sync.Mutex
+		stats Stats
+		seen  map[cas.Ref]struct{}
+	}
+)
+
+const (
+	DefaultConcurrency = 8
+)
+
+// Push copies root, and everything reachable from it, from local to remote
+func Push(ctx context.Context, local, remote *cas.C, root graph.Node, opts Options) (Stats, error) {
+	return Sync(ctx, remote, local, root, opts)
+}
+
+// Pull copies root, and everything reachable from it, from remote to local
+func Pull(ctx context.Context, local, remote *cas.C, root graph.Node, opts Options) (Stats, error) {
+	return Sync(ctx, local, remote, root, opts)
+}
+
+// Sync copies the objects reachable from root which are missing on dst
+func Sync(ctx context.Context, dst, src *cas.C, root graph.Node, opts Options) (Stats, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	s := &syncer{dst: dst, src: src, opts: opts, seen: make(map[cas.Ref]struct{})}
+	missing, err := s.missing(ctx, []graph.Node{root})
+	if err != nil {
+		return s.stats, err
+	}
+	if len(missing) > 0 {
+		err = s.visit(ctx, root)
+	}
+	return s.stats, err
+}
+
+// visit copies the missing children of n and then n itself
+func (s *syncer) visit(ctx context.Context, n graph.Node) error {
+	if n.Kind.Leaf() {
+		return s.copy(ctx, n, nil)
+	}
+	content, err := graph.Read(ctx, s.src, n)
+	if err != nil {
+		return err
+	}
+	children, err := graph.Children(n, content)
+	if err != nil {
+		return err
+	}
+	missing, err := s.missing(ctx, children)
+	if err != nil {
+		return err
+	}
+	var leaves []graph.Node
+	for _, c := range missing {
+		if c.Kind.Leaf() {
+			leaves = append(leaves, c)
+			continue
+		}
+		if err := s.visit(ctx, c); err != nil {
+			return err
+		}
+	}
+	if err := s.copyAll(ctx, leaves); err != nil {
+		return err
+	}
+	return s.copy(ctx, n, content)
+}
+
+// missing returns the nodes which don't exist on the destination and
+// were not copied yet
+func (s *syncer) missing(ctx context.Context, nodes []graph.Node) ([]graph.Node, error) {
+	var candidates []graph.Node
+	var refs []cas.Ref
+	s.mu.Lock()
+	for _, n := range nodes {
+		if _, ok := s.seen[n.Ref]; ok {
+			continue
+		}
+		s.seen[n.Ref] = struct{}{}
+		candidates = append(candidates, n)
+		refs = append(refs, n.Ref)
+	}
+	s.mu.Unlock()
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	exists, err := s.dst.ExistsBatch(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check objects on destination, cause: %w", err)
+	}
+	var out []graph.Node
+	s.mu.Lock()
+	for i, n := range candidates {
+		s.stats.Checked++
+		if exists[i] {
+			s.stats.Skipped++
+		} else {
+			out = append(out, n)
+		}
+	}
+	s.mu.Unlock()
+	s.progress()
+	return out, nil
+}
+
+// copyAll copies nodes concurrently
+func (s *syncer) copyAll(ctx context.Context, nodes []graph.Node) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sem := make(chan struct{}, s.opts.Concurrency)
+	errs := make(chan error, len(nodes))
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n graph.Node) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := s.copy(ctx, n, nil); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// copy writes content (or the content read from src if nil)
+// to dst and checks if the ref matches
+func (s *syncer) copy(ctx context.Context, n graph.Node, content []byte) error {
+	if content == nil {
+		var err error
+		content, err = graph.Read(ctx, s.src, n)
+		if err != nil {
+			return err
+		}
+	}
+	ref, err := s.dst.PutContent(ctx, bytes.NewBuffer(content))
+	if err != nil {
+		return fmt.Errorf("unable to write %v %v, cause: %w", n.Kind, n.Ref, err)
+	}
+	if ref != n.Ref {
+		return fmt.Errorf("%v %v is corrupted on the source, content hashes to %v", n.Kind, n.Ref, ref)
+	}
+	s.mu.Lock()
+	s.stats.Copied++
+	s.stats.Bytes += int64(len(content))
+	s.mu.Unlock()
+	s.progress()
+	return nil
+}
+
+func (s *syncer) progress() {
+	if s.opts.Progress == nil {
+		return
+	}
+	s.mu.Lock()
+	stats := s.stats
+	s.mu.Unlock()
+	s.opts.Progress(stats)
+}
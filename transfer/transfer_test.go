@@ -0,0 +1,145 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/graph"
+	"github.com/andrebq/dbfs/internal/testutil"
+)
+
+func upload(ctx context.Context, t *testing.T, c *cas.C, b *blob.B, content []byte) graph.Node {
+	root, err := b.Upload(ctx, c, bytes.NewBuffer(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return graph.Node{Ref: root, Kind: graph.KindTree}
+}
+
+func randomContent(size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(buf)
+	return buf
+}
+
+func expectBlob(ctx context.Context, t *testing.T, c *cas.C, root graph.Node, content []byte) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if _, err := blob.Read(ctx, c, buf, root.Ref); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Fatal("Content on destination does not match the source")
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	ctx := context.Background()
+	local, b := testutil.OpenStore(ctx, t)
+	remote, _ := testutil.OpenStore(ctx, t)
+	content := randomContent(3_000_000)
+	root := upload(ctx, t, local, b, content)
+
+	stats, err := Push(ctx, local, remote, root, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied == 0 || stats.Copied != stats.Checked {
+		t.Errorf("Every object should be copied to an empty remote: %#v", stats)
+	}
+	expectBlob(ctx, t, remote, root, content)
+
+	stats, err = Push(ctx, local, remote, root, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 0 || stats.Checked != 1 {
+		t.Errorf("Pushing again should only check the root: %#v", stats)
+	}
+
+	// change the tail of the content, only the new objects
+	// should be fetched back
+	changed := append([]byte(nil), content...)
+	copy(changed[len(changed)-1000:], randomContent(1000))
+	changedRoot := upload(ctx, t, remote, b, changed)
+	stats, err = Pull(ctx, local, remote, changedRoot, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied == 0 || stats.Skipped == 0 {
+		t.Errorf("Pull should copy only the changed objects: %#v", stats)
+	}
+	expectBlob(ctx, t, local, changedRoot, changed)
+}
+
+func TestResume(t *testing.T) {
+	ctx := context.Background()
+	src, b := testutil.OpenStore(ctx, t)
+	dst, _ := testutil.OpenStore(ctx, t)
+	content := randomContent(3_000_000)
+	root := upload(ctx, t, src, b, content)
+
+	interrupted, cancel := context.WithCancel(ctx)
+	_, err := Sync(interrupted, dst, src, root, Options{
+		Concurrency: 1,
+		Progress: func(s Stats) {
+			if s.Copied >= 3 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Sync should be interrupted, got %v", err)
+	}
+	if found, err := dst.Exists(ctx, root.Ref); err != nil {
+		t.Fatal(err)
+	} else if found {
+		t.Fatal("Root should be the last object copied")
+	}
+
+	stats, err := Sync(ctx, dst, src, root, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Skipped < 3 {
+		t.Errorf("Objects copied before the interruption should be skipped: %#v", stats)
+	}
+	expectBlob(ctx, t, dst, root, content)
+}
+
+func TestMissingRoot(t *testing.T) {
+	ctx := context.Background()
+	src, _ := testutil.OpenStore(ctx, t)
+	dst, _ := testutil.OpenStore(ctx, t)
+	ref, err := src.PutContent(ctx, bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref[0]++
+	if _, err := Sync(ctx, dst, src, graph.Node{Ref: ref, Kind: graph.KindChunk}, Options{}); err == nil {
+		t.Fatal("Sync should fail when the root is missing from the source")
+	}
+}
+
+func TestConcurrentSync(t *testing.T) {
+	// objects are written to dst by several goroutines,
+	// run with -race to catch unsynchronized access
+	ctx := context.Background()
+	src, b := testutil.OpenStore(ctx, t)
+	dst, _ := testutil.OpenStore(ctx, t)
+	content := randomContent(10_000_000)
+	root := upload(ctx, t, src, b, content)
+	stats, err := Sync(ctx, dst, src, root, Options{Concurrency: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != stats.Checked {
+		t.Errorf("Every object should be copied to an empty destination: %#v", stats)
+	}
+	expectBlob(ctx, t, dst, root, content)
+}
@@ -0,0 +1,14 @@
+// package watch keeps a ref up to date with the content of a local
+// directory, creating a new commit after every batch of changes
+//
+// Changes are detected with fsnotify (inotify on Linux). Directories
+// where nothing changed reuse the entry from the previous snapshot
+// without being listed and files whose size and modification time
+// didn't change reuse their previous blob, so each commit only reads
+// the files which were modified.
+//
+// A snapshot is only taken after the directory is quiet for the
+// debounce period, which avoids storing files while they are written.
+// Every time the watcher starts it lists the whole directory once,
+// so changes made while it was not running are not lost.
+package watch
@@ -0,0 +1,438 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/refs"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	// Watcher commits the content of a directory to a ref
+	// every time the directory changes
+	Watcher struct {
+		c    *cas.C
+		b    *blob.B
+		rs   *refs.Store
+		dir  string
+		name string
+		cfg  config
+
+		// tree is the root of the last snapshot committed to name
+		tree cas.Ref
+	}
+
+	// Result describes a snapshot taken by the watcher, Commit
+	// is the zero value if the snapshot didn't change
+	Result struct {
+		Commit cas.Ref
+		Tree   cas.Ref
+		Stats  snapshot.Stats
+	}
+
+	config struct {
+		debounce time.Duration
+		interval time.Duration
+		author   string
+		message  string
+		hooks    []func(Result)
+		filter   snapshot.Filter
+	}
+
+	Option func(cfg *config) error
+
+	// changes keeps the directories which must be listed in
+	// the next snapshot, all is set when it is not possible
+	// to know which directories changed
+	changes struct {
+		dirs map[string]struct{}
+		all  bool
+	}
+)
+
+const (
+	// DefaultDebounce is how long the directory must be quiet
+	// before a snapshot is taken
+	DefaultDebounce = 2 * time.Second
+
+	// DefaultInterval is the minimum time between two commits
+	DefaultInterval = time.Minute
+
+	// DefaultMessage is used for every commit
+	DefaultMessage = "Changes detected by watch"
+)
+
+// Debounce configures how long the directory must be quiet before a
+// snapshot is taken, files which are still being written keep
+// delaying the snapshot
+func Debounce(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return fmt.Errorf("debounce must be positive, got %v", d)
+		}
+		cfg.debounce = d
+		return nil
+	}
+}
+
+// Interval configures the minimum time between two commits,
+// changes made in between are grouped in a single commit
+func Interval(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return fmt.Errorf("interval cannot be negative, got %v", d)
+		}
+		cfg.interval = d
+		return nil
+	}
+}
+
+// Author configures the author of the commits
+func Author(name string) Option {
+	return func(cfg *config) error {
+		cfg.author = name
+		return nil
+	}
+}
+
+// Message configures the message of the commits
+func Message(msg string) Option {
+	return func(cfg *config) error {
+		cfg.message = msg
+		return nil
+	}
+}
+
+// Filter configures which entries are stored, excluded
+// directories are not watched
+func Filter(f snapshot.Filter) Option {
+	return func(cfg *config) error {
+		cfg.filter = f
+		return nil
+	}
+}
+
+// OnSnapshot adds a hook which is called after every snapshot
+func OnSnapshot(fn func(Result)) Option {
+	return func(cfg *config) error {
+		cfg.hooks = append(cfg.hooks, fn)
+		return nil
+	}
+}
+
+// New returns a watcher which commits the content of dir to the ref name
+func New(c *cas.C, b *blob.B, rs *refs.Store, dir, name string, options ...Option) (*Watcher, error) {
+	cfg := config{debounce: DefaultDebounce, interval: DefaultInterval, author: "dbfs", message: DefaultMessage}
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := refs.ValidName(name); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%v is not a directory", dir)
+	}
+	return &Watcher{c: c, b: b, rs: rs, dir: filepath.Clean(dir), name: name, cfg: cfg}, nil
+}
+
+// Run watches the directory until ctx is done.
+//
+// The whole directory is snapshot when Run starts, after that only the
+// directories with changes are listed again. Errors while taking a
+// snapshot are logged and the snapshot is retried after the next
+// debounce period
+func (w *Watcher) Run(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to watch %v, cause: %w", w.dir, err)
+	}
+	defer fw.Close()
+	pending := changes{dirs: make(map[string]struct{})}
+	// directories must be watched before the first snapshot,
+	// otherwise changes made while it is taken would be missed
+	if err := w.watchTree(fw, w.dir, &pending); err != nil {
+		return err
+	}
+	if err := w.loadTree(ctx); err != nil {
+		return err
+	}
+	pending.all = true
+
+	ticker := time.NewTicker(w.cfg.debounce / 2)
+	defer ticker.Stop()
+	// the first snapshot doesn't wait for the debounce period
+	lastEvent := time.Now().Add(-w.cfg.debounce)
+	var lastSnapshot time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			lastEvent = time.Now()
+			w.event(fw, ev, &pending)
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			// events might have been lost, so every
+			// directory is listed in the next snapshot
+			log.Warn().Err(err).Str("dir", w.dir).Msg("Watch error, the whole directory will be listed")
+			lastEvent = time.Now()
+			pending.all = true
+		case now := <-ticker.C:
+			if pending.empty() || now.Sub(lastEvent) < w.cfg.debounce || now.Sub(lastSnapshot) < w.cfg.interval {
+				continue
+			}
+			current := pending
+			pending = changes{dirs: make(map[string]struct{})}
+			if _, err := w.snapshot(ctx, current); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Warn().Err(err).Str("dir", w.dir).Msg("Unable to snapshot, it will be retried")
+				pending.merge(current)
+				continue
+			}
+			lastSnapshot = now
+		}
+	}
+}
+
+// loadTree reads the tree of the commit currently pointed by name
+func (w *Watcher) loadTree(ctx context.Context) error {
+	ref, _, err := w.rs.Get(ctx, w.name)
+	if errors.Is(err, cas.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	t, _, err := w.c.GetTyped(ctx, ref)
+	if err != nil {
+		return err
+	}
+	switch t {
+	case commit.Type:
+		cm, err := commit.Read(ctx, w.c, ref)
+		if err != nil {
+			return err
+		}
+		w.tree = cm.Tree
+	case snapshot.DirType:
+		w.tree = ref
+	}
+	return nil
+}
+
+// snapshot takes a snapshot listing only the directories in ch
+// and commits it if the tree changed
+func (w *Watcher) snapshot(ctx context.Context, ch changes) (Result, error) {
+	opts := snapshot.Options{Previous: w.tree, Filter: w.cfg.filter}
+	if !ch.all {
+		opts.Changed = ch.changed
+	}
+	tree, stats, err := snapshot.Take(ctx, w.c, w.b, w.dir, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Tree: tree, Stats: stats}
+	if tree != w.tree {
+		res.Commit, err = w.commit(ctx, tree)
+		if err != nil {
+			return Result{}, err
+		}
+		w.tree = tree
+	}
+	for _, h := range w.cfg.hooks {
+		h(res)
+	}
+	return res, nil
+}
+
+func (w *Watcher) commit(ctx context.Context, tree cas.Ref) (cas.Ref, error) {
+	var head cas.Ref
+	_, err := w.rs.Update(ctx, w.name, func(current cas.Ref, found bool) (cas.Ref, error) {
+		cm := commit.Commit{
+			Tree:    tree,
+			Author:  w.cfg.author,
+			Time:    time.Now().Truncate(time.Second),
+			Message: w.cfg.message,
+		}
+		if found {
+			// the ref might point to a snapshot, which cannot
+			// be used as a parent
+			if t, _, err := w.c.GetTyped(ctx, current); err != nil {
+				return cas.Ref{}, err
+			} else if t == commit.Type {
+				cm.Parents = []cas.Ref{current}
+			}
+		}
+		var err error
+		head, err = commit.Write(ctx, w.c, cm)
+		return head, err
+	})
+	return head, err
+}
+
+// event marks the directory which contains the changed entry, and
+// every directory above it, as changed. New directories are watched
+func (w *Watcher) event(fw *fsnotify.Watcher, ev fsnotify.Event, pending *changes) {
+	rel, err := filepath.Rel(w.dir, ev.Name)
+	if err != nil {
+		pending.all = true
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	pending.mark(path.Dir(rel))
+	if ev.Op&fsnotify.Create == 0 {
+		return
+	}
+	if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+		if err := w.watchTree(fw, ev.Name, pending); err != nil {
+			log.Warn().Err(err).Str("dir", ev.Name).Msg("Unable to watch directory")
+			pending.all = true
+		}
+	}
+}
+
+// watchTree watches dir and every directory below it which is not
+// excluded, they are also marked as changed since they might have
+// new entries
+func (w *Watcher) watchTree(fw *fsnotify.Watcher, dir string, pending *changes) error {
+	rel, err := filepath.Rel(w.dir, dir)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return w.watchDir(fw, w.dir, "", w.cfg.filter, pending)
+	}
+	rel = filepath.ToSlash(rel)
+	f, excluded, err := w.filterFor(rel)
+	if err != nil || excluded {
+		return err
+	}
+	return w.watchDir(fw, dir, rel, f, pending)
+}
+
+// watchDir watches the directory at fullpath and its children,
+// f is the filter of its parent
+func (w *Watcher) watchDir(fw *fsnotify.Watcher, fullpath, rel string, f snapshot.Filter, pending *changes) error {
+	if f != nil {
+		var err error
+		if f, err = f.Enter(fullpath, rel); err != nil {
+			return err
+		}
+	}
+	if err := fw.Add(fullpath); os.IsNotExist(err) {
+		// removed while the tree was listed
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to watch %v, cause: %w", fullpath, err)
+	}
+	pending.mark(rel)
+	infos, err := ioutil.ReadDir(fullpath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		child, childRel := filepath.Join(fullpath, info.Name()), path.Join(rel, info.Name())
+		if f != nil && f.Exclude(child, childRel, info) {
+			continue
+		}
+		if err := w.watchDir(fw, child, childRel, f, pending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterFor returns the filter of the directory which contains rel,
+// excluded is true if rel, or any directory above it, is excluded
+func (w *Watcher) filterFor(rel string) (snapshot.Filter, bool, error) {
+	f := w.cfg.filter
+	if f == nil {
+		return nil, false, nil
+	}
+	f, err := f.Enter(w.dir, "")
+	if err != nil {
+		return nil, false, err
+	}
+	fullpath, current := w.dir, ""
+	names := strings.Split(rel, "/")
+	for i, name := range names {
+		fullpath, current = filepath.Join(fullpath, name), path.Join(current, name)
+		info, err := os.Lstat(fullpath)
+		if err != nil {
+			// removed before it could be watched
+			return nil, true, nil
+		}
+		if f.Exclude(fullpath, current, info) {
+			return nil, true, nil
+		}
+		if i == len(names)-1 {
+			break
+		}
+		if f, err = f.Enter(fullpath, current); err != nil {
+			return nil, false, err
+		}
+	}
+	return f, false, nil
+}
+
+// mark adds p, and every directory above it up to the root ("."), to the set
+func (c *changes) mark(p string) {
+	if p == "" {
+		p = "."
+	}
+	for {
+		if _, ok := c.dirs[p]; ok {
+			return
+		}
+		c.dirs[p] = struct{}{}
+		if p == "." {
+			return
+		}
+		p = path.Dir(p)
+	}
+}
+
+func (c *changes) merge(other changes) {
+	c.all = c.all || other.all
+	for p := range other.dirs {
+		c.dirs[p] = struct{}{}
+	}
+}
+
+func (c *changes) changed(p string) bool {
+	_, ok := c.dirs[p]
+	return ok
+}
+
+func (c *changes) empty() bool {
+	return !c.all && len(c.dirs) == 0
+}
@@ -0,0 +1,122 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/commit"
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/refs"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+func nextResult(t *testing.T, results chan Result) Result {
+	t.Helper()
+	select {
+	case res := <-results:
+		return res
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for a snapshot")
+	}
+	return Result{}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, b := testutil.OpenStore(ctx, t)
+	rs, err := refs.Open(c.KV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "dbfs-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testutil.WriteFile(t, filepath.Join(dir, "a.txt"), "file a")
+	testutil.WriteFile(t, filepath.Join(dir, "docs", "readme"), "read me")
+
+	results := make(chan Result, 10)
+	w, err := New(c, b, rs, dir, "refs/heads/backup",
+		Debounce(50*time.Millisecond), Interval(0), Author("test"),
+		OnSnapshot(func(r Result) { results <- r }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+
+	first := nextResult(t, results)
+	if first.Commit == (cas.Ref{}) {
+		t.Fatal("First snapshot should create a commit")
+	}
+
+	testutil.WriteFile(t, filepath.Join(dir, "src", "main.go"), "package main")
+	second := nextResult(t, results)
+	if second.Commit == (cas.Ref{}) {
+		t.Fatal("Changes should create a commit")
+	}
+	if second.Stats.Bytes != int64(len("package main")) {
+		t.Errorf("Only the new file should be read: %#v", second.Stats)
+	}
+	cm, err := commit.Read(ctx, c, second.Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Parents) != 1 || cm.Parents[0] != first.Commit || cm.Author != "test" {
+		t.Errorf("Unexpected commit %#v", cm)
+	}
+	if head, _, err := rs.Get(ctx, "refs/heads/backup"); err != nil {
+		t.Fatal(err)
+	} else if head != second.Commit {
+		t.Errorf("Ref should point to the last commit %v got %v", second.Commit, head)
+	}
+	main, err := snapshot.Lookup(ctx, c, cm.Tree, "src/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := blob.Read(ctx, c, buf, main.Ref); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != "package main" {
+		t.Errorf("Unexpected content %q", buf.String())
+	}
+
+	// new directories must be watched too
+	testutil.WriteFile(t, filepath.Join(dir, "src", "util.go"), "package main // util")
+	third := nextResult(t, results)
+	if _, err := snapshot.Lookup(ctx, c, third.Tree, "src/util.go"); err != nil {
+		t.Errorf("Changes inside new directories should be stored, got %v", err)
+	}
+	for _, p := range []string{"a.txt", "docs"} {
+		before, err := snapshot.Lookup(ctx, c, first.Tree, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := snapshot.Lookup(ctx, c, third.Tree, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before.Ref != after.Ref {
+			t.Errorf("Unchanged entry %v should keep its ref", p)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run should stop once the context is done")
+	}
+}
@@ -0,0 +1,11 @@
+// package webdav serves snapshot trees as WebDAV shares
+//
+// Files are read with blob.Reader, so clients requesting a range of a
+// large file only download the chunks covering that range. Symbolic
+// links are not exposed.
+//
+// A writable FS passes every change (closing a written file, creating,
+// removing or renaming an entry) to a CommitFunc, which usually applies
+// it to the tree of the latest commit of a named ref, so changes made
+// by other writers are kept.
+package webdav
@@ -0,0 +1,208 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/snapshot"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// fileInfo implements os.FileInfo and the optional
+	// webdav.ETager and webdav.ContentTyper interfaces
+	fileInfo struct {
+		e snapshot.Entry
+	}
+
+	// readFile reads a regular file from its blob, the blob
+	// is only opened when the content is needed
+	readFile struct {
+		ctx context.Context
+		c   *cas.C
+		e   snapshot.Entry
+		r   *blob.Reader
+	}
+
+	dirFile struct {
+		e       snapshot.Entry
+		entries []snapshot.Entry
+		pos     int
+	}
+
+	// writeFile keeps the content in a temporary file
+	// which is stored when the file is closed
+	writeFile struct {
+		ctx  context.Context
+		fs   *FS
+		name string
+		tmp  *os.File
+	}
+)
+
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotWrite = errors.New("file is not open for writing")
+	errNotDir   = errors.New("not a directory")
+)
+
+func (fi fileInfo) Name() string       { return fi.e.Name }
+func (fi fileInfo) Size() int64        { return fi.e.Size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.e.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.e.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+// ETag uses the ref of the entry, so it only changes with the content
+func (fi fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.e.Ref == (cas.Ref{}) {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.e.Ref.String() + `"`, nil
+}
+
+// ContentType only uses the extension, otherwise listing a directory
+// would read the first bytes of every file
+func (fi fileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(fi.e.Name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (f *readFile) reader() (*blob.Reader, error) {
+	if f.r == nil {
+		r, err := blob.NewReader(f.ctx, f.c, f.e.Ref)
+		if err != nil {
+			return nil, err
+		}
+		f.r = r
+	}
+	return f.r, nil
+}
+
+func (f *readFile) Read(buf []byte) (int, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(buf)
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) { return nil, errIsDir }
+func (f *readFile) Stat() (os.FileInfo, error)               { return fileInfo{f.e}, nil }
+func (f *readFile) Write(buf []byte) (int, error)            { return 0, errNotWrite }
+func (f *readFile) Close() error                             { return nil }
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	remaining := f.entries[f.pos:]
+	if count > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		if len(remaining) > count {
+			remaining = remaining[:count]
+		}
+	}
+	infos := make([]os.FileInfo, len(remaining))
+	for i, e := range remaining {
+		infos[i] = fileInfo{e}
+	}
+	f.pos += len(remaining)
+	return infos, nil
+}
+
+func (f *dirFile) Read(buf []byte) (int, error)                 { return 0, errIsDir }
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) { return 0, errIsDir }
+func (f *dirFile) Stat() (os.FileInfo, error)                   { return fileInfo{f.e}, nil }
+func (f *dirFile) Write(buf []byte) (int, error)                { return 0, errIsDir }
+func (f *dirFile) Close() error                                 { return nil }
+
+// create opens name for writing, unless O_TRUNC is used the current
+// content is copied to the temporary file
+func (fs *FS) create(ctx context.Context, name string, flag int) (webdav.File, error) {
+	if !fs.Writable() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errReadOnly}
+	}
+	e, err := fs.lookup(ctx, fs.Root(), "open", name)
+	exists := err == nil
+	switch {
+	case err == nil && e.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case os.IsNotExist(err) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "dbfs-webdav-")
+	if err != nil {
+		return nil, err
+	}
+	f := &writeFile{ctx: ctx, fs: fs, name: name, tmp: tmp}
+	if exists && flag&os.O_TRUNC == 0 {
+		if _, err := blob.Read(ctx, fs.c, tmp, e.Ref); err != nil {
+			f.discard()
+			return nil, err
+		}
+		if flag&os.O_APPEND == 0 {
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				f.discard()
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *writeFile) Read(buf []byte) (int, error)                 { return f.tmp.Read(buf) }
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) { return f.tmp.Seek(offset, whence) }
+func (f *writeFile) Write(buf []byte) (int, error)                { return f.tmp.Write(buf) }
+func (f *writeFile) Readdir(count int) ([]os.FileInfo, error)     { return nil, errNotDir }
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	info, err := f.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{snapshot.Entry{Name: path.Base(f.name), Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}}, nil
+}
+
+// Close stores the content and commits the new tree
+func (f *writeFile) Close() error {
+	defer f.discard()
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := f.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	ref, err := f.fs.cfg.blob.Upload(f.ctx, f.fs.c, f.tmp)
+	if err != nil {
+		return err
+	}
+	return f.fs.put(f.ctx, f.name, snapshot.Entry{Mode: 0644, Size: info.Size(), ModTime: time.Now(), Ref: ref})
+}
+
+func (f *writeFile) discard() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
@@ -0,0 +1,287 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/snapshot"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/webdav"
+)
+
+type (
+	// FS implements webdav.FileSystem over a snapshot tree
+	FS struct {
+		c   *cas.C
+		cfg config
+
+		mu   sync.Mutex
+		root cas.Ref
+	}
+
+	// CommitFunc records a change, it must call edit with the latest
+	// snapshot root (which might include changes made by other writers)
+	// and store the root returned by edit. The root which was stored
+	// is returned, the change is discarded if it returns an error.
+	//
+	// edit might be called more than once if the root changes
+	// while the change is stored
+	CommitFunc func(ctx context.Context, edit EditFunc) (cas.Ref, error)
+
+	// EditFunc applies a change to the snapshot root
+	EditFunc func(root cas.Ref) (cas.Ref, error)
+
+	config struct {
+		blob   *blob.B
+		commit CommitFunc
+	}
+
+	Option func(cfg *config) error
+
+	// editFunc changes the entry called name inside d
+	editFunc func(d *snapshot.Dir, name string) error
+)
+
+var (
+	errReadOnly = errors.New("share is read-only")
+)
+
+// Writable accepts changes, new files are chunked with b
+// and every change is recorded by fn
+func Writable(b *blob.B, fn CommitFunc) Option {
+	return func(cfg *config) error {
+		if b == nil || fn == nil {
+			return errors.New("writable shares require a blob and a commit function")
+		}
+		cfg.blob = b
+		cfg.commit = fn
+		return nil
+	}
+}
+
+// NewFS returns a FS which serves the directory snapshot root
+func NewFS(ctx context.Context, c *cas.C, root cas.Ref, options ...Option) (*FS, error) {
+	var cfg config
+	for _, opt := range options {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := snapshot.ReadDir(ctx, c, root); err != nil {
+		return nil, err
+	}
+	return &FS{c: c, cfg: cfg, root: root}, nil
+}
+
+// Handler returns a http.Handler serving fs with the WebDAV protocol,
+// read-only shares reject methods which change content
+func Handler(fs *FS) http.Handler {
+	h := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				log.Debug().Err(err).Str("method", req.Method).Str("path", req.URL.Path).Msg("WebDAV request failed")
+			}
+		},
+	}
+	if fs.Writable() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+			h.ServeHTTP(w, req)
+		default:
+			http.Error(w, errReadOnly.Error(), http.StatusForbidden)
+		}
+	})
+}
+
+// Root returns the current snapshot root
+func (fs *FS) Root() cas.Ref {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.root
+}
+
+// Writable returns true if fs accepts changes
+func (fs *FS) Writable() bool { return fs.cfg.commit != nil }
+
+func (fs *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	e, err := fs.lookup(ctx, fs.Root(), "stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{e}, nil
+}
+
+func (fs *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return fs.create(ctx, name, flag)
+	}
+	e, err := fs.lookup(ctx, fs.Root(), "open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir() {
+		d, err := snapshot.ReadDir(ctx, fs.c, e.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{e: e, entries: visible(d.Entries)}, nil
+	}
+	return &readFile{ctx: ctx, c: fs.c, e: e}, nil
+}
+
+func (fs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	empty, err := snapshot.WriteDir(ctx, fs.c, snapshot.Dir{})
+	if err != nil {
+		return err
+	}
+	return fs.change(ctx, "mkdir", name, func(root cas.Ref) (cas.Ref, error) {
+		return fs.edit(ctx, root, name, func(d *snapshot.Dir, base string) error {
+			if _, found := d.Find(base); found {
+				return os.ErrExist
+			}
+			d.Set(snapshot.Entry{Name: base, Mode: os.ModeDir | 0755, ModTime: time.Now(), Ref: empty})
+			return nil
+		})
+	})
+}
+
+func (fs *FS) RemoveAll(ctx context.Context, name string) error {
+	return fs.change(ctx, "remove", name, func(root cas.Ref) (cas.Ref, error) {
+		return fs.edit(ctx, root, name, func(d *snapshot.Dir, base string) error {
+			d.Remove(base)
+			return nil
+		})
+	})
+}
+
+func (fs *FS) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, newPath := strings.Join(snapshot.SplitPath(oldName), "/"), strings.Join(snapshot.SplitPath(newName), "/")
+	if newPath == oldPath || strings.HasPrefix(newPath, oldPath+"/") {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	return fs.change(ctx, "rename", oldName, func(root cas.Ref) (cas.Ref, error) {
+		e, err := fs.lookup(ctx, root, "rename", oldName)
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		root, err = fs.edit(ctx, root, oldName, func(d *snapshot.Dir, base string) error {
+			d.Remove(base)
+			return nil
+		})
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		return fs.edit(ctx, root, newName, func(d *snapshot.Dir, base string) error {
+			e.Name = base
+			d.Set(e)
+			return nil
+		})
+	})
+}
+
+// put replaces the entry at name with a regular file
+func (fs *FS) put(ctx context.Context, name string, e snapshot.Entry) error {
+	return fs.change(ctx, "write", name, func(root cas.Ref) (cas.Ref, error) {
+		return fs.edit(ctx, root, name, func(d *snapshot.Dir, base string) error {
+			if current, found := d.Find(base); found && current.IsDir() {
+				return errors.New("a directory exists at the same path")
+			}
+			e.Name = base
+			d.Set(e)
+			return nil
+		})
+	})
+}
+
+// change applies fn to the latest root and commits it, changes
+// are serialized so none of them is lost
+func (fs *FS) change(ctx context.Context, op, name string, fn EditFunc) error {
+	if !fs.Writable() {
+		return &os.PathError{Op: op, Path: name, Err: errReadOnly}
+	}
+	if len(snapshot.SplitPath(name)) == 0 {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var editErr error
+	root, err := fs.cfg.commit(ctx, func(current cas.Ref) (cas.Ref, error) {
+		var root cas.Ref
+		root, editErr = fn(current)
+		return root, editErr
+	})
+	if editErr != nil {
+		return pathError(op, name, editErr)
+	} else if err != nil {
+		return fmt.Errorf("unable to commit %v of %v, cause: %w", op, name, err)
+	}
+	fs.root = root
+	return nil
+}
+
+// edit applies fn to the parent of name, unlike snapshot.Edit
+// it fails if the parent does not exist
+func (fs *FS) edit(ctx context.Context, root cas.Ref, name string, fn editFunc) (cas.Ref, error) {
+	names := snapshot.SplitPath(name)
+	if len(names) == 0 {
+		return cas.Ref{}, os.ErrPermission
+	}
+	parent, err := snapshot.Lookup(ctx, fs.c, root, strings.Join(names[:len(names)-1], "/"))
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	if !parent.IsDir() {
+		return cas.Ref{}, os.ErrNotExist
+	}
+	return snapshot.Edit(ctx, fs.c, root, name, fn)
+}
+
+func (fs *FS) lookup(ctx context.Context, root cas.Ref, op, name string) (snapshot.Entry, error) {
+	e, err := snapshot.Lookup(ctx, fs.c, root, name)
+	if err == nil && e.IsSymlink() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		return snapshot.Entry{}, pathError(op, name, err)
+	}
+	if names := snapshot.SplitPath(name); len(names) > 0 {
+		e.Name = names[len(names)-1]
+	}
+	return e, nil
+}
+
+// pathError wraps err in a os.PathError, webdav.Handler uses
+// os.IsNotExist and os.IsExist which don't unwrap other errors
+func pathError(op, name string, err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case errors.Is(err, os.ErrExist):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	}
+	return err
+}
+
+// visible removes the entries which are not exposed
+func visible(entries []snapshot.Entry) []snapshot.Entry {
+	out := entries[:0]
+	for _, e := range entries {
+		if !e.IsSymlink() {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrebq/dbfs/blob"
+	"github.com/andrebq/dbfs/cas"
+	"github.com/andrebq/dbfs/internal/testutil"
+	"github.com/andrebq/dbfs/snapshot"
+)
+
+func sampleTree(ctx context.Context, t *testing.T, content []byte) (*cas.C, *blob.B, cas.Ref) {
+	c, b := testutil.OpenStore(ctx, t)
+	fileRef, err := b.Upload(ctx, c, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "large.bin", Mode: 0644, Size: int64(len(content)), ModTime: time.Now(), Ref: fileRef},
+		{Name: "link", Mode: os.ModeSymlink | 0777, Target: "large.bin"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := snapshot.WriteDir(ctx, c, snapshot.Dir{Entries: []snapshot.Entry{
+		{Name: "docs", Mode: os.ModeDir | 0755, Size: int64(len(content)), ModTime: time.Now(), Ref: docs},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, b, root
+}
+
+func do(t *testing.T, method, url string, body string, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, content
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	content := make([]byte, 5_000_000)
+	rand.New(rand.NewSource(1)).Read(content)
+	c, _, root := sampleTree(ctx, t, content)
+	fs, err := NewFS(ctx, c, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(fs))
+	defer srv.Close()
+
+	res, body := do(t, "PROPFIND", srv.URL+"/docs/", "", "Depth", "1")
+	if res.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("unexpected status %v: %s", res.Status, body)
+	}
+	if !strings.Contains(string(body), "/docs/large.bin") {
+		t.Errorf("listing should contain large.bin: %s", body)
+	}
+	if strings.Contains(string(body), "/docs/link") {
+		t.Errorf("listing should not contain symbolic links: %s", body)
+	}
+
+	res, body = do(t, http.MethodGet, srv.URL+"/docs/large.bin", "", "Range", "bytes=1000000-1000099")
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("unexpected status %v", res.Status)
+	}
+	if !bytes.Equal(body, content[1000000:1000100]) {
+		t.Error("range returned the wrong bytes")
+	}
+
+	if res, _ := do(t, http.MethodGet, srv.URL+"/docs/missing", ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing files should return 404, got %v", res.Status)
+	}
+	if res, _ := do(t, http.MethodPut, srv.URL+"/docs/new.txt", "new"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("writes on a read-only share should return 403, got %v", res.Status)
+	}
+}
+
+func TestWritable(t *testing.T) {
+	ctx := context.Background()
+	c, b, root := sampleTree(ctx, t, []byte("large enough"))
+	var commits []cas.Ref
+	head := root
+	fs, err := NewFS(ctx, c, root, Writable(b, func(ctx context.Context, edit EditFunc) (cas.Ref, error) {
+		next, err := edit(head)
+		if err != nil {
+			return cas.Ref{}, err
+		}
+		head = next
+		commits = append(commits, next)
+		return next, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(fs))
+	defer srv.Close()
+
+	if res, body := do(t, "MKCOL", srv.URL+"/notes", ""); res.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %v: %s", res.Status, body)
+	}
+	// another writer changes the tree served by fs
+	other, err := b.Upload(ctx, c, bytes.NewBufferString("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err = snapshot.Edit(ctx, c, head, "other.txt", func(d *snapshot.Dir, name string) error {
+		d.Set(snapshot.Entry{Name: name, Mode: 0644, Size: 5, ModTime: time.Now(), Ref: other})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, body := do(t, http.MethodPut, srv.URL+"/notes/todo.txt", "write tests"); res.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %v: %s", res.Status, body)
+	}
+	if res, body := do(t, "MOVE", srv.URL+"/docs/large.bin", "", "Destination", srv.URL+"/notes/large.bin"); res.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %v: %s", res.Status, body)
+	}
+	if len(commits) != 3 || commits[2] != fs.Root() {
+		t.Fatalf("every change should be committed, got %v commits", len(commits))
+	}
+
+	for p, expected := range map[string]string{"notes/todo.txt": "write tests", "notes/large.bin": "large enough"} {
+		e, err := snapshot.Lookup(ctx, c, fs.Root(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		if _, err := blob.Read(ctx, c, buf, e.Ref); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != expected || e.Size != int64(len(expected)) {
+			t.Errorf("%v should contain %q, got %q (size %v)", p, expected, buf.String(), e.Size)
+		}
+	}
+	if _, err := snapshot.Lookup(ctx, c, fs.Root(), "other.txt"); err != nil {
+		t.Errorf("Changes from other writers should be kept, got %v", err)
+	}
+	if _, err := snapshot.Lookup(ctx, c, fs.Root(), "docs/large.bin"); err == nil {
+		t.Error("docs/large.bin should have been moved")
+	}
+	if e, _ := snapshot.Lookup(ctx, c, fs.Root(), "notes"); e.Size != int64(len("write tests")+len("large enough")) {
+		t.Errorf("directory size should be updated, got %v", e.Size)
+	}
+}